@@ -45,6 +45,9 @@ func main() {
 	cliApp.Name = "helmfile"
 	cliApp.Usage = ""
 	cliApp.Version = Version
+	if Version != "" {
+		state.HelmfileVersion = Version
+	}
 	cliApp.Flags = []cli.Flag{
 		cli.StringFlag{
 			Name:  "helm-binary, b",
@@ -55,8 +58,9 @@ func main() {
 			Usage: "load config from file or directory. defaults to `helmfile.yaml` or `helmfile.d`(means `helmfile.d/*.yaml`) in this preference",
 		},
 		cli.StringFlag{
-			Name:  "environment, e",
-			Usage: "specify the environment name. defaults to `default`",
+			Name:   "environment, e",
+			Usage:  "specify the environment name. defaults to `default`",
+			EnvVar: "HELMFILE_ENVIRONMENT",
 		},
 		cli.StringSliceFlag{
 			Name:  "state-values-set",
@@ -84,7 +88,7 @@ func main() {
 		},
 		cli.StringSliceFlag{
 			Name: "selector, l",
-			Usage: `Only run using the releases that match labels. Labels can take the form of foo=bar or foo!=bar.
+			Usage: `Only run using the releases that match labels. Labels can take the form of foo=bar, foo!=bar, foo in (bar,baz), foo notin (bar,baz), foo, !foo, foo=~regex or foo!~regex.
 	A release must match all labels in a group in order to be used. Multiple groups can be specified at once.
 	--selector tier=frontend,tier!=proxy --selector tier=backend. Will match all frontend, non-proxy releases AND all backend releases.
 	The name of a release can be used as a label. --selector name=myrelease`,
@@ -97,6 +101,26 @@ func main() {
 			Name:  "interactive, i",
 			Usage: "Request confirmation before attempting to modify clusters",
 		},
+		cli.BoolFlag{
+			Name:  "offline",
+			Usage: "Resolve chart versions only from the lock files and local chart tarballs, without any network access",
+		},
+		cli.StringFlag{
+			Name:  "lockfile",
+			Usage: "Path to the lock file of a single state file, or the directory containing the lock files when it ends with / or exists, overriding dependencyResolution.lockFilePath of all the state files",
+		},
+		cli.BoolFlag{
+			Name:  "frozen-lockfile",
+			Usage: "Fail instead of updating the lock files when they are missing or any dependency would need a different version than the locked one",
+		},
+		cli.BoolFlag{
+			Name:  "skip-resolve",
+			Usage: "Skip dependency resolution entirely, deploying the versions declared in releases as is without reading nor updating the lock files. Implies the --skip-deps of each command",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run, print-commands",
+			Usage: "Log the helm commands that would install, upgrade, delete and test releases, with secrets masked, instead of running them",
+		},
 	}
 
 	cliApp.Before = configureLogging
@@ -110,11 +134,96 @@ func main() {
 					Value: "",
 					Usage: "pass args to helm exec",
 				},
+				cli.BoolFlag{
+					Name:  "plan",
+					Usage: "print which charts would be resolved and which are already pinned by the lock file, without updating it",
+				},
+				cli.BoolFlag{
+					Name:  "check",
+					Usage: "fail when the lock file is stale relative to the state file, without accessing chart repositories nor updating the lock file. Useful in CI",
+				},
+				cli.StringFlag{
+					Name:  "impact",
+					Value: "",
+					Usage: "list the releases affected by a bump of the chart's version, without updating the lock file",
+				},
+				cli.IntFlag{
+					Name:  "max-failures",
+					Value: 0,
+					Usage: "continue updating the lock files of the other state files until more than this number of state files fail. 0 aborts on the first failure",
+				},
 			},
 			Action: action(func(run *app.App, c configImpl) error {
 				return run.Deps(c)
 			}),
 		},
+		{
+			Name:  "warm-cache",
+			Usage: "fetch the charts of versions recorded in the lock files into dependencyResolution.cacheDir",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "args",
+					Value: "",
+					Usage: "pass args to helm exec",
+				},
+			},
+			Action: action(func(run *app.App, c configImpl) error {
+				return run.WarmCache(c)
+			}),
+		},
+		{
+			Name:  "fetch",
+			Usage: "fetch the charts of all the releases at the versions recorded in the lock files into a local directory",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "output-dir",
+					Usage: "directory to fetch the charts into. Each chart is extracted under <output-dir>/<repository>/<chart>/<version>",
+				},
+				cli.BoolFlag{
+					Name:  "rewrite",
+					Usage: "rewrite the chart of each release in the state files to the path of the fetched chart",
+				},
+				cli.StringFlag{
+					Name:  "args",
+					Value: "",
+					Usage: "pass args to helm exec",
+				},
+			},
+			Action: action(func(run *app.App, c configImpl) error {
+				return run.Fetch(c)
+			}),
+		},
+		{
+			Name:  "check-locks",
+			Usage: "report charts pinned to divergent versions across the lock files of all the state files",
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:  "allow",
+					Usage: "name of a chart intentionally pinned to divergent versions. Can be specified multiple times",
+				},
+			},
+			Action: action(func(run *app.App, c configImpl) error {
+				return run.CheckLocks(c)
+			}),
+		},
+		{
+			Name:  "list",
+			Usage: "list the releases and their chart versions resolved from the lock files",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "outdated",
+					Usage: "list only the releases whose charts have newer versions available in their repositories, along with the versions",
+				},
+				cli.StringFlag{
+					Name:  "output, o",
+					Value: "table",
+					Usage: "output format: table or json",
+				},
+			},
+			Action: action(func(run *app.App, c configImpl) error {
+				return run.List(c)
+			}),
+		},
 		{
 			Name:  "repos",
 			Usage: "sync repositories from state file (helm repo add && helm repo update)",
@@ -419,16 +528,9 @@ func NewUrfaveCliConfigImpl(c *cli.Context) (configImpl, error) {
 
 	optsSet := c.GlobalStringSlice("state-values-set")
 	if len(optsSet) > 0 {
-		set := map[string]interface{}{}
-		for i := range optsSet {
-			ops := strings.Split(optsSet[i], ",")
-			for j := range ops {
-				op := strings.SplitN(ops[j], "=", 2)
-				k := strings.Split(op[0], ".")
-				v := op[1]
-
-				set = maputil.Set(set, k, v)
-			}
+		set, err := maputil.ParseSetValues(optsSet)
+		if err != nil {
+			return configImpl{}, fmt.Errorf("err: %v", err)
 		}
 		conf.set = set
 	}
@@ -456,10 +558,48 @@ func (c configImpl) HasCommandName(name string) bool {
 	return c.c.Command.HasName(name)
 }
 
+// DepsConfig
+
+func (c configImpl) Plan() bool {
+	return c.c.Bool("plan")
+}
+
+func (c configImpl) Check() bool {
+	return c.c.Bool("check")
+}
+
+func (c configImpl) Impact() string {
+	return c.c.String("impact")
+}
+
+func (c configImpl) MaxFailures() int {
+	return c.c.Int("max-failures")
+}
+
+func (c configImpl) Allow() []string {
+	return c.c.StringSlice("allow")
+}
+
+// FetchConfig
+
+func (c configImpl) Rewrite() bool {
+	return c.c.Bool("rewrite")
+}
+
+// ListConfig
+
+func (c configImpl) Outdated() bool {
+	return c.c.Bool("outdated")
+}
+
+func (c configImpl) Output() string {
+	return c.c.String("output")
+}
+
 // DiffConfig
 
 func (c configImpl) SkipDeps() bool {
-	return c.c.Bool("skip-deps")
+	return c.c.Bool("skip-deps") || c.SkipResolve()
 }
 
 func (c configImpl) DetailedExitcode() bool {
@@ -500,6 +640,26 @@ func (c configImpl) Namespace() string {
 	return c.c.GlobalString("namespace")
 }
 
+func (c configImpl) Offline() bool {
+	return c.c.GlobalBool("offline")
+}
+
+func (c configImpl) FrozenLockfile() bool {
+	return c.c.GlobalBool("frozen-lockfile")
+}
+
+func (c configImpl) LockFile() string {
+	return c.c.GlobalString("lockfile")
+}
+
+func (c configImpl) SkipResolve() bool {
+	return c.c.GlobalBool("skip-resolve")
+}
+
+func (c configImpl) DryRun() bool {
+	return c.c.GlobalBool("dry-run")
+}
+
 func (c configImpl) FileOrDir() string {
 	return c.c.GlobalString("file")
 }
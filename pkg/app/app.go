@@ -32,6 +32,19 @@ type App struct {
 
 	FileOrDir string
 
+	// Offline forces dependency resolution to avoid any network access
+	Offline bool
+
+	// FrozenLockfile forbids dependency resolution from modifying the lock files
+	FrozenLockfile bool
+
+	// LockFile overrides the lock file path, or the directory containing lock files, of all the state files.
+	// A relative path is relative to the working directory helmfile runs in.
+	LockFile string
+
+	// SkipResolve skips dependency resolution entirely, so that releases are deployed with their declared versions
+	SkipResolve bool
+
 	ErrorHandler func(error) error
 
 	readFile          func(string) ([]byte, error)
@@ -47,23 +60,36 @@ type App struct {
 	remote *remote.Remote
 
 	helmExecer helmexec.Interface
+
+	// visiting is the chain of the state files being visited, from the root to the nested one, to detect cyclic references in `helmfiles:`
+	visiting []string
+
+	// sharedLockFile is the lock file given by LockFile when it isn't a directory, which only a single state file can use
+	sharedLockFile string
 }
 
 func New(conf ConfigProvider) *App {
+	helm := helmexec.New(conf.Logger(), conf.KubeContext(), &helmexec.ShellRunner{
+		Logger: conf.Logger(),
+	})
+	helm.SetDryRun(conf.DryRun())
+
 	return Init(&App{
-		KubeContext: conf.KubeContext(),
-		Logger:      conf.Logger(),
-		Env:         conf.Env(),
-		Namespace:   conf.Namespace(),
-		Selectors:   conf.Selectors(),
-		HelmBinary:  conf.HelmBinary(),
-		Args:        conf.Args(),
-		FileOrDir:   conf.FileOrDir(),
-		ValuesFiles: conf.ValuesFiles(),
-		Set:         conf.Set(),
-		helmExecer: helmexec.New(conf.Logger(), conf.KubeContext(), &helmexec.ShellRunner{
-			Logger: conf.Logger(),
-		}),
+		KubeContext:    conf.KubeContext(),
+		Logger:         conf.Logger(),
+		Env:            conf.Env(),
+		Namespace:      conf.Namespace(),
+		Selectors:      conf.Selectors(),
+		HelmBinary:     conf.HelmBinary(),
+		Args:           conf.Args(),
+		FileOrDir:      conf.FileOrDir(),
+		ValuesFiles:    conf.ValuesFiles(),
+		Set:            conf.Set(),
+		Offline:        conf.Offline(),
+		FrozenLockfile: conf.FrozenLockfile(),
+		LockFile:       conf.LockFile(),
+		SkipResolve:    conf.SkipResolve(),
+		helmExecer:     helm,
 	})
 }
 
@@ -80,11 +106,116 @@ func Init(app *App) *App {
 }
 
 func (a *App) Deps(c DepsConfigProvider) error {
-	return a.ForEachState(func(run *Run) []error {
+	do := func(run *Run) []error {
 		return run.Deps(c)
+	}
+
+	if c.MaxFailures() <= 0 {
+		return a.ForEachState(do)
+	}
+
+	failures := &batchFailures{max: c.MaxFailures()}
+	if err := a.ForEachState(failures.tolerate(do)); err != nil {
+		return err
+	}
+
+	for _, f := range failures.failures {
+		for _, err := range f.errs {
+			a.Logger.Warnf("tolerated failure in %s: %v", f.file, err)
+		}
+	}
+	if len(failures.failures) > 0 {
+		a.Logger.Warnf("%d state files failed, within the failure threshold of %d", len(failures.failures), failures.max)
+	}
+
+	return nil
+}
+
+func (a *App) WarmCache(c WarmCacheConfigProvider) error {
+	return a.ForEachState(func(run *Run) []error {
+		return run.WarmCache(c)
 	})
 }
 
+func (a *App) Fetch(c FetchConfigProvider) error {
+	if c.OutputDir() == "" {
+		return fmt.Errorf("--output-dir must be set to fetch charts into")
+	}
+
+	// Resolve the output directory before visiting state files, as helmfile changes the working directory to the directory of each state file
+	outputDir := c.OutputDir()
+	if !filepath.IsAbs(outputDir) {
+		dir, err := a.getwd()
+		if err != nil {
+			return err
+		}
+		outputDir = filepath.Join(dir, outputDir)
+	}
+
+	return a.ForEachState(func(run *Run) []error {
+		return run.Fetch(c, outputDir)
+	})
+}
+
+func (a *App) CheckLocks(c CheckLocksConfigProvider) error {
+	locks := map[string][]state.ResolvedChartDependency{}
+
+	err := a.ForEachState(func(run *Run) []error {
+		path, deps, err := run.state.LockedDependencies()
+		if err != nil {
+			return []error{err}
+		}
+		if deps != nil {
+			locks[path] = deps
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	divergent := state.FindDivergentPins(locks, c.Allow())
+	for _, d := range divergent {
+		c.Logger().Errorf("%s", d)
+	}
+	if len(divergent) > 0 {
+		return fmt.Errorf("%d charts are pinned to divergent versions across %d lock files", len(divergent), len(locks))
+	}
+
+	c.Logger().Infof("no charts are pinned to divergent versions across %d lock files", len(locks))
+
+	return nil
+}
+
+func (a *App) List(c ListConfigProvider) error {
+	versions := []state.ReleaseVersion{}
+
+	err := a.ForEachState(func(run *Run) []error {
+		vs, err := run.state.ReleaseVersions(c.Outdated())
+		if err != nil {
+			return []error{err}
+		}
+		for _, v := range vs {
+			if !c.Outdated() || v.Outdated() {
+				versions = append(versions, v)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	out, err := formatReleaseVersions(versions, c.Outdated(), c.Output())
+	if err != nil {
+		return err
+	}
+
+	fmt.Print(out)
+
+	return nil
+}
+
 func (a *App) Repos(c ReposConfigProvider) error {
 	return a.ForEachState(func(run *Run) []error {
 		return run.Repos(c)
@@ -239,6 +370,7 @@ func (a *App) loadDesiredStateFromYaml(file string, opts ...LoadOpts) (*state.He
 		Reverse:     a.Reverse,
 		KubeContext: a.KubeContext,
 		glob:        a.glob,
+		remote:      a.remote,
 	}
 
 	var op LoadOpts
@@ -252,6 +384,10 @@ func (a *App) loadDesiredStateFromYaml(file string, opts ...LoadOpts) (*state.He
 func (a *App) visitStates(fileOrDir string, defOpts LoadOpts, converge func(*state.HelmState, helmexec.Interface) (bool, []error)) error {
 	noMatchInHelmfiles := true
 
+	// The environment is undefined only when none of the helmfiles define it
+	var undefinedEnv *state.UndefinedEnvError
+	envDefined := false
+
 	err := a.visitStateFiles(fileOrDir, func(f, d string) error {
 		opts := defOpts.DeepCopy()
 
@@ -259,6 +395,17 @@ func (a *App) visitStates(fileOrDir string, defOpts LoadOpts, converge func(*sta
 			opts.CalleePath = f
 		}
 
+		path := filepath.Join(d, f)
+		for i, v := range a.visiting {
+			if v == path {
+				return fmt.Errorf("cyclic reference in helmfiles: %s", strings.Join(append(a.visiting[i:], path), " -> "))
+			}
+		}
+		a.visiting = append(a.visiting, path)
+		defer func() {
+			a.visiting = a.visiting[:len(a.visiting)-1]
+		}()
+
 		st, err := a.loadDesiredStateFromYaml(f, opts)
 
 		sigs := make(chan os.Signal, 1)
@@ -285,8 +432,9 @@ func (a *App) visitStates(fileOrDir string, defOpts LoadOpts, converge func(*sta
 			switch stateLoadErr := err.(type) {
 			// Addresses https://github.com/roboll/helmfile/issues/279
 			case *state.StateLoadError:
-				switch stateLoadErr.Cause.(type) {
+				switch cause := stateLoadErr.Cause.(type) {
 				case *state.UndefinedEnvError:
+					undefinedEnv = mergeUndefinedEnvErrors(undefinedEnv, cause)
 					return nil
 				default:
 					return ctx.wrapErrs(err)
@@ -295,8 +443,13 @@ func (a *App) visitStates(fileOrDir string, defOpts LoadOpts, converge func(*sta
 				return ctx.wrapErrs(err)
 			}
 		}
+		envDefined = true
 		st.Selectors = opts.Selectors
 
+		if len(st.Helmfiles) > 0 && a.sharedLockFile != "" {
+			return a.sharedLockFileError()
+		}
+
 		if len(st.Helmfiles) > 0 {
 			noMatchInSubHelmfiles := true
 			for i, m := range st.Helmfiles {
@@ -313,7 +466,7 @@ func (a *App) visitStates(fileOrDir string, defOpts LoadOpts, converge func(*sta
 
 				if err := a.visitStates(m.Path, optsForNestedState, converge); err != nil {
 					switch err.(type) {
-					case *NoMatchingHelmfileError:
+					case *NoMatchingHelmfileError, *state.UndefinedEnvError:
 
 					default:
 						return appError(fmt.Sprintf("in .helmfiles[%d]", i), err)
@@ -339,12 +492,41 @@ func (a *App) visitStates(fileOrDir string, defOpts LoadOpts, converge func(*sta
 	}
 
 	if noMatchInHelmfiles {
+		if !envDefined && undefinedEnv != nil {
+			return undefinedEnv
+		}
 		return &NoMatchingHelmfileError{selectors: a.Selectors, env: a.Env}
 	}
 
 	return nil
 }
 
+func (a *App) sharedLockFileError() error {
+	return fmt.Errorf("--lockfile %s is a file, which multiple state files can't share: specify a directory ending with / instead", a.LockFile)
+}
+
+// mergeUndefinedEnvErrors merges the environments known to the helmfiles not defining the environment,
+// so that the user is able to see every environment one could select
+func mergeUndefinedEnvErrors(acc, e *state.UndefinedEnvError) *state.UndefinedEnvError {
+	if acc == nil {
+		return &state.UndefinedEnvError{Env: e.Env, Known: append([]string{}, e.Known...)}
+	}
+	for _, k := range e.Known {
+		found := false
+		for _, a := range acc.Known {
+			if a == k {
+				found = true
+				break
+			}
+		}
+		if !found {
+			acc.Known = append(acc.Known, k)
+		}
+	}
+	sort.Strings(acc.Known)
+	return acc
+}
+
 func (a *App) ForEachState(do func(*Run) []error) error {
 	err := a.VisitDesiredStatesWithReleasesFiltered(a.FileOrDir, func(st *state.HelmState, helm helmexec.Interface) []error {
 		ctx := NewContext()
@@ -400,7 +582,53 @@ func (a *App) VisitDesiredStatesWithReleasesFiltered(fileOrDir string, converge
 
 	a.remote = remote
 
-	return a.visitStates(fileOrDir, opts, func(st *state.HelmState, helm helmexec.Interface) (bool, []error) {
+	// Resolve the lock file path before visiting state files, as helmfile changes the working directory to the directory of each state file.
+	// A lock file, unlike a directory of lock files, is rejected when multiple state files are visited, as they would overwrite each other's locks.
+	lockFile := a.LockFile
+	if lockFile != "" {
+		isDir := state.IsLockFileDir(lockFile, a.directoryExistsAt)
+		if !filepath.IsAbs(lockFile) {
+			lockFile = filepath.Join(dir, lockFile)
+		}
+		if isDir {
+			// Keep the trailing slash, so that the directory is created on the first write when it doesn't exist yet
+			lockFile += "/"
+		} else {
+			if files, err := a.findDesiredStateFiles(fileOrDir); err == nil && len(files) > 1 {
+				return a.sharedLockFileError()
+			}
+			a.sharedLockFile = lockFile
+			defer func() {
+				a.sharedLockFile = ""
+			}()
+		}
+	}
+
+	err = a.visitStates(fileOrDir, opts, func(st *state.HelmState, helm helmexec.Interface) (bool, []error) {
+		if a.Offline {
+			st.DependencyResolution.Offline = true
+		}
+
+		if a.FrozenLockfile {
+			st.DependencyResolution.FrozenLockfile = true
+		}
+
+		if lockFile != "" {
+			st.DependencyResolution.LockFilePath = lockFile
+		}
+
+		if a.SkipResolve {
+			st.DependencyResolution.SkipResolve = true
+		}
+
+		if err := st.CheckNeeds(); err != nil {
+			return false, []error{err}
+		}
+
+		if err := st.FilterReleasesByConditions(); err != nil {
+			return false, []error{err}
+		}
+
 		if len(st.Selectors) > 0 {
 			err := st.FilterReleases()
 			if err != nil {
@@ -430,12 +658,22 @@ func (a *App) VisitDesiredStatesWithReleasesFiltered(fileOrDir string, converge
 			}
 		}
 
+		if err := st.CheckHelmVersion(helm); err != nil {
+			return false, []error{err}
+		}
+
 		errs := converge(st, helm)
 
 		processed := len(st.Releases) != 0 && len(errs) == 0
 
 		return processed, errs
 	})
+
+	if e, ok := err.(*state.UndefinedEnvError); ok {
+		return appError("", e)
+	}
+
+	return err
 }
 
 func (a *App) findStateFilesInAbsPaths(specifiedPath string) ([]string, error) {
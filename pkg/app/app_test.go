@@ -10,6 +10,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"strings"
 	"testing"
 
 	"go.uber.org/zap"
@@ -84,6 +85,71 @@ releases:
 	}
 }
 
+func TestVisitDesiredStatesWithReleasesFiltered_LockFile(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
+helmfiles:
+- helmfile.d/a.yaml
+`,
+		"/path/to/helmfile.d/a.yaml": `
+releases:
+- name: zipkin
+  chart: stable/zipkin
+`,
+		"/path/to/helmfile.d/b.yaml": `
+releases:
+- name: grafana
+  chart: stable/grafana
+`,
+		"/path/to/locks/a.lock": ``,
+	}
+
+	tests := []struct {
+		lockFile  string
+		fileOrDir string
+		expected  []string
+		wantErr   bool
+	}{
+		{lockFile: "locks/prod.yaml", fileOrDir: "/path/to/helmfile.d/a.yaml", expected: []string{"/path/to/locks/prod.yaml"}},
+		{lockFile: "locks", fileOrDir: "/path/to/helmfile.d", expected: []string{"/path/to/locks/", "/path/to/locks/"}},
+		{lockFile: "newlocks/", fileOrDir: "/path/to/helmfile.d", expected: []string{"/path/to/newlocks/", "/path/to/newlocks/"}},
+		{lockFile: "locks/prod.lock", fileOrDir: "/path/to/helmfile.d", wantErr: true},
+		{lockFile: "locks/prod.lock", fileOrDir: "/path/to/helmfile.yaml", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.lockFile+" for "+tt.fileOrDir, func(t *testing.T) {
+			app := appWithFs(&App{
+				KubeContext: "default",
+				Logger:      helmexec.NewLogger(os.Stderr, "debug"),
+				Env:         "default",
+				LockFile:    tt.lockFile,
+			}, files)
+
+			actual := []string{}
+			err := app.VisitDesiredStatesWithReleasesFiltered(tt.fileOrDir, func(st *state.HelmState, helm helmexec.Interface) []error {
+				actual = append(actual, st.DependencyResolution.LockFilePath)
+				return []error{}
+			})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected error for the lock file shared by multiple state files, got none")
+				}
+				if len(actual) != 0 {
+					t.Errorf("unexpected state files visited before the error: %v", actual)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(actual, tt.expected) {
+				t.Errorf("unexpected lock file paths: expected=%v, got=%v", tt.expected, actual)
+			}
+		})
+	}
+}
+
 func TestVisitDesiredStatesWithReleasesFiltered_EnvValuesFileOrder(t *testing.T) {
 	files := map[string]string{
 		"/path/to/helmfile.yaml": `
@@ -280,6 +346,45 @@ releases:
 	}
 }
 
+func TestVisitDesiredStatesWithReleasesFiltered_CyclicHelmfiles(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
+helmfiles:
+- helmfile.d/a.yaml
+`,
+		"/path/to/helmfile.d/a.yaml": `
+helmfiles:
+- ../helmfile.yaml
+releases:
+- name: zipkin
+  chart: stable/zipkin
+`,
+	}
+
+	fs := testhelper.NewTestFs(files)
+	app := &App{
+		KubeContext: "default",
+		Logger:      helmexec.NewLogger(os.Stderr, "debug"),
+		Namespace:   "",
+		Env:         "default",
+	}
+	app = injectFs(app, fs)
+	noop := func(st *state.HelmState, helm helmexec.Interface) []error {
+		return []error{}
+	}
+
+	err := app.VisitDesiredStatesWithReleasesFiltered(
+		"helmfile.yaml", noop,
+	)
+	if err == nil {
+		t.Fatal("expected error for the cyclic helmfiles, got none")
+	}
+	expected := "cyclic reference in helmfiles: /path/to/helmfile.yaml -> /path/to/helmfile.d/a.yaml -> /path/to/helmfile.yaml"
+	if !strings.Contains(err.Error(), expected) {
+		t.Errorf("unexpected error: expected to contain=%s, got=%v", expected, err)
+	}
+}
+
 // See https://github.com/roboll/helmfile/issues/320
 func TestVisitDesiredStatesWithReleasesFiltered_UndefinedEnv(t *testing.T) {
 	files := map[string]string{
@@ -312,6 +417,8 @@ releases:
 		{name: "prod", expectErr: false},
 	}
 
+	expectedErr := `environment "undefined_env" is not defined. known environments: default, prod`
+
 	for _, testcase := range testcases {
 		app := appWithFs(&App{
 			KubeContext: "default",
@@ -325,12 +432,72 @@ releases:
 		)
 		if testcase.expectErr && err == nil {
 			t.Errorf("error expected but not happened for environment=%s", testcase.name)
+		} else if testcase.expectErr && err.Error() != expectedErr {
+			t.Errorf("unexpected error for environment=%s: expected=%s, got=%v", testcase.name, expectedErr, err)
 		} else if !testcase.expectErr && err != nil {
 			t.Errorf("unexpected error for environment=%s: %v", testcase.name, err)
 		}
 	}
 }
 
+func TestVisitDesiredStatesWithReleasesFiltered_EnvDefinedInSomeHelmfiles(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.d/a.yaml": `
+environments:
+  staging:
+releases:
+- name: zipkin
+  chart: stable/zipkin
+`,
+		"/path/to/helmfile.d/b.yaml": `
+environments:
+  prod:
+releases:
+- name: grafana
+  chart: stable/grafana
+`,
+	}
+
+	testcases := []struct {
+		env      string
+		releases []string
+		err      string
+	}{
+		{env: "staging", releases: []string{"zipkin"}},
+		{env: "prod", releases: []string{"grafana"}},
+		{env: "production", err: `environment "production" is not defined. known environments: default, prod, staging`},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.env, func(t *testing.T) {
+			var releases []string
+			app := appWithFs(&App{
+				KubeContext: "default",
+				Logger:      helmexec.NewLogger(os.Stderr, "debug"),
+				Env:         tc.env,
+			}, files)
+			err := app.VisitDesiredStatesWithReleasesFiltered("helmfile.d", func(st *state.HelmState, helm helmexec.Interface) []error {
+				for _, r := range st.Releases {
+					releases = append(releases, r.Name)
+				}
+				return []error{}
+			})
+			if tc.err != "" {
+				if err == nil || err.Error() != tc.err {
+					t.Fatalf("unexpected error: expected=%s, got=%v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(releases, tc.releases) {
+				t.Errorf("unexpected releases: expected=%v, got=%v", tc.releases, releases)
+			}
+		})
+	}
+}
+
 // See https://github.com/roboll/helmfile/issues/322
 func TestVisitDesiredStatesWithReleasesFiltered_Selectors(t *testing.T) {
 	files := map[string]string{
@@ -383,9 +550,10 @@ releases:
 		errMsg        string
 	}{
 		{label: "name=prometheus", expectedCount: 1, expectErr: false},
-		{label: "name=", expectedCount: 0, expectErr: true, errMsg: "in ./helmfile.yaml: in .helmfiles[0]: in /path/to/helmfile.d/a1.yaml: Malformed label: name=. Expected label in form k=v or k!=v"},
-		{label: "name!=", expectedCount: 0, expectErr: true, errMsg: "in ./helmfile.yaml: in .helmfiles[0]: in /path/to/helmfile.d/a1.yaml: Malformed label: name!=. Expected label in form k=v or k!=v"},
-		{label: "name", expectedCount: 0, expectErr: true, errMsg: "in ./helmfile.yaml: in .helmfiles[0]: in /path/to/helmfile.d/a1.yaml: Malformed label: name. Expected label in form k=v or k!=v"},
+		{label: "name=", expectedCount: 0, expectErr: true, errMsg: "in ./helmfile.yaml: in .helmfiles[0]: in /path/to/helmfile.d/a1.yaml: Malformed label: name=. Expected label in form k=v, k!=v, k in (v1,v2), k notin (v1,v2), k, !k, k=~regex or k!~regex"},
+		{label: "name!=", expectedCount: 0, expectErr: true, errMsg: "in ./helmfile.yaml: in .helmfiles[0]: in /path/to/helmfile.d/a1.yaml: Malformed label: name!=. Expected label in form k=v, k!=v, k in (v1,v2), k notin (v1,v2), k, !k, k=~regex or k!~regex"},
+		{label: "name in ()", expectedCount: 0, expectErr: true, errMsg: "in ./helmfile.yaml: in .helmfiles[0]: in /path/to/helmfile.d/a1.yaml: Malformed label: name in (). Expected values in form k in (v1,v2)"},
+		{label: "name in (prometheus,zipkin)", expectedCount: 2, expectErr: false},
 		// See https://github.com/roboll/helmfile/issues/193
 		{label: "duplicated=yes", expectedCount: 0, expectErr: true, errMsg: "in ./helmfile.yaml: in .helmfiles[2]: in /path/to/helmfile.d/b.yaml: duplicate release \"foo\" found in \"zoo\": there were 2 releases named \"foo\" matching specified selector"},
 		{label: "duplicatedOK=yes", expectedCount: 2, expectErr: false},
@@ -1229,6 +1397,74 @@ helmDefaults:
 	}
 }
 
+func TestLoadDesiredStateFromYaml_BasesOverride(t *testing.T) {
+	yamlFile := "/path/to/yaml/file"
+	yamlContent := `bases:
+- ../defaults.yaml
+- ../prod.yaml
+
+helmDefaults:
+  kubeContext: main
+
+repositories:
+- name: incubator
+  url: https://incubator.example.com
+
+releases:
+- name: myrelease
+  chart: stable/mychart
+`
+	testFs := testhelper.NewTestFs(map[string]string{
+		yamlFile: yamlContent,
+		"/path/to/defaults.yaml": `helmDefaults:
+  kubeContext: defaults
+  tillerNamespace: defaults
+  timeout: 300
+
+repositories:
+- name: stable
+  url: https://stable.example.com
+`,
+		"/path/to/prod.yaml": `helmDefaults:
+  tillerNamespace: prod
+`,
+	})
+	app := &App{
+		readFile:     testFs.ReadFile,
+		glob:         testFs.Glob,
+		abs:          testFs.Abs,
+		fileExistsAt: testFs.FileExistsAt,
+		fileExists:   testFs.FileExists,
+		Env:          "default",
+		Logger:       helmexec.NewLogger(os.Stderr, "debug"),
+	}
+	st, err := app.loadDesiredStateFromYaml(yamlFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if st.HelmDefaults.KubeContext != "main" {
+		t.Errorf("unexpected helmDefaults.kubeContext: expected=main, got=%s", st.HelmDefaults.KubeContext)
+	}
+	if st.HelmDefaults.TillerNamespace != "prod" {
+		t.Errorf("unexpected helmDefaults.tillerNamespace: expected=prod, got=%s", st.HelmDefaults.TillerNamespace)
+	}
+	if st.HelmDefaults.Timeout != 300 {
+		t.Errorf("unexpected helmDefaults.timeout: expected=300, got=%d", st.HelmDefaults.Timeout)
+	}
+
+	repos := []string{}
+	for _, r := range st.Repositories {
+		repos = append(repos, r.Name)
+	}
+	if !reflect.DeepEqual(repos, []string{"stable", "incubator"}) {
+		t.Errorf("unexpected repositories: expected=[stable incubator], got=%v", repos)
+	}
+	if len(st.Releases) != 1 || st.Releases[0].Name != "myrelease" {
+		t.Errorf("unexpected releases: %v", st.Releases)
+	}
+}
+
 func TestLoadDesiredStateFromYaml_MultiPartTemplate(t *testing.T) {
 	yamlFile := "/path/to/yaml/file"
 	yamlContent := `bases:
@@ -1862,6 +2098,9 @@ func (helm *mockHelmExec) SetHelmBinary(bin string) {
 func (helm *mockHelmExec) AddRepo(name, repository, certfile, keyfile, username, password string) error {
 	return nil
 }
+func (helm *mockHelmExec) RegistryLogin(registry, username, password string) error {
+	return nil
+}
 func (helm *mockHelmExec) UpdateRepo() error {
 	return nil
 }
@@ -1938,3 +2177,65 @@ releases:
 
 	}
 }
+
+func TestLoadDesiredStateFromYaml_EnvironmentKubeContext(t *testing.T) {
+	yamlFile := "/path/to/yaml/file"
+	environments := `environments:
+  default:
+  production:
+    kubeContext: prod-cluster
+
+releases:
+- name: myrelease
+  chart: stable/mychart
+`
+	helmDefaults := `
+helmDefaults:
+  kubeContext: dev-cluster
+`
+	testcases := []struct {
+		name        string
+		env         string
+		content     string
+		kubeContext string
+		expected    string
+		expectedErr string
+	}{
+		{name: "helmDefaults", env: "default", content: environments + helmDefaults, expected: "dev-cluster"},
+		{name: "environment overriding helmDefaults", env: "production", content: environments + helmDefaults, expected: "prod-cluster"},
+		{name: "--kube-context", env: "default", content: environments, kubeContext: "other", expected: "other"},
+		{name: "environment and --kube-context", env: "production", content: environments, kubeContext: "other", expectedErr: "err: Cannot use option --kube-context and set attribute environments.production.kubeContext."},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			testFs := testhelper.NewTestFs(map[string]string{
+				yamlFile: tc.content,
+			})
+			app := &App{
+				readFile:     testFs.ReadFile,
+				glob:         testFs.Glob,
+				abs:          testFs.Abs,
+				fileExistsAt: testFs.FileExistsAt,
+				fileExists:   testFs.FileExists,
+				Env:          tc.env,
+				KubeContext:  tc.kubeContext,
+				Logger:       helmexec.NewLogger(os.Stderr, "debug"),
+			}
+			st, err := app.loadDesiredStateFromYaml(yamlFile)
+			if tc.expectedErr != "" {
+				if err == nil || err.Error() != tc.expectedErr {
+					t.Fatalf("unexpected error: expected=%s, got=%v", tc.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if st.HelmDefaults.KubeContext != tc.expected {
+				t.Errorf("unexpected helmDefaults.kubeContext: expected=%s, got=%s", tc.expected, st.HelmDefaults.KubeContext)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package app
+
+import (
+	"fmt"
+	"strings"
+)
+
+// batchFailure is the failure of the run against one of the state files in a batch
+type batchFailure struct {
+	file string
+	errs []error
+}
+
+// batchFailures lets a run over many state files continue past up to max failed state files, collecting the failures,
+// so that a large batch isn't abandoned due to one flaky state file
+type batchFailures struct {
+	max      int
+	failures []batchFailure
+}
+
+// tolerate wraps the function run per state file so that its failures are collected instead of aborting the batch,
+// until the number of the failed state files exceeds the threshold
+func (b *batchFailures) tolerate(do func(*Run) []error) func(*Run) []error {
+	return func(run *Run) []error {
+		errs := do(run)
+		if len(errs) == 0 {
+			return nil
+		}
+
+		b.failures = append(b.failures, batchFailure{file: run.state.FilePath, errs: errs})
+
+		if b.exceeded() {
+			return []error{b}
+		}
+
+		return nil
+	}
+}
+
+func (b *batchFailures) exceeded() bool {
+	return len(b.failures) > b.max
+}
+
+func (b *batchFailures) Error() string {
+	lines := []string{}
+	for _, f := range b.failures {
+		for _, err := range f.errs {
+			lines = append(lines, fmt.Sprintf("%s: %v", f.file, err))
+		}
+	}
+	return fmt.Sprintf("%d state files failed, exceeding the failure threshold of %d:\n%s", len(b.failures), b.max, strings.Join(lines, "\n"))
+}
@@ -0,0 +1,105 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/roboll/helmfile/pkg/helmexec"
+	"go.uber.org/zap"
+)
+
+// depsHelmExec fails to update the dependencies of the charts whose paths contain "error", and records the other charts
+type depsHelmExec struct {
+	helmexec.Interface
+	charts []string
+}
+
+func (helm *depsHelmExec) SetExtraArgs(args ...string) {}
+
+func (helm *depsHelmExec) UpdateDeps(chart string) error {
+	if strings.Contains(chart, "error") {
+		return fmt.Errorf("simulated UpdateDeps failure for chart: %s", chart)
+	}
+	helm.charts = append(helm.charts, chart)
+	return nil
+}
+
+type depsConfig struct {
+	maxFailures int
+	logger      *zap.SugaredLogger
+}
+
+func (c depsConfig) Args() string               { return "" }
+func (c depsConfig) Plan() bool                 { return false }
+func (c depsConfig) Check() bool                { return false }
+func (c depsConfig) Impact() string             { return "" }
+func (c depsConfig) MaxFailures() int           { return c.maxFailures }
+func (c depsConfig) Interactive() bool          { return false }
+func (c depsConfig) Logger() *zap.SugaredLogger { return c.logger }
+
+func TestApp_Deps_MaxFailures(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.d/a.yaml": `
+releases:
+- name: a
+  chart: ./charts/error-a
+`,
+		"/path/to/helmfile.d/b.yaml": `
+releases:
+- name: b
+  chart: ./charts/b
+`,
+		"/path/to/helmfile.d/c.yaml": `
+releases:
+- name: c
+  chart: ./charts/error-c
+`,
+	}
+
+	tests := []struct {
+		name        string
+		maxFailures int
+		wantErr     string
+	}{
+		{
+			name:        "within the threshold",
+			maxFailures: 2,
+		},
+		{
+			name:        "exceeding the threshold",
+			maxFailures: 1,
+			wantErr: "in /path/to/helmfile.d/c.yaml: 2 state files failed, exceeding the failure threshold of 1:\n" +
+				"a.yaml: simulated UpdateDeps failure for chart: charts/error-a\n" +
+				"c.yaml: simulated UpdateDeps failure for chart: charts/error-c",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := helmexec.NewLogger(os.Stderr, "debug")
+			helm := &depsHelmExec{}
+			app := appWithFs(&App{
+				KubeContext: "default",
+				Logger:      logger,
+				Env:         "default",
+				helmExecer:  helm,
+			}, files)
+
+			err := app.Deps(depsConfig{maxFailures: tt.maxFailures, logger: logger})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			} else if err == nil || err.Error() != tt.wantErr {
+				t.Fatalf("unexpected error:\nexpected=%s\ngot=%v", tt.wantErr, err)
+			}
+
+			// The state file following the failed one is processed as long as the failures are within the threshold
+			if len(helm.charts) != 1 || helm.charts[0] != "charts/b" {
+				t.Errorf("unexpected charts updated: expected=[charts/b], got=%v", helm.charts)
+			}
+		})
+	}
+}
@@ -13,6 +13,11 @@ type ConfigProvider interface {
 	Set() map[string]interface{}
 	ValuesFiles() []string
 	Env() string
+	Offline() bool
+	FrozenLockfile() bool
+	LockFile() string
+	SkipResolve() bool
+	DryRun() bool
 
 	loggingConfig
 }
@@ -26,6 +31,42 @@ type DeprecatedChartsConfigProvider interface {
 
 type DepsConfigProvider interface {
 	Args() string
+
+	Plan() bool
+	Check() bool
+	Impact() string
+	MaxFailures() int
+
+	interactive
+	loggingConfig
+}
+
+type WarmCacheConfigProvider interface {
+	Args() string
+
+	loggingConfig
+}
+
+type FetchConfigProvider interface {
+	Args() string
+
+	OutputDir() string
+	Rewrite() bool
+
+	loggingConfig
+}
+
+type CheckLocksConfigProvider interface {
+	Allow() []string
+
+	loggingConfig
+}
+
+type ListConfigProvider interface {
+	Outdated() bool
+	Output() string
+
+	loggingConfig
 }
 
 type ReposConfigProvider interface {
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"github.com/imdario/mergo"
 	"github.com/roboll/helmfile/pkg/environment"
+	"github.com/roboll/helmfile/pkg/remote"
 	"github.com/roboll/helmfile/pkg/state"
 	"go.uber.org/zap"
 	"path/filepath"
@@ -24,6 +25,8 @@ type desiredStateLoader struct {
 	abs        func(string) (string, error)
 	glob       func(string) ([]string, error)
 
+	remote *remote.Remote
+
 	logger *zap.SugaredLogger
 }
 
@@ -63,11 +66,18 @@ func (ld *desiredStateLoader) Load(f string, opts LoadOpts) (*state.HelmState, e
 		sort.Slice(st.Helmfiles, rev)
 	}
 
+	envKubeContext := st.Environments[ld.env].KubeContext
+
 	if ld.KubeContext != "" {
 		if st.HelmDefaults.KubeContext != "" {
 			return nil, errors.New("err: Cannot use option --kube-context and set attribute helmDefaults.kubeContext.")
 		}
+		if envKubeContext != "" {
+			return nil, fmt.Errorf("err: Cannot use option --kube-context and set attribute environments.%s.kubeContext.", ld.env)
+		}
 		st.HelmDefaults.KubeContext = ld.KubeContext
+	} else if envKubeContext != "" {
+		st.HelmDefaults.KubeContext = envKubeContext
 	}
 
 	if ld.namespace != "" {
@@ -127,6 +137,7 @@ func (ld *desiredStateLoader) loadFileWithOverrides(inheritedEnv, overrodeEnv *e
 func (a *desiredStateLoader) underlying() *state.StateCreator {
 	c := state.NewCreator(a.logger, a.readFile, a.fileExists, a.abs, a.glob)
 	c.LoadFile = a.loadFile
+	c.Remote = a.remote
 	return c
 }
 
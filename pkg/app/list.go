@@ -0,0 +1,49 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/roboll/helmfile/pkg/state"
+	"github.com/tatsushid/go-prettytable"
+)
+
+// formatReleaseVersions renders the release versions as either a table or JSON.
+// The wanted and latest versions are rendered in the table only when the repositories were checked for them.
+func formatReleaseVersions(versions []state.ReleaseVersion, checked bool, output string) (string, error) {
+	switch output {
+	case "json":
+		bs, err := json.MarshalIndent(versions, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		return string(bs) + "\n", nil
+	case "", "table":
+		cols := []prettytable.Column{
+			{Header: "NAME"},
+			{Header: "NAMESPACE"},
+			{Header: "CHART"},
+			{Header: "VERSION"},
+		}
+		if checked {
+			cols = append(cols, prettytable.Column{Header: "WANTED"}, prettytable.Column{Header: "LATEST"})
+		}
+		tbl, err := prettytable.NewTable(cols...)
+		if err != nil {
+			return "", err
+		}
+		tbl.Separator = "   "
+		for _, v := range versions {
+			row := []interface{}{v.Name, v.Namespace, v.Chart, v.Version}
+			if checked {
+				row = append(row, v.Wanted, v.Latest)
+			}
+			if err := tbl.AddRow(row...); err != nil {
+				return "", err
+			}
+		}
+		return tbl.String(), nil
+	default:
+		return "", fmt.Errorf("unsupported output %q: it must be either \"table\" or \"json\"", output)
+	}
+}
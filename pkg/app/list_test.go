@@ -0,0 +1,68 @@
+package app
+
+import (
+	"testing"
+
+	"github.com/roboll/helmfile/pkg/state"
+)
+
+func TestFormatReleaseVersions(t *testing.T) {
+	versions := []state.ReleaseVersion{
+		{Name: "envoy", Namespace: "proxy", Chart: "stable/envoy", Version: "1.5.0", Wanted: "1.6.0", Latest: "2.0.0"},
+	}
+
+	tests := []struct {
+		output   string
+		checked  bool
+		expected string
+		wantErr  string
+	}{
+		{
+			output: "json",
+			expected: `[
+  {
+    "name": "envoy",
+    "namespace": "proxy",
+    "chart": "stable/envoy",
+    "version": "1.5.0",
+    "wanted": "1.6.0",
+    "latest": "2.0.0"
+  }
+]
+`,
+		},
+		{
+			output:  "table",
+			checked: true,
+			expected: `NAME    NAMESPACE   CHART          VERSION   WANTED   LATEST
+envoy   proxy       stable/envoy   1.5.0     1.6.0    2.0.0
+`,
+		},
+		{
+			output: "table",
+			expected: `NAME    NAMESPACE   CHART          VERSION
+envoy   proxy       stable/envoy   1.5.0
+`,
+		},
+		{
+			output:  "yaml",
+			wantErr: `unsupported output "yaml": it must be either "table" or "json"`,
+		},
+	}
+
+	for _, tt := range tests {
+		actual, err := formatReleaseVersions(versions, tt.checked, tt.output)
+		if tt.wantErr != "" {
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("unexpected error: expected=%s, got=%v", tt.wantErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if actual != tt.expected {
+			t.Errorf("unexpected output:\nexpected=%q\ngot=%q", tt.expected, actual)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/roboll/helmfile/pkg/argparser"
 	"github.com/roboll/helmfile/pkg/helmexec"
 	"github.com/roboll/helmfile/pkg/state"
+	"io/ioutil"
 	"strings"
 )
 
@@ -30,11 +31,160 @@ func (r *Run) askForConfirmation(msg string) bool {
 func (r *Run) Deps(c DepsConfigProvider) []error {
 	r.helm.SetExtraArgs(argparser.GetArgs(c.Args(), r.state)...)
 
-	if errs := r.ctx.SyncReposOnce(r.state, r.helm); errs != nil && len(errs) > 0 {
+	if chart := c.Impact(); chart != "" {
+		index, err := r.state.ChartReleases()
+		if err != nil {
+			return []error{err}
+		}
+
+		releases := index[chart]
+		if len(releases) == 0 {
+			c.Logger().Infof("No releases in %s are affected by a bump of %s", r.state.FilePath, chart)
+		} else {
+			c.Logger().Infof("Releases in %s affected by a bump of %s:\n%s", r.state.FilePath, chart, strings.Join(releases, "\n"))
+		}
+		return nil
+	}
+
+	if c.Check() {
+		stale, err := r.state.CheckLockFile()
+		if err != nil {
+			return []error{err}
+		}
+		if len(stale) > 0 {
+			return []error{fmt.Errorf("the lock file of %s is stale: run helmfile deps to update it:\n%s", r.state.FilePath, strings.Join(stale, "\n"))}
+		}
+		c.Logger().Infof("The lock file of %s is up to date", r.state.FilePath)
+		return nil
+	}
+
+	if c.Plan() || c.Interactive() {
+		plan, err := r.state.PlanDependencyResolution()
+		if err != nil {
+			return []error{err}
+		}
+
+		if c.Plan() {
+			c.Logger().Infof("Dependency resolution plan for %s:\n%s", r.state.FilePath, plan)
+			return nil
+		}
+
+		msg := fmt.Sprintf(`Dependency resolution plan for %s:
+%s
+Do you really want to update the lock file?
+  Helmfile will run "helm dependency update" to resolve the charts, as shown above.
+
+`, r.state.FilePath, plan)
+		if !r.askForConfirmation(msg) {
+			return nil
+		}
+	}
+
+	// Repositories aren't needed for resolving charts offline against local chart tarballs
+	if !r.state.DependencyResolution.Offline {
+		if errs := r.ctx.SyncReposOnce(r.state, r.helm); errs != nil && len(errs) > 0 {
+			return errs
+		}
+	}
+
+	before, err := r.state.LockedRequirements()
+	if err != nil {
+		return []error{err}
+	}
+
+	if errs := r.state.UpdateDeps(r.helm); len(errs) > 0 {
+		return errs
+	}
+
+	after, err := r.state.LockedRequirements()
+	if err != nil {
+		return []error{err}
+	}
+
+	changes, err := state.DiffLockedRequirements(before, after)
+	if err != nil {
+		return []error{err}
+	}
+
+	if len(changes) == 0 {
+		c.Logger().Infof("No chart versions changed in the lock file of %s", r.state.FilePath)
+	} else {
+		c.Logger().Infof("Updated the lock file of %s:\n%s", r.state.FilePath, state.RenderChangelog(changes))
+	}
+
+	return nil
+}
+
+func (r *Run) WarmCache(c WarmCacheConfigProvider) []error {
+	r.helm.SetExtraArgs(argparser.GetArgs(c.Args(), r.state)...)
+
+	results, err := r.state.WarmCache(r.helm)
+	if err != nil {
+		return []error{err}
+	}
+
+	errs := []error{}
+	for _, res := range results {
+		if res.Err != nil {
+			c.Logger().Errorf("failed to fetch %s %s from %s: %v", res.Chart, res.Version, res.Repository, res.Err)
+			errs = append(errs, fmt.Errorf("unable to fetch %s %s: %v", res.Chart, res.Version, res.Err))
+		} else if res.Cached {
+			c.Logger().Infof("%s %s is already cached", res.Chart, res.Version)
+		} else {
+			c.Logger().Infof("fetched %s %s from %s", res.Chart, res.Version, res.Repository)
+		}
+	}
+
+	if len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
+
+func (r *Run) Fetch(c FetchConfigProvider, outputDir string) []error {
+	r.helm.SetExtraArgs(argparser.GetArgs(c.Args(), r.state)...)
+
+	charts, err := r.state.VendorCharts(r.helm, outputDir)
+	if err != nil {
+		return []error{err}
+	}
+
+	errs := []error{}
+	for _, ch := range charts {
+		if ch.Err != nil {
+			c.Logger().Errorf("failed to fetch %s %s from %s: %v", ch.Chart, ch.Version, ch.Repository, ch.Err)
+			errs = append(errs, fmt.Errorf("unable to fetch %s %s: %v", ch.Chart, ch.Version, ch.Err))
+		} else if ch.Cached {
+			c.Logger().Infof("%s %s is already fetched into %s", ch.Chart, ch.Version, ch.Path)
+		} else {
+			c.Logger().Infof("fetched %s %s from %s into %s", ch.Chart, ch.Version, ch.Repository, ch.Path)
+		}
+	}
+
+	if len(errs) != 0 {
 		return errs
 	}
 
-	return r.state.UpdateDeps(r.helm)
+	if !c.Rewrite() || len(charts) == 0 {
+		return nil
+	}
+
+	content, err := ioutil.ReadFile(r.state.FilePath)
+	if err != nil {
+		return []error{err}
+	}
+
+	rewritten, missing := r.state.RewriteVendoredCharts(content, charts)
+	for _, release := range missing {
+		c.Logger().Warnf("unable to rewrite the chart of the release %q in %s to the fetched chart: edit it by hand", release, r.state.FilePath)
+	}
+
+	if err := ioutil.WriteFile(r.state.FilePath, rewritten, 0644); err != nil {
+		return []error{err}
+	}
+	c.Logger().Infof("rewrote %s to use the fetched charts", r.state.FilePath)
+
+	return nil
 }
 
 func (r *Run) Repos(c ReposConfigProvider) []error {
@@ -9,6 +9,17 @@ type HelmContext struct {
 	Tillerless      bool
 	TillerNamespace string
 	WorkerIndex     int
+	// Namespace is the namespace of the release, which helm v3 needs to find the release by its name
+	Namespace string
+	// HelmBinary is the helm binary of the release, overriding the default one of the helmexec
+	HelmBinary string
+	// KubeContext is the kube context of the release, overriding the default one of the helmexec
+	KubeContext string
+	// CreateNamespace, when set to true, creates the namespace of the release if missing on sync
+	CreateNamespace bool
+	// NamespaceLabels and NamespaceAnnotations are set on the namespace of the release before installing it, when CreateNamespace is true
+	NamespaceLabels      map[string]string
+	NamespaceAnnotations map[string]string
 }
 
 func (context *HelmContext) GetTillerlessArgs(helmBinary string) []string {
@@ -1,14 +1,17 @@
 package helmexec
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 
+	"github.com/Masterminds/semver"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
@@ -24,6 +27,14 @@ type execer struct {
 	kubeContext     string
 	extra           []string
 	decryptionMutex sync.Mutex
+	// tillerMutex serializes tillerless commands, as each `helm tiller run` starts tiller locally on the same port
+	tillerMutex sync.Mutex
+	// dryRun, when true, logs the commands modifying releases instead of running them
+	dryRun bool
+
+	versionMutex sync.Mutex
+	// versions memoizes the versions of helm binaries, which are nil when they couldn't be detected
+	versions map[string]*semver.Version
 }
 
 func NewLogger(writer io.Writer, logLevel string) *zap.SugaredLogger {
@@ -43,6 +54,8 @@ func NewLogger(writer io.Writer, logLevel string) *zap.SugaredLogger {
 	return zap.New(core).Sugar()
 }
 
+var _ Interface = &execer{}
+
 // New for running helm commands
 func New(logger *zap.SugaredLogger, kubeContext string, runner Runner) *execer {
 	return &execer{
@@ -50,6 +63,7 @@ func New(logger *zap.SugaredLogger, kubeContext string, runner Runner) *execer {
 		logger:      logger,
 		kubeContext: kubeContext,
 		runner:      runner,
+		versions:    map[string]*semver.Version{},
 	}
 }
 
@@ -61,6 +75,111 @@ func (helm *execer) SetHelmBinary(bin string) {
 	helm.helmBinary = bin
 }
 
+// SetDryRun enables the dry-run mode, in which the commands that modify releases, like `helm upgrade --install` and `helm delete`,
+// are logged with secrets masked instead of being run, so that users can audit what helmfile would run.
+// Commands that only read, like `helm list` and `helm diff`, still run, so that helmfile decides which releases to modify as usual.
+func (helm *execer) SetDryRun(dryRun bool) {
+	helm.dryRun = dryRun
+}
+
+// Version returns the version of the helm binary, as reported by `helm version --client --short`.
+// The version is detected once, and nil is returned when it can't be detected.
+func (helm *execer) Version() *semver.Version {
+	return helm.versionOf(helm.helmBinary)
+}
+
+// VersionOf returns the version of the helm binary, or of the default helm binary when bin is empty
+func (helm *execer) VersionOf(bin string) *semver.Version {
+	if bin == "" {
+		bin = helm.helmBinary
+	}
+	return helm.versionOf(bin)
+}
+
+func (helm *execer) versionOf(bin string) *semver.Version {
+	helm.versionMutex.Lock()
+	defer helm.versionMutex.Unlock()
+
+	v, ok := helm.versions[bin]
+	if !ok {
+		out, err := helm.runner.Execute(bin, []string{"version", "--client", "--short"}, map[string]string{})
+		if err != nil {
+			helm.logger.Debugf("unable to detect the version of %s: %v", bin, err)
+		} else if parsed, err := parseHelmVersion(string(out)); err == nil {
+			v = parsed
+		}
+		helm.versions[bin] = v
+	}
+
+	return v
+}
+
+// IsHelm3 returns true when the helm binary is helm v3.
+// The helm binary is assumed to be helm v2 when its version can't be detected.
+func (helm *execer) IsHelm3() bool {
+	return helm.isHelm3(helm.helmBinary)
+}
+
+func (helm *execer) isHelm3(bin string) bool {
+	v := helm.versionOf(bin)
+	return v != nil && v.Major() >= 3
+}
+
+// supportsCreateNamespace returns true when `helm upgrade --install` accepts `--create-namespace`, which was added in helm v3.2.0
+func (helm *execer) supportsCreateNamespace(bin string) bool {
+	v := helm.versionOf(bin)
+	return v != nil && (v.Major() > 3 || v.Major() == 3 && v.Minor() >= 2)
+}
+
+// binary returns the helm binary to run commands against the release in the context with,
+// which is the one of the release when it overrides the default one
+func (helm *execer) binary(context HelmContext) string {
+	if context.HelmBinary != "" {
+		return context.HelmBinary
+	}
+	return helm.helmBinary
+}
+
+// tillerless returns the args and the envvars to run the helm command via the helm-tiller plugin when the context is tillerless.
+// helm v3 has no tiller, so that the context is ignored.
+func (helm *execer) tillerless(context HelmContext) ([]string, map[string]string) {
+	bin := helm.binary(context)
+	if helm.isHelm3(bin) {
+		return []string{}, map[string]string{}
+	}
+	return context.GetTillerlessArgs(bin), context.getTillerlessEnv()
+}
+
+// lockTiller locks the local tiller when the context is tillerless, so that concurrent commands don't start tiller on the same port at once.
+// It returns the function to unlock it.
+func (helm *execer) lockTiller(context HelmContext) func() {
+	if !context.Tillerless || helm.isHelm3(helm.binary(context)) {
+		return func() {}
+	}
+	helm.tillerMutex.Lock()
+	return helm.tillerMutex.Unlock
+}
+
+// releaseCommand returns the args and the envvars to run the helm command against the release in the context.
+// The flags are built for helm v2, and translated for helm v3, which also needs the namespace of the release,
+// as release names are scoped to namespaces instead of tiller.
+func (helm *execer) releaseCommand(context HelmContext, args []string, flags []string) ([]string, map[string]string) {
+	preArgs, env := helm.tillerless(context)
+	if helm.isHelm3(helm.binary(context)) {
+		flags = helm3Flags(flags)
+		if context.Namespace != "" && !hasFlag(flags, "--namespace") {
+			flags = append(flags, "--namespace", context.Namespace)
+		}
+		// The kube context is omitted from the flags of tillerless releases, which helm v3 doesn't have
+		if context.KubeContext != "" && !hasFlag(flags, "--kube-context") {
+			flags = append(flags, "--kube-context", context.KubeContext)
+		}
+	} else {
+		flags = helm2Flags(flags)
+	}
+	return append(append(preArgs, args...), flags...), env
+}
+
 func (helm *execer) AddRepo(name, repository, certfile, keyfile, username, password string) error {
 	var args []string
 	args = append(args, "repo", "add", name, repository)
@@ -76,6 +195,42 @@ func (helm *execer) AddRepo(name, repository, certfile, keyfile, username, passw
 	return err
 }
 
+// ListPlugins returns the names of the installed helm plugins, like `diff` for helm-diff
+func (helm *execer) ListPlugins() ([]string, error) {
+	out, err := helm.exec([]string{"plugin", "list"}, map[string]string{})
+	if err != nil {
+		return nil, err
+	}
+	return parsePluginList(string(out)), nil
+}
+
+// parsePluginList returns the names in the output of `helm plugin list`, which is the table headed by `NAME VERSION DESCRIPTION`
+func parsePluginList(out string) []string {
+	names := []string{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] == "NAME" {
+			continue
+		}
+		names = append(names, fields[0])
+	}
+	return names
+}
+
+func (helm *execer) InstallPlugin(url string) error {
+	helm.logger.Infof("Installing helm plugin %v", url)
+	out, err := helm.exec([]string{"plugin", "install", url}, map[string]string{})
+	helm.info(out)
+	return err
+}
+
+func (helm *execer) RegistryLogin(registry, username, password string) error {
+	helm.logger.Infof("Logging in to registry %v", registry)
+	out, err := helm.exec([]string{"registry", "login", registry, "--username", username, "--password", password}, map[string]string{})
+	helm.info(out)
+	return err
+}
+
 func (helm *execer) UpdateRepo() error {
 	helm.logger.Info("Updating repo")
 	out, err := helm.exec([]string{"repo", "update"}, map[string]string{})
@@ -84,8 +239,13 @@ func (helm *execer) UpdateRepo() error {
 }
 
 func (helm *execer) UpdateDeps(chart string) error {
+	return helm.UpdateDepsContext(context.Background(), chart)
+}
+
+// UpdateDepsContext runs `helm dependency update` like UpdateDeps, killing helm once the context is done when the runner supports it
+func (helm *execer) UpdateDepsContext(ctx context.Context, chart string) error {
 	helm.logger.Infof("Updating dependency %v", chart)
-	out, err := helm.exec([]string{"dependency", "update", chart}, map[string]string{})
+	out, err := helm.execBinaryContext(ctx, helm.helmBinary, []string{"dependency", "update", chart}, map[string]string{})
 	helm.info(out)
 	return err
 }
@@ -99,27 +259,109 @@ func (helm *execer) BuildDeps(chart string) error {
 
 func (helm *execer) SyncRelease(context HelmContext, name, chart string, flags ...string) error {
 	helm.logger.Infof("Upgrading %v", chart)
-	preArgs := context.GetTillerlessArgs(helm.helmBinary)
-	env := context.getTillerlessEnv()
-	out, err := helm.exec(append(append(preArgs, "upgrade", "--install", "--reset-values", name, chart), flags...), env)
-	helm.write(out)
+	defer helm.lockTiller(context)()
+	bin := helm.binary(context)
+	args, env := helm.releaseCommand(context, []string{"upgrade", "--install", "--reset-values", name, chart}, flags)
+	labeled := len(context.NamespaceLabels) > 0 || len(context.NamespaceAnnotations) > 0
+	if context.CreateNamespace && context.Namespace != "" && labeled {
+		// The namespace is labeled before installing the release, so that labels like `istio-injection` take effect on the first pods of the release
+		if err := helm.createNamespace(context); err != nil {
+			return err
+		}
+		if err := helm.labelNamespace(context); err != nil {
+			return err
+		}
+	} else if context.CreateNamespace && context.Namespace != "" && helm.isHelm3(bin) {
+		// tiller of helm v2 creates the namespace of the release if missing, which helm v3 does only when told to
+		if helm.supportsCreateNamespace(bin) {
+			args = append(args, "--create-namespace")
+		} else if err := helm.createNamespace(context); err != nil {
+			return err
+		}
+	}
+	out, err := helm.modify(bin, args, env)
+	helm.releaseOutput(context, name, "upgrade", out)
+	return err
+}
+
+// createNamespace creates the namespace of the release with kubectl, for helm v3 prior to v3.2.0 lacking `--create-namespace`,
+// and for labeling the namespace before installing the release.
+// The namespace already existing isn't an error.
+func (helm *execer) createNamespace(context HelmContext) error {
+	if err := helm.kubectl(context, "create", "namespace", context.Namespace); err != nil && !strings.Contains(err.Error(), "AlreadyExists") {
+		return err
+	}
+	return nil
+}
+
+// labelNamespace sets the labels and the annotations on the namespace of the release, overwriting the existing ones
+func (helm *execer) labelNamespace(context HelmContext) error {
+	if len(context.NamespaceLabels) > 0 {
+		args := append([]string{"label", "namespace", context.Namespace}, keyValues(context.NamespaceLabels)...)
+		if err := helm.kubectl(context, append(args, "--overwrite")...); err != nil {
+			return err
+		}
+	}
+	if len(context.NamespaceAnnotations) > 0 {
+		args := append([]string{"annotate", "namespace", context.Namespace}, keyValues(context.NamespaceAnnotations)...)
+		if err := helm.kubectl(context, append(args, "--overwrite")...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// kubectl runs kubectl against the kube context of the release
+func (helm *execer) kubectl(context HelmContext, args ...string) error {
+	kubeContext := helm.kubeContext
+	if context.KubeContext != "" {
+		kubeContext = context.KubeContext
+	}
+	if kubeContext != "" {
+		args = append(args, "--context", kubeContext)
+	}
+
+	cmd := fmt.Sprintf("kubectl %s", strings.Join(args, " "))
+	if helm.dryRun {
+		helm.logger.Infof("dry-run: %s", cmd)
+		return nil
+	}
+
+	helm.logger.Debugf("exec: %s", cmd)
+	out, err := helm.runner.Execute("kubectl", args, map[string]string{})
+	helm.logger.Debugf("exec: %s: %s", cmd, out)
 	return err
 }
 
+// keyValues returns `key=value` pairs sorted by the keys
+func keyValues(m map[string]string) []string {
+	kvs := []string{}
+	for k, v := range m {
+		kvs = append(kvs, k+"="+v)
+	}
+	sort.Strings(kvs)
+	return kvs
+}
+
 func (helm *execer) ReleaseStatus(context HelmContext, name string, flags ...string) error {
 	helm.logger.Infof("Getting status %v", name)
-	preArgs := context.GetTillerlessArgs(helm.helmBinary)
-	env := context.getTillerlessEnv()
-	out, err := helm.exec(append(append(preArgs, "status", name), flags...), env)
+	defer helm.lockTiller(context)()
+	args, env := helm.releaseCommand(context, []string{"status", name}, flags)
+	out, err := helm.execBinary(helm.binary(context), args, env)
 	helm.write(out)
 	return err
 }
 
 func (helm *execer) List(context HelmContext, filter string, flags ...string) (string, error) {
 	helm.logger.Infof("Listing releases matching %v", filter)
-	preArgs := context.GetTillerlessArgs(helm.helmBinary)
-	env := context.getTillerlessEnv()
-	out, err := helm.exec(append(append(preArgs, "list", filter), flags...), env)
+	defer helm.lockTiller(context)()
+	// helm v3 takes the filter as the flag instead of the argument
+	list := []string{"list", filter}
+	if helm.isHelm3(helm.binary(context)) {
+		list = []string{"list", "--filter", filter}
+	}
+	args, env := helm.releaseCommand(context, list, flags)
+	out, err := helm.execBinary(helm.binary(context), args, env)
 	helm.write(out)
 	return string(out), err
 }
@@ -134,9 +376,10 @@ func (helm *execer) DecryptSecret(context HelmContext, name string, flags ...str
 		return "", err
 	}
 	helm.logger.Infof("Decrypting secret %v", absPath)
-	preArgs := context.GetTillerlessArgs(helm.helmBinary)
-	env := context.getTillerlessEnv()
-	out, err := helm.exec(append(append(preArgs, "secrets", "dec", absPath), flags...), env)
+	unlock := helm.lockTiller(context)
+	preArgs, env := helm.tillerless(context)
+	out, err := helm.execBinary(helm.binary(context), append(append(preArgs, "secrets", "dec", absPath), flags...), env)
+	unlock()
 	helm.info(out)
 	if err != nil {
 		return "", err
@@ -181,16 +424,20 @@ func (helm *execer) DecryptSecret(context HelmContext, name string, flags ...str
 }
 
 func (helm *execer) TemplateRelease(chart string, flags ...string) error {
-	out, err := helm.exec(append([]string{"template", chart}, flags...), map[string]string{})
+	args := append([]string{"template", chart}, helm2Flags(flags)...)
+	if helm.IsHelm3() {
+		args = helm3TemplateArgs(chart, flags)
+	}
+	out, err := helm.exec(args, map[string]string{})
 	helm.write(out)
 	return err
 }
 
 func (helm *execer) DiffRelease(context HelmContext, name, chart string, flags ...string) error {
 	helm.logger.Infof("Comparing %v %v", name, chart)
-	preArgs := context.GetTillerlessArgs(helm.helmBinary)
-	env := context.getTillerlessEnv()
-	out, err := helm.exec(append(append(preArgs, "diff", "upgrade", "--reset-values", "--allow-unreleased", name, chart), flags...), env)
+	defer helm.lockTiller(context)()
+	args, env := helm.releaseCommand(context, []string{"diff", "upgrade", "--reset-values", "--allow-unreleased", name, chart}, flags)
+	out, err := helm.execBinary(helm.binary(context), args, env)
 	// Do our best to write STDOUT only when diff existed
 	// Unfortunately, this works only when you run helmfile with `--detailed-exitcode`
 	detailedExitcodeEnabled := false
@@ -230,33 +477,72 @@ func (helm *execer) Fetch(chart string, flags ...string) error {
 
 func (helm *execer) DeleteRelease(context HelmContext, name string, flags ...string) error {
 	helm.logger.Infof("Deleting %v", name)
-	preArgs := context.GetTillerlessArgs(helm.helmBinary)
-	env := context.getTillerlessEnv()
-	out, err := helm.exec(append(append(preArgs, "delete", name), flags...), env)
-	helm.write(out)
+	defer helm.lockTiller(context)()
+	bin := helm.binary(context)
+	del := "delete"
+	if helm.isHelm3(bin) {
+		del = "uninstall"
+	}
+	args, env := helm.releaseCommand(context, []string{del, name}, flags)
+	// helm v3 purges the release unless told to keep its history, where helm v2 kept it unless told to purge it
+	if helm.isHelm3(bin) && !hasFlag(flags, "--purge") {
+		args = append(args, "--keep-history")
+	}
+	out, err := helm.modify(bin, args, env)
+	helm.releaseOutput(context, name, del, out)
 	return err
 }
 
 func (helm *execer) TestRelease(context HelmContext, name string, flags ...string) error {
 	helm.logger.Infof("Testing %v", name)
-	preArgs := context.GetTillerlessArgs(helm.helmBinary)
-	env := context.getTillerlessEnv()
-	out, err := helm.exec(append(append(preArgs, "test", name), flags...), env)
+	defer helm.lockTiller(context)()
+	args, env := helm.releaseCommand(context, []string{"test", name}, flags)
+	out, err := helm.modify(helm.binary(context), args, env)
 	helm.write(out)
 	return err
 }
 
 func (helm *execer) exec(args []string, env map[string]string) ([]byte, error) {
+	return helm.execBinary(helm.helmBinary, args, env)
+}
+
+// modify runs the helm command that modifies the release, which is only logged in the dry-run mode
+func (helm *execer) modify(bin string, args []string, env map[string]string) ([]byte, error) {
+	if helm.dryRun {
+		helm.logger.Infof("dry-run: %s %s", bin, strings.Join(maskSecrets(helm.cmdArgs(args)), " "))
+		return []byte{}, nil
+	}
+	return helm.execBinary(bin, args, env)
+}
+
+func (helm *execer) cmdArgs(args []string) []string {
 	cmdargs := args
 	if len(helm.extra) > 0 {
 		cmdargs = append(cmdargs, helm.extra...)
 	}
-	if helm.kubeContext != "" {
+	// The kube context of the release, if any, takes precedence over the default one
+	if helm.kubeContext != "" && !hasFlag(cmdargs, "--kube-context") {
 		cmdargs = append(cmdargs, "--kube-context", helm.kubeContext)
 	}
-	cmd := fmt.Sprintf("exec: %s %s", helm.helmBinary, strings.Join(cmdargs, " "))
+	return cmdargs
+}
+
+func (helm *execer) execBinary(bin string, args []string, env map[string]string) ([]byte, error) {
+	return helm.execBinaryContext(context.Background(), bin, args, env)
+}
+
+// execBinaryContext runs the binary, killing it once the context is done when the runner supports it
+func (helm *execer) execBinaryContext(ctx context.Context, bin string, args []string, env map[string]string) ([]byte, error) {
+	cmdargs := helm.cmdArgs(args)
+	cmd := fmt.Sprintf("exec: %s %s", bin, strings.Join(cmdargs, " "))
 	helm.logger.Debug(cmd)
-	bytes, err := helm.runner.Execute(helm.helmBinary, cmdargs, env)
+	var bytes []byte
+	var err error
+	if runner, ok := helm.runner.(ContextRunner); ok {
+		bytes, err = runner.ExecuteContext(ctx, bin, cmdargs, env)
+	} else {
+		bytes, err = helm.runner.Execute(bin, cmdargs, env)
+	}
 	helm.logger.Debugf("%s: %s", cmd, bytes)
 	return bytes, err
 }
@@ -267,6 +553,18 @@ func (helm *execer) info(out []byte) {
 	}
 }
 
+// releaseOutput logs the progress output of the helm command modifying the release line by line, with the release, its namespace and the command as fields,
+// so that the outputs of releases processed concurrently are attributable to the releases instead of being interleaved
+func (helm *execer) releaseOutput(context HelmContext, release, command string, out []byte) {
+	if len(out) == 0 {
+		return
+	}
+	logger := helm.logger.With("release", release, "namespace", context.Namespace, "command", command)
+	for _, line := range strings.Split(strings.TrimRight(string(out), "\n"), "\n") {
+		logger.Info(line)
+	}
+}
+
 func (helm *execer) write(out []byte) {
 	if len(out) > 0 {
 		fmt.Printf("%s\n", out)
@@ -3,11 +3,14 @@ package helmexec
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 
 	"go.uber.org/zap"
 )
@@ -20,7 +23,7 @@ type mockRunner struct {
 }
 
 func (mock *mockRunner) Execute(cmd string, args []string, env map[string]string) ([]byte, error) {
-	return []byte{}, nil
+	return mock.output, mock.err
 }
 
 func MockExecer(logger *zap.SugaredLogger, kubeContext string) *execer {
@@ -28,6 +31,23 @@ func MockExecer(logger *zap.SugaredLogger, kubeContext string) *execer {
 	return execer
 }
 
+// mockVersionRunner reports the versions of helm binaries for `helm version`, and runs any other command successfully without output
+type mockVersionRunner struct {
+	versions map[string]string
+}
+
+func (mock *mockVersionRunner) Execute(cmd string, args []string, env map[string]string) ([]byte, error) {
+	if len(args) > 0 && args[0] == "version" {
+		return []byte(mock.versions[cmd]), nil
+	}
+	return []byte{}, nil
+}
+
+func MockHelm3Execer(logger *zap.SugaredLogger, kubeContext string, version string) *execer {
+	execer := New(logger, kubeContext, &mockVersionRunner{versions: map[string]string{"helm": version}})
+	return execer
+}
+
 // Test methods
 
 func TestNewHelmExec(t *testing.T) {
@@ -116,6 +136,20 @@ exec: helm repo add myRepo https://repo.example.com/ --username example_user --p
 	}
 }
 
+func Test_RegistryLogin(t *testing.T) {
+	var buffer bytes.Buffer
+	logger := NewLogger(&buffer, "debug")
+	helm := MockExecer(logger, "dev")
+	helm.RegistryLogin("registry.example.com", "example_user", "example_password")
+	expected := `Logging in to registry registry.example.com
+exec: helm registry login registry.example.com --username example_user --password example_password --kube-context dev
+exec: helm registry login registry.example.com --username example_user --password example_password --kube-context dev: 
+`
+	if buffer.String() != expected {
+		t.Errorf("helmexec.RegistryLogin()\nactual = %v\nexpect = %v", buffer.String(), expected)
+	}
+}
+
 func Test_UpdateRepo(t *testing.T) {
 	var buffer bytes.Buffer
 	logger := NewLogger(&buffer, "debug")
@@ -169,6 +203,271 @@ exec: helm tiller run foo -- helm upgrade --install --reset-values release chart
 	}
 }
 
+// concurrencyRunner records the maximum number of commands running at once
+type concurrencyRunner struct {
+	mu      sync.Mutex
+	running int
+	max     int
+}
+
+func (r *concurrencyRunner) Execute(cmd string, args []string, env map[string]string) ([]byte, error) {
+	r.mu.Lock()
+	r.running++
+	if r.running > r.max {
+		r.max = r.running
+	}
+	r.mu.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+
+	r.mu.Lock()
+	r.running--
+	r.mu.Unlock()
+	return []byte{}, nil
+}
+
+func Test_SyncReleaseTillerlessConcurrency(t *testing.T) {
+	logger := NewLogger(ioutil.Discard, "debug")
+	runner := &concurrencyRunner{}
+	helm := New(logger, "dev", runner)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			helm.SyncRelease(HelmContext{Tillerless: true, TillerNamespace: "foo"}, "release", "chart")
+		}()
+	}
+	wg.Wait()
+
+	if runner.max != 1 {
+		t.Errorf("unexpected number of concurrent tillerless commands: expected=1, got=%d", runner.max)
+	}
+}
+
+func Test_SyncReleaseHistoryMax(t *testing.T) {
+	var buffer bytes.Buffer
+	logger := NewLogger(&buffer, "debug")
+	helm := MockHelm3Execer(logger, "dev", "v3.1.2+gd878f5d\n")
+	helm.SyncRelease(HelmContext{}, "release", "chart", "--history-max", "5")
+	expected := `Upgrading chart
+exec: helm upgrade --install --reset-values release chart --history-max 5 --kube-context dev
+exec: helm upgrade --install --reset-values release chart --history-max 5 --kube-context dev: 
+`
+	if buffer.String() != expected {
+		t.Errorf("helmexec.SyncRelease()\nactual = %v\nexpect = %v", buffer.String(), expected)
+	}
+
+	buffer.Reset()
+	helm = MockExecer(logger, "dev")
+	helm.SyncRelease(HelmContext{}, "release", "chart", "--history-max", "5", "--wait")
+	expected = `Upgrading chart
+exec: helm upgrade --install --reset-values release chart --wait --kube-context dev
+exec: helm upgrade --install --reset-values release chart --wait --kube-context dev: 
+`
+	if buffer.String() != expected {
+		t.Errorf("helmexec.SyncRelease()\nactual = %v\nexpect = %v", buffer.String(), expected)
+	}
+}
+
+func Test_SyncReleaseCreateNamespace(t *testing.T) {
+	var buffer bytes.Buffer
+	logger := NewLogger(&buffer, "debug")
+	helm := MockHelm3Execer(logger, "dev", "v3.1.2+gd878f5d\n")
+	helm.SyncRelease(HelmContext{Namespace: "foo", KubeContext: "prod", CreateNamespace: true}, "release", "chart")
+	expected := `Upgrading chart
+exec: kubectl create namespace foo --context prod
+exec: kubectl create namespace foo --context prod: 
+exec: helm upgrade --install --reset-values release chart --namespace foo --kube-context prod
+exec: helm upgrade --install --reset-values release chart --namespace foo --kube-context prod: 
+`
+	if buffer.String() != expected {
+		t.Errorf("helmexec.SyncRelease()\nactual = %v\nexpect = %v", buffer.String(), expected)
+	}
+
+	buffer.Reset()
+	helm = MockHelm3Execer(logger, "dev", "v3.2.0+ge29ce2a\n")
+	helm.SyncRelease(HelmContext{Namespace: "foo"}, "release", "chart")
+	expected = `Upgrading chart
+exec: helm upgrade --install --reset-values release chart --namespace foo --kube-context dev
+exec: helm upgrade --install --reset-values release chart --namespace foo --kube-context dev: 
+`
+	if buffer.String() != expected {
+		t.Errorf("helmexec.SyncRelease()\nactual = %v\nexpect = %v", buffer.String(), expected)
+	}
+}
+
+func Test_SyncReleaseNamespaceLabels(t *testing.T) {
+	var buffer bytes.Buffer
+	logger := NewLogger(&buffer, "debug")
+	helm := MockHelm3Execer(logger, "dev", "v3.2.0+ge29ce2a\n")
+	helm.SyncRelease(HelmContext{
+		Namespace:            "foo",
+		CreateNamespace:      true,
+		NamespaceLabels:      map[string]string{"team": "web", "istio-injection": "enabled"},
+		NamespaceAnnotations: map[string]string{"owner": "web@example.com"},
+	}, "release", "chart")
+	expected := `Upgrading chart
+exec: kubectl create namespace foo --context dev
+exec: kubectl create namespace foo --context dev: 
+exec: kubectl label namespace foo istio-injection=enabled team=web --overwrite --context dev
+exec: kubectl label namespace foo istio-injection=enabled team=web --overwrite --context dev: 
+exec: kubectl annotate namespace foo owner=web@example.com --overwrite --context dev
+exec: kubectl annotate namespace foo owner=web@example.com --overwrite --context dev: 
+exec: helm upgrade --install --reset-values release chart --namespace foo --kube-context dev
+exec: helm upgrade --install --reset-values release chart --namespace foo --kube-context dev: 
+`
+	if buffer.String() != expected {
+		t.Errorf("helmexec.SyncRelease()\nactual = %v\nexpect = %v", buffer.String(), expected)
+	}
+
+	buffer.Reset()
+	helm.SyncRelease(HelmContext{
+		Namespace:       "foo",
+		NamespaceLabels: map[string]string{"team": "web"},
+	}, "release", "chart")
+	expected = `Upgrading chart
+exec: helm upgrade --install --reset-values release chart --namespace foo --kube-context dev
+exec: helm upgrade --install --reset-values release chart --namespace foo --kube-context dev: 
+`
+	if buffer.String() != expected {
+		t.Errorf("helmexec.SyncRelease()\nactual = %v\nexpect = %v", buffer.String(), expected)
+	}
+}
+
+func Test_SyncReleaseHelm3(t *testing.T) {
+	var buffer bytes.Buffer
+	logger := NewLogger(&buffer, "debug")
+	helm := MockHelm3Execer(logger, "dev", "v3.2.0+ge29ce2a\n")
+	helm.SyncRelease(HelmContext{Tillerless: true, Namespace: "foo", CreateNamespace: true}, "release", "chart",
+		"--namespace", "foo", "--timeout", "300", "--tiller-namespace", "kube-system", "--tls")
+	expected := `Upgrading chart
+exec: helm upgrade --install --reset-values release chart --namespace foo --timeout 300s --create-namespace --kube-context dev
+exec: helm upgrade --install --reset-values release chart --namespace foo --timeout 300s --create-namespace --kube-context dev: 
+`
+	if buffer.String() != expected {
+		t.Errorf("helmexec.SyncRelease()\nactual = %v\nexpect = %v", buffer.String(), expected)
+	}
+
+	buffer.Reset()
+	helm = MockHelm3Execer(logger, "dev", "v3.1.2+gd878f5d\n")
+	helm.SyncRelease(HelmContext{}, "release", "chart")
+	expected = `Upgrading chart
+exec: helm upgrade --install --reset-values release chart --kube-context dev
+exec: helm upgrade --install --reset-values release chart --kube-context dev: 
+`
+	if buffer.String() != expected {
+		t.Errorf("helmexec.SyncRelease()\nactual = %v\nexpect = %v", buffer.String(), expected)
+	}
+}
+
+func Test_SyncReleaseHelmBinary(t *testing.T) {
+	var buffer bytes.Buffer
+	logger := NewLogger(&buffer, "debug")
+	helm := New(logger, "dev", &mockVersionRunner{versions: map[string]string{
+		"helm":  "Client: v2.14.1+g5270352\n",
+		"helm3": "v3.0.0+ge29ce2a\n",
+	}})
+	helm.SyncRelease(HelmContext{HelmBinary: "helm3", Tillerless: true}, "release", "chart", "--tls")
+	expected := `Upgrading chart
+exec: helm3 upgrade --install --reset-values release chart --kube-context dev
+exec: helm3 upgrade --install --reset-values release chart --kube-context dev: 
+`
+	if buffer.String() != expected {
+		t.Errorf("helmexec.SyncRelease()\nactual = %v\nexpect = %v", buffer.String(), expected)
+	}
+
+	buffer.Reset()
+	helm.SyncRelease(HelmContext{Tillerless: true}, "release", "chart", "--tls")
+	expected = `Upgrading chart
+exec: helm tiller run -- helm upgrade --install --reset-values release chart --tls --kube-context dev
+exec: helm tiller run -- helm upgrade --install --reset-values release chart --tls --kube-context dev: 
+`
+	if buffer.String() != expected {
+		t.Errorf("helmexec.SyncRelease()\nactual = %v\nexpect = %v", buffer.String(), expected)
+	}
+}
+
+func Test_SyncReleaseDryRun(t *testing.T) {
+	var buffer bytes.Buffer
+	logger := NewLogger(&buffer, "debug")
+	helm := New(logger, "dev", &mockRunner{output: []byte("unexpected")})
+	helm.SetDryRun(true)
+	helm.SyncRelease(HelmContext{}, "release", "chart", "--set", "password=secret")
+	expected := `Upgrading chart
+dry-run: helm upgrade --install --reset-values release chart --set password=*** --kube-context dev
+`
+	if buffer.String() != expected {
+		t.Errorf("helmexec.SyncRelease()\nactual = %v\nexpect = %v", buffer.String(), expected)
+	}
+
+	buffer.Reset()
+	out, err := helm.List(HelmContext{}, "^release$")
+	if err != nil || out != "unexpected" {
+		t.Errorf("helmexec.List() should run in the dry-run mode: out = %s, err = %v", out, err)
+	}
+}
+
+func Test_SyncReleaseOutput(t *testing.T) {
+	var buffer bytes.Buffer
+	logger := NewLogger(&buffer, "info")
+	helm := New(logger, "dev", &mockRunner{output: []byte("Release \"release\" has been upgraded.\nSTATUS: DEPLOYED\n")})
+	helm.SyncRelease(HelmContext{Namespace: "foo"}, "release", "chart")
+	expected := `Upgrading chart
+Release "release" has been upgraded.	{"release": "release", "namespace": "foo", "command": "upgrade"}
+STATUS: DEPLOYED	{"release": "release", "namespace": "foo", "command": "upgrade"}
+`
+	if buffer.String() != expected {
+		t.Errorf("helmexec.SyncRelease()\nactual = %v\nexpect = %v", buffer.String(), expected)
+	}
+}
+
+func Test_SyncReleaseKubeContext(t *testing.T) {
+	var buffer bytes.Buffer
+	logger := NewLogger(&buffer, "debug")
+	helm := MockExecer(logger, "dev")
+	helm.SyncRelease(HelmContext{}, "release", "chart", "--kube-context", "prod")
+	expected := `Upgrading chart
+exec: helm upgrade --install --reset-values release chart --kube-context prod
+exec: helm upgrade --install --reset-values release chart --kube-context prod: 
+`
+	if buffer.String() != expected {
+		t.Errorf("helmexec.SyncRelease()\nactual = %v\nexpect = %v", buffer.String(), expected)
+	}
+
+	buffer.Reset()
+	helm = MockHelm3Execer(logger, "dev", "v3.0.0+ge29ce2a\n")
+	helm.SyncRelease(HelmContext{Tillerless: true, KubeContext: "prod"}, "release", "chart")
+	if buffer.String() != expected {
+		t.Errorf("helmexec.SyncRelease()\nactual = %v\nexpect = %v", buffer.String(), expected)
+	}
+}
+
+func Test_parsePluginList(t *testing.T) {
+	out := `NAME   	VERSION	DESCRIPTION
+diff   	3.0.0  	Preview helm upgrade changes as a diff
+secrets	2.0.2  	This plugin provides secrets values encryption for Helm charts secure storing
+`
+	expected := []string{"diff", "secrets"}
+	if actual := parsePluginList(out); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("unexpected plugins: expected=%v, got=%v", expected, actual)
+	}
+}
+
+func Test_ReleaseStatusOutput(t *testing.T) {
+	var buffer bytes.Buffer
+	logger := NewLogger(&buffer, "info")
+	helm := New(logger, "dev", &mockRunner{output: []byte("STATUS: DEPLOYED\n")})
+	helm.ReleaseStatus(HelmContext{Namespace: "foo"}, "release")
+	// The status is the result of the command written to stdout, rather than progress logged
+	expected := `Getting status release
+`
+	if buffer.String() != expected {
+		t.Errorf("helmexec.ReleaseStatus()\nactual = %v\nexpect = %v", buffer.String(), expected)
+	}
+}
+
 func Test_UpdateDeps(t *testing.T) {
 	var buffer bytes.Buffer
 	logger := NewLogger(&buffer, "debug")
@@ -194,6 +493,26 @@ exec: helm dependency update ./chart/foo --verify --kube-context dev:
 	}
 }
 
+func Test_IsHelm3(t *testing.T) {
+	tests := []struct {
+		output   string
+		err      error
+		expected bool
+	}{
+		{output: "v3.0.0+ge29ce2a\n", expected: true},
+		{output: "Client: v2.14.1+g5270352\n", expected: false},
+		{output: "v3.0.0+ge29ce2a\n", err: fmt.Errorf("exit status 1"), expected: false},
+	}
+
+	for _, tt := range tests {
+		logger := NewLogger(os.Stdout, "info")
+		helm := New(logger, "dev", &mockRunner{output: []byte(tt.output), err: tt.err})
+		if actual := helm.IsHelm3(); actual != tt.expected {
+			t.Errorf("unexpected result for %q: expected=%v, got=%v", tt.output, tt.expected, actual)
+		}
+	}
+}
+
 func Test_BuildDeps(t *testing.T) {
 	var buffer bytes.Buffer
 	logger := NewLogger(&buffer, "debug")
@@ -302,6 +621,30 @@ exec: helm delete release --purge --kube-context dev:
 	}
 }
 
+func Test_DeleteReleaseHelm3(t *testing.T) {
+	var buffer bytes.Buffer
+	logger := NewLogger(&buffer, "debug")
+	helm := MockHelm3Execer(logger, "dev", "v3.0.0+ge29ce2a\n")
+	helm.DeleteRelease(HelmContext{Namespace: "foo"}, "release", "--purge", "--tiller-namespace=kube-system")
+	expected := `Deleting release
+exec: helm uninstall release --namespace foo --kube-context dev
+exec: helm uninstall release --namespace foo --kube-context dev: 
+`
+	if buffer.String() != expected {
+		t.Errorf("helmexec.DeleteRelease()\nactual = %v\nexpect = %v", buffer.String(), expected)
+	}
+
+	buffer.Reset()
+	helm.DeleteRelease(HelmContext{}, "release")
+	expected = `Deleting release
+exec: helm uninstall release --keep-history --kube-context dev
+exec: helm uninstall release --keep-history --kube-context dev: 
+`
+	if buffer.String() != expected {
+		t.Errorf("helmexec.DeleteRelease()\nactual = %v\nexpect = %v", buffer.String(), expected)
+	}
+}
+
 func Test_TestRelease(t *testing.T) {
 	var buffer bytes.Buffer
 	logger := NewLogger(&buffer, "debug")
@@ -329,6 +672,100 @@ exec: helm test release --cleanup --timeout 60 --kube-context dev:
 	}
 }
 
+func Test_TestReleaseHelm3(t *testing.T) {
+	var buffer bytes.Buffer
+	logger := NewLogger(&buffer, "debug")
+	helm := MockHelm3Execer(logger, "dev", "v3.0.0+ge29ce2a\n")
+	helm.TestRelease(HelmContext{Namespace: "foo"}, "release", "--cleanup", "--timeout", "60")
+	expected := `Testing release
+exec: helm test release --timeout 60s --namespace foo --kube-context dev
+exec: helm test release --timeout 60s --namespace foo --kube-context dev: 
+`
+	if buffer.String() != expected {
+		t.Errorf("helmexec.TestRelease()\nactual = %v\nexpect = %v", buffer.String(), expected)
+	}
+}
+
+// mockHelm3ListRunner lists the releases like helm v3, which prints the table header even when no release matches unless `--short`
+type mockHelm3ListRunner struct {
+	releases []string
+}
+
+func (mock *mockHelm3ListRunner) Execute(cmd string, args []string, env map[string]string) ([]byte, error) {
+	if len(args) > 0 && args[0] == "version" {
+		return []byte("v3.0.0+ge29ce2a\n"), nil
+	}
+	out := ""
+	short := false
+	for _, a := range args {
+		short = short || a == "--short"
+	}
+	if !short {
+		out = "NAME\tNAMESPACE\tREVISION\tUPDATED\tSTATUS\tCHART\tAPP VERSION\n"
+	}
+	for _, r := range mock.releases {
+		if short {
+			out += r + "\n"
+		} else {
+			out += r + "\tfoo\t1\t2019-06-01 00:00:00\tdeployed\tmychart-1.0.0\t1.0.0\n"
+		}
+	}
+	return []byte(out), nil
+}
+
+func Test_ListHelm3(t *testing.T) {
+	var buffer bytes.Buffer
+	logger := NewLogger(&buffer, "debug")
+	helm := MockHelm3Execer(logger, "dev", "v3.0.0+ge29ce2a\n")
+	helm.List(HelmContext{Namespace: "foo"}, "^release$")
+	expected := `Listing releases matching ^release$
+exec: helm list --filter ^release$ --namespace foo --kube-context dev
+exec: helm list --filter ^release$ --namespace foo --kube-context dev: 
+`
+	if buffer.String() != expected {
+		t.Errorf("helmexec.List()\nactual = %v\nexpect = %v", buffer.String(), expected)
+	}
+
+	tests := []struct {
+		releases []string
+		flags    []string
+		expected string
+	}{
+		{releases: []string{"release"}, flags: []string{"--short"}, expected: "release\n"},
+		{releases: []string{}, flags: []string{"--short"}, expected: ""},
+		{releases: []string{}, expected: "NAME\tNAMESPACE\tREVISION\tUPDATED\tSTATUS\tCHART\tAPP VERSION\n"},
+	}
+
+	for _, tt := range tests {
+		helm := New(NewLogger(&bytes.Buffer{}, "debug"), "dev", &mockHelm3ListRunner{releases: tt.releases})
+		out, err := helm.List(HelmContext{Namespace: "foo"}, "^release$", tt.flags...)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if out != tt.expected {
+			t.Errorf("unexpected output for releases %v with flags %v: expected=%q, got=%q", tt.releases, tt.flags, tt.expected, out)
+		}
+	}
+}
+
+func Test_helm3Flags(t *testing.T) {
+	tests := []struct {
+		flags    []string
+		expected []string
+	}{
+		{flags: []string{"--purge", "--tls", "--tls-cert", "cert.pem"}, expected: []string{}},
+		{flags: []string{"--timeout", "300", "--wait"}, expected: []string{"--timeout", "300s", "--wait"}},
+		{flags: []string{"--timeout=5m", "--tiller-namespace=kube-system"}, expected: []string{"--timeout=5m"}},
+		{flags: []string{"--timeout=60", "--namespace", "foo"}, expected: []string{"--timeout=60s", "--namespace", "foo"}},
+	}
+
+	for _, tt := range tests {
+		if actual := helm3Flags(tt.flags); !reflect.DeepEqual(actual, tt.expected) {
+			t.Errorf("unexpected flags for %v: expected=%v, got=%v", tt.flags, tt.expected, actual)
+		}
+	}
+}
+
 func Test_ReleaseStatus(t *testing.T) {
 	var buffer bytes.Buffer
 	logger := NewLogger(&buffer, "debug")
@@ -500,3 +937,26 @@ exec: helm template path/to/chart --values file.yml --kube-context dev:
 		t.Errorf("helmexec.Template()\nactual = %v\nexpect = %v", buffer.String(), expected)
 	}
 }
+
+func Test_TemplateCRDs(t *testing.T) {
+	var buffer bytes.Buffer
+	logger := NewLogger(&buffer, "debug")
+	helm := MockExecer(logger, "dev")
+	helm.TemplateRelease("path/to/chart", "--name", "release", "--include-crds")
+	expected := `exec: helm template path/to/chart --name release --kube-context dev
+exec: helm template path/to/chart --name release --kube-context dev: 
+`
+	if buffer.String() != expected {
+		t.Errorf("helmexec.Template()\nactual = %v\nexpect = %v", buffer.String(), expected)
+	}
+
+	buffer.Reset()
+	helm = MockHelm3Execer(logger, "dev", "v3.2.0+ge29ce2a\n")
+	helm.TemplateRelease("path/to/chart", "--name", "release", "--include-crds")
+	expected = `exec: helm template release path/to/chart --include-crds --kube-context dev
+exec: helm template release path/to/chart --include-crds --kube-context dev: 
+`
+	if buffer.String() != expected {
+		t.Errorf("helmexec.Template()\nactual = %v\nexpect = %v", buffer.String(), expected)
+	}
+}
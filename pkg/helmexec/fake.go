@@ -0,0 +1,53 @@
+package helmexec
+
+import (
+	"strings"
+	"sync"
+)
+
+// Command is the command run via the Runner
+type Command struct {
+	Name string
+	Args []string
+	Env  map[string]string
+}
+
+// String returns the command line, like `helm upgrade --install myapp stable/myapp`
+func (c Command) String() string {
+	return strings.Join(append([]string{c.Name}, c.Args...), " ")
+}
+
+// FakeRunner is the Runner recording commands instead of running them,
+// so that helmfile can be run without helm binaries, like in tests of tools built on helmfile.
+// Give it to New to assert on the exact commands the helm executor issues.
+//
+// Commands succeed without output unless Handler is set. Set Handler to emulate helm, like answering `helm version` to emulate helm v3,
+// or writing `requirements.lock` of the chart given to `helm dependency update` to emulate dependency updates.
+type FakeRunner struct {
+	// Handler returns the output of the command
+	Handler func(cmd Command) ([]byte, error)
+
+	mu       sync.Mutex
+	commands []Command
+}
+
+// Execute records the command, and runs Handler if any
+func (r *FakeRunner) Execute(cmd string, args []string, env map[string]string) ([]byte, error) {
+	c := Command{Name: cmd, Args: append([]string{}, args...), Env: env}
+
+	r.mu.Lock()
+	r.commands = append(r.commands, c)
+	r.mu.Unlock()
+
+	if r.Handler == nil {
+		return []byte{}, nil
+	}
+	return r.Handler(c)
+}
+
+// Commands returns the commands run so far, in the order they were run
+func (r *FakeRunner) Commands() []Command {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Command{}, r.commands...)
+}
@@ -0,0 +1,43 @@
+package helmexec
+
+import (
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestFakeRunner(t *testing.T) {
+	runner := &FakeRunner{
+		Handler: func(cmd Command) ([]byte, error) {
+			switch cmd.Args[0] {
+			case "version":
+				return []byte("v3.2.0+ge29ce2a\n"), nil
+			case "status":
+				return nil, errors.New("release: not found")
+			}
+			return []byte{}, nil
+		},
+	}
+	helm := New(NewLogger(ioutil.Discard, "debug"), "dev", runner)
+
+	if err := helm.SyncRelease(HelmContext{Namespace: "foo", CreateNamespace: true}, "release", "chart", "--timeout", "300"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := helm.ReleaseStatus(HelmContext{Namespace: "foo"}, "release"); err == nil {
+		t.Fatalf("expected error from the handler, got none")
+	}
+
+	expected := []string{
+		"helm version --client --short",
+		"helm upgrade --install --reset-values release chart --timeout 300s --namespace foo --create-namespace --kube-context dev",
+		"helm status release --namespace foo --kube-context dev",
+	}
+	actual := []string{}
+	for _, c := range runner.Commands() {
+		actual = append(actual, c.String())
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("unexpected commands: expected=%v, got=%v", expected, actual)
+	}
+}
@@ -0,0 +1,138 @@
+package helmexec
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/Masterminds/semver"
+)
+
+// helm2OnlyFlags are the flags helm v3 removed along with tiller, mapped to whether they take a value
+var helm2OnlyFlags = map[string]bool{
+	"--purge":                     false,
+	"--cleanup":                   false,
+	"--tls":                       false,
+	"--tls-verify":                false,
+	"--tls-key":                   true,
+	"--tls-cert":                  true,
+	"--tls-ca-cert":               true,
+	"--tls-hostname":              true,
+	"--tiller-namespace":          true,
+	"--tiller-connection-timeout": true,
+}
+
+// helm3OnlyFlags are the flags of helm v3 whose counterparts in helm v2 are settings of tiller, mapped to whether they take a value
+var helm3OnlyFlags = map[string]bool{
+	"--history-max":  true,
+	"--skip-crds":    false,
+	"--include-crds": false,
+}
+
+// timeoutSeconds matches the timeout of helm v2, which is the number of seconds.
+// helm v3 takes durations like `300s` instead.
+var timeoutSeconds = regexp.MustCompile(`^[0-9]+$`)
+
+// parseHelmVersion parses the output of `helm version --client --short`, like `v3.0.0+ge29ce2a` from helm v3 and `Client: v2.14.1+g5270352` from helm v2
+func parseHelmVersion(out string) (*semver.Version, error) {
+	v := strings.TrimSpace(out)
+	v = strings.TrimPrefix(v, "Client: ")
+	return semver.NewVersion(v)
+}
+
+// helm3Flags translates the flags helmfile builds for helm v2 into the ones helm v3 accepts,
+// so that the same helmfile state can be deployed with both.
+// Flags of tiller and of commands helm v3 removed are dropped, and timeouts in seconds are converted to durations.
+func helm3Flags(flags []string) []string {
+	translated := []string{}
+	for i := 0; i < len(flags); i++ {
+		f := flags[i]
+		name := f
+		if j := strings.Index(f, "="); j >= 0 {
+			name = f[:j]
+		}
+
+		if takesValue, ok := helm2OnlyFlags[name]; ok {
+			if takesValue && name == f {
+				i++
+			}
+			continue
+		}
+
+		if name == "--timeout" {
+			if name == f && i+1 < len(flags) {
+				i++
+				translated = append(translated, f, helm3Timeout(flags[i]))
+			} else {
+				translated = append(translated, name+"="+helm3Timeout(strings.TrimPrefix(f, name+"=")))
+			}
+			continue
+		}
+
+		translated = append(translated, f)
+	}
+	return translated
+}
+
+// helm2Flags drops the flags helm v2 doesn't accept, like `--history-max` which is set on tiller via `helm init` instead,
+// and `--skip-crds` and `--include-crds`, as helm v2 has no special handling of CRDs
+func helm2Flags(flags []string) []string {
+	kept := []string{}
+	for i := 0; i < len(flags); i++ {
+		f := flags[i]
+		name := f
+		if j := strings.Index(f, "="); j >= 0 {
+			name = f[:j]
+		}
+
+		if takesValue, ok := helm3OnlyFlags[name]; ok {
+			if takesValue && name == f {
+				i++
+			}
+			continue
+		}
+
+		kept = append(kept, f)
+	}
+	return kept
+}
+
+func helm3Timeout(timeout string) string {
+	if timeoutSeconds.MatchString(timeout) {
+		return timeout + "s"
+	}
+	return timeout
+}
+
+// helm3TemplateArgs returns the args of `helm template` for helm v3, which takes the release name as the argument instead of `--name`
+func helm3TemplateArgs(chart string, flags []string) []string {
+	name := ""
+	rest := []string{}
+	for i := 0; i < len(flags); i++ {
+		f := flags[i]
+		switch {
+		case f == "--name" && i+1 < len(flags):
+			i++
+			name = flags[i]
+		case strings.HasPrefix(f, "--name="):
+			name = strings.TrimPrefix(f, "--name=")
+		default:
+			rest = append(rest, f)
+		}
+	}
+
+	args := []string{"template"}
+	if name != "" {
+		args = append(args, name)
+	}
+	return append(append(args, chart), helm3Flags(rest)...)
+}
+
+// hasFlag returns true when the flag is given either as `--flag value` or `--flag=value`
+func hasFlag(flags []string, name string) bool {
+	for _, f := range flags {
+		if f == name || strings.HasPrefix(f, name+"=") {
+			return true
+		}
+	}
+	return false
+}
@@ -1,5 +1,11 @@
 package helmexec
 
+import (
+	"context"
+
+	"github.com/Masterminds/semver"
+)
+
 // Interface for executing helm commands
 type Interface interface {
 	SetExtraArgs(args ...string)
@@ -7,6 +13,7 @@ type Interface interface {
 
 	AddRepo(name, repository, certfile, keyfile, username, password string) error
 	UpdateRepo() error
+	RegistryLogin(registry, username, password string) error
 	BuildDeps(chart string) error
 	UpdateDeps(chart string) error
 	SyncRelease(context HelmContext, name, chart string, flags ...string) error
@@ -24,3 +31,30 @@ type Interface interface {
 type DependencyUpdater interface {
 	UpdateDeps(chart string) error
 }
+
+// ContextDependencyUpdater is a DependencyUpdater that stops updating the dependencies once the context is done, like on timeouts
+type ContextDependencyUpdater interface {
+	UpdateDepsContext(ctx context.Context, chart string) error
+}
+
+// VersionDetector detects the major version of helm, as helm v3 reads the dependencies of a chart from `Chart.yaml` and `Chart.lock`
+// instead of `requirements.yaml` and `requirements.lock`
+type VersionDetector interface {
+	IsHelm3() bool
+}
+
+// VersionGetter returns the version of the helm binary, or of the default helm binary when bin is empty.
+// nil is returned when the version can't be detected.
+type VersionGetter interface {
+	VersionOf(bin string) *semver.Version
+}
+
+// PluginManager lists and installs helm plugins, like helm-diff and helm-secrets helmfile runs
+type PluginManager interface {
+	ListPlugins() ([]string, error)
+	InstallPlugin(url string) error
+}
+
+type ChartFetcher interface {
+	Fetch(chart string, flags ...string) error
+}
@@ -0,0 +1,72 @@
+package helmexec
+
+import "strings"
+
+const masked = "***"
+
+// maskSecrets masks the values of the flags that may contain secrets in the command, like `--password` and `--set`.
+// The keys of `--set` values are kept, so that the masked command still tells which values are set.
+func maskSecrets(args []string) []string {
+	res := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		name, value, inline := a, "", false
+		if j := strings.Index(a, "="); strings.HasPrefix(a, "--") && j >= 0 {
+			name, value, inline = a[:j], a[j+1:], true
+		}
+
+		var mask func(string) string
+		switch name {
+		case "--password":
+			mask = func(string) string { return masked }
+		case "--set", "--set-string":
+			mask = maskSetValues
+		default:
+			res = append(res, a)
+			continue
+		}
+
+		if inline {
+			res = append(res, name+"="+mask(value))
+		} else if i+1 < len(args) {
+			i++
+			res = append(res, a, mask(args[i]))
+		} else {
+			res = append(res, a)
+		}
+	}
+	return res
+}
+
+// maskSetValues masks the values in `--set` values like `a=1,b.c={x,y}`, keeping the keys like `a=***,b.c=***`
+func maskSetValues(values string) string {
+	var b strings.Builder
+	inValue, depth := false, 0
+	for i := 0; i < len(values); i++ {
+		c := values[i]
+		if !inValue {
+			b.WriteByte(c)
+			if c == '\\' && i+1 < len(values) {
+				i++
+				b.WriteByte(values[i])
+			} else if c == '=' {
+				b.WriteString(masked)
+				inValue = true
+			}
+			continue
+		}
+
+		switch {
+		case c == '\\':
+			i++
+		case c == '{':
+			depth++
+		case c == '}' && depth > 0:
+			depth--
+		case c == ',' && depth == 0:
+			b.WriteByte(c)
+			inValue = false
+		}
+	}
+	return b.String()
+}
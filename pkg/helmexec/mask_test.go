@@ -0,0 +1,32 @@
+package helmexec
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_maskSecrets(t *testing.T) {
+	tests := []struct {
+		args     []string
+		expected []string
+	}{
+		{
+			args:     []string{"repo", "add", "myrepo", "https://repo.example.com", "--username", "user", "--password", "pass"},
+			expected: []string{"repo", "add", "myrepo", "https://repo.example.com", "--username", "user", "--password", "***"},
+		},
+		{
+			args:     []string{"upgrade", "--install", "foo", "chart", "--set", "db.password=secret,image.tag=1.0", "--set-string=tags={a,b}"},
+			expected: []string{"upgrade", "--install", "foo", "chart", "--set", "db.password=***,image.tag=***", "--set-string=tags=***"},
+		},
+		{
+			args:     []string{"--set", `a\=b=c\,d,e=f`, "--set-file", "g=values.yaml"},
+			expected: []string{"--set", `a\=b=***,e=***`, "--set-file", "g=values.yaml"},
+		},
+	}
+
+	for _, tt := range tests {
+		if actual := maskSecrets(tt.args); !reflect.DeepEqual(actual, tt.expected) {
+			t.Errorf("unexpected masked args for %v: expected=%v, got=%v", tt.args, tt.expected, actual)
+		}
+	}
+}
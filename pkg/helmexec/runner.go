@@ -2,6 +2,7 @@ package helmexec
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"go.uber.org/zap"
@@ -21,6 +22,11 @@ type Runner interface {
 	Execute(cmd string, args []string, env map[string]string) ([]byte, error)
 }
 
+// ContextRunner is a Runner that kills the command once the context is done
+type ContextRunner interface {
+	ExecuteContext(ctx context.Context, cmd string, args []string, env map[string]string) ([]byte, error)
+}
+
 // ShellRunner implemention for shell commands
 type ShellRunner struct {
 	Dir string
@@ -30,7 +36,12 @@ type ShellRunner struct {
 
 // Execute a shell command
 func (shell ShellRunner) Execute(cmd string, args []string, env map[string]string) ([]byte, error) {
-	preparedCmd := exec.Command(cmd, args...)
+	return shell.ExecuteContext(context.Background(), cmd, args, env)
+}
+
+// ExecuteContext executes a shell command, killing it once the context is done
+func (shell ShellRunner) ExecuteContext(ctx context.Context, cmd string, args []string, env map[string]string) ([]byte, error) {
+	preparedCmd := exec.CommandContext(ctx, cmd, args...)
 	preparedCmd.Dir = shell.Dir
 	preparedCmd.Env = mergeEnv(os.Environ(), env)
 	return combinedOutput(preparedCmd, shell.Logger)
@@ -66,7 +77,10 @@ func combinedOutput(c *exec.Cmd, logger *zap.SugaredLogger) ([]byte, error) {
 			exitStatus := waitStatus.ExitStatus()
 			err = newExitError(c.Path, exitStatus, string(e))
 		default:
-			panic(fmt.Sprintf("unexpected error: %v", err))
+			// The command isn't started at all when the context is already done
+			if err != context.Canceled && err != context.DeadlineExceeded {
+				panic(fmt.Sprintf("unexpected error: %v", err))
+			}
 		}
 	}
 
@@ -1,6 +1,9 @@
 package maputil
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 func CastKeysToStrings(s interface{}) (map[string]interface{}, error) {
 	new := map[string]interface{}{}
@@ -60,16 +63,24 @@ func recursivelyStringifyMapKey(v interface{}) (interface{}, error) {
 	return casted_v, nil
 }
 
-func Set(m map[string]interface{}, key []string, value string) map[string]interface{} {
+func Set(m map[string]interface{}, key []string, value interface{}) map[string]interface{} {
 	if len(key) == 0 {
 		panic(fmt.Errorf("bug: unexpected length of key: %d", len(key)))
 	}
 
+	if err := set(m, key, value); err != nil {
+		panic(err)
+	}
+
+	return m
+}
+
+func set(m map[string]interface{}, key []string, value interface{}) error {
 	k := key[0]
 
 	if len(key) == 1 {
 		m[k] = value
-		return m
+		return nil
 	}
 
 	remain := key[1:]
@@ -80,12 +91,33 @@ func Set(m map[string]interface{}, key []string, value string) map[string]interf
 	}
 	switch t := nested.(type) {
 	case map[string]interface{}:
-		nested = Set(t, remain, value)
+		if err := set(t, remain, value); err != nil {
+			return err
+		}
+		nested = t
 	default:
-		panic(fmt.Errorf("unexpected type: %v(%T)", t, t))
+		return fmt.Errorf("unexpected type: %v(%T)", t, t)
 	}
 
 	m[k] = nested
 
-	return m
+	return nil
+}
+
+// ParseSetValues parses key-value pairs like `key1=val1,key2.nested=val2` given via `--state-values-set` into nested maps of strings.
+func ParseSetValues(opts []string) (map[string]interface{}, error) {
+	m := map[string]interface{}{}
+	for _, opt := range opts {
+		for _, kv := range strings.Split(opt, ",") {
+			op := strings.SplitN(kv, "=", 2)
+			if len(op) != 2 || op[0] == "" {
+				return nil, fmt.Errorf("invalid state value \"%s\": it must be in the form of key=value", kv)
+			}
+
+			if err := set(m, strings.Split(op[0], "."), op[1]); err != nil {
+				return nil, fmt.Errorf("invalid state value \"%s\": %v", kv, err)
+			}
+		}
+	}
+	return m, nil
 }
@@ -1,6 +1,9 @@
 package maputil
 
-import "testing"
+import (
+	"reflect"
+	"testing"
+)
 
 func TestMapUtil_StrKeys(t *testing.T) {
 	m := map[string]interface{}{
@@ -59,3 +62,45 @@ func TestMapUtil_IFKeys(t *testing.T) {
 		t.Errorf("unexpected c: expected=C, got=%s", c)
 	}
 }
+
+func TestMapUtil_ParseSetValues(t *testing.T) {
+	testcases := []struct {
+		opts     []string
+		expected map[string]interface{}
+		err      string
+	}{
+		{
+			opts: []string{"image.tag=1.10,enabled=true", "a.b=false", "a.c=x=y"},
+			expected: map[string]interface{}{
+				"image":   map[string]interface{}{"tag": "1.10"},
+				"enabled": "true",
+				"a":       map[string]interface{}{"b": "false", "c": "x=y"},
+			},
+		},
+		{
+			opts: []string{"foo"},
+			err:  `invalid state value "foo": it must be in the form of key=value`,
+		},
+		{
+			opts: []string{"a=1,a.b=2"},
+			err:  `invalid state value "a.b=2": unexpected type: 1(string)`,
+		},
+	}
+
+	for i := range testcases {
+		tc := testcases[i]
+		actual, err := ParseSetValues(tc.opts)
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("unexpected error: expected=%s, got=%v", tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(actual, tc.expected) {
+			t.Errorf("unexpected result: expected=%v, got=%v", tc.expected, actual)
+		}
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/hashicorp/go-getter/helper/url"
 	"go.uber.org/zap"
 	"gopkg.in/yaml.v2"
+	"path"
 	"path/filepath"
 	"strings"
 )
@@ -104,6 +105,10 @@ func (e InvalidURLError) Error() string {
 
 type Source struct {
 	Getter, Scheme, User, Host, Dir, File, RawQuery string
+
+	// FileMode is true when the URL refers to a single file without `@`, like `https://example.com/path/to/values.yaml`.
+	// The file is fetched alone rather than the directory containing it, which allows pinning its checksum via `?checksum=sha256:...`
+	FileMode bool
 }
 
 func IsRemote(goGetterSrc string) bool {
@@ -132,8 +137,20 @@ func Parse(goGetterSrc string) (*Source, error) {
 	}
 
 	pathComponents := strings.Split(u.Path, "@")
+	if len(pathComponents) == 1 && path.Base(u.Path) != "/" && path.Base(u.Path) != "." {
+		return &Source{
+			Getter:   getter,
+			User:     u.User.String(),
+			Scheme:   u.Scheme,
+			Host:     u.Host,
+			Dir:      path.Dir(u.Path),
+			File:     path.Base(u.Path),
+			RawQuery: u.RawQuery,
+			FileMode: true,
+		}, nil
+	}
 	if len(pathComponents) != 2 {
-		return nil, fmt.Errorf("invalid src format: it must be `[<getter>::]<scheme>://<host>/<path/to/dir>@<path/to/file>?key1=val1&key2=val2: got %s", goGetterSrc)
+		return nil, fmt.Errorf("invalid src format: it must be `[<getter>::]<scheme>://<host>/<path/to/dir>@<path/to/file>?key1=val1&key2=val2` or `[<getter>::]<scheme>://<host>/<path/to/file>?key1=val1&key2=val2`: got %s", goGetterSrc)
 	}
 
 	return &Source{
@@ -156,6 +173,12 @@ func (r *Remote) Fetch(goGetterSrc string) (string, error) {
 	srcDir := fmt.Sprintf("%s://%s%s", u.Scheme, u.Host, u.Dir)
 	file := u.File
 
+	// A single file is cached per file, so that fetching another file from the same directory doesn't hit the cache
+	keySrc := srcDir
+	if u.FileMode {
+		keySrc = fmt.Sprintf("%s://%s%s", u.Scheme, u.Host, path.Join(u.Dir, file))
+	}
+
 	r.Logger.Debugf("getter: %s", u.Getter)
 	r.Logger.Debugf("scheme: %s", u.Scheme)
 	r.Logger.Debugf("user: %s", u.User)
@@ -170,7 +193,7 @@ func (r *Remote) Fetch(goGetterSrc string) (string, error) {
 
 	var cacheKey string
 	replacer := strings.NewReplacer(":", "", "//", "_", "/", "_", ".", "_")
-	dirKey := replacer.Replace(srcDir)
+	dirKey := replacer.Replace(keySrc)
 	if len(query) > 0 {
 		paramsKey := strings.Replace(query, "&", "_", -1)
 		cacheKey = fmt.Sprintf("%s.%s", dirKey, paramsKey)
@@ -193,17 +216,24 @@ func (r *Remote) Fetch(goGetterSrc string) (string, error) {
 			return "", fmt.Errorf("%s is not directory. please remove it so that variant could use it for dependency caching", getterDst)
 		}
 
-		if r.DirExists(cacheDirPath) {
+		if u.FileMode {
+			cached = r.FileExists(filepath.Join(cacheDirPath, file))
+		} else if r.DirExists(cacheDirPath) {
 			cached = true
 		}
 	}
 
 	if !cached {
+		srcPath := u.Dir
+		if u.FileMode {
+			srcPath = path.Join(u.Dir, file)
+		}
+
 		var getterSrc string
 		if u.User != "" {
-			getterSrc = fmt.Sprintf("%s://%s@%s%s", u.Scheme, u.User, u.Host, u.Dir)
+			getterSrc = fmt.Sprintf("%s://%s@%s%s", u.Scheme, u.User, u.Host, srcPath)
 		} else {
-			getterSrc = fmt.Sprintf("%s://%s%s", u.Scheme, u.Host, u.Dir)
+			getterSrc = fmt.Sprintf("%s://%s%s", u.Scheme, u.Host, srcPath)
 		}
 
 		if len(query) > 0 {
@@ -214,10 +244,20 @@ func (r *Remote) Fetch(goGetterSrc string) (string, error) {
 			getterSrc = u.Getter + "::" + getterSrc
 		}
 
-		r.Logger.Debugf("downloading %s to %s", getterSrc, getterDst)
+		if u.FileMode {
+			fileDst := filepath.Join(getterDst, file)
+
+			r.Logger.Debugf("downloading %s to %s", getterSrc, fileDst)
 
-		if err := r.Getter.Get(r.Home, getterSrc, getterDst); err != nil {
-			return "", err
+			if err := r.Getter.GetFile(r.Home, getterSrc, fileDst); err != nil {
+				return "", err
+			}
+		} else {
+			r.Logger.Debugf("downloading %s to %s", getterSrc, getterDst)
+
+			if err := r.Getter.Get(r.Home, getterSrc, getterDst); err != nil {
+				return "", err
+			}
 		}
 	}
 
@@ -225,7 +265,10 @@ func (r *Remote) Fetch(goGetterSrc string) (string, error) {
 }
 
 type Getter interface {
+	// Get fetches the directory at src into the dst directory
 	Get(wd, src, dst string) error
+	// GetFile fetches the single file at src into the dst file, verifying its checksum when src has the `checksum` query parameter
+	GetFile(wd, src, dst string) error
 }
 
 type GoGetter struct {
@@ -233,6 +276,14 @@ type GoGetter struct {
 }
 
 func (g *GoGetter) Get(wd, src, dst string) error {
+	return g.get(wd, src, dst, getter.ClientModeDir)
+}
+
+func (g *GoGetter) GetFile(wd, src, dst string) error {
+	return g.get(wd, src, dst, getter.ClientModeFile)
+}
+
+func (g *GoGetter) get(wd, src, dst string, mode getter.ClientMode) error {
 	ctx := context.Background()
 
 	get := &getter.Client{
@@ -240,7 +291,7 @@ func (g *GoGetter) Get(wd, src, dst string) error {
 		Src:     src,
 		Dst:     dst,
 		Pwd:     wd,
-		Mode:    getter.ClientModeDir,
+		Mode:    mode,
 		Options: []getter.ClientOption{},
 	}
 
@@ -156,10 +156,91 @@ func TestRemote_SShGitHub(t *testing.T) {
 	}
 }
 
+func TestRemote_HttpsFile(t *testing.T) {
+	cleanfs := map[string]string{
+		"path/to/home": "",
+	}
+	cachefs := map[string]string{
+		"path/to/home/.helmfile/cache/https_config_example_com_app_prod_yaml.checksum=sha256:123/prod.yaml": "foo: bar",
+	}
+
+	type testcase struct {
+		files          map[string]string
+		expectCacheHit bool
+	}
+
+	testcases := []testcase{
+		{files: cleanfs, expectCacheHit: false},
+		{files: cachefs, expectCacheHit: true},
+	}
+
+	for i := range testcases {
+		testcase := testcases[i]
+
+		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
+			testfs := testhelper.NewTestFs(testcase.files)
+
+			hit := true
+
+			getFile := func(wd, src, dst string) error {
+				if wd != "path/to/home" {
+					return fmt.Errorf("unexpected wd: %s", wd)
+				}
+				if src != "https://config.example.com/app/prod.yaml?checksum=sha256:123" {
+					return fmt.Errorf("unexpected src: %s", src)
+				}
+				if dst != ".helmfile/cache/https_config_example_com_app_prod_yaml.checksum=sha256:123/prod.yaml" {
+					return fmt.Errorf("unexpected dst: %s", dst)
+				}
+
+				hit = false
+
+				return nil
+			}
+
+			getter := &testGetter{
+				getFile: getFile,
+			}
+			remote := &Remote{
+				Logger:     helmexec.NewLogger(os.Stderr, "debug"),
+				Home:       "path/to/home",
+				Getter:     getter,
+				ReadFile:   testfs.ReadFile,
+				FileExists: testfs.FileExistsAt,
+				DirExists:  testfs.DirectoryExistsAt,
+			}
+
+			// Without `@`, the URL refers to the single file, which is fetched alone in the go-getter's `file` mode
+			// that verifies the checksum of the file given via the `checksum` parameter
+			url := "https://config.example.com/app/prod.yaml?checksum=sha256:123"
+			file, err := remote.Locate(url)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if file != "path/to/home/.helmfile/cache/https_config_example_com_app_prod_yaml.checksum=sha256:123/prod.yaml" {
+				t.Errorf("unexpected file located: %s", file)
+			}
+
+			if testcase.expectCacheHit && !hit {
+				t.Errorf("unexpected result: unexpected cache miss")
+			}
+			if !testcase.expectCacheHit && hit {
+				t.Errorf("unexpected result: unexpected cache hit")
+			}
+		})
+	}
+}
+
 type testGetter struct {
-	get func(wd, src, dst string) error
+	get     func(wd, src, dst string) error
+	getFile func(wd, src, dst string) error
 }
 
 func (t *testGetter) Get(wd, src, dst string) error {
 	return t.get(wd, src, dst)
 }
+
+func (t *testGetter) GetFile(wd, src, dst string) error {
+	return t.getFile(wd, src, dst)
+}
@@ -0,0 +1,55 @@
+package state
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// AirgapManifest lists the chart versions approved for, and mirrored into, an air-gapped environment
+type AirgapManifest struct {
+	Charts []AirgapChart `yaml:"charts"`
+}
+
+type AirgapChart struct {
+	Name string `yaml:"name"`
+	// Repository is the URL of the repository the chart is mirrored from. When omitted, the chart is approved regardless of its repository.
+	Repository string `yaml:"repository"`
+	Version    string `yaml:"version"`
+}
+
+func (m *AirgapManifest) approves(dep ResolvedChartDependency) bool {
+	for _, c := range m.Charts {
+		if c.Name == dep.ChartName && c.Version == dep.Version && (c.Repository == "" || c.Repository == dep.Repository) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateAirgapManifest fails when any of the resolved dependencies isn't approved in the air-gap manifest, reporting all the violations at once
+func (m *chartDependencyManager) validateAirgapManifest(filename string, resolved *ResolvedDependencies) error {
+	content, err := m.readBytes(filename)
+	if err != nil {
+		return fmt.Errorf("unable to read air-gap manifest: %v", err)
+	}
+
+	manifest := &AirgapManifest{}
+	if err := yaml.Unmarshal(content, manifest); err != nil {
+		return fmt.Errorf("unable to parse air-gap manifest %s: %v", filename, err)
+	}
+
+	violations := []string{}
+	for _, dep := range resolved.sorted() {
+		if !manifest.approves(dep) {
+			violations = append(violations, fmt.Sprintf("%s %s from %s", dep.ChartName, dep.Version, dep.Repository))
+		}
+	}
+
+	if len(violations) > 0 {
+		return fmt.Errorf("%d chart(s) not approved in air-gap manifest %s: %s", len(violations), filename, strings.Join(violations, ", "))
+	}
+
+	return nil
+}
@@ -0,0 +1,82 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/roboll/helmfile/pkg/testhelper"
+)
+
+func TestHelmState_ResolveDeps_AirgapManifest(t *testing.T) {
+	lockFile := `dependencies:
+- name: envoy
+  repository: https://kubernetes-charts.storage.googleapis.com
+  version: 1.5.0
+- name: mysql
+  repository: https://kubernetes-charts.storage.googleapis.com
+  version: 1.0.0
+`
+
+	tests := []struct {
+		name     string
+		manifest string
+		wantErr  string
+	}{
+		{
+			name: "approved",
+			manifest: `charts:
+- name: envoy
+  version: 1.5.0
+- name: mysql
+  repository: https://kubernetes-charts.storage.googleapis.com
+  version: 1.0.0
+`,
+		},
+		{
+			name: "not approved",
+			manifest: `charts:
+- name: envoy
+  version: 1.4.0
+- name: mysql
+  repository: https://mirror.example.com
+  version: 1.0.0
+`,
+			wantErr: "2 chart(s) not approved in air-gap manifest /path/to/airgap.yaml: " +
+				"envoy 1.5.0 from https://kubernetes-charts.storage.googleapis.com, mysql 1.0.0 from https://kubernetes-charts.storage.googleapis.com",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := testhelper.NewTestFs(map[string]string{
+				"/path/to/helmfile.lock": lockFile,
+				"/path/to/airgap.yaml":   tt.manifest,
+			})
+			state := injectFs(&HelmState{
+				FilePath: "/path/to/helmfile.yaml",
+				Releases: []ReleaseSpec{
+					{Chart: "stable/envoy"},
+					{Chart: "stable/mysql"},
+				},
+				Repositories: []RepositorySpec{
+					{
+						Name: "stable",
+						URL:  "https://kubernetes-charts.storage.googleapis.com",
+					},
+				},
+				DependencyResolution: DependencyResolutionSpec{
+					AirgapManifest: "/path/to/airgap.yaml",
+				},
+				logger: logger,
+			}, fs)
+
+			_, err := state.ResolveDeps()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			} else if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("unexpected error:\nexpected=%s\ngot=%v", tt.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomically(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "helmfile.lock")
+	for _, content := range []string{"first", "second"} {
+		if err := writeFileAtomically(filename, []byte(content), 0644); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		actual, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if string(actual) != content {
+			t.Errorf("unexpected content: expected=%s, got=%s", content, string(actual))
+		}
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(files) != 1 {
+		t.Errorf("unexpected temporary files left: %v", files)
+	}
+	if files[0].Mode().Perm() != 0644 {
+		t.Errorf("unexpected permission: expected=%v, got=%v", os.FileMode(0644), files[0].Mode().Perm())
+	}
+}
+
+func TestChartDependencyManager_ConcurrentLockFileModification(t *testing.T) {
+	files := map[string][]byte{
+		"helmfile.lock": []byte(`dependencies:
+- name: envoy
+  repository: https://stable.example.com
+  version: 1.4.0
+`),
+	}
+	depMan := NewChartDependencyManager("helmfile", logger)
+	depMan.now = lockFileTime
+	depMan.readFile = func(filename string) ([]byte, error) {
+		content, ok := files[filename]
+		if !ok {
+			return nil, os.ErrNotExist
+		}
+		return content, nil
+	}
+	depMan.writeFile = func(filename string, data []byte, perm os.FileMode) error {
+		files[filename] = data
+		return nil
+	}
+
+	unresolved := &UnresolvedDependencies{deps: map[string][]unresolvedChartDependency{}}
+	unresolved.Add("envoy", "https://stable.example.com", "")
+	if _, err := depMan.readLockFile(unresolved); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Another process locks a newer version in the meantime
+	modified := []byte(`dependencies:
+- name: envoy
+  repository: https://stable.example.com
+  version: 1.6.0
+`)
+	files["helmfile.lock"] = modified
+
+	err := depMan.writeLockFile(&ChartLockedRequirements{
+		ResolvedDependencies: []ResolvedChartDependency{
+			{ChartName: "envoy", Repository: "https://stable.example.com", Version: "1.5.0"},
+		},
+	})
+	expected := "the lock file helmfile.lock was modified by another process while resolving dependencies: run helmfile again to resolve them against the modified lock file"
+	if err == nil || err.Error() != expected {
+		t.Errorf("unexpected error:\nexpected=%s\ngot=%v", expected, err)
+	}
+	if string(files["helmfile.lock"]) != string(modified) {
+		t.Errorf("unexpected overwrite of the modified lock file: %s", files["helmfile.lock"])
+	}
+}
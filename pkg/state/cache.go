@@ -0,0 +1,87 @@
+package state
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/roboll/helmfile/pkg/helmexec"
+)
+
+// WarmCacheResult is the result of fetching a locked chart into the cache directory
+type WarmCacheResult struct {
+	Chart      string
+	Version    string
+	Repository string
+	// Cached is true when the chart tarball already existed in the cache directory
+	Cached bool
+	Err    error
+}
+
+// WarmCache fetches the chart tarballs of all the locked versions into `dependencyResolution.cacheDir`,
+// so that the subsequent deployment doesn't need to access chart repositories.
+// The lock file and the state are left untouched.
+func (st *HelmState) WarmCache(helm helmexec.ChartFetcher) ([]WarmCacheResult, error) {
+	if st.DependencyResolution.Offline {
+		return nil, fmt.Errorf("unable to warm the cache offline, as fetching charts requires network access")
+	}
+
+	dir := st.DependencyResolution.CacheDir
+	if dir == "" {
+		return nil, fmt.Errorf("dependencyResolution.cacheDir must be set to warm the cache")
+	}
+
+	filename, unresolved, err := getUnresolvedDependenciess(st)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(unresolved.deps) == 0 {
+		return []WarmCacheResult{}, nil
+	}
+
+	depMan := st.newChartDependencyManager(filename)
+
+	resolved, lockfileExists, err := depMan.Resolve(unresolved)
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve %d deps: %v", len(unresolved.deps), err)
+	}
+	if !lockfileExists {
+		return nil, fmt.Errorf("no lock file found at %s: run `helmfile deps` to generate it", depMan.lockFileName())
+	}
+
+	fileExists := st.fileExists
+	if fileExists == nil {
+		fileExists = func(path string) (bool, error) {
+			return pathExists(path), nil
+		}
+	}
+
+	return resolved.WarmCache(helm, dir, fileExists), nil
+}
+
+// WarmCache fetches the tarball of each resolved dependency into dir, unless it is already there
+func (d *ResolvedDependencies) WarmCache(helm helmexec.ChartFetcher, dir string, fileExists func(string) (bool, error)) []WarmCacheResult {
+	results := []WarmCacheResult{}
+
+	for _, dep := range d.sorted() {
+		result := WarmCacheResult{
+			Chart:      dep.ChartName,
+			Version:    dep.Version,
+			Repository: dep.Repository,
+		}
+
+		tarball := filepath.Join(dir, fmt.Sprintf("%s-%s.tgz", dep.ChartName, dep.Version))
+		exists, err := fileExists(tarball)
+		if err != nil {
+			result.Err = err
+		} else if exists {
+			result.Cached = true
+		} else {
+			result.Err = helm.Fetch(dep.ChartName, "--repo", dep.Repository, "--version", dep.Version, "--destination", dir)
+		}
+
+		results = append(results, result)
+	}
+
+	return results
+}
@@ -0,0 +1,85 @@
+package state
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/roboll/helmfile/pkg/testhelper"
+)
+
+type chartFetcherFunc func(chart string, flags ...string) error
+
+func (f chartFetcherFunc) Fetch(chart string, flags ...string) error {
+	return f(chart, flags...)
+}
+
+func TestHelmState_WarmCache(t *testing.T) {
+	fs := testhelper.NewTestFs(map[string]string{
+		"/path/to/helmfile.lock": `dependencies:
+- name: envoy
+  repository: https://kubernetes-charts.storage.googleapis.com
+  version: 1.5.0
+- name: mysql
+  repository: https://kubernetes-charts.storage.googleapis.com
+  version: 1.0.0
+- name: redis
+  repository: https://kubernetes-charts.storage.googleapis.com
+  version: 9.0.0
+`,
+		"/cache/redis-9.0.0.tgz": "",
+	})
+	state := injectFs(&HelmState{
+		FilePath: "/path/to/helmfile.yaml",
+		Releases: []ReleaseSpec{
+			{Chart: "stable/envoy"},
+			{Chart: "stable/mysql"},
+			{Chart: "stable/redis"},
+		},
+		Repositories: []RepositorySpec{
+			{
+				Name: "stable",
+				URL:  "https://kubernetes-charts.storage.googleapis.com",
+			},
+		},
+		DependencyResolution: DependencyResolutionSpec{
+			CacheDir: "/cache",
+		},
+		logger: logger,
+	}, fs)
+
+	fetched := [][]string{}
+	helm := chartFetcherFunc(func(chart string, flags ...string) error {
+		fetched = append(fetched, append([]string{chart}, flags...))
+		if chart == "mysql" {
+			return errors.New("simulated fetch failure")
+		}
+		return nil
+	})
+
+	results, err := state.WarmCache(helm)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expectedFetches := [][]string{
+		{"envoy", "--repo", "https://kubernetes-charts.storage.googleapis.com", "--version", "1.5.0", "--destination", "/cache"},
+		{"mysql", "--repo", "https://kubernetes-charts.storage.googleapis.com", "--version", "1.0.0", "--destination", "/cache"},
+	}
+	if !reflect.DeepEqual(fetched, expectedFetches) {
+		t.Errorf("unexpected fetches:\nexpected=%v\ngot=%v", expectedFetches, fetched)
+	}
+
+	if len(results) != 3 {
+		t.Fatalf("unexpected number of results: expected=3, got=%d", len(results))
+	}
+	if results[0].Chart != "envoy" || results[0].Err != nil || results[0].Cached {
+		t.Errorf("unexpected result for envoy: %+v", results[0])
+	}
+	if results[1].Chart != "mysql" || results[1].Err == nil {
+		t.Errorf("unexpected result for mysql: %+v", results[1])
+	}
+	if results[2].Chart != "redis" || results[2].Err != nil || !results[2].Cached {
+		t.Errorf("unexpected result for redis: %+v", results[2])
+	}
+}
@@ -0,0 +1,106 @@
+package state
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultCertificateExpiryWindow is the number of days before the expiry of a repository's TLS certificate to start warning about it by default
+const DefaultCertificateExpiryWindow = 14
+
+// certificateChecker inspects the TLS certificates served by chart repositories
+type certificateChecker struct {
+	now func() time.Time
+}
+
+func newCertificateChecker() *certificateChecker {
+	return &certificateChecker{now: time.Now}
+}
+
+// transport returns the transport trusting the repository's CA file, if any, in addition to the system roots,
+// presenting the repository's client certificate, if any, and connecting via the proxies configured in the environment
+func (c *certificateChecker) transport(repo RepositorySpec) (*http.Transport, error) {
+	tlsConfig := &tls.Config{}
+
+	if repo.CAFile != "" {
+		pem, err := ioutil.ReadFile(repo.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", repo.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if repo.CertFile != "" && repo.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(repo.CertFile, repo.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tlsConfig,
+	}, nil
+}
+
+// check returns the warning about the repository's TLS certificate, or an empty string if the certificate is valid beyond the window
+func (c *certificateChecker) check(repo RepositorySpec, window time.Duration) string {
+	transport, err := c.transport(repo)
+	if err != nil {
+		return fmt.Sprintf("unable to check the TLS certificate of the repository %s: %v", repo.Name, err)
+	}
+	defer transport.CloseIdleConnections()
+
+	client := &http.Client{Transport: transport, Timeout: 30 * time.Second}
+	res, err := client.Head(strings.TrimSuffix(repo.URL, "/") + "/index.yaml")
+	if err != nil {
+		return fmt.Sprintf("unable to verify the TLS certificate of the repository %s: %v", repo.Name, err)
+	}
+	res.Body.Close()
+
+	if res.TLS == nil || len(res.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+
+	cert := res.TLS.PeerCertificates[0]
+	now := c.now()
+	if now.After(cert.NotAfter) {
+		return fmt.Sprintf("the TLS certificate of the repository %s expired at %s", repo.Name, cert.NotAfter.Format(time.RFC3339))
+	}
+	if now.Add(window).After(cert.NotAfter) {
+		return fmt.Sprintf("the TLS certificate of the repository %s expires at %s, in %d days: renew it before helmfile fails to fetch charts from it", repo.Name, cert.NotAfter.Format(time.RFC3339), int(cert.NotAfter.Sub(now).Hours()/24))
+	}
+
+	return ""
+}
+
+// checkRepositoryCertificates warns about HTTPS repositories whose TLS certificates are invalid, expired, or expiring within the configured window
+func (st *HelmState) checkRepositoryCertificates(checker *certificateChecker) {
+	days := st.DependencyResolution.CertificateExpiryWindow
+	if days == 0 {
+		days = DefaultCertificateExpiryWindow
+	}
+	window := time.Duration(days) * 24 * time.Hour
+
+	for _, repo := range st.Repositories {
+		if !strings.HasPrefix(repo.URL, "https://") {
+			continue
+		}
+		if msg := checker.check(repo, window); msg != "" {
+			st.warn(ResolutionWarningCertificate, "", "%s", msg)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package state
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHelmState_CheckRepositoryCertificates(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	caFile := filepath.Join(dir, "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, caPEM, 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	notAfter := srv.Certificate().NotAfter
+
+	tests := []struct {
+		name    string
+		caFile  string
+		now     time.Time
+		window  int
+		warning string
+	}{
+		{
+			name:   "valid",
+			caFile: caFile,
+			now:    notAfter.Add(-30 * 24 * time.Hour),
+		},
+		{
+			name:    "expiring within the default window",
+			caFile:  caFile,
+			now:     notAfter.Add(-3*24*time.Hour - time.Hour),
+			warning: "the TLS certificate of the repository myrepo expires at " + notAfter.Format(time.RFC3339) + ", in 3 days",
+		},
+		{
+			name:   "expiring out of the window",
+			caFile: caFile,
+			now:    notAfter.Add(-3*24*time.Hour - time.Hour),
+			window: 2,
+		},
+		{
+			name:    "expired",
+			caFile:  caFile,
+			now:     notAfter.Add(time.Hour),
+			warning: "the TLS certificate of the repository myrepo expired at " + notAfter.Format(time.RFC3339),
+		},
+		{
+			name:    "untrusted",
+			now:     notAfter.Add(-30 * 24 * time.Hour),
+			warning: "unable to verify the TLS certificate of the repository myrepo",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := &HelmState{
+				Repositories: []RepositorySpec{
+					{Name: "myrepo", URL: srv.URL, CAFile: tt.caFile},
+					{Name: "plain", URL: "http://127.0.0.1:1"},
+				},
+				DependencyResolution: DependencyResolutionSpec{
+					CertificateExpiryWindow: tt.window,
+				},
+				logger: logger,
+			}
+
+			checker := newCertificateChecker()
+			checker.now = func() time.Time { return tt.now }
+
+			warnings := state.collectResolutionWarnings()
+			state.checkRepositoryCertificates(checker)
+			got := warnings()
+
+			if tt.warning == "" {
+				if len(got) != 0 {
+					t.Errorf("unexpected warnings: %v", got)
+				}
+				return
+			}
+			if len(got) != 1 || got[0].Kind != ResolutionWarningCertificate || !strings.HasPrefix(got[0].Message, tt.warning) {
+				t.Errorf("unexpected warnings: expected=%q, got=%v", tt.warning, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package state
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.com/Masterminds/semver"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	DependencyChangeAdded      = "Added"
+	DependencyChangeRemoved    = "Removed"
+	DependencyChangeUpgraded   = "Upgraded"
+	DependencyChangeDowngraded = "Downgraded"
+)
+
+// DependencyChange is a change of a locked chart version between two lock files
+type DependencyChange struct {
+	Kind       string
+	Chart      string
+	Repository string
+	// OldVersion is empty for added charts
+	OldVersion string
+	// NewVersion is empty for removed charts
+	NewVersion string
+}
+
+type chartRepo struct {
+	chart, repo string
+}
+
+// DiffLockedRequirements returns the changes of locked versions from one lock file to another, ordered by chart name, repository and versions.
+// When a chart from a repository is locked to exactly one version in both, the change is an upgrade or a downgrade.
+// Otherwise, each version locked in only either of them is an addition or a removal.
+func DiffLockedRequirements(from, to *ChartLockedRequirements) ([]DependencyChange, error) {
+	versions := func(reqs *ChartLockedRequirements) map[chartRepo]map[string]bool {
+		m := map[chartRepo]map[string]bool{}
+		for _, d := range reqs.ResolvedDependencies {
+			k := chartRepo{d.ChartName, d.Repository}
+			if m[k] == nil {
+				m[k] = map[string]bool{}
+			}
+			m[k][d.Version] = true
+		}
+		return m
+	}
+
+	oldVersions, newVersions := versions(from), versions(to)
+
+	keys := map[chartRepo]bool{}
+	for k := range oldVersions {
+		keys[k] = true
+	}
+	for k := range newVersions {
+		keys[k] = true
+	}
+
+	changes := []DependencyChange{}
+	for k := range keys {
+		removed, added := []string{}, []string{}
+		for v := range oldVersions[k] {
+			if !newVersions[k][v] {
+				removed = append(removed, v)
+			}
+		}
+		for v := range newVersions[k] {
+			if !oldVersions[k][v] {
+				added = append(added, v)
+			}
+		}
+
+		if len(removed) == 1 && len(added) == 1 && len(oldVersions[k]) == 1 && len(newVersions[k]) == 1 {
+			oldVer, err := semver.NewVersion(removed[0])
+			if err != nil {
+				return nil, err
+			}
+			newVer, err := semver.NewVersion(added[0])
+			if err != nil {
+				return nil, err
+			}
+			kind := DependencyChangeUpgraded
+			if newVer.LessThan(oldVer) {
+				kind = DependencyChangeDowngraded
+			}
+			changes = append(changes, DependencyChange{Kind: kind, Chart: k.chart, Repository: k.repo, OldVersion: removed[0], NewVersion: added[0]})
+			continue
+		}
+
+		for _, v := range removed {
+			changes = append(changes, DependencyChange{Kind: DependencyChangeRemoved, Chart: k.chart, Repository: k.repo, OldVersion: v})
+		}
+		for _, v := range added {
+			changes = append(changes, DependencyChange{Kind: DependencyChangeAdded, Chart: k.chart, Repository: k.repo, NewVersion: v})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		a, b := changes[i], changes[j]
+		if a.Chart != b.Chart {
+			return a.Chart < b.Chart
+		}
+		if a.Repository != b.Repository {
+			return a.Repository < b.Repository
+		}
+		if a.OldVersion != b.OldVersion {
+			return a.OldVersion < b.OldVersion
+		}
+		return a.NewVersion < b.NewVersion
+	})
+
+	return changes, nil
+}
+
+// RenderChangelog renders the changes as a markdown changelog grouped by added, removed, upgraded and downgraded charts
+func RenderChangelog(changes []DependencyChange) string {
+	var buf bytes.Buffer
+
+	buf.WriteString("## Chart changes\n")
+
+	if len(changes) == 0 {
+		buf.WriteString("\nNo chart changes.\n")
+		return buf.String()
+	}
+
+	for _, kind := range []string{DependencyChangeAdded, DependencyChangeRemoved, DependencyChangeUpgraded, DependencyChangeDowngraded} {
+		lines := []string{}
+		for _, c := range changes {
+			if c.Kind != kind {
+				continue
+			}
+			switch kind {
+			case DependencyChangeAdded:
+				lines = append(lines, fmt.Sprintf("- %s %s (%s)", c.Chart, c.NewVersion, c.Repository))
+			case DependencyChangeRemoved:
+				lines = append(lines, fmt.Sprintf("- %s %s (%s)", c.Chart, c.OldVersion, c.Repository))
+			default:
+				lines = append(lines, fmt.Sprintf("- %s %s -> %s (%s)", c.Chart, c.OldVersion, c.NewVersion, c.Repository))
+			}
+		}
+		if len(lines) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(&buf, "\n### %s\n\n", kind)
+		for _, l := range lines {
+			buf.WriteString(l + "\n")
+		}
+	}
+
+	return buf.String()
+}
+
+// LockFileChangelog renders the markdown changelog of chart versions between the two lock files, like the ones of the last release and HEAD
+func LockFileChangelog(oldFile, newFile string) (string, error) {
+	read := func(file string) (*ChartLockedRequirements, error) {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		reqs := &ChartLockedRequirements{}
+		if err := yaml.Unmarshal(content, reqs); err != nil {
+			return nil, fmt.Errorf("unable to parse %s: %v", file, err)
+		}
+		return reqs, nil
+	}
+
+	from, err := read(oldFile)
+	if err != nil {
+		return "", err
+	}
+	to, err := read(newFile)
+	if err != nil {
+		return "", err
+	}
+
+	changes, err := DiffLockedRequirements(from, to)
+	if err != nil {
+		return "", err
+	}
+
+	return RenderChangelog(changes), nil
+}
+
+// LockedRequirements returns the requirements currently recorded in the lock file of the state, merged across split lock files.
+// It returns empty requirements when the state isn't locked yet.
+func (st *HelmState) LockedRequirements() (*ChartLockedRequirements, error) {
+	filename, unresolved, err := getUnresolvedDependenciess(st)
+	if err != nil {
+		return nil, err
+	}
+
+	reqs := &ChartLockedRequirements{}
+	if len(unresolved.deps) == 0 {
+		return reqs, nil
+	}
+
+	content, err := st.newChartDependencyManager(filename).readLockFile(unresolved)
+	if err != nil {
+		return nil, err
+	}
+	if content == nil {
+		return reqs, nil
+	}
+
+	if err := yaml.Unmarshal(content, reqs); err != nil {
+		return nil, err
+	}
+
+	return reqs, nil
+}
@@ -0,0 +1,130 @@
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/roboll/helmfile/pkg/testhelper"
+)
+
+func TestLockFileChangelog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	before := `dependencies:
+- name: envoy
+  repository: https://kubernetes-charts.storage.googleapis.com
+  version: 1.4.0
+- name: mysql
+  repository: https://kubernetes-charts.storage.googleapis.com
+  version: 1.2.0
+- name: redis
+  repository: https://kubernetes-charts.storage.googleapis.com
+  version: 9.0.0
+- name: unchanged
+  repository: https://kubernetes-charts.storage.googleapis.com
+  version: 0.1.0
+digest: sha256:old
+generated: "2019-05-16T15:42:45.50486+09:00"
+`
+	after := `dependencies:
+- name: envoy
+  repository: https://kubernetes-charts.storage.googleapis.com
+  version: 1.5.0
+- name: mysql
+  repository: https://kubernetes-charts.storage.googleapis.com
+  version: 1.1.0
+- name: nginx
+  repository: https://kubernetes-charts.storage.googleapis.com
+  version: 2.0.0
+- name: unchanged
+  repository: https://kubernetes-charts.storage.googleapis.com
+  version: 0.1.0
+digest: sha256:new
+generated: "2019-06-16T15:42:45.50486+09:00"
+`
+	oldFile := filepath.Join(dir, "old.lock")
+	newFile := filepath.Join(dir, "new.lock")
+	if err := ioutil.WriteFile(oldFile, []byte(before), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := ioutil.WriteFile(newFile, []byte(after), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	actual, err := LockFileChangelog(oldFile, newFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := `## Chart changes
+
+### Added
+
+- nginx 2.0.0 (https://kubernetes-charts.storage.googleapis.com)
+
+### Removed
+
+- redis 9.0.0 (https://kubernetes-charts.storage.googleapis.com)
+
+### Upgraded
+
+- envoy 1.4.0 -> 1.5.0 (https://kubernetes-charts.storage.googleapis.com)
+
+### Downgraded
+
+- mysql 1.2.0 -> 1.1.0 (https://kubernetes-charts.storage.googleapis.com)
+`
+	if actual != expected {
+		t.Errorf("unexpected changelog:\nexpected=%s\ngot=%s", expected, actual)
+	}
+
+	same, err := LockFileChangelog(oldFile, oldFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if same != "## Chart changes\n\nNo chart changes.\n" {
+		t.Errorf("unexpected changelog for identical lock files: %s", same)
+	}
+}
+
+func TestHelmState_LockedRequirements(t *testing.T) {
+	fs := testhelper.NewTestFs(map[string]string{
+		"/path/to/helmfile.lock": `dependencies:
+- name: envoy
+  repository: https://kubernetes-charts.storage.googleapis.com
+  version: 1.5.0
+`,
+	})
+	state := injectFs(&HelmState{
+		FilePath: "/path/to/helmfile.yaml",
+		Releases: []ReleaseSpec{
+			{Chart: "stable/envoy"},
+		},
+		Repositories: []RepositorySpec{
+			{
+				Name: "stable",
+				URL:  "https://kubernetes-charts.storage.googleapis.com",
+			},
+		},
+		logger: logger,
+	}, fs)
+
+	reqs, err := state.LockedRequirements()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []ResolvedChartDependency{
+		{ChartName: "envoy", Repository: "https://kubernetes-charts.storage.googleapis.com", Version: "1.5.0"},
+	}
+	if !reflect.DeepEqual(reqs.ResolvedDependencies, expected) {
+		t.Errorf("unexpected locked dependencies: expected=%v, got=%v", expected, reqs.ResolvedDependencies)
+	}
+}
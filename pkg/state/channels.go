@@ -0,0 +1,81 @@
+package state
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/Masterminds/semver"
+	"gopkg.in/yaml.v2"
+)
+
+var channelNamePattern = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_-]*$`)
+
+// isChannel returns true when the version looks like a symbolic channel name like `stable`, rather than a version constraint
+func isChannel(version string) bool {
+	if !channelNamePattern.MatchString(version) {
+		return false
+	}
+	_, err := semver.NewConstraint(version)
+	return err != nil
+}
+
+// loadChannels reads the channel definition file mapping chart names to channel names to version constraints, like:
+//
+//	envoy:
+//	  stable: 1.5.0
+//	  edge: ~1.6.0-0
+func (st *HelmState) loadChannels() (map[string]map[string]string, error) {
+	if st.channels != nil {
+		return st.channels, nil
+	}
+
+	readFile := st.readFile
+	if readFile == nil {
+		readFile = ioutil.ReadFile
+	}
+
+	file := st.DependencyResolution.ChannelsFile
+	content, err := readFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read channels: %v", err)
+	}
+
+	channels := map[string]map[string]string{}
+	if err := yaml.Unmarshal(content, &channels); err != nil {
+		return nil, fmt.Errorf("unable to parse channels in %s: %v", file, err)
+	}
+
+	st.channels = channels
+
+	return channels, nil
+}
+
+// channelConstraint returns the version constraint the release's channel maps to, or the release's version as is when it isn't a channel
+func (st *HelmState) channelConstraint(r ReleaseSpec, chart string) (string, error) {
+	if st.DependencyResolution.ChannelsFile == "" || !isChannel(r.Version) {
+		return r.Version, nil
+	}
+
+	channels, err := st.loadChannels()
+	if err != nil {
+		return "", err
+	}
+
+	constraint, ok := channels[chart][r.Version]
+	if !ok {
+		defined := []string{}
+		for ch := range channels[chart] {
+			defined = append(defined, ch)
+		}
+		sort.Strings(defined)
+		if len(defined) == 0 {
+			return "", fmt.Errorf("release %q: unknown channel %q: no channels are defined for the chart %q in %s", r.Name, r.Version, chart, st.DependencyResolution.ChannelsFile)
+		}
+		return "", fmt.Errorf("release %q: unknown channel %q for the chart %q: defined channels are %s", r.Name, r.Version, chart, strings.Join(defined, ", "))
+	}
+
+	return constraint, nil
+}
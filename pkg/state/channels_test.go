@@ -0,0 +1,95 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/roboll/helmfile/pkg/testhelper"
+)
+
+func TestHelmState_ResolveDeps_Channels(t *testing.T) {
+	tests := []struct {
+		name       string
+		version    string
+		constraint string
+		expected   string
+		wantErr    string
+	}{
+		{
+			name:       "channel",
+			version:    "stable",
+			constraint: "~1.4",
+			expected:   "1.4.0",
+		},
+		{
+			name:       "another channel",
+			version:    "edge",
+			constraint: "~1.5",
+			expected:   "1.5.0",
+		},
+		{
+			name:       "version constraint",
+			version:    ">= 1.5.0",
+			constraint: ">= 1.5.0",
+			expected:   "1.5.0",
+		},
+		{
+			name:    "unknown channel",
+			version: "beta",
+			wantErr: `release "envoy": unknown channel "beta" for the chart "envoy": defined channels are edge, stable`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := testhelper.NewTestFs(map[string]string{
+				"/path/to/helmfile.lock": `dependencies:
+- name: envoy
+  repository: https://kubernetes-charts.storage.googleapis.com
+  version: 1.4.0
+- name: envoy
+  repository: https://kubernetes-charts.storage.googleapis.com
+  version: 1.5.0
+`,
+				"/path/to/channels.yaml": `envoy:
+  stable: ~1.4
+  edge: ~1.5
+`,
+			})
+			state := injectFs(&HelmState{
+				FilePath: "/path/to/helmfile.yaml",
+				Releases: []ReleaseSpec{
+					{Name: "envoy", Chart: "stable/envoy", Version: tt.version},
+				},
+				Repositories: []RepositorySpec{
+					{Name: "stable", URL: "https://kubernetes-charts.storage.googleapis.com"},
+				},
+				DependencyResolution: DependencyResolutionSpec{
+					ChannelsFile: "/path/to/channels.yaml",
+				},
+				logger: logger,
+			}, fs)
+
+			_, unresolved, err := getUnresolvedDependenciess(state)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("unexpected error: expected=%q, got=%v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if c := unresolved.deps["envoy"][0].VersionConstraint; c != tt.constraint {
+				t.Errorf("unexpected version constraint: expected=%s, got=%s", tt.constraint, c)
+			}
+
+			resolved, err := state.ResolveDeps()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if resolved.Releases[0].Version != tt.expected {
+				t.Errorf("unexpected version number: expected=%s, got=%s", tt.expected, resolved.Releases[0].Version)
+			}
+		})
+	}
+}
@@ -1,6 +1,9 @@
 package state
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/Masterminds/semver"
 	"github.com/roboll/helmfile/pkg/helmexec"
@@ -8,9 +11,13 @@ import (
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
+	"reflect"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type ChartMeta struct {
@@ -19,41 +26,74 @@ type ChartMeta struct {
 
 type unresolvedChartDependency struct {
 	// ChartName identifies the dependant chart. In Helmfile, ChartName for `chart: stable/envoy` would be just `envoy`.
-	// It can't be collided with other charts referenced in the same helmfile spec.
-	// That is, collocating `chart: incubator/foo` and `chart: stable/foo` isn't allowed. Name them differently for a work-around.
+	// Collocating `chart: incubator/foo` and `chart: stable/foo` is allowed, in which case both are aliased as `incubator-foo` and `stable-foo` by Alias.
 	ChartName string `yaml:"name"`
 	// Repository contains the URL for the helm chart repository that hosts the chart identified by ChartName
 	Repository string `yaml:"repository"`
 	// VersionConstraint is the version constraint of the dependent chart. "*" means the latest version.
 	VersionConstraint string `yaml:"version"`
+	// Alias is the unique name of the dependency, set when charts of the same name are referenced from different repositories,
+	// so that both can coexist in the requirements of the temporary local chart
+	Alias string `yaml:"alias,omitempty"`
+
+	// versionRef is the reference to the chart whose resolved version determines VersionConstraint, if any
+	versionRef *versionReference
 }
 
 type ResolvedChartDependency struct {
 	// ChartName identifies the dependant chart. In Helmfile, ChartName for `chart: stable/envoy` would be just `envoy`.
-	// It can't be collided with other charts referenced in the same helmfile spec.
-	// That is, collocating `chart: incubator/foo` and `chart: stable/foo` isn't allowed. Name them differently for a work-around.
+	// Collocating `chart: incubator/foo` and `chart: stable/foo` is allowed, in which case both are locked and distinguished by Repository.
 	ChartName string `yaml:"name"`
 	// Repository contains the URL for the helm chart repository that hosts the chart identified by ChartName
 	Repository string `yaml:"repository"`
 	// Version is the version number of the dependent chart.
 	// In the context of helmfile this can be omitted. When omitted, it is considered `*` which results helm/helmfile fetching the latest version.
 	Version string `yaml:"version"`
+	// Source is the URL of the repository or its mirror that actually served the chart. Recorded only in the failover mode.
+	Source string `yaml:"source,omitempty"`
+	// Digest is the digest of the chart tarball, like `sha256:<hex>`, verified before the chart is deployed.
+	// Missing in lock files written by older helmfiles.
+	Digest string `yaml:"digest,omitempty"`
 }
 
 type UnresolvedDependencies struct {
 	deps map[string][]unresolvedChartDependency
+
+	// releases maps chart names to the names of the releases referencing them
+	releases map[string][]string
 }
 
 type ChartRequirements struct {
 	UnresolvedDependencies []unresolvedChartDependency `yaml:"dependencies"`
 }
 
+// helm3Chart is `Chart.yaml` of a chart for helm v3, which declares dependencies in `Chart.yaml` instead of `requirements.yaml`
+type helm3Chart struct {
+	APIVersion   string                      `yaml:"apiVersion"`
+	Name         string                      `yaml:"name"`
+	Version      string                      `yaml:"version"`
+	Dependencies []unresolvedChartDependency `yaml:"dependencies"`
+}
+
 type ChartLockedRequirements struct {
 	ResolvedDependencies []ResolvedChartDependency `yaml:"dependencies"`
 	Digest               string                    `yaml:"digest"`
 	Generated            string                    `yaml:"generated"`
+	// Metadata records when and by which helmfile the lock file was written. Missing in lock files written by older helmfiles.
+	Metadata *LockFileMetadata `yaml:"metadata,omitempty"`
 }
 
+// LockFileMetadata is the audit trail of a lock file
+type LockFileMetadata struct {
+	// GeneratedAt is the RFC3339 timestamp of when helmfile wrote the lock file
+	GeneratedAt string `yaml:"generatedAt"`
+	// HelmfileVersion is the version of helmfile that wrote the lock file
+	HelmfileVersion string `yaml:"helmfileVersion"`
+}
+
+// HelmfileVersion is the version of helmfile recorded in lock files. It is set by the helmfile command.
+var HelmfileVersion = "unknown"
+
 func (d *UnresolvedDependencies) Add(chart, url, versionConstraint string) error {
 	dep := unresolvedChartDependency{
 		ChartName:         chart,
@@ -63,6 +103,66 @@ func (d *UnresolvedDependencies) Add(chart, url, versionConstraint string) error
 	return d.add(dep)
 }
 
+// addReference adds the dependency whose version constraint is determined once the referenced chart is resolved
+func (d *UnresolvedDependencies) addReference(chart, url string, ref *versionReference) error {
+	dep := unresolvedChartDependency{
+		ChartName:  chart,
+		Repository: url,
+		versionRef: ref,
+	}
+	return d.add(dep)
+}
+
+func (d *UnresolvedDependencies) hasVersionReferences() bool {
+	for _, deps := range d.deps {
+		for _, dep := range deps {
+			if dep.versionRef != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// partitionByReferences splits the dependencies into the charts ready for resolution and the rest.
+// A chart is ready when all the charts referenced by its version references are already resolved to the versions.
+// The version constraints of the ready dependencies are computed from the referenced versions.
+func (d *UnresolvedDependencies) partitionByReferences(versions map[string][]string) (*UnresolvedDependencies, *UnresolvedDependencies, error) {
+	ready := &UnresolvedDependencies{deps: map[string][]unresolvedChartDependency{}}
+	rest := &UnresolvedDependencies{deps: map[string][]unresolvedChartDependency{}}
+	blocked := map[string]*versionReference{}
+
+	for chart, deps := range d.deps {
+		computed := []unresolvedChartDependency{}
+		for _, dep := range deps {
+			if dep.versionRef != nil {
+				constraint, ok, err := dep.versionRef.resolve(versions)
+				if err != nil {
+					return nil, nil, err
+				}
+				if !ok {
+					blocked[chart] = dep.versionRef
+					break
+				}
+				dep.VersionConstraint = constraint
+				dep.versionRef = nil
+			}
+			computed = append(computed, dep)
+		}
+		if _, ok := blocked[chart]; ok {
+			rest.deps[chart] = deps
+		} else {
+			ready.deps[chart] = computed
+		}
+	}
+
+	if len(ready.deps) == 0 && len(rest.deps) > 0 {
+		return nil, nil, unresolvableReferencesError(blocked)
+	}
+
+	return ready, rest, nil
+}
+
 func (d *UnresolvedDependencies) add(dep unresolvedChartDependency) error {
 	deps := d.deps[dep.ChartName]
 	if deps == nil {
@@ -74,6 +174,30 @@ func (d *UnresolvedDependencies) add(dep unresolvedChartDependency) error {
 	return nil
 }
 
+// aliasCollidingCharts aliases the dependencies on charts of the same name from different repositories as `<repo>-<chart>`.
+// repoNames maps repository URLs to their names.
+func (d *UnresolvedDependencies) aliasCollidingCharts(repoNames map[string]string) {
+	for chart, deps := range d.deps {
+		repos := map[string]bool{}
+		for _, dep := range deps {
+			repos[dep.Repository] = true
+		}
+		if len(repos) < 2 {
+			continue
+		}
+		for i := range deps {
+			name := repoNames[deps[i].Repository]
+			// OCI registries referenced only by URLs are named after the last elements of their paths
+			if isOCIRepository(name) {
+				name = path.Base(name)
+			}
+			deps[i].Alias = fmt.Sprintf("%s-%s", name, chart)
+		}
+	}
+}
+
+// ToChartRequirements returns the requirements of the temporary local chart, ordered by chart name, repository and version constraint,
+// so that the generated `requirements.yaml` and the digest recorded in the lock file are stable across runs
 func (d *UnresolvedDependencies) ToChartRequirements() *ChartRequirements {
 	deps := []unresolvedChartDependency{}
 
@@ -86,11 +210,24 @@ func (d *UnresolvedDependencies) ToChartRequirements() *ChartRequirements {
 		}
 	}
 
+	sort.SliceStable(deps, func(i, j int) bool {
+		if deps[i].ChartName != deps[j].ChartName {
+			return deps[i].ChartName < deps[j].ChartName
+		}
+		if deps[i].Repository != deps[j].Repository {
+			return deps[i].Repository < deps[j].Repository
+		}
+		return deps[i].VersionConstraint < deps[j].VersionConstraint
+	})
+
 	return &ChartRequirements{UnresolvedDependencies: deps}
 }
 
 type ResolvedDependencies struct {
 	deps map[string][]ResolvedChartDependency
+
+	// digest is the digest of the requirements recorded in the lock file
+	digest string
 }
 
 func (d *ResolvedDependencies) add(dep ResolvedChartDependency) error {
@@ -104,99 +241,396 @@ func (d *ResolvedDependencies) add(dep ResolvedChartDependency) error {
 	return nil
 }
 
+func (d *ResolvedDependencies) has(dep ResolvedChartDependency) bool {
+	for _, d := range d.deps[dep.ChartName] {
+		if d == dep {
+			return true
+		}
+	}
+	return false
+}
+
+func sortResolvedDependencies(deps []ResolvedChartDependency) {
+	sort.Slice(deps, func(i, j int) bool {
+		if deps[i].ChartName != deps[j].ChartName {
+			return deps[i].ChartName < deps[j].ChartName
+		}
+		if deps[i].Repository != deps[j].Repository {
+			return deps[i].Repository < deps[j].Repository
+		}
+		return deps[i].Version < deps[j].Version
+	})
+}
+
+// sorted returns all the resolved dependencies ordered by chart name, repository and version
+func (d *ResolvedDependencies) sorted() []ResolvedChartDependency {
+	all := []ResolvedChartDependency{}
+	for _, deps := range d.deps {
+		all = append(all, deps...)
+	}
+
+	sortResolvedDependencies(all)
+
+	return all
+}
+
 func (d *ResolvedDependencies) Get(chart, versionConstraint string) (string, error) {
+	dep, err := d.get(chart, versionConstraint)
+	if err != nil {
+		return "", err
+	}
+	return dep.Version, nil
+}
+
+func (d *ResolvedDependencies) get(chart, versionConstraint string) (*ResolvedChartDependency, error) {
+	return d.getFromRepository(chart, "", versionConstraint)
+}
+
+// getFromRepository returns the resolved dependency on the chart from the repository satisfying the version constraint.
+// The repository is taken into account only when the chart is locked from multiple repositories, so that the lock file keeps working after the URL of a repository changes.
+// An empty repository matches any repository.
+func (d *ResolvedDependencies) getFromRepository(chart, repository, versionConstraint string) (*ResolvedChartDependency, error) {
 	if versionConstraint == "" {
 		versionConstraint = "*"
 	}
 
 	deps, exists := d.deps[chart]
 	if exists {
+		repos := map[string]bool{}
+		for _, dep := range deps {
+			repos[dep.Repository] = true
+		}
+		if len(repos) < 2 {
+			repository = ""
+		}
+
+		// The highest locked version satisfying the constraint is the best match for a range like `>=1.0, <2.0`
+		var best *ResolvedChartDependency
+		var bestVersion *semver.Version
 		for _, dep := range deps {
+			if repository != "" && dep.Repository != repository {
+				continue
+			}
 			constraint, err := semver.NewConstraint(versionConstraint)
 			if err != nil {
-				return "", err
+				return nil, err
 			}
 			version, err := semver.NewVersion(dep.Version)
 			if err != nil {
-				return "", err
+				return nil, err
 			}
-			if constraint.Check(version) {
-				return dep.Version, nil
+			if constraint.Check(version) && (bestVersion == nil || version.GreaterThan(bestVersion)) {
+				dep := dep
+				best, bestVersion = &dep, version
 			}
 		}
+		if best != nil {
+			return best, nil
+		}
 	}
-	return "", fmt.Errorf("no resolved dependency found for \"%s\"", chart)
+	return nil, fmt.Errorf("no resolved dependency found for \"%s\"", chart)
 }
 
 func (st *HelmState) mergeLockedDependencies() (*HelmState, error) {
+	if st.DependencyResolution.SkipResolve {
+		st.logger.Debugf("skipping dependency resolution for %s", st.FilePath)
+		return st, nil
+	}
+
 	filename, unresolved, err := getUnresolvedDependenciess(st)
 	if err != nil {
 		return nil, err
 	}
 
 	if len(unresolved.deps) == 0 {
+		st.warnNoRemoteCharts()
 		return st, nil
 	}
 
-	depMan := NewChartDependencyManager(filename, st.logger)
+	depMan := st.newChartDependencyManager(filename)
 
-	if st.readFile != nil {
-		depMan.readFile = st.readFile
+	pinFilter, err := st.pinFilter()
+	if err != nil {
+		return nil, err
+	}
+
+	return resolveDependencies(st, depMan, unresolved, pinFilter)
+}
+
+func (st *HelmState) warnNoRemoteCharts() {
+	if !st.DependencyResolution.WarnOnNoRemoteCharts || len(st.Repositories) == 0 {
+		return
 	}
 
-	return resolveDependencies(st, depMan, unresolved)
+	st.warn(ResolutionWarningNoRemoteCharts, "", "no remote charts to resolve in %s: %d repositories are declared but no release references a chart in them", st.FilePath, len(st.Repositories))
 }
 
-func resolveDependencies(st *HelmState, depMan *chartDependencyManager, unresolved *UnresolvedDependencies) (*HelmState, error) {
+// pinFilter returns the filter for releases whose versions are rewritten to the locked ones, or nil for all the releases
+func (st *HelmState) pinFilter() (ReleaseFilter, error) {
+	if st.DependencyResolution.PinSelector == "" {
+		return nil, nil
+	}
+
+	f, err := ParseLabels(st.DependencyResolution.PinSelector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pinSelector: %v", err)
+	}
+
+	return f, nil
+}
+
+// resolveDependencies returns a copy of the state whose releases have the locked versions.
+// When pinFilter is not nil, only the releases matching it are updated.
+func resolveDependencies(st *HelmState, depMan *chartDependencyManager, unresolved *UnresolvedDependencies, pinFilter ReleaseFilter) (*HelmState, error) {
 	resolved, lockfileExists, err := depMan.Resolve(unresolved)
 	if err != nil {
 		return nil, fmt.Errorf("unable to resolve %d deps: %v", len(unresolved.deps), err)
 	}
 	if !lockfileExists {
+		if st.DependencyResolution.FrozenLockfile {
+			return nil, fmt.Errorf("lock file %s is missing, while the lock file is frozen: run helmfile deps without --frozen-lockfile to create it", depMan.lockFileName())
+		}
 		return st, nil
 	}
 
-	repoToURL := map[string]string{}
-
-	for _, r := range st.Repositories {
-		repoToURL[r.Name] = r.URL
+	if st.DependencyResolution.AirgapManifest != "" {
+		if err := depMan.validateAirgapManifest(st.DependencyResolution.AirgapManifest, resolved); err != nil {
+			return nil, err
+		}
 	}
 
+	repoToURL := st.repositoryURLs()
+
 	updated := *st
-	for i, r := range updated.Releases {
-		repo, chart, ok := resolveRemoteChart(r.Chart)
-		if !ok {
-			continue
+	updated.Releases = append([]ReleaseSpec{}, st.Releases...)
+
+	// Releases whose versions reference other charts are processed after the referenced charts are resolved
+	versions := map[string][]string{}
+	pending := []int{}
+	for i := range updated.Releases {
+		pending = append(pending, i)
+	}
+	for len(pending) > 0 {
+		next := []int{}
+		blocked := map[string]*versionReference{}
+		for _, i := range pending {
+			r := &updated.Releases[i]
+
+			if r.SkipDeps {
+				continue
+			}
+
+			if isGitChart(r.Chart) {
+				if pinFilter == nil || pinFilter.Match(*r) {
+					if err := st.pinGitChart(r, resolved); err != nil {
+						return nil, err
+					}
+				}
+				continue
+			}
+
+			ref, err := parseVersionReference(r.Version)
+			if err != nil {
+				return nil, fmt.Errorf("release %q: %v", r.Name, err)
+			}
+			var constraint string
+			if ref == nil {
+				_, chart, _ := st.resolveRemoteChart(r.Chart)
+				constraint, err = st.versionConstraint(*r, chart)
+				if err != nil {
+					return nil, err
+				}
+			} else {
+				var ok bool
+				constraint, ok, err = ref.resolve(versions)
+				if err != nil {
+					return nil, fmt.Errorf("release %q: %v", r.Name, err)
+				}
+				if !ok {
+					_, chart, _ := st.resolveRemoteChart(r.Chart)
+					blocked[chart] = ref
+					next = append(next, i)
+					continue
+				}
+			}
+
+			dep, err := st.applyLockedVersion(r, constraint, resolved, pinFilter, repoToURL)
+			if err != nil {
+				return nil, err
+			}
+			if dep != nil {
+				versions[dep.ChartName] = appendVersion(versions[dep.ChartName], dep.Version)
+			}
+		}
+		if len(next) == len(pending) {
+			return nil, unresolvableReferencesError(blocked)
+		}
+		pending = next
+	}
+
+	return &updated, nil
+}
+
+func appendVersion(versions []string, version string) []string {
+	for _, v := range versions {
+		if v == version {
+			return versions
 		}
+	}
+	return append(versions, version)
+}
 
-		_, ok = repoToURL[repo]
-		// Skip this chart from dependency management, as there's no matching `repository` in the helmfile state,
-		// which may imply that this is a local chart within a directory, like `charts/myapp`
-		if !ok {
-			continue
+// applyLockedVersion sets the version locked for the release's chart satisfying the constraint to the release.
+// It returns the locked dependency, or nil when the release's chart isn't subject to dependency management.
+func (st *HelmState) applyLockedVersion(r *ReleaseSpec, constraint string, resolved *ResolvedDependencies, pinFilter ReleaseFilter, repoToURL map[string]string) (*ResolvedChartDependency, error) {
+	if r.SkipDeps {
+		return nil, nil
+	}
+
+	repo, chart, ok := st.resolveRemoteChart(r.Chart)
+	if !ok {
+		return nil, nil
+	}
+
+	url, ok := repoToURL[repo]
+	// Skip this chart from dependency management, as there's no matching `repository` in the helmfile state,
+	// which may imply that this is a local chart within a directory, like `charts/myapp`
+	if !ok {
+		return nil, nil
+	}
+
+	if st.isNoPinRepository(repo) {
+		return nil, nil
+	}
+
+	// Releases with version references and channels are always pinned, as helm doesn't understand them.
+	// Other releases not matching the pin filter keep their versions, but still provide the locked versions, if any, to the references.
+	// Version ranges only normalized into the constraints aren't symbolic.
+	symbolic := constraint != normalizeVersionConstraint(r.Version)
+	if pinFilter != nil && !symbolic && !pinFilter.Match(*r) {
+		dep, err := resolved.getFromRepository(chart, url, constraint)
+		if err != nil {
+			return nil, nil
 		}
+		return dep, nil
+	}
+
+	dep, err := resolved.getFromRepository(chart, url, constraint)
+	if err != nil {
+		return nil, err
+	}
+
+	ver, err := normalizeVersionPrefix(st.DependencyResolution.VersionPrefix, dep.Version)
+	if err != nil {
+		return nil, err
+	}
 
-		ver, err := resolved.Get(chart, r.Version)
+	if len(st.DependencyResolution.ResolvedLabels) > 0 {
+		labels, err := resolvedLabels(r.Labels, st.DependencyResolution.ResolvedLabels, dep)
 		if err != nil {
 			return nil, err
 		}
+		r.Labels = labels
+	}
+
+	r.Version = ver
+
+	return dep, nil
+}
+
+// resolvedLabels returns a copy of the release labels with the resolved metadata recorded under the configured keys.
+// The digest is the one of the chart tarball, which is left unrecorded when the chart is locked without it.
+// Values are sanitized into valid label values, as digests and repository URLs contain characters labels don't allow.
+func resolvedLabels(labels map[string]string, keys map[string]string, dep *ResolvedChartDependency) (map[string]string, error) {
+	updated := map[string]string{}
+	for k, v := range labels {
+		updated[k] = v
+	}
+
+	for k, field := range keys {
+		switch field {
+		case ResolvedLabelVersion:
+			updated[k] = labelValue(dep.Version)
+		case ResolvedLabelDigest:
+			if dep.Digest != "" {
+				updated[k] = labelValue(dep.Digest)
+			}
+		case ResolvedLabelRepository:
+			repo := dep.Repository
+			if i := strings.Index(repo, "://"); i >= 0 {
+				repo = repo[i+3:]
+			}
+			updated[k] = labelValue(repo)
+		default:
+			return nil, fmt.Errorf("invalid resolvedLabels value %q for %q: it must be one of %q, %q and %q", field, k, ResolvedLabelVersion, ResolvedLabelDigest, ResolvedLabelRepository)
+		}
+	}
 
-		updated.Releases[i].Version = ver
+	return updated, nil
+}
+
+// labelValue replaces the characters other than alphanumerics, `-`, `_` and `.` with `-`,
+// and truncates the value to 63 characters beginning and ending with alphanumerics, so that it's a valid label value
+func labelValue(v string) string {
+	sanitized := []rune(strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '-'
+	}, v))
+	if len(sanitized) > 63 {
+		sanitized = sanitized[:63]
 	}
+	return strings.Trim(string(sanitized), "-_.")
+}
 
-	return &updated, nil
+// normalizeVersionPrefix strips or adds the leading `v` of the version number according to the policy
+func normalizeVersionPrefix(policy, version string) (string, error) {
+	switch policy {
+	case "":
+		return version, nil
+	case VersionPrefixStrip:
+		return strings.TrimPrefix(version, "v"), nil
+	case VersionPrefixAdd:
+		if strings.HasPrefix(version, "v") {
+			return version, nil
+		}
+		return "v" + version, nil
+	default:
+		return "", fmt.Errorf("invalid versionPrefix %q: it must be either %q or %q", policy, VersionPrefixStrip, VersionPrefixAdd)
+	}
 }
 
 func (st *HelmState) updateDependenciesInTempDir(shell helmexec.DependencyUpdater, tempDir func(string, string) (string, error)) (*HelmState, error) {
+	if st.DependencyResolution.SkipResolve {
+		st.logger.Debugf("skipping dependency resolution for %s", st.FilePath)
+		return st, nil
+	}
+
 	filename, unresolved, err := getUnresolvedDependenciess(st)
 	if err != nil {
 		return nil, err
 	}
 
 	if len(unresolved.deps) == 0 {
+		st.warnNoRemoteCharts()
 		return st, nil
 	}
 
+	// The frozen lock file is only verified to satisfy all the dependencies, without running `helm dependency update`.
+	// All the releases are verified regardless of pinSelector.
+	if st.DependencyResolution.FrozenLockfile {
+		updated, err := resolveDependencies(st, st.newChartDependencyManager(filename), unresolved, nil)
+		if err != nil {
+			return nil, fmt.Errorf("the frozen lock file doesn't satisfy the dependencies: %v", err)
+		}
+		return updated, nil
+	}
+
+	if st.DependencyResolution.CheckCertificates && !st.DependencyResolution.Offline {
+		st.checkRepositoryCertificates(newCertificateChecker())
+	}
+
 	d, err := tempDir("", "")
 	if err != nil {
 		return nil, fmt.Errorf("unable to create dir: %v", err)
@@ -206,20 +640,138 @@ func (st *HelmState) updateDependenciesInTempDir(shell helmexec.DependencyUpdate
 	return updateDependencies(st, shell, unresolved, filename, d)
 }
 
-func getUnresolvedDependenciess(st *HelmState) (string, *UnresolvedDependencies, error) {
+func (st *HelmState) isNoPinRepository(repo string) bool {
+	// Nested repositories like `myrepo/library` follow their parents
+	if i := strings.Index(repo, "/"); i > 0 && !isOCIRepository(repo) {
+		repo = repo[:i]
+	}
+	for _, r := range st.Repositories {
+		if r.Name == repo {
+			return r.NoPin
+		}
+	}
+	return false
+}
+
+// isLocalChartDir returns true when the chart reference points to an existing directory relative to the state file
+func (st *HelmState) isLocalChartDir(chart string) (bool, error) {
+	path := filepath.Join(st.basePath, chart, "Chart.yaml")
+	if st.fileExists != nil {
+		return st.fileExists(path)
+	}
+	return pathExists(path), nil
+}
+
+// defaultRepositories maps the names of well-known public chart repositories to their URLs.
+// They are consulted only when `dependencyResolution.useDefaultRepositories` is enabled and the repository isn't declared in the state.
+var defaultRepositories = map[string]string{
+	"stable":    "https://kubernetes-charts.storage.googleapis.com",
+	"incubator": "https://kubernetes-charts-incubator.storage.googleapis.com",
+	"bitnami":   "https://charts.bitnami.com/bitnami",
+}
+
+// repositoryNames inverts the map from repository names to URLs.
+// The first name in the alphabetical order is used when multiple names share the same URL, so that the result doesn't depend on the map order.
+func repositoryNames(repoToURL map[string]string) map[string]string {
+	names := []string{}
+	for name := range repoToURL {
+		names = append(names, name)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	repoNames := map[string]string{}
+	for _, name := range names {
+		repoNames[repoToURL[name]] = name
+	}
+	return repoNames
+}
+
+// repositoryURLs returns the map from repository names to URLs used for dependency resolution.
+// Repositories declared in the state take precedence over the default ones.
+func (st *HelmState) repositoryURLs() map[string]string {
 	repoToURL := map[string]string{}
 
+	if st.DependencyResolution.UseDefaultRepositories {
+		for name, url := range defaultRepositories {
+			repoToURL[name] = url
+		}
+		for name, url := range st.DependencyResolution.DefaultRepositories {
+			repoToURL[name] = url
+		}
+	}
+
 	for _, r := range st.Repositories {
 		repoToURL[r.Name] = r.URL
 	}
 
-	unresolved := &UnresolvedDependencies{deps: map[string][]unresolvedChartDependency{}}
+	for name, r := range st.nestedRepositories() {
+		repoToURL[name] = r.URL
+	}
+
+	// Releases may reference charts in OCI registries by their URLs, without declaring the registries in `repositories`
+	for _, r := range st.Releases {
+		if repo, _, ok := splitOCIChart(r.Chart); ok {
+			if _, declared := repoToURL[repo]; !declared {
+				repoToURL[repo] = repo
+			}
+		}
+	}
+
+	return repoToURL
+}
+
+func getUnresolvedDependenciess(st *HelmState) (string, *UnresolvedDependencies, error) {
+	repoToURL := st.repositoryURLs()
+
+	declared := map[string]bool{}
+	for _, r := range st.Repositories {
+		declared[r.Name] = true
+	}
+	for name := range st.nestedRepositories() {
+		declared[name] = true
+	}
+
+	unresolved := &UnresolvedDependencies{deps: map[string][]unresolvedChartDependency{}, releases: map[string][]string{}}
 	//if err := unresolved.Add("stable/envoy", "https://kubernetes-charts.storage.googleapis.com", ""); err != nil {
 	//	panic(err)
 	//}
 
 	for _, r := range st.Releases {
-		repo, chart, ok := resolveRemoteChart(r.Chart)
+		if r.SkipDeps {
+			st.logger.Debugf("skipping %s from dependency locking, as the release %q is marked skipDeps", r.Chart, r.Name)
+			continue
+		}
+
+		if err := st.validateChartReference(r.Chart); err != nil {
+			return "", nil, fmt.Errorf("release %q: %v", r.Name, err)
+		}
+
+		// Charts in git repositories are locked at the commits their refs point to
+		if isGitChart(r.Chart) {
+			c, err := parseGitChart(r.Chart)
+			if err != nil {
+				return "", nil, fmt.Errorf("release %q: %v", r.Name, err)
+			}
+			unresolved.releases[c.name()] = append(unresolved.releases[c.name()], r.Name)
+			if err := unresolved.Add(c.name(), r.Chart, c.Ref); err != nil {
+				return "", nil, err
+			}
+			continue
+		}
+
+		// Charts referenced by tarball URLs are locked with the digests of the tarballs, at the versions in the URLs
+		if isChartURL(r.Chart) {
+			chart, version, ok := splitChartURL(r.Chart)
+			if !ok {
+				return "", nil, fmt.Errorf("release %q: unable to read the chart name and version from the chart URL %s: expected a tarball named like <chart>-<version>.tgz", r.Name, r.Chart)
+			}
+			unresolved.releases[chart] = append(unresolved.releases[chart], r.Name)
+			if err := unresolved.Add(chart, r.Chart, version); err != nil {
+				return "", nil, err
+			}
+			continue
+		}
+
+		repo, chart, ok := st.resolveRemoteChart(r.Chart)
 		if !ok {
 			continue
 		}
@@ -228,14 +780,67 @@ func getUnresolvedDependenciess(st *HelmState) (string, *UnresolvedDependencies,
 		// Skip this chart from dependency management, as there's no matching `repository` in the helmfile state,
 		// which may imply that this is a local chart within a directory, like `charts/myapp`
 		if !ok {
+			if st.DependencyResolution.StrictRepositoryMatch {
+				local, err := st.isLocalChartDir(r.Chart)
+				if err != nil {
+					return "", nil, err
+				}
+				if !local {
+					return "", nil, fmt.Errorf("release %q references the chart %q but the repository %q isn't declared in %s, nor is it a local chart directory", r.Name, r.Chart, repo, st.FilePath)
+				}
+			}
+			continue
+		}
+
+		if st.isNoPinRepository(repo) {
+			st.logger.Debugf("skipping %s from dependency locking, as the repository %q is marked noPin", r.Chart, repo)
+			continue
+		}
+
+		if !declared[repo] && !isOCIRepository(repo) {
+			st.warn(ResolutionWarningDefaultRepository, chart, "using the default repository %s for %s, as the repository %q isn't declared in %s", url, r.Chart, repo, st.FilePath)
+		}
+
+		unresolved.releases[chart] = append(unresolved.releases[chart], r.Name)
+
+		ref, err := parseVersionReference(r.Version)
+		if err != nil {
+			return "", nil, fmt.Errorf("release %q: %v", r.Name, err)
+		}
+		if ref != nil {
+			if err := unresolved.addReference(chart, url, ref); err != nil {
+				return "", nil, err
+			}
 			continue
 		}
 
-		if err := unresolved.Add(chart, url, r.Version); err != nil {
+		constraint, err := st.versionConstraint(r, chart)
+		if err != nil {
+			return "", nil, err
+		}
+
+		if err := unresolved.Add(chart, url, constraint); err != nil {
 			return "", nil, err
 		}
 	}
 
+	if err := st.addLocalChartDependencies(unresolved, repoToURL); err != nil {
+		return "", nil, err
+	}
+
+	unresolved.aliasCollidingCharts(repositoryNames(repoToURL))
+
+	for chart, deps := range unresolved.deps {
+		for _, d := range deps {
+			if d.versionRef == nil {
+				continue
+			}
+			if _, ok := unresolved.deps[d.versionRef.Chart]; !ok {
+				return "", nil, fmt.Errorf("the version of chart %q references the chart %q, which isn't used by any release with a declared repository in %s", chart, d.versionRef.Chart, st.FilePath)
+			}
+		}
+	}
+
 	filename := filepath.Base(st.FilePath)
 	filename = strings.TrimSuffix(filename, ".gotmpl")
 	filename = strings.TrimSuffix(filename, ".yaml")
@@ -244,96 +849,810 @@ func getUnresolvedDependenciess(st *HelmState) (string, *UnresolvedDependencies,
 	return filename, unresolved, nil
 }
 
+// isHelm3 returns true when the dependency updater runs helm v3
+func isHelm3(shell helmexec.DependencyUpdater) bool {
+	d, ok := shell.(helmexec.VersionDetector)
+	return ok && d.IsHelm3()
+}
+
 func updateDependencies(st *HelmState, shell helmexec.DependencyUpdater, unresolved *UnresolvedDependencies, filename, wd string) (*HelmState, error) {
-	depMan := NewChartDependencyManager(filename, st.logger)
+	depMan := st.newChartDependencyManager(filename)
+
+	if st.DependencyResolution.Failover && !st.DependencyResolution.Offline {
+		primaries, err := st.failoverRepositories(unresolved)
+		if err != nil {
+			return nil, err
+		}
+		depMan.primaries = primaries
+	}
+
+	depMan.Helm3 = isHelm3(shell)
+
+	// Only helm v3 resolves dependencies from OCI registries
+	if !depMan.Helm3 && depMan.ChartsDir == "" {
+		for chart, deps := range unresolved.deps {
+			for _, d := range deps {
+				if isOCIRepository(d.Repository) {
+					return nil, fmt.Errorf("unable to resolve %s from the OCI registry %s, as it requires helm v3", chart, d.Repository)
+				}
+			}
+		}
+	}
 
 	_, err := depMan.Update(shell, wd, unresolved)
 	if err != nil {
 		return nil, fmt.Errorf("unable to resolve %d deps: %v", len(unresolved.deps), err)
 	}
 
-	return resolveDependencies(st, depMan, unresolved)
+	pinFilter, err := st.pinFilter()
+	if err != nil {
+		return nil, err
+	}
+
+	return resolveDependencies(st, depMan, unresolved, pinFilter)
 }
 
 type chartDependencyManager struct {
 	Name string
 
+	// MaxDownloadSize is the maximum total size in bytes of chart tarballs fetched by `Update`. 0 means unlimited.
+	MaxDownloadSize int64
+
+	// ChartsDir is the directory containing pre-downloaded chart tarballs to resolve dependencies against, instead of running helm
+	ChartsDir string
+
+	// MaxVersionsPerChart is the number of the newest versions of a chart considered first when helmfile selects a version by itself.
+	// Older versions are considered only when none of them satisfies the constraint. 0 means all the versions.
+	MaxVersionsPerChart int
+
+	// Timeout is the timeout of `helm dependency update`. 0 means no timeout.
+	Timeout time.Duration
+
+	// ChartTimeouts overrides Timeout per chart name. Charts with overrides are updated in separate `helm dependency update` runs.
+	ChartTimeouts map[string]time.Duration
+
+	// NegativeCacheTTL is how long dependency updates failed due to missing charts or versions are remembered. 0 disables it.
+	NegativeCacheTTL time.Duration
+
+	// negativeCache remembers the failed dependency updates
+	negativeCache *negativeCache
+
+	// KeepUnselected keeps the versions locked for the charts missing in the dependencies being updated,
+	// so that updating the dependencies of the releases matching selectors doesn't unlock the rest
+	KeepUnselected bool
+
+	// lockFileSnapshots are the contents of the lock files when they were read, nil for missing ones, to detect concurrent modifications before writing them
+	lockFileSnapshots map[string][]byte
+
+	// ResolutionCacheDir is the directory the versions resolved for repositories, charts and version constraints are cached in across runs.
+	// Empty disables the cache.
+	ResolutionCacheDir string
+
+	// ResolutionCacheTTL is how long the cached versions are reused. Offline resolutions reuse them regardless of it.
+	ResolutionCacheTTL time.Duration
+
+	// Retries is the number of times `helm dependency update` is retried when IsRetryable returns true for the failure
+	Retries int
+
+	// IsRetryable decides whether the failure of `helm dependency update` is retryable
+	IsRetryable func(error) bool
+
+	// Helm3 generates the temporary local chart for helm v3, with dependencies declared in `Chart.yaml` and locked in `Chart.lock`.
+	// The format of the lock file written by helmfile is the same regardless of the version of helm.
+	Helm3 bool
+
+	// RewriteRequirements, when set, rewrites the generated `requirements.yaml` before helm consumes it
+	RewriteRequirements func([]byte) ([]byte, error)
+
+	// SplitLockFile, when set to true, splits the lock file into `<name>.<repo>.lock` per repository
+	SplitLockFile bool
+	// LockFilePath is the path to the lock file, or the directory containing `<name>.lock` when IsLockFileDir. Defaults to `<name>.lock`.
+	LockFilePath string
+
+	// Offline, when set to true, makes `Update` fail unless ChartsDir is set, and `Resolve` skip verifying locked versions
+	Offline bool
+
+	// VerifyLockedVersions, when set to true, makes `Resolve` confirm that every locked version is still published in its repository
+	VerifyLockedVersions bool
+
+	// ProvenanceKeyrings maps the names of charts whose provenance is verified before being locked by `Update` to the keyrings to verify them with.
+	// An empty keyring means helm's default keyring.
+	ProvenanceKeyrings map[string]string
+
+	// repoNames maps repository URLs to repository names, used for naming split lock files
+	repoNames map[string]string
+
+	// repos maps repository URLs to repositories, used for fetching repository indexes
+	repos map[string]RepositorySpec
+
+	// primaries maps the URLs of the sources serving charts to the primary URLs of their repositories in the failover mode
+	primaries map[string]string
+
+	// credentials looks up the credentials of repositories when fetching their indexes. Optional.
+	credentials CredentialsProvider
+
+	// warnings collects warnings for the caller of the resolution. When nil, warnings are only logged
+	warnings *resolutionWarnings
+
+	// git resolves the refs of charts in git repositories to commits
+	git gitClient
+
+	indexFetcher interface {
+		Fetch(RepositorySpec) (*repoIndex, error)
+		FetchTags(RepositorySpec, string) (*repoIndex, error)
+		FetchChart(RepositorySpec) ([]byte, error)
+	}
+
 	logger *zap.SugaredLogger
 
 	readFile  func(string) ([]byte, error)
 	writeFile func(string, []byte, os.FileMode) error
+	mkdirAll  func(string, os.FileMode) error
+	dirExists func(string) bool
+	sleep     func(time.Duration)
+	now       func() time.Time
 }
 
 func NewChartDependencyManager(name string, logger *zap.SugaredLogger) *chartDependencyManager {
 	return &chartDependencyManager{
-		Name:      name,
-		readFile:  ioutil.ReadFile,
-		writeFile: ioutil.WriteFile,
-		logger:    logger,
+		Name:        name,
+		readFile:    ioutil.ReadFile,
+		writeFile:   writeFileAtomically,
+		mkdirAll:    os.MkdirAll,
+		dirExists:   dirExists,
+		logger:      logger,
+		IsRetryable: IsTransientError,
+		sleep:       time.Sleep,
+		now:         time.Now,
+
+		NegativeCacheTTL: DefaultNegativeCacheTTL,
+		negativeCache:    newNegativeCache(),
+
+		ResolutionCacheTTL: DefaultResolutionCacheTTL,
+
+		indexFetcher: newRepoIndexFetcher(logger),
+		git:          gitCommand{},
+	}
+}
+
+func (st *HelmState) newChartDependencyManager(name string) *chartDependencyManager {
+	depMan := NewChartDependencyManager(name, st.logger)
+
+	if st.readFile != nil {
+		depMan.readFile = st.readFile
+	}
+
+	depMan.MaxDownloadSize = st.DependencyResolution.MaxDownloadSize
+	depMan.SplitLockFile = st.DependencyResolution.SplitLockFile
+	depMan.LockFilePath = st.DependencyResolution.LockFilePath
+	depMan.ChartsDir = st.DependencyResolution.ChartsDir
+	depMan.MaxVersionsPerChart = st.DependencyResolution.MaxVersionsPerChart
+	depMan.Retries = st.DependencyResolution.Retries
+	depMan.Timeout = time.Duration(st.DependencyResolution.Timeout) * time.Second
+	if len(st.DependencyResolution.ChartTimeouts) > 0 {
+		depMan.ChartTimeouts = map[string]time.Duration{}
+		for chart, timeout := range st.DependencyResolution.ChartTimeouts {
+			depMan.ChartTimeouts[chart] = time.Duration(timeout) * time.Second
+		}
+	}
+	if st.DependencyResolution.NegativeCacheTTL != nil {
+		depMan.NegativeCacheTTL = time.Duration(*st.DependencyResolution.NegativeCacheTTL) * time.Second
+	}
+	if st.DependencyResolution.ResolutionCacheDir != "" {
+		depMan.ResolutionCacheDir = expandHome(st.DependencyResolution.ResolutionCacheDir)
+	}
+	if st.DependencyResolution.ResolutionCacheTTL != nil {
+		depMan.ResolutionCacheTTL = time.Duration(*st.DependencyResolution.ResolutionCacheTTL) * time.Second
+	}
+	if st.DependencyResolution.IsRetryable != nil {
+		depMan.IsRetryable = st.DependencyResolution.IsRetryable
+	}
+
+	depMan.RewriteRequirements = st.DependencyResolution.RewriteRequirements
+	depMan.VerifyLockedVersions = st.DependencyResolution.VerifyLockedVersions
+	depMan.ProvenanceKeyrings = st.provenanceKeyrings()
+	depMan.KeepUnselected = len(st.Selectors) > 0
+	depMan.Offline = st.DependencyResolution.Offline
+	depMan.warnings = st.resolutionWarnings
+	depMan.credentials = st.credentialsProvider()
+
+	depMan.repoNames = map[string]string{}
+	depMan.repos = map[string]RepositorySpec{}
+	for url, name := range repositoryNames(st.repositoryURLs()) {
+		depMan.repoNames[url] = helmRepositoryName(name)
+		depMan.repos[url] = RepositorySpec{Name: name, URL: url}
+	}
+	for _, r := range st.Repositories {
+		depMan.repos[r.URL] = r
+		for _, mirror := range r.Mirrors {
+			depMan.repoNames[mirror] = r.Name
+		}
+	}
+	for _, r := range st.nestedRepositories() {
+		depMan.repos[r.URL] = r
+	}
+	// Charts referenced by tarball URLs or in git repositories are locked into the split lock files named after the charts
+	for _, r := range st.Releases {
+		if chart, _, ok := splitChartURL(r.Chart); ok {
+			depMan.repoNames[r.Chart] = chart
+		} else if c, err := parseGitChart(r.Chart); isGitChart(r.Chart) && err == nil {
+			depMan.repoNames[r.Chart] = c.name()
+		}
 	}
+	depMan.git = st.gitClient()
+
+	return depMan
 }
 
 func (m *chartDependencyManager) lockFileName() string {
-	return fmt.Sprintf("%s.lock", m.Name)
+	name := fmt.Sprintf("%s.lock", m.Name)
+	if m.LockFilePath == "" {
+		return name
+	}
+	if IsLockFileDir(m.LockFilePath, m.dirExists) {
+		return filepath.Join(m.LockFilePath, name)
+	}
+	return m.LockFilePath
+}
+
+// IsLockFileDir returns true when the lock file path is the directory containing the lock files, that is, it ends with `/` or is an existing directory.
+// Any other path is the lock file itself, regardless of its extension.
+func IsLockFileDir(path string, dirExists func(string) bool) bool {
+	return strings.HasSuffix(path, "/") || dirExists(path)
+}
+
+func dirExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+func (m *chartDependencyManager) splitLockFileName(repo string) string {
+	return fmt.Sprintf("%s.%s.lock", strings.TrimSuffix(m.lockFileName(), ".lock"), repo)
+}
+
+// referencedRepos returns the sorted names of the repositories hosting the unresolved dependencies
+func (m *chartDependencyManager) referencedRepos(unresolved *UnresolvedDependencies) ([]string, error) {
+	names := map[string]bool{}
+	for _, deps := range unresolved.deps {
+		for _, d := range deps {
+			name, ok := m.repoNames[d.Repository]
+			if !ok {
+				return nil, fmt.Errorf("no repository found for %s", d.Repository)
+			}
+			names[name] = true
+		}
+	}
+
+	repos := []string{}
+	for name := range names {
+		repos = append(repos, name)
+	}
+	sort.Strings(repos)
+
+	return repos, nil
+}
+
+// readLockFile returns the content of the lock file, or nil if there's no lock file yet.
+// For split lock files, the lock files of all the repositories referenced by the unresolved dependencies are merged into one.
+func (m *chartDependencyManager) readLockFile(unresolved *UnresolvedDependencies) ([]byte, error) {
+	m.lockFileSnapshots = map[string][]byte{}
+
+	if !m.SplitLockFile {
+		content, err := m.readBytes(m.lockFileName())
+		if err != nil {
+			if os.IsNotExist(err) {
+				m.lockFileSnapshots[m.lockFileName()] = nil
+				return nil, nil
+			}
+			return nil, err
+		}
+		m.lockFileSnapshots[m.lockFileName()] = content
+		return content, nil
+	}
+
+	repos, err := m.referencedRepos(unresolved)
+	if err != nil {
+		return nil, err
+	}
+
+	merged := &ChartLockedRequirements{}
+	var found bool
+	for _, repo := range repos {
+		content, err := m.readBytes(m.splitLockFileName(repo))
+		if err != nil {
+			if os.IsNotExist(err) {
+				m.lockFileSnapshots[m.splitLockFileName(repo)] = nil
+				continue
+			}
+			return nil, err
+		}
+		m.lockFileSnapshots[m.splitLockFileName(repo)] = content
+		found = true
+
+		locked := &ChartLockedRequirements{}
+		if err := yaml.Unmarshal(content, locked); err != nil {
+			return nil, err
+		}
+		merged.ResolvedDependencies = append(merged.ResolvedDependencies, locked.ResolvedDependencies...)
+		merged.Digest = locked.Digest
+		if locked.Generated > merged.Generated {
+			merged.Generated = locked.Generated
+		}
+		if locked.Metadata != nil && (merged.Metadata == nil || locked.Metadata.GeneratedAt > merged.Metadata.GeneratedAt) {
+			merged.Metadata = locked.Metadata
+		}
+	}
+
+	if !found {
+		return nil, nil
+	}
+
+	return yaml.Marshal(merged)
+}
+
+// writeLockFile commits the locked requirements to the lock file.
+// For split lock files, only the lock files of the repositories having any locked dependency are written.
+func (m *chartDependencyManager) writeLockFile(lockedReqs *ChartLockedRequirements) error {
+	lockedReqs.Metadata = &LockFileMetadata{
+		GeneratedAt:     m.now().UTC().Format(time.RFC3339),
+		HelmfileVersion: HelmfileVersion,
+	}
+
+	if !m.SplitLockFile {
+		return m.writeLockedRequirements(m.lockFileName(), lockedReqs)
+	}
+
+	byRepo := map[string]*ChartLockedRequirements{}
+	repos := []string{}
+	for _, d := range lockedReqs.ResolvedDependencies {
+		name, ok := m.repoNames[d.Repository]
+		if !ok {
+			return fmt.Errorf("no repository found for %s", d.Repository)
+		}
+		locked, ok := byRepo[name]
+		if !ok {
+			locked = &ChartLockedRequirements{Digest: lockedReqs.Digest, Generated: lockedReqs.Generated, Metadata: lockedReqs.Metadata}
+			byRepo[name] = locked
+			repos = append(repos, name)
+		}
+		locked.ResolvedDependencies = append(locked.ResolvedDependencies, d)
+	}
+
+	sort.Strings(repos)
+
+	for _, repo := range repos {
+		if err := m.writeLockedRequirements(m.splitLockFileName(repo), byRepo[repo]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeLockedRequirements writes the locked requirements to the lock file, unless the lock file already locks the same dependencies.
+// Leaving it untouched keeps the timestamps in the committed lock file from changing on every run.
+// It fails when the lock file was modified since it was read, e.g. by another helmfile process resolving the same dependencies concurrently,
+// rather than silently overwriting the other's changes.
+func (m *chartDependencyManager) writeLockedRequirements(filename string, lockedReqs *ChartLockedRequirements) error {
+	current, err := m.readFile(filename)
+	if err == nil {
+		var existing ChartLockedRequirements
+		if err := yaml.Unmarshal(current, &existing); err == nil &&
+			existing.Digest == lockedReqs.Digest &&
+			reflect.DeepEqual(existing.ResolvedDependencies, lockedReqs.ResolvedDependencies) {
+			m.logger.Debugf("writeLockedRequirements: %s is up to date", filename)
+			return nil
+		}
+	} else {
+		current = nil
+	}
+
+	if snapshot, ok := m.lockFileSnapshots[filename]; ok && !bytes.Equal(snapshot, current) {
+		return fmt.Errorf("the lock file %s was modified by another process while resolving dependencies: run helmfile again to resolve them against the modified lock file", filename)
+	}
+
+	content, err := yaml.Marshal(lockedReqs)
+	if err != nil {
+		return err
+	}
+	return m.writeBytes(filename, content)
 }
 
 func (m *chartDependencyManager) Update(shell helmexec.DependencyUpdater, wd string, unresolved *UnresolvedDependencies) (*ResolvedDependencies, error) {
-	// Generate `Chart.yaml` of the temporary local chart
-	if err := m.writeBytes(filepath.Join(wd, "Chart.yaml"), []byte(fmt.Sprintf("name: %s\n", m.Name))); err != nil {
+	if m.ChartsDir != "" {
+		return m.updateFromChartsDir(unresolved)
+	}
+
+	// Charts referenced by tarball URLs or in git repositories are locked without running helm, as helm can't resolve them as dependencies.
+	// So are charts in repositories declaring custom headers, as helm can't send the headers.
+	urls, remaining := unresolved.partitionByRepository(isChartURL)
+	gits, remaining := remaining.partitionByRepository(isGitChart)
+	indexed, remaining := remaining.partitionByRepository(m.hasHeaders)
+
+	if m.Offline {
+		if _, misses := m.partitionCached(remaining); len(misses.deps) > 0 {
+			return nil, errors.New("unable to update dependencies offline, as running `helm dependency update` requires network access: set dependencyResolution.chartsDir to resolve them against local chart tarballs instead, or dependencyResolution.resolutionCacheDir to reuse the versions resolved online before")
+		}
+	}
+
+	// Generate `requirements.lock`, or `Chart.lock` for helm v3, of the temporary local chart by coping `<basename>.lock`
+	lockFileContent, err := m.readLockFile(unresolved)
+	if err != nil {
 		return nil, err
 	}
 
-	// Generate `requirements.yaml` of the temporary local chart from the helmfile state
-	reqsContent, err := yaml.Marshal(unresolved.ToChartRequirements())
+	lockedURLs, err := m.lockChartURLs(urls, lockFileContent)
+	if err != nil {
+		return nil, err
+	}
+
+	lockedGits, err := m.lockGitCharts(gits, lockFileContent)
 	if err != nil {
 		return nil, err
 	}
-	if err := m.writeBytes(filepath.Join(wd, "requirements.yaml"), reqsContent); err != nil {
+
+	lockedIndexed, err := m.lockFromIndexes(indexed)
+	if err != nil {
 		return nil, err
 	}
 
-	// Generate `requirements.lock` of the temporary local chart by coping `<basename>.lock`
-	lockFile := m.lockFileName()
+	// Charts with their own timeouts are updated separately, so that they don't share the timeout with other charts.
+	// Charts with version references are updated in later phases, after the referenced charts are resolved.
+	multiRun := remaining.hasVersionReferences() || len(m.groupByTimeout(remaining)) > 1
+
+	lockedReqs := &ChartLockedRequirements{}
+	versions := map[string][]string{}
+	for _, d := range append(lockedURLs, lockedIndexed...) {
+		versions[d.ChartName] = appendVersion(versions[d.ChartName], d.Version)
+	}
+	if len(remaining.deps) == 0 && lockFileContent != nil {
+		// Keep the digest and the timestamp of the current lock file, as helm doesn't run
+		if err := yaml.Unmarshal(lockFileContent, lockedReqs); err != nil {
+			return nil, err
+		}
+		lockedReqs.ResolvedDependencies = nil
+	}
+	lockedReqs.ResolvedDependencies = append(lockedReqs.ResolvedDependencies, lockedURLs...)
+	lockedReqs.ResolvedDependencies = append(lockedReqs.ResolvedDependencies, lockedGits...)
+	lockedReqs.ResolvedDependencies = append(lockedReqs.ResolvedDependencies, lockedIndexed...)
+
+	var downloaded int64
+	var run int
+	for pending := remaining; len(pending.deps) > 0; {
+		ready, rest, err := pending.partitionByReferences(versions)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, g := range m.groupByTimeout(ready) {
+			dir := wd
+			if multiRun {
+				dir = filepath.Join(wd, strconv.Itoa(run))
+				if err := os.Mkdir(dir, 0755); err != nil {
+					return nil, err
+				}
+			}
+			run++
+
+			// Dependencies resolved in previous runs are taken from the resolution cache, and only the rest are resolved by helm
+			cached, misses := m.partitionCached(g.unresolved)
+
+			locked := &ChartLockedRequirements{}
+			if len(misses.deps) > 0 {
+				locked, err = m.updateInDir(shell, dir, misses, lockFileContent, g.timeout)
+				if err != nil {
+					return nil, err
+				}
+
+				downloaded, err = m.checkDownloadSize(dir, downloaded)
+				if err != nil {
+					return nil, err
+				}
+
+				if err := recordDigests(filepath.Join(dir, "charts"), locked.ResolvedDependencies); err != nil {
+					return nil, err
+				}
+
+				m.cacheResolutions(misses, locked.ResolvedDependencies)
+			} else if lockFileContent != nil {
+				// Keep the digest and the timestamp of the current lock file, as helm didn't run
+				if err := yaml.Unmarshal(lockFileContent, locked); err != nil {
+					return nil, err
+				}
+				locked.ResolvedDependencies = nil
+			}
+			locked.ResolvedDependencies = append(locked.ResolvedDependencies, cached...)
+
+			for i, d := range locked.ResolvedDependencies {
+				versions[d.ChartName] = appendVersion(versions[d.ChartName], d.Version)
+
+				// Lock charts served by mirrors under their primary repositories, along with the sources for traceability
+				if primary, ok := m.primaries[d.Repository]; ok {
+					locked.ResolvedDependencies[i].Source = d.Repository
+					locked.ResolvedDependencies[i].Repository = primary
+				}
+			}
+
+			lockedReqs.ResolvedDependencies = append(lockedReqs.ResolvedDependencies, locked.ResolvedDependencies...)
+			lockedReqs.Digest = locked.Digest
+			lockedReqs.Generated = locked.Generated
+		}
+
+		pending = rest
+	}
 
-	lockFileContent, err := m.readBytes(lockFile)
-	if err != nil && !os.IsNotExist(err) {
+	if err := m.keepUnselected(lockedReqs, unresolved, lockFileContent); err != nil {
 		return nil, err
 	}
 
+	// Sort requirements alphabetically by name, repository and version, so that the lock file is deterministic
+	// regardless of the order helm or concurrent resolutions produced the dependencies in.
+	sortResolvedDependencies(lockedReqs.ResolvedDependencies)
+
+	if err := m.verifyProvenance(shell, lockedReqs.ResolvedDependencies, lockFileContent); err != nil {
+		return nil, err
+	}
+
+	// Commit the lock file if and only if everything looks ok
+	if err := m.writeLockFile(lockedReqs); err != nil {
+		return nil, err
+	}
+
+	resolved, _, err := m.Resolve(unresolved)
+	return resolved, err
+}
+
+type timeoutGroup struct {
+	timeout    time.Duration
+	unresolved *UnresolvedDependencies
+}
+
+// groupByTimeout groups the unresolved dependencies by their timeouts, ordered by the timeout.
+// A per-chart timeout takes precedence over the global timeout.
+func (m *chartDependencyManager) groupByTimeout(unresolved *UnresolvedDependencies) []timeoutGroup {
+	if len(m.ChartTimeouts) == 0 {
+		return []timeoutGroup{{timeout: m.Timeout, unresolved: unresolved}}
+	}
+
+	byTimeout := map[time.Duration]*UnresolvedDependencies{}
+	for chart, deps := range unresolved.deps {
+		timeout, ok := m.ChartTimeouts[chart]
+		if !ok {
+			timeout = m.Timeout
+		}
+		g, ok := byTimeout[timeout]
+		if !ok {
+			g = &UnresolvedDependencies{deps: map[string][]unresolvedChartDependency{}}
+			byTimeout[timeout] = g
+		}
+		g.deps[chart] = deps
+	}
+
+	groups := []timeoutGroup{}
+	for timeout, g := range byTimeout {
+		groups = append(groups, timeoutGroup{timeout: timeout, unresolved: g})
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].timeout < groups[j].timeout
+	})
+
+	return groups
+}
+
+// updateInDir generates the temporary local chart for the unresolved dependencies in wd, and runs `helm dependency update` on it
+func (m *chartDependencyManager) updateInDir(shell helmexec.DependencyUpdater, wd string, unresolved *UnresolvedDependencies, lockFileContent []byte, timeout time.Duration) (*ChartLockedRequirements, error) {
+	reqsContent, err := yaml.Marshal(unresolved.ToChartRequirements())
+	if err != nil {
+		return nil, err
+	}
+	if m.RewriteRequirements != nil {
+		reqsContent, err = m.RewriteRequirements(reqsContent)
+		if err != nil {
+			return nil, fmt.Errorf("unable to rewrite requirements.yaml: %v", err)
+		}
+	}
+
+	if m.Helm3 {
+		// Generate `Chart.yaml` of the temporary local chart with the dependencies embedded, as helm v3 ignores `requirements.yaml`
+		reqs := &ChartRequirements{}
+		if err := yaml.Unmarshal(reqsContent, reqs); err != nil {
+			return nil, err
+		}
+		chart := helm3Chart{
+			APIVersion:   "v2",
+			Name:         m.Name,
+			Version:      "1.0.0",
+			Dependencies: reqs.UnresolvedDependencies,
+		}
+		chartContent, err := yaml.Marshal(chart)
+		if err != nil {
+			return nil, err
+		}
+		if err := m.writeBytes(filepath.Join(wd, "Chart.yaml"), chartContent); err != nil {
+			return nil, err
+		}
+	} else {
+		// Generate `Chart.yaml` of the temporary local chart
+		if err := m.writeBytes(filepath.Join(wd, "Chart.yaml"), []byte(fmt.Sprintf("name: %s\n", m.Name))); err != nil {
+			return nil, err
+		}
+
+		// Generate `requirements.yaml` of the temporary local chart from the helmfile state
+		if err := m.writeBytes(filepath.Join(wd, "requirements.yaml"), reqsContent); err != nil {
+			return nil, err
+		}
+	}
+
 	if lockFileContent != nil {
-		if err := m.writeBytes(filepath.Join(wd, "requirements.lock"), lockFileContent); err != nil {
+		if err := m.writeBytes(filepath.Join(wd, m.chartLockFileName()), lockFileContent); err != nil {
+			return nil, err
+		}
+	}
+
+	if m.NegativeCacheTTL > 0 {
+		if err := m.negativeCache.get(m.Name, reqsContent); err != nil {
 			return nil, err
 		}
 	}
 
 	// Update the lock file by running `helm dependency update`
-	if err := shell.UpdateDeps(wd); err != nil {
+	if err := m.updateDepsWithTimeout(shell, wd, timeout); err != nil {
+		if m.NegativeCacheTTL > 0 && isChartNotFoundError(err) {
+			m.negativeCache.put(m.Name, reqsContent, err, m.NegativeCacheTTL)
+		}
 		return nil, err
 	}
 
-	updatedLockFileContent, err := m.readBytes(filepath.Join(wd, "requirements.lock"))
+	updatedLockFileContent, err := m.readBytes(filepath.Join(wd, m.chartLockFileName()))
 	if err != nil {
 		return nil, err
 	}
 
-	// Sort requirements alphabetically by name.
 	lockedReqs := &ChartLockedRequirements{}
 	if err := yaml.Unmarshal(updatedLockFileContent, lockedReqs); err != nil {
 		return nil, err
 	}
 
-	sort.Slice(lockedReqs.ResolvedDependencies, func(i, j int) bool {
-		return lockedReqs.ResolvedDependencies[i].ChartName < lockedReqs.ResolvedDependencies[j].ChartName
-	})
+	return lockedReqs, nil
+}
+
+// chartLockFileName returns the name of the lock file helm reads and writes in the temporary local chart
+func (m *chartDependencyManager) chartLockFileName() string {
+	if m.Helm3 {
+		return "Chart.lock"
+	}
+	return "requirements.lock"
+}
+
+// chartRequirementsFileName returns the name of the file declaring the dependencies of the temporary local chart
+func (m *chartDependencyManager) chartRequirementsFileName() string {
+	if m.Helm3 {
+		return "Chart.yaml"
+	}
+	return "requirements.yaml"
+}
+
+// updateDepsWithTimeout fails when updateDeps doesn't complete within the timeout. 0 means no timeout.
+// helm is killed on the timeout, so that it never keeps writing into wd after returning.
+func (m *chartDependencyManager) updateDepsWithTimeout(shell helmexec.DependencyUpdater, wd string, timeout time.Duration) error {
+	if timeout <= 0 {
+		return m.updateDeps(context.Background(), shell, wd)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-	updatedLockFileContent, err = yaml.Marshal(lockedReqs)
+	err := m.updateDeps(ctx, shell, wd)
+	if err == nil || ctx.Err() == nil {
+		return err
+	}
+
+	charts := []string{}
+	content, err := m.readBytes(filepath.Join(wd, m.chartRequirementsFileName()))
+	if err == nil {
+		reqs := &ChartRequirements{}
+		if yaml.Unmarshal(content, reqs) == nil {
+			for _, d := range reqs.UnresolvedDependencies {
+				charts = append(charts, d.ChartName)
+			}
+		}
+	}
+	sort.Strings(charts)
+	return fmt.Errorf("timed out after %v updating dependencies: %s", timeout, strings.Join(charts, ", "))
+}
+
+func (m *chartDependencyManager) warn(kind, chart, format string, args ...interface{}) {
+	if m.warnings == nil {
+		m.logger.Warnf(format, args...)
+		return
+	}
+	m.warnings.add(kind, chart, format, args...)
+}
+
+// updateDeps runs `helm dependency update`, retrying up to Retries times while the failure is retryable and the context isn't done
+func (m *chartDependencyManager) updateDeps(ctx context.Context, shell helmexec.DependencyUpdater, wd string) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = updateDepsContext(ctx, shell, wd)
+		if err == nil || ctx.Err() != nil || attempt >= m.Retries || !m.IsRetryable(err) {
+			return err
+		}
+		m.warn(ResolutionWarningRetry, "", "retrying dependency update (%d/%d) after failure: %v", attempt+1, m.Retries, err)
+		m.sleep(time.Duration(attempt+1) * time.Second)
+	}
+}
+
+// updateDepsContext runs `helm dependency update`, stopping it once the context is done when the dependency updater supports it.
+// Otherwise, the update runs to completion regardless of the context.
+func updateDepsContext(ctx context.Context, shell helmexec.DependencyUpdater, wd string) error {
+	if s, ok := shell.(helmexec.ContextDependencyUpdater); ok {
+		return s.UpdateDepsContext(ctx, wd)
+	}
+	return shell.UpdateDeps(wd)
+}
+
+// transientErrorMessages are substrings of errors from helm that are likely to succeed on retry
+var transientErrorMessages = []string{
+	"timeout",
+	"connection refused",
+	"connection reset",
+	"no such host",
+	"temporary failure",
+	"TLS handshake",
+	"502 Bad Gateway",
+	"503 Service Unavailable",
+	"504 Gateway Timeout",
+	"429 Too Many Requests",
+}
+
+// IsTransientError is the default predicate for retrying failed dependency updates, and the predicate for retrying other failed helm operations.
+// It considers network failures, rate limiting and server-side HTTP errors transient.
+func IsTransientError(err error) bool {
+	msg := err.Error()
+	for _, m := range transientErrorMessages {
+		if strings.Contains(msg, m) {
+			return true
+		}
+	}
+	return false
+}
 
+// updateFromChartsDir updates the lock file by resolving the unresolved dependencies against chart tarballs in ChartsDir
+func (m *chartDependencyManager) updateFromChartsDir(unresolved *UnresolvedDependencies) (*ResolvedDependencies, error) {
+	files, err := ioutil.ReadDir(m.ChartsDir)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("unable to read charts dir: %v", err)
 	}
 
-	// Commit the lock file if and only if everything looks ok
-	if err := m.writeBytes(lockFile, updatedLockFileContent); err != nil {
+	lockedReqs := &ChartLockedRequirements{}
+	locked := map[ResolvedChartDependency]bool{}
+	versions := map[string][]string{}
+	for pending := unresolved; len(pending.deps) > 0; {
+		ready, rest, err := pending.partitionByReferences(versions)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := m.lockFromChartFiles(files, ready, lockedReqs, locked, versions); err != nil {
+			return nil, err
+		}
+
+		pending = rest
+	}
+
+	if m.KeepUnselected {
+		lockFileContent, err := m.readLockFile(unresolved)
+		if err != nil {
+			return nil, err
+		}
+		if err := m.keepUnselected(lockedReqs, unresolved, lockFileContent); err != nil {
+			return nil, err
+		}
+	}
+
+	sortResolvedDependencies(lockedReqs.ResolvedDependencies)
+
+	if err := m.writeLockFile(lockedReqs); err != nil {
 		return nil, err
 	}
 
@@ -341,14 +1660,126 @@ func (m *chartDependencyManager) Update(shell helmexec.DependencyUpdater, wd str
 	return resolved, err
 }
 
-func (m *chartDependencyManager) Resolve(unresolved *UnresolvedDependencies) (*ResolvedDependencies, bool, error) {
-	updatedLockFileContent, err := m.readBytes(m.lockFileName())
+// keepUnselected adds the versions locked in the current lock file for the charts missing in the unresolved dependencies,
+// like the charts of the releases excluded by selectors, when KeepUnselected is true
+func (m *chartDependencyManager) keepUnselected(lockedReqs *ChartLockedRequirements, unresolved *UnresolvedDependencies, lockFileContent []byte) error {
+	if !m.KeepUnselected || lockFileContent == nil {
+		return nil
+	}
+
+	current := &ChartLockedRequirements{}
+	if err := yaml.Unmarshal(lockFileContent, current); err != nil {
+		return err
+	}
+
+	for _, d := range current.ResolvedDependencies {
+		if _, ok := unresolved.deps[d.ChartName]; !ok {
+			lockedReqs.ResolvedDependencies = append(lockedReqs.ResolvedDependencies, d)
+		}
+	}
+
+	return nil
+}
+
+// lockFromChartFiles locks each unresolved dependency to the latest version among the chart tarballs satisfying its constraint
+func (m *chartDependencyManager) lockFromChartFiles(files []os.FileInfo, unresolved *UnresolvedDependencies, lockedReqs *ChartLockedRequirements, locked map[ResolvedChartDependency]bool, versions map[string][]string) error {
+	charts := []string{}
+	for chart := range unresolved.deps {
+		charts = append(charts, chart)
+	}
+	sort.Strings(charts)
+
+	for _, chart := range charts {
+		available := []*semver.Version{}
+		for _, f := range files {
+			name := f.Name()
+			if f.IsDir() || !strings.HasPrefix(name, chart+"-") || !strings.HasSuffix(name, ".tgz") {
+				continue
+			}
+			v, err := semver.NewVersion(strings.TrimSuffix(strings.TrimPrefix(name, chart+"-"), ".tgz"))
+			if err != nil {
+				continue
+			}
+			available = append(available, v)
+		}
+		sort.Sort(sort.Reverse(semver.Collection(available)))
+
+		for _, d := range unresolved.deps[chart] {
+			versionConstraint := d.VersionConstraint
+			if versionConstraint == "" {
+				versionConstraint = "*"
+			}
+			constraint, err := semver.NewConstraint(versionConstraint)
+			if err != nil {
+				return err
+			}
+
+			availableVersions := []string{}
+			for _, v := range available {
+				availableVersions = append(availableVersions, v.Original())
+			}
+			matched := latestMatchingVersion(availableVersions, constraint, m.MaxVersionsPerChart)
+			if matched == "" {
+				return fmt.Errorf("no chart tarball found for %s satisfying %q in %s: available versions are [%s]", chart, versionConstraint, m.ChartsDir, strings.Join(availableVersions, ", "))
+			}
+
+			dep := ResolvedChartDependency{
+				ChartName:  chart,
+				Repository: d.Repository,
+				Version:    matched,
+			}
+			digest, err := chartDigest(filepath.Join(m.ChartsDir, chartTarballName(chart, matched)))
+			if err != nil {
+				return err
+			}
+			dep.Digest = digest
+			if !locked[dep] {
+				locked[dep] = true
+				lockedReqs.ResolvedDependencies = append(lockedReqs.ResolvedDependencies, dep)
+				versions[chart] = appendVersion(versions[chart], dep.Version)
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkDownloadSize adds up the sizes of chart tarballs fetched into `<wd>/charts` to the already downloaded bytes, and fails once the total exceeds MaxDownloadSize
+func (m *chartDependencyManager) checkDownloadSize(wd string, downloaded int64) (int64, error) {
+	if m.MaxDownloadSize <= 0 {
+		return downloaded, nil
+	}
+
+	files, err := ioutil.ReadDir(filepath.Join(wd, "charts"))
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil, false, nil
+			return downloaded, nil
+		}
+		return downloaded, err
+	}
+
+	total := downloaded
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".tgz" {
+			continue
 		}
+		total += f.Size()
+		if total > m.MaxDownloadSize {
+			return total, fmt.Errorf("downloading %s exceeded the max download size of %d bytes: %d bytes downloaded in total", f.Name(), m.MaxDownloadSize, total)
+		}
+	}
+
+	return total, nil
+}
+
+func (m *chartDependencyManager) Resolve(unresolved *UnresolvedDependencies) (*ResolvedDependencies, bool, error) {
+	updatedLockFileContent, err := m.readLockFile(unresolved)
+	if err != nil {
 		return nil, false, err
 	}
+	if updatedLockFileContent == nil {
+		return nil, false, nil
+	}
 
 	// Load resolved dependencies into memory
 	lockedReqs := &ChartLockedRequirements{}
@@ -356,16 +1787,102 @@ func (m *chartDependencyManager) Resolve(unresolved *UnresolvedDependencies) (*R
 		return nil, false, err
 	}
 
-	resolved := &ResolvedDependencies{deps: map[string][]ResolvedChartDependency{}}
+	resolved := &ResolvedDependencies{deps: map[string][]ResolvedChartDependency{}, digest: lockedReqs.Digest}
 	for _, d := range lockedReqs.ResolvedDependencies {
 		if err := resolved.add(d); err != nil {
 			return nil, false, err
 		}
 	}
 
+	if m.VerifyLockedVersions && m.Offline {
+		m.logger.Debugf("skipping verification of locked versions, as it requires network access")
+	} else if m.VerifyLockedVersions {
+		if err := m.verifyLockedVersions(resolved); err != nil {
+			return nil, false, err
+		}
+	}
+
 	return resolved, true, nil
 }
 
+// lockedRequirements parses the content of the lock file, which is empty when there's no lock file yet
+func (m *chartDependencyManager) lockedRequirements(lockFileContent []byte) (*ChartLockedRequirements, error) {
+	locked := &ChartLockedRequirements{}
+	if lockFileContent != nil {
+		if err := yaml.Unmarshal(lockFileContent, locked); err != nil {
+			return nil, err
+		}
+	}
+	return locked, nil
+}
+
+// verifyLockedVersions fails when any of the locked versions is no longer published in its repository's index, e.g. due to being yanked
+func (m *chartDependencyManager) verifyLockedVersions(resolved *ResolvedDependencies) error {
+	indexes := map[string]*repoIndex{}
+	vanished := []string{}
+
+	for _, dep := range resolved.sorted() {
+		// Charts referenced by tarball URLs have no index, and are verified by their digests instead.
+		// Charts in git repositories are locked at commits rather than published versions.
+		if isChartURL(dep.Repository) || isGitChart(dep.Repository) {
+			continue
+		}
+
+		key := indexKey(dep.Repository, dep.ChartName)
+		index, ok := indexes[key]
+		if !ok {
+			var err error
+			index, err = m.fetchIndex(dep.Repository, dep.ChartName)
+			if err != nil {
+				return fmt.Errorf("unable to verify locked versions: %v", err)
+			}
+			indexes[key] = index
+		}
+
+		var published bool
+		for _, e := range index.Entries[dep.ChartName] {
+			if e.Version == dep.Version {
+				published = true
+				break
+			}
+		}
+		if !published {
+			vanished = append(vanished, fmt.Sprintf("%s %s in %s", dep.ChartName, dep.Version, dep.Repository))
+		}
+	}
+
+	if len(vanished) > 0 {
+		return fmt.Errorf("locked versions no longer published: %s: run `helmfile deps` to re-resolve them", strings.Join(vanished, ", "))
+	}
+
+	return nil
+}
+
+// fetchIndex fetches the index of the repository at the URL, with the credentials of the repository.
+// For OCI registries, which have no index, the index contains only the tags of the chart.
+func (m *chartDependencyManager) fetchIndex(url, chart string) (*repoIndex, error) {
+	repo, ok := m.repos[url]
+	if !ok {
+		repo = RepositorySpec{URL: url}
+	}
+	repo, err := withCredentials(m.credentials, repo)
+	if err != nil {
+		return nil, err
+	}
+	if isOCIRepository(url) {
+		return m.indexFetcher.FetchTags(repo, chart)
+	}
+	return m.indexFetcher.Fetch(repo)
+}
+
+// indexKey is the key to cache the index fetched for the chart by, as the index of an OCI registry is per chart
+func indexKey(url, chart string) string {
+	if isOCIRepository(url) {
+		return url + "/" + chart
+	}
+	return url
+}
+
 func (m *chartDependencyManager) readBytes(filename string) ([]byte, error) {
 	bytes, err := m.readFile(filename)
 	if err != nil {
@@ -376,6 +1893,12 @@ func (m *chartDependencyManager) readBytes(filename string) ([]byte, error) {
 }
 
 func (m *chartDependencyManager) writeBytes(filename string, data []byte) error {
+	// The directory of a custom lock file path, like `locks/`, is created on the first write
+	if m.LockFilePath != "" && m.mkdirAll != nil {
+		if err := m.mkdirAll(filepath.Dir(filename), 0755); err != nil {
+			return err
+		}
+	}
 	err := m.writeFile(filename, data, 0644)
 	if err != nil {
 		return err
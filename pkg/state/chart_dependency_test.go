@@ -0,0 +1,1790 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/roboll/helmfile/pkg/helmexec"
+	"github.com/roboll/helmfile/pkg/testhelper"
+	"gopkg.in/yaml.v2"
+)
+
+// lockFileTime is the time lock files are written at in tests
+func lockFileTime() time.Time {
+	return time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)
+}
+
+func TestChartDependencyManager_CheckDownloadSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		max     int64
+		charts  map[string]int
+		wantErr string
+	}{
+		{
+			name:   "unlimited",
+			max:    0,
+			charts: map[string]int{"envoy-1.5.0.tgz": 100},
+		},
+		{
+			name:   "within budget",
+			max:    150,
+			charts: map[string]int{"envoy-1.5.0.tgz": 100, "mysql-1.0.0.tgz": 50},
+		},
+		{
+			name:    "exceeded",
+			max:     120,
+			charts:  map[string]int{"envoy-1.5.0.tgz": 100, "mysql-1.0.0.tgz": 50},
+			wantErr: "downloading mysql-1.0.0.tgz exceeded the max download size of 120 bytes: 150 bytes downloaded in total",
+		},
+		{
+			name:   "non tarballs are ignored",
+			max:    120,
+			charts: map[string]int{"envoy-1.5.0.tgz": 100, "README.md": 50},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wd, err := ioutil.TempDir("", "")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer os.RemoveAll(wd)
+
+			if err := os.Mkdir(filepath.Join(wd, "charts"), 0755); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			for name, size := range tt.charts {
+				if err := ioutil.WriteFile(filepath.Join(wd, "charts", name), []byte(strings.Repeat("x", size)), 0644); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+
+			depMan := NewChartDependencyManager("helmfile", logger)
+			depMan.now = lockFileTime
+			depMan.MaxDownloadSize = tt.max
+
+			_, err = depMan.checkDownloadSize(wd, 0)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			} else if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("unexpected error: expected=%q, got=%v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestHelmState_ResolveDeps_PinSelector(t *testing.T) {
+	fs := testhelper.NewTestFs(map[string]string{
+		"/path/to/helmfile.lock": `dependencies:
+- name: envoy
+  repository: https://kubernetes-charts.storage.googleapis.com
+  version: 1.5.0
+`,
+	})
+	state := injectFs(&HelmState{
+		FilePath: "/path/to/helmfile.yaml",
+		Releases: []ReleaseSpec{
+			{
+				Name:   "prod",
+				Chart:  "stable/envoy",
+				Labels: map[string]string{"tier": "prod"},
+			},
+			{
+				Name:    "canary",
+				Chart:   "stable/envoy",
+				Version: "1.6.0",
+				Labels:  map[string]string{"tier": "canary"},
+			},
+			{
+				Name:    "staging",
+				Chart:   "stable/envoy",
+				Version: ">=1.0 <2.0",
+				Labels:  map[string]string{"tier": "staging"},
+			},
+		},
+		Repositories: []RepositorySpec{
+			{
+				Name: "stable",
+				URL:  "https://kubernetes-charts.storage.googleapis.com",
+			},
+		},
+		DependencyResolution: DependencyResolutionSpec{
+			PinSelector: "tier=prod",
+		},
+		logger: logger,
+	}, fs)
+
+	resolved, err := state.ResolveDeps()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if resolved.Releases[0].Version != "1.5.0" {
+		t.Errorf("unexpected version number: expected=1.5.0, got=%s", resolved.Releases[0].Version)
+	}
+	if resolved.Releases[1].Version != "1.6.0" {
+		t.Errorf("unexpected version number: expected=1.6.0, got=%s", resolved.Releases[1].Version)
+	}
+	if resolved.Releases[2].Version != ">=1.0 <2.0" {
+		t.Errorf("unexpected version number: expected=>=1.0 <2.0, got=%s", resolved.Releases[2].Version)
+	}
+}
+
+func TestGetUnresolvedDependencies_DefaultRepositories(t *testing.T) {
+	tests := []struct {
+		name     string
+		spec     DependencyResolutionSpec
+		repos    []RepositorySpec
+		expected map[string]string
+	}{
+		{
+			name:     "disabled",
+			expected: map[string]string{},
+		},
+		{
+			name: "enabled",
+			spec: DependencyResolutionSpec{UseDefaultRepositories: true},
+			expected: map[string]string{
+				"envoy": "https://kubernetes-charts.storage.googleapis.com",
+				"redis": "https://charts.bitnami.com/bitnami",
+			},
+		},
+		{
+			name: "overridden by spec",
+			spec: DependencyResolutionSpec{
+				UseDefaultRepositories: true,
+				DefaultRepositories:    map[string]string{"bitnami": "https://mirror.example.com/bitnami"},
+			},
+			expected: map[string]string{
+				"envoy": "https://kubernetes-charts.storage.googleapis.com",
+				"redis": "https://mirror.example.com/bitnami",
+			},
+		},
+		{
+			name:  "overridden by repositories",
+			spec:  DependencyResolutionSpec{UseDefaultRepositories: true},
+			repos: []RepositorySpec{{Name: "stable", URL: "https://mirror.example.com/stable"}},
+			expected: map[string]string{
+				"envoy": "https://mirror.example.com/stable",
+				"redis": "https://charts.bitnami.com/bitnami",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := &HelmState{
+				FilePath: "/path/to/helmfile.yaml",
+				Releases: []ReleaseSpec{
+					{Chart: "stable/envoy"},
+					{Chart: "bitnami/redis"},
+				},
+				Repositories:         tt.repos,
+				DependencyResolution: tt.spec,
+				logger:               logger,
+			}
+
+			_, unresolved, err := getUnresolvedDependenciess(state)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			actual := map[string]string{}
+			for chart, deps := range unresolved.deps {
+				actual[chart] = deps[0].Repository
+			}
+			if !reflect.DeepEqual(actual, tt.expected) {
+				t.Errorf("unexpected repositories: expected=%v, got=%v", tt.expected, actual)
+			}
+		})
+	}
+}
+
+type dependencyUpdaterFunc func(chart string) error
+
+func (f dependencyUpdaterFunc) UpdateDeps(chart string) error {
+	return f(chart)
+}
+
+// contextDependencyUpdaterFunc is the dependency updater stopped once the context is done, like helm killed on timeouts
+type contextDependencyUpdaterFunc func(ctx context.Context, chart string) error
+
+func (f contextDependencyUpdaterFunc) UpdateDeps(chart string) error {
+	return f(context.Background(), chart)
+}
+
+func (f contextDependencyUpdaterFunc) UpdateDepsContext(ctx context.Context, chart string) error {
+	return f(ctx, chart)
+}
+
+type helm3DependencyUpdater struct {
+	dependencyUpdaterFunc
+}
+
+func (u helm3DependencyUpdater) IsHelm3() bool {
+	return true
+}
+
+func TestChartDependencyManager_Helm3(t *testing.T) {
+	wd, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(wd)
+
+	files := map[string]string{
+		"helmfile.lock": `dependencies:
+- name: envoy
+  repository: https://stable.example.com
+  version: 1.4.0
+digest: sha256:old
+generated: "2019-05-16T15:42:45.50486+09:00"
+`,
+	}
+
+	depMan := NewChartDependencyManager("helmfile", logger)
+	depMan.now = lockFileTime
+	depMan.readFile = func(filename string) ([]byte, error) {
+		if content, ok := files[filename]; ok {
+			return []byte(content), nil
+		}
+		return ioutil.ReadFile(filename)
+	}
+	depMan.writeFile = func(filename string, data []byte, perm os.FileMode) error {
+		if filepath.Dir(filename) == wd {
+			return ioutil.WriteFile(filename, data, perm)
+		}
+		files[filename] = string(data)
+		return nil
+	}
+
+	var chartGivenToHelm, lockFileGivenToHelm string
+	shell := helm3DependencyUpdater{dependencyUpdaterFunc(func(chart string) error {
+		if _, err := os.Stat(filepath.Join(chart, "requirements.yaml")); !os.IsNotExist(err) {
+			return fmt.Errorf("unexpected requirements.yaml for helm 3: %v", err)
+		}
+
+		content, err := ioutil.ReadFile(filepath.Join(chart, "Chart.yaml"))
+		if err != nil {
+			return err
+		}
+		chartGivenToHelm = string(content)
+
+		content, err = ioutil.ReadFile(filepath.Join(chart, "Chart.lock"))
+		if err != nil {
+			return err
+		}
+		lockFileGivenToHelm = string(content)
+
+		return ioutil.WriteFile(filepath.Join(chart, "Chart.lock"), []byte(`dependencies:
+- name: envoy
+  repository: https://stable.example.com
+  version: 1.5.0
+digest: sha256:new
+generated: "2019-06-01T00:00:00Z"
+`), 0644)
+	})}
+
+	depMan.Helm3 = isHelm3(shell)
+	if !depMan.Helm3 {
+		t.Fatalf("expected helm 3 to be detected")
+	}
+
+	unresolved := &UnresolvedDependencies{deps: map[string][]unresolvedChartDependency{}}
+	unresolved.Add("envoy", "https://stable.example.com", "")
+
+	if _, err := depMan.Update(shell, wd, unresolved); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expectedChart := `apiVersion: v2
+name: helmfile
+version: 1.0.0
+dependencies:
+- name: envoy
+  repository: https://stable.example.com
+  version: '*'
+`
+	if chartGivenToHelm != expectedChart {
+		t.Errorf("unexpected Chart.yaml given to helm:\nexpected=%s\ngot=%s", expectedChart, chartGivenToHelm)
+	}
+
+	if !strings.Contains(lockFileGivenToHelm, "version: 1.4.0") {
+		t.Errorf("expected the lock file to be given to helm as Chart.lock, but got:\n%s", lockFileGivenToHelm)
+	}
+
+	expected := `dependencies:
+- name: envoy
+  repository: https://stable.example.com
+  version: 1.5.0
+digest: sha256:new
+generated: "2019-06-01T00:00:00Z"
+metadata:
+  generatedAt: "2019-06-01T00:00:00Z"
+  helmfileVersion: unknown
+`
+	if files["helmfile.lock"] != expected {
+		t.Errorf("unexpected lock file:\nexpected=%s\ngot=%s", expected, files["helmfile.lock"])
+	}
+}
+
+func TestChartDependencyManager_LockFilePath(t *testing.T) {
+	tests := []struct {
+		lockFilePath string
+		split        bool
+		expected     string
+	}{
+		{lockFilePath: "", expected: "helmfile.lock"},
+		{lockFilePath: "locks", expected: "locks/helmfile.lock"},
+		{lockFilePath: "locks/", expected: "locks/helmfile.lock"},
+		{lockFilePath: "newlocks/", expected: "newlocks/helmfile.lock"},
+		{lockFilePath: "newlocks", expected: "newlocks"},
+		{lockFilePath: "locks/prod.yaml", expected: "locks/prod.yaml"},
+		{lockFilePath: "/path/to/shared.lock", expected: "/path/to/shared.lock"},
+		{lockFilePath: "", split: true, expected: "helmfile.stable.lock"},
+		{lockFilePath: "locks", split: true, expected: "locks/helmfile.stable.lock"},
+		{lockFilePath: "/path/to/shared.lock", split: true, expected: "/path/to/shared.stable.lock"},
+	}
+
+	for _, tt := range tests {
+		depMan := NewChartDependencyManager("helmfile", logger)
+		depMan.LockFilePath = tt.lockFilePath
+		// Only `locks` exists as a directory
+		depMan.dirExists = func(dir string) bool {
+			return dir == "locks"
+		}
+
+		var actual string
+		if tt.split {
+			actual = depMan.splitLockFileName("stable")
+		} else {
+			actual = depMan.lockFileName()
+		}
+		if actual != tt.expected {
+			t.Errorf("unexpected lock file name for %q: expected=%s, got=%s", tt.lockFilePath, tt.expected, actual)
+		}
+	}
+
+	depMan := NewChartDependencyManager("helmfile", logger)
+	depMan.LockFilePath = "locks/"
+	var created, written string
+	depMan.mkdirAll = func(dir string, perm os.FileMode) error {
+		created = dir
+		return nil
+	}
+	depMan.writeFile = func(filename string, data []byte, perm os.FileMode) error {
+		written = filename
+		return nil
+	}
+	if err := depMan.writeLockFile(&ChartLockedRequirements{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if created != "locks" || written != "locks/helmfile.lock" {
+		t.Errorf("unexpected lock file written: expected=locks/helmfile.lock in locks, got=%s in %s", written, created)
+	}
+}
+
+func TestChartDependencyManager_SplitLockFile(t *testing.T) {
+	wd, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(wd)
+
+	files := map[string]string{
+		"helmfile.stable.lock": `dependencies:
+- name: envoy
+  repository: https://stable.example.com
+  version: 1.4.0
+digest: sha256:old
+generated: "2019-05-16T15:42:45.50486+09:00"
+`,
+		"helmfile.untouched.lock": `dependencies:
+- name: foo
+  repository: https://untouched.example.com
+  version: 0.1.0
+`,
+	}
+
+	depMan := NewChartDependencyManager("helmfile", logger)
+	depMan.now = lockFileTime
+	depMan.SplitLockFile = true
+	depMan.repoNames = map[string]string{
+		"https://stable.example.com":    "stable",
+		"https://bitnami.example.com":   "bitnami",
+		"https://untouched.example.com": "untouched",
+	}
+	depMan.readFile = func(filename string) ([]byte, error) {
+		if content, ok := files[filename]; ok {
+			return []byte(content), nil
+		}
+		return ioutil.ReadFile(filename)
+	}
+	depMan.writeFile = func(filename string, data []byte, perm os.FileMode) error {
+		if filepath.Dir(filename) == wd {
+			return ioutil.WriteFile(filename, data, perm)
+		}
+		files[filename] = string(data)
+		return nil
+	}
+
+	var lockFileGivenToHelm string
+	shell := dependencyUpdaterFunc(func(chart string) error {
+		content, err := ioutil.ReadFile(filepath.Join(chart, "requirements.lock"))
+		if err != nil {
+			return err
+		}
+		lockFileGivenToHelm = string(content)
+
+		return ioutil.WriteFile(filepath.Join(chart, "requirements.lock"), []byte(`dependencies:
+- name: redis
+  repository: https://bitnami.example.com
+  version: 9.0.0
+- name: envoy
+  repository: https://stable.example.com
+  version: 1.5.0
+digest: sha256:new
+generated: "2019-06-01T00:00:00Z"
+`), 0644)
+	})
+
+	unresolved := &UnresolvedDependencies{deps: map[string][]unresolvedChartDependency{}}
+	unresolved.Add("envoy", "https://stable.example.com", "")
+	unresolved.Add("redis", "https://bitnami.example.com", "")
+
+	if _, err := depMan.Update(shell, wd, unresolved); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !strings.Contains(lockFileGivenToHelm, "version: 1.4.0") {
+		t.Errorf("expected the split lock file to be given to helm, but got:\n%s", lockFileGivenToHelm)
+	}
+
+	expected := map[string]string{
+		"helmfile.stable.lock": `dependencies:
+- name: envoy
+  repository: https://stable.example.com
+  version: 1.5.0
+digest: sha256:new
+generated: "2019-06-01T00:00:00Z"
+metadata:
+  generatedAt: "2019-06-01T00:00:00Z"
+  helmfileVersion: unknown
+`,
+		"helmfile.bitnami.lock": `dependencies:
+- name: redis
+  repository: https://bitnami.example.com
+  version: 9.0.0
+digest: sha256:new
+generated: "2019-06-01T00:00:00Z"
+metadata:
+  generatedAt: "2019-06-01T00:00:00Z"
+  helmfileVersion: unknown
+`,
+		"helmfile.untouched.lock": files["helmfile.untouched.lock"],
+	}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("unexpected lock files:\nexpected=%v\ngot=%v", expected, files)
+	}
+}
+
+func TestNormalizeVersionPrefix(t *testing.T) {
+	tests := []struct {
+		policy   string
+		version  string
+		expected string
+		wantErr  bool
+	}{
+		{policy: "", version: "v1.2.3", expected: "v1.2.3"},
+		{policy: "", version: "1.2.3", expected: "1.2.3"},
+		{policy: "strip", version: "v1.2.3", expected: "1.2.3"},
+		{policy: "strip", version: "1.2.3", expected: "1.2.3"},
+		{policy: "add", version: "1.2.3", expected: "v1.2.3"},
+		{policy: "add", version: "v1.2.3", expected: "v1.2.3"},
+		{policy: "foo", version: "1.2.3", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		actual, err := normalizeVersionPrefix(tt.policy, tt.version)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("normalizeVersionPrefix(%q, %q): expected error, got none", tt.policy, tt.version)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("normalizeVersionPrefix(%q, %q): unexpected error: %v", tt.policy, tt.version, err)
+		}
+		if actual != tt.expected {
+			t.Errorf("normalizeVersionPrefix(%q, %q): expected=%s, got=%s", tt.policy, tt.version, tt.expected, actual)
+		}
+	}
+}
+
+func TestChartDependencyManager_Update_DeterministicUnderConcurrency(t *testing.T) {
+	locked := []string{
+		"- name: mysql\n  repository: https://stable.example.com\n  version: 1.0.0\n",
+		"- name: envoy\n  repository: https://stable.example.com\n  version: 1.5.0\n",
+		"- name: envoy\n  repository: https://stable.example.com\n  version: 1.4.0\n",
+		"- name: envoy\n  repository: https://incubator.example.com\n  version: 0.1.0\n",
+	}
+
+	const n = 50
+
+	var mu sync.Mutex
+	results := map[string]int{}
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			wd, err := ioutil.TempDir("", "")
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+			defer os.RemoveAll(wd)
+
+			var written string
+			depMan := NewChartDependencyManager("helmfile", logger)
+			depMan.now = lockFileTime
+			depMan.writeFile = func(filename string, data []byte, perm os.FileMode) error {
+				if filename == depMan.lockFileName() {
+					written = string(data)
+					return nil
+				}
+				return ioutil.WriteFile(filename, data, perm)
+			}
+			depMan.readFile = func(filename string) ([]byte, error) {
+				if filename == depMan.lockFileName() {
+					return []byte(written), nil
+				}
+				return ioutil.ReadFile(filename)
+			}
+
+			// Simulate helm and concurrent resolutions producing dependencies in arbitrary order
+			shell := dependencyUpdaterFunc(func(chart string) error {
+				content := "dependencies:\n"
+				for j := range locked {
+					content += locked[(i+j)%len(locked)]
+				}
+				return ioutil.WriteFile(filepath.Join(chart, "requirements.lock"), []byte(content), 0644)
+			})
+
+			unresolved := &UnresolvedDependencies{deps: map[string][]unresolvedChartDependency{}}
+			unresolved.Add("envoy", "https://stable.example.com", "")
+			unresolved.Add("mysql", "https://stable.example.com", "")
+
+			if _, err := depMan.Update(shell, wd, unresolved); err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+
+			mu.Lock()
+			results[written]++
+			mu.Unlock()
+		}(i)
+	}
+	wg.Wait()
+
+	if len(results) != 1 {
+		t.Fatalf("expected the lock file to be identical across %d concurrent resolutions, but got %d variants: %v", n, len(results), results)
+	}
+
+	expected := "dependencies:\n" + locked[3] + locked[2] + locked[1] + locked[0] + "digest: \"\"\ngenerated: \"\"\nmetadata:\n  generatedAt: \"2019-06-01T00:00:00Z\"\n  helmfileVersion: unknown\n"
+	if _, ok := results[expected]; !ok {
+		t.Errorf("unexpected lock file: expected=%s, got=%v", expected, results)
+	}
+}
+
+func TestChartDependencyManager_UpdateFromChartsDir(t *testing.T) {
+	chartsDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(chartsDir)
+
+	for _, name := range []string{"envoy-1.4.0.tgz", "envoy-1.5.0.tgz", "envoy-2.0.0.tgz", "cert-manager-v0.9.1.tgz"} {
+		if err := ioutil.WriteFile(filepath.Join(chartsDir, name), []byte{}, 0644); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name        string
+		constraints map[string]string
+		expected    string
+		wantErr     string
+	}{
+		{
+			name:        "satisfied",
+			constraints: map[string]string{"envoy": "~1.4", "cert-manager": ""},
+			expected: `dependencies:
+- name: cert-manager
+  repository: https://charts.example.com
+  version: v0.9.1
+  digest: sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855
+- name: envoy
+  repository: https://charts.example.com
+  version: 1.4.0
+  digest: sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855
+digest: ""
+generated: ""
+metadata:
+  generatedAt: "2019-06-01T00:00:00Z"
+  helmfileVersion: unknown
+`,
+		},
+		{
+			name:        "unsatisfied",
+			constraints: map[string]string{"envoy": ">= 3.0.0"},
+			wantErr:     `no chart tarball found for envoy satisfying ">= 3.0.0" in ` + chartsDir + `: available versions are [2.0.0, 1.5.0, 1.4.0]`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var written string
+			depMan := NewChartDependencyManager("helmfile", logger)
+			depMan.now = lockFileTime
+			depMan.ChartsDir = chartsDir
+			depMan.writeFile = func(filename string, data []byte, perm os.FileMode) error {
+				written = string(data)
+				return nil
+			}
+			depMan.readFile = func(filename string) ([]byte, error) {
+				return []byte(written), nil
+			}
+
+			unresolved := &UnresolvedDependencies{deps: map[string][]unresolvedChartDependency{}}
+			for chart, constraint := range tt.constraints {
+				unresolved.Add(chart, "https://charts.example.com", constraint)
+			}
+
+			_, err := depMan.Update(nil, "", unresolved)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("unexpected error: expected=%q, got=%v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if written != tt.expected {
+				t.Errorf("unexpected lock file:\nexpected=%s\ngot=%s", tt.expected, written)
+			}
+		})
+	}
+}
+
+func TestHelmState_ResolveDeps_ResolvedLabels(t *testing.T) {
+	fs := testhelper.NewTestFs(map[string]string{
+		"/path/to/helmfile.lock": `dependencies:
+- name: envoy
+  repository: https://kubernetes-charts.storage.googleapis.com
+  version: 1.5.0
+  digest: sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855
+digest: sha256:8194b597c85bb3d1fee8476d4a486e952681d5c65f185ad5809f2118bc4079b5
+`,
+	})
+	state := injectFs(&HelmState{
+		FilePath: "/path/to/helmfile.yaml",
+		Releases: []ReleaseSpec{
+			{
+				Name:   "envoy",
+				Chart:  "stable/envoy",
+				Labels: map[string]string{"tier": "prod"},
+			},
+		},
+		Repositories: []RepositorySpec{
+			{
+				Name: "stable",
+				URL:  "https://kubernetes-charts.storage.googleapis.com",
+			},
+		},
+		DependencyResolution: DependencyResolutionSpec{
+			ResolvedLabels: map[string]string{
+				"chartVersion":    "version",
+				"chartDigest":     "digest",
+				"chartRepository": "repository",
+			},
+		},
+		logger: logger,
+	}, fs)
+
+	resolved, err := state.ResolveDeps()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[string]string{
+		"tier":            "prod",
+		"chartVersion":    "1.5.0",
+		"chartDigest":     "sha256-e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b",
+		"chartRepository": "kubernetes-charts.storage.googleapis.com",
+	}
+	if !reflect.DeepEqual(resolved.Releases[0].Labels, expected) {
+		t.Errorf("unexpected labels: expected=%v, got=%v", expected, resolved.Releases[0].Labels)
+	}
+}
+
+func TestHelmState_ResolveDeps_WarnOnNoRemoteCharts(t *testing.T) {
+	tests := []struct {
+		name     string
+		warn     bool
+		releases []ReleaseSpec
+		expected string
+	}{
+		{
+			name:     "disabled",
+			releases: []ReleaseSpec{{Chart: "charts/myapp"}},
+		},
+		{
+			name:     "enabled with local charts only",
+			warn:     true,
+			releases: []ReleaseSpec{{Chart: "charts/myapp"}},
+			expected: "no remote charts to resolve in /path/to/helmfile.yaml: 1 repositories are declared but no release references a chart in them\n",
+		},
+		{
+			name:     "enabled with remote charts",
+			warn:     true,
+			releases: []ReleaseSpec{{Chart: "stable/envoy"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			state := &HelmState{
+				FilePath: "/path/to/helmfile.yaml",
+				Releases: tt.releases,
+				Repositories: []RepositorySpec{
+					{
+						Name: "stable",
+						URL:  "https://kubernetes-charts.storage.googleapis.com",
+					},
+				},
+				DependencyResolution: DependencyResolutionSpec{
+					WarnOnNoRemoteCharts: tt.warn,
+				},
+				readFile: func(string) ([]byte, error) {
+					return nil, os.ErrNotExist
+				},
+				logger: helmexec.NewLogger(&buf, "warn"),
+			}
+
+			if _, err := state.ResolveDeps(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if buf.String() != tt.expected {
+				t.Errorf("unexpected log: expected=%q, got=%q", tt.expected, buf.String())
+			}
+		})
+	}
+}
+
+func TestChartDependencyManager_UpdateDepsRetries(t *testing.T) {
+	tests := []struct {
+		name          string
+		retries       int
+		isRetryable   func(error) bool
+		failures      []error
+		expectedCalls int
+		wantErr       bool
+	}{
+		{
+			name:          "no retries",
+			failures:      []error{errors.New("dial tcp: i/o timeout")},
+			expectedCalls: 1,
+			wantErr:       true,
+		},
+		{
+			name:          "transient failure retried",
+			retries:       2,
+			failures:      []error{errors.New("dial tcp: i/o timeout"), errors.New("503 Service Unavailable")},
+			expectedCalls: 3,
+		},
+		{
+			name:          "fatal failure not retried",
+			retries:       2,
+			failures:      []error{errors.New("chart not found")},
+			expectedCalls: 1,
+			wantErr:       true,
+		},
+		{
+			name:    "custom predicate",
+			retries: 2,
+			isRetryable: func(err error) bool {
+				return strings.Contains(err.Error(), "not found")
+			},
+			failures:      []error{errors.New("chart not found")},
+			expectedCalls: 2,
+		},
+		{
+			name:          "retries exhausted",
+			retries:       1,
+			failures:      []error{errors.New("connection refused"), errors.New("connection refused")},
+			expectedCalls: 2,
+			wantErr:       true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			depMan := NewChartDependencyManager("helmfile", logger)
+			depMan.now = lockFileTime
+			depMan.Retries = tt.retries
+			if tt.isRetryable != nil {
+				depMan.IsRetryable = tt.isRetryable
+			}
+			depMan.sleep = func(time.Duration) {}
+
+			calls := 0
+			shell := dependencyUpdaterFunc(func(chart string) error {
+				calls++
+				if calls <= len(tt.failures) {
+					return tt.failures[calls-1]
+				}
+				return nil
+			})
+
+			err := depMan.updateDeps(context.Background(), shell, "/tmp/chart")
+			if tt.wantErr && err == nil {
+				t.Errorf("expected error, got none")
+			} else if !tt.wantErr && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if calls != tt.expectedCalls {
+				t.Errorf("unexpected number of calls: expected=%d, got=%d", tt.expectedCalls, calls)
+			}
+		})
+	}
+}
+
+func TestGetUnresolvedDependencies_StrictRepositoryMatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		strict  bool
+		chart   string
+		wantErr string
+	}{
+		{
+			name:  "undeclared repository is skipped by default",
+			chart: "stabel/envoy",
+		},
+		{
+			name:    "undeclared repository fails in strict mode",
+			strict:  true,
+			chart:   "stabel/envoy",
+			wantErr: `release "myapp" references the chart "stabel/envoy" but the repository "stabel" isn't declared in /path/to/helmfile.yaml, nor is it a local chart directory`,
+		},
+		{
+			name:   "local chart directory is allowed in strict mode",
+			strict: true,
+			chart:  "charts/myapp",
+		},
+		{
+			name:   "declared repository in strict mode",
+			strict: true,
+			chart:  "stable/envoy",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := testhelper.NewTestFs(map[string]string{
+				"/path/to/charts/myapp/Chart.yaml": "name: myapp\n",
+			})
+			state := injectFs(&HelmState{
+				basePath: "/path/to",
+				FilePath: "/path/to/helmfile.yaml",
+				Releases: []ReleaseSpec{
+					{Name: "myapp", Chart: tt.chart},
+				},
+				Repositories: []RepositorySpec{
+					{
+						Name: "stable",
+						URL:  "https://kubernetes-charts.storage.googleapis.com",
+					},
+				},
+				DependencyResolution: DependencyResolutionSpec{
+					StrictRepositoryMatch: tt.strict,
+				},
+				logger: logger,
+			}, fs)
+
+			_, _, err := getUnresolvedDependenciess(state)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			} else if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("unexpected error:\nexpected=%s\ngot=%v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestHelmState_ResolveDeps_NoPin(t *testing.T) {
+	fs := testhelper.NewTestFs(map[string]string{
+		"/path/to/helmfile.lock": `dependencies:
+- name: envoy
+  repository: https://kubernetes-charts.storage.googleapis.com
+  version: 1.5.0
+- name: myapp
+  repository: https://dev.example.com
+  version: 0.1.0
+`,
+	})
+	state := injectFs(&HelmState{
+		FilePath: "/path/to/helmfile.yaml",
+		Releases: []ReleaseSpec{
+			{Chart: "stable/envoy"},
+			{Chart: "dev/myapp", Version: ">0.0.0-0"},
+		},
+		Repositories: []RepositorySpec{
+			{
+				Name: "stable",
+				URL:  "https://kubernetes-charts.storage.googleapis.com",
+			},
+			{
+				Name:  "dev",
+				URL:   "https://dev.example.com",
+				NoPin: true,
+			},
+		},
+		logger: logger,
+	}, fs)
+
+	_, unresolved, err := getUnresolvedDependenciess(state)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := unresolved.deps["myapp"]; ok {
+		t.Errorf("unexpected unresolved dependency for the noPin repository: %v", unresolved.deps)
+	}
+
+	resolved, err := state.ResolveDeps()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if resolved.Releases[0].Version != "1.5.0" {
+		t.Errorf("unexpected version number: expected=1.5.0, got=%s", resolved.Releases[0].Version)
+	}
+	if resolved.Releases[1].Version != ">0.0.0-0" {
+		t.Errorf("unexpected version number: expected=>0.0.0-0, got=%s", resolved.Releases[1].Version)
+	}
+}
+
+func TestHelmState_ResolveDeps_SkipResolve(t *testing.T) {
+	fs := testhelper.NewTestFs(map[string]string{
+		"/path/to/helmfile.lock": `dependencies:
+- name: envoy
+  repository: https://kubernetes-charts.storage.googleapis.com
+  version: 1.5.0
+`,
+	})
+	state := injectFs(&HelmState{
+		FilePath: "/path/to/helmfile.yaml",
+		Releases: []ReleaseSpec{
+			{Chart: "stable/envoy", Version: "~1.5"},
+		},
+		Repositories: []RepositorySpec{
+			{
+				Name: "stable",
+				URL:  "https://kubernetes-charts.storage.googleapis.com",
+			},
+		},
+		DependencyResolution: DependencyResolutionSpec{SkipResolve: true},
+		logger:               logger,
+	}, fs)
+
+	resolved, err := state.ResolveDeps()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resolved.Releases[0].Version != "~1.5" {
+		t.Errorf("unexpected version number: expected=~1.5, got=%s", resolved.Releases[0].Version)
+	}
+
+	shell := dependencyUpdaterFunc(func(chart string) error {
+		t.Errorf("unexpected helm run for %s", chart)
+		return nil
+	})
+	tempDir := func(dir, prefix string) (string, error) {
+		t.Errorf("unexpected temp dir creation")
+		return "", nil
+	}
+	if _, err := state.updateDependenciesInTempDir(shell, tempDir); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestHelmState_ResolveDeps_ReleaseSkipDeps(t *testing.T) {
+	fs := testhelper.NewTestFs(map[string]string{
+		"/path/to/helmfile.lock": `dependencies:
+- name: mysql
+  repository: https://kubernetes-charts.storage.googleapis.com
+  version: 1.0.0
+`,
+		"/path/to/charts/umbrella/Chart.yaml": "name: umbrella\n",
+	})
+	state := injectFs(&HelmState{
+		basePath: "/path/to",
+		FilePath: "/path/to/helmfile.yaml",
+		Releases: []ReleaseSpec{
+			{Name: "envoy", Chart: "stable/envoy", Version: "~1.5", SkipDeps: true},
+			{Name: "mysql", Chart: "stable/mysql", Version: "~1.0"},
+			{Name: "umbrella", Chart: "./charts/umbrella", SkipDeps: true},
+		},
+		Repositories: []RepositorySpec{
+			{
+				Name: "stable",
+				URL:  "https://kubernetes-charts.storage.googleapis.com",
+			},
+		},
+		logger: logger,
+	}, fs)
+
+	_, unresolved, err := getUnresolvedDependenciess(state)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := unresolved.deps["envoy"]; ok {
+		t.Errorf("unexpected unresolved dependency for the release marked skipDeps: %v", unresolved.deps)
+	}
+
+	resolved, err := state.ResolveDeps()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resolved.Releases[0].Version != "~1.5" {
+		t.Errorf("unexpected version number: expected=~1.5, got=%s", resolved.Releases[0].Version)
+	}
+	if resolved.Releases[1].Version != "1.0.0" {
+		t.Errorf("unexpected version number: expected=1.0.0, got=%s", resolved.Releases[1].Version)
+	}
+
+	helm := &mockHelmExec{}
+	if errs := state.BuildDeps(helm); len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if len(helm.charts) != 0 {
+		t.Errorf("unexpected dependency build for the release marked skipDeps: %v", helm.charts)
+	}
+}
+
+func TestChartDependencyManager_Update_ChartTimeouts(t *testing.T) {
+	tests := []struct {
+		name          string
+		timeout       time.Duration
+		chartTimeouts map[string]time.Duration
+		wantErr       string
+	}{
+		{
+			name:    "global timeout exceeded by the slow chart",
+			timeout: 50 * time.Millisecond,
+			wantErr: "timed out after 50ms updating dependencies: envoy, umbrella",
+		},
+		{
+			name:          "per-chart timeout for the slow chart",
+			timeout:       50 * time.Millisecond,
+			chartTimeouts: map[string]time.Duration{"umbrella": time.Second},
+		},
+		{
+			name:          "per-chart timeout exceeded",
+			timeout:       time.Second,
+			chartTimeouts: map[string]time.Duration{"umbrella": 50 * time.Millisecond},
+			wantErr:       "timed out after 50ms updating dependencies: umbrella",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wd, err := ioutil.TempDir("", "")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer os.RemoveAll(wd)
+
+			depMan := NewChartDependencyManager("helmfile", logger)
+			depMan.now = lockFileTime
+			depMan.Timeout = tt.timeout
+			depMan.ChartTimeouts = tt.chartTimeouts
+			// Failures are retried, except for the ones on timeouts
+			depMan.Retries = 2
+			depMan.IsRetryable = func(error) bool { return true }
+			depMan.sleep = func(time.Duration) {}
+
+			var mu sync.Mutex
+			var written string
+			depMan.writeFile = func(filename string, data []byte, perm os.FileMode) error {
+				if filename == depMan.lockFileName() {
+					mu.Lock()
+					written = string(data)
+					mu.Unlock()
+					return nil
+				}
+				return ioutil.WriteFile(filename, data, perm)
+			}
+			depMan.readFile = func(filename string) ([]byte, error) {
+				if filename == depMan.lockFileName() {
+					mu.Lock()
+					defer mu.Unlock()
+					if written == "" {
+						return nil, os.ErrNotExist
+					}
+					return []byte(written), nil
+				}
+				return ioutil.ReadFile(filename)
+			}
+
+			// Fetching the umbrella chart takes 200ms whereas the others complete immediately
+			var running, runs int
+			shell := contextDependencyUpdaterFunc(func(ctx context.Context, chart string) error {
+				mu.Lock()
+				running++
+				runs++
+				mu.Unlock()
+				defer func() {
+					mu.Lock()
+					running--
+					mu.Unlock()
+				}()
+
+				reqs, err := ioutil.ReadFile(filepath.Join(chart, "requirements.yaml"))
+				if err != nil {
+					return err
+				}
+				content := "dependencies:\n"
+				if strings.Contains(string(reqs), "umbrella") {
+					select {
+					case <-time.After(200 * time.Millisecond):
+					case <-ctx.Done():
+						return ctx.Err()
+					}
+					content += "- name: umbrella\n  repository: https://charts.example.com\n  version: 1.0.0\n"
+				}
+				if strings.Contains(string(reqs), "envoy") {
+					content += "- name: envoy\n  repository: https://charts.example.com\n  version: 1.5.0\n"
+				}
+				return ioutil.WriteFile(filepath.Join(chart, "requirements.lock"), []byte(content), 0644)
+			})
+
+			unresolved := &UnresolvedDependencies{deps: map[string][]unresolvedChartDependency{}}
+			unresolved.Add("envoy", "https://charts.example.com", "")
+			unresolved.Add("umbrella", "https://charts.example.com", "")
+
+			_, err = depMan.Update(shell, wd, unresolved)
+
+			// The update that timed out is stopped and never retried, rather than left running in background
+			mu.Lock()
+			if running != 0 {
+				t.Errorf("unexpected dependency updates still running: %d", running)
+			}
+			mu.Unlock()
+
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("unexpected error: expected=%q, got=%v", tt.wantErr, err)
+				}
+				if runs != 1 {
+					t.Errorf("unexpected number of dependency updates: expected=1, got=%d", runs)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			expected := `dependencies:
+- name: envoy
+  repository: https://charts.example.com
+  version: 1.5.0
+- name: umbrella
+  repository: https://charts.example.com
+  version: 1.0.0
+digest: ""
+generated: ""
+metadata:
+  generatedAt: "2019-06-01T00:00:00Z"
+  helmfileVersion: unknown
+`
+			if written != expected {
+				t.Errorf("unexpected lock file:\nexpected=%s\ngot=%s", expected, written)
+			}
+		})
+	}
+}
+
+func TestChartDependencyManager_Update_RewriteRequirements(t *testing.T) {
+	tests := []struct {
+		name     string
+		rewrite  func([]byte) ([]byte, error)
+		expected string
+		wantErr  string
+	}{
+		{
+			name: "rewritten",
+			rewrite: func(content []byte) ([]byte, error) {
+				return []byte(strings.Replace(string(content), "  version: 1.5.0\n", "  version: 1.5.0\n  alias: proxy\n", 1)), nil
+			},
+			expected: `dependencies:
+- name: envoy
+  repository: https://charts.example.com
+  version: 1.5.0
+  alias: proxy
+`,
+		},
+		{
+			name: "failed",
+			rewrite: func(content []byte) ([]byte, error) {
+				return nil, errors.New("boom")
+			},
+			wantErr: "unable to rewrite requirements.yaml: boom",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wd, err := ioutil.TempDir("", "")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer os.RemoveAll(wd)
+
+			depMan := NewChartDependencyManager("helmfile", logger)
+			depMan.now = lockFileTime
+			depMan.RewriteRequirements = tt.rewrite
+			depMan.writeFile = func(filename string, data []byte, perm os.FileMode) error {
+				if filename == depMan.lockFileName() {
+					return nil
+				}
+				return ioutil.WriteFile(filename, data, perm)
+			}
+			depMan.readFile = func(filename string) ([]byte, error) {
+				if filename == depMan.lockFileName() {
+					return nil, os.ErrNotExist
+				}
+				return ioutil.ReadFile(filename)
+			}
+
+			var consumed string
+			shell := dependencyUpdaterFunc(func(chart string) error {
+				reqs, err := ioutil.ReadFile(filepath.Join(chart, "requirements.yaml"))
+				if err != nil {
+					return err
+				}
+				consumed = string(reqs)
+				return ioutil.WriteFile(filepath.Join(chart, "requirements.lock"), []byte("dependencies: []\n"), 0644)
+			})
+
+			unresolved := &UnresolvedDependencies{deps: map[string][]unresolvedChartDependency{}}
+			unresolved.Add("envoy", "https://charts.example.com", "1.5.0")
+
+			_, err = depMan.Update(shell, wd, unresolved)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("unexpected error: expected=%q, got=%v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if consumed != tt.expected {
+				t.Errorf("unexpected requirements.yaml:\nexpected=%s\ngot=%s", tt.expected, consumed)
+			}
+		})
+	}
+}
+
+func TestHelmState_Offline(t *testing.T) {
+	fs := testhelper.NewTestFs(map[string]string{
+		"/path/to/helmfile.lock": `dependencies:
+- name: envoy
+  repository: https://charts.example.com
+  version: 1.5.0
+`,
+	})
+	newState := func() *HelmState {
+		return injectFs(&HelmState{
+			FilePath: "/path/to/helmfile.yaml",
+			Releases: []ReleaseSpec{
+				{Name: "envoy", Chart: "myrepo/envoy"},
+			},
+			Repositories: []RepositorySpec{
+				{Name: "myrepo", URL: "https://charts.example.com"},
+			},
+			DependencyResolution: DependencyResolutionSpec{
+				Offline:              true,
+				VerifyLockedVersions: true,
+			},
+			logger: logger,
+		}, fs)
+	}
+
+	resolved, err := newState().ResolveDeps()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resolved.Releases[0].Version != "1.5.0" {
+		t.Errorf("unexpected version number: expected=1.5.0, got=%s", resolved.Releases[0].Version)
+	}
+
+	var updated bool
+	shell := dependencyUpdaterFunc(func(chart string) error {
+		updated = true
+		return nil
+	})
+	_, err = newState().updateDependenciesInTempDir(shell, ioutil.TempDir)
+	expected := "unable to resolve 1 deps: unable to update dependencies offline, as running `helm dependency update` requires network access: set dependencyResolution.chartsDir to resolve them against local chart tarballs instead, or dependencyResolution.resolutionCacheDir to reuse the versions resolved online before"
+	if err == nil || err.Error() != expected {
+		t.Errorf("unexpected error:\nexpected=%s\ngot=%v", expected, err)
+	}
+	if updated {
+		t.Errorf("unexpected dependency update while offline")
+	}
+
+	local := newState()
+	local.Releases = []ReleaseSpec{{Name: "local", Chart: "./charts/local"}}
+	errs := local.UpdateDeps(&mockHelmExec{})
+	expected = "unable to update dependencies of the local chart ./charts/local offline, as running `helm dependency update` requires network access"
+	if len(errs) != 1 || errs[0].Error() != expected {
+		t.Errorf("unexpected errors:\nexpected=%s\ngot=%v", expected, errs)
+	}
+}
+
+func TestHelmState_FrozenLockfile(t *testing.T) {
+	lockFile := `dependencies:
+- name: envoy
+  repository: https://charts.example.com
+  version: 1.5.0
+`
+
+	tests := []struct {
+		name     string
+		files    map[string]string
+		version  string
+		expected string
+	}{
+		{
+			name:    "satisfied",
+			files:   map[string]string{"/path/to/helmfile.lock": lockFile},
+			version: "~1.5.0",
+		},
+		{
+			name:     "version constraint changed",
+			files:    map[string]string{"/path/to/helmfile.lock": lockFile},
+			version:  "~1.6.0",
+			expected: "the frozen lock file doesn't satisfy the dependencies: no resolved dependency found for \"envoy\"",
+		},
+		{
+			name:     "missing lock file",
+			files:    map[string]string{},
+			version:  "~1.5.0",
+			expected: "the frozen lock file doesn't satisfy the dependencies: lock file helmfile.lock is missing, while the lock file is frozen: run helmfile deps without --frozen-lockfile to create it",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := injectFs(&HelmState{
+				FilePath: "/path/to/helmfile.yaml",
+				Releases: []ReleaseSpec{
+					{Name: "envoy", Chart: "myrepo/envoy", Version: tt.version},
+				},
+				Repositories: []RepositorySpec{
+					{Name: "myrepo", URL: "https://charts.example.com"},
+				},
+				DependencyResolution: DependencyResolutionSpec{
+					FrozenLockfile: true,
+				},
+				logger: logger,
+			}, testhelper.NewTestFs(tt.files))
+			readFile := st.readFile
+			st.readFile = func(filename string) ([]byte, error) {
+				if _, ok := tt.files[filepath.Join("/path/to", filename)]; !ok {
+					return nil, &os.PathError{Op: "open", Path: filename, Err: os.ErrNotExist}
+				}
+				return readFile(filename)
+			}
+
+			var updated bool
+			shell := dependencyUpdaterFunc(func(chart string) error {
+				updated = true
+				return nil
+			})
+			_, err := st.updateDependenciesInTempDir(shell, ioutil.TempDir)
+			if tt.expected == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			} else if err == nil || err.Error() != tt.expected {
+				t.Errorf("unexpected error:\nexpected=%s\ngot=%v", tt.expected, err)
+			}
+			if updated {
+				t.Errorf("unexpected dependency update with the frozen lock file")
+			}
+		})
+	}
+
+	local := &HelmState{
+		Releases: []ReleaseSpec{{Name: "local", Chart: "./charts/local"}},
+		DependencyResolution: DependencyResolutionSpec{
+			FrozenLockfile: true,
+		},
+		basePath: "/src",
+		logger:   logger,
+		fileExists: func(path string) (bool, error) {
+			return path == "/src/charts/local/requirements.lock", nil
+		},
+	}
+	helm := &mockHelmExec{}
+	if errs := local.UpdateDeps(helm); len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if !reflect.DeepEqual(helm.charts, []string{"/src/charts/local"}) {
+		t.Errorf("unexpected charts built: expected=%v, got=%v", []string{"/src/charts/local"}, helm.charts)
+	}
+
+	unlocked := &HelmState{
+		Releases: []ReleaseSpec{{Name: "local", Chart: "./charts/local"}},
+		DependencyResolution: DependencyResolutionSpec{
+			FrozenLockfile: true,
+		},
+		basePath: "/src",
+		logger:   logger,
+		fileExists: func(path string) (bool, error) {
+			return false, nil
+		},
+	}
+	helm = &mockHelmExec{}
+	if errs := unlocked.UpdateDeps(helm); len(errs) != 1 {
+		t.Fatalf("unexpected errors: expected=1 error, got=%v", errs)
+	}
+	if len(helm.charts) > 0 {
+		t.Errorf("unexpected charts built: expected=none, got=%v", helm.charts)
+	}
+}
+
+func TestHelmState_ResolveDeps_SameChartFromMultipleRepositories(t *testing.T) {
+	fs := testhelper.NewTestFs(map[string]string{
+		"/path/to/helmfile.lock": `dependencies:
+- name: foo
+  repository: https://incubator.example.com
+  version: 0.2.0
+- name: foo
+  repository: https://stable.example.com
+  version: 1.5.0
+`,
+	})
+	state := injectFs(&HelmState{
+		FilePath: "/path/to/helmfile.yaml",
+		Releases: []ReleaseSpec{
+			{Name: "foo-stable", Chart: "stable/foo"},
+			{Name: "foo-incubator", Chart: "incubator/foo"},
+		},
+		Repositories: []RepositorySpec{
+			{Name: "stable", URL: "https://stable.example.com"},
+			{Name: "incubator", URL: "https://incubator.example.com"},
+		},
+		logger: logger,
+	}, fs)
+
+	_, unresolved, err := getUnresolvedDependenciess(state)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	aliases := map[string]string{}
+	for _, d := range unresolved.ToChartRequirements().UnresolvedDependencies {
+		aliases[d.Repository] = d.Alias
+	}
+	expectedAliases := map[string]string{
+		"https://stable.example.com":    "stable-foo",
+		"https://incubator.example.com": "incubator-foo",
+	}
+	if !reflect.DeepEqual(aliases, expectedAliases) {
+		t.Errorf("unexpected aliases: expected=%v, got=%v", expectedAliases, aliases)
+	}
+
+	resolved, err := state.ResolveDeps()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resolved.Releases[0].Version != "1.5.0" {
+		t.Errorf("unexpected version number of %s: expected=1.5.0, got=%s", resolved.Releases[0].Name, resolved.Releases[0].Version)
+	}
+	if resolved.Releases[1].Version != "0.2.0" {
+		t.Errorf("unexpected version number of %s: expected=0.2.0, got=%s", resolved.Releases[1].Name, resolved.Releases[1].Version)
+	}
+}
+
+func TestHelmState_ResolveDeps_LockFileMetadata(t *testing.T) {
+	fs := testhelper.NewTestFs(map[string]string{
+		"/path/to/helmfile.lock": `dependencies:
+- name: envoy
+  repository: https://kubernetes-charts.storage.googleapis.com
+  version: 1.5.0
+digest: sha256:8194b597c85bb3d1fee8476d4a486e952681d5c65f185ad5809f2118bc4079b5
+generated: "2019-05-16T15:42:45.50486+09:00"
+metadata:
+  generatedAt: "2019-05-16T06:42:45Z"
+  helmfileVersion: v0.80.0
+`,
+	})
+	state := injectFs(&HelmState{
+		FilePath: "/path/to/helmfile.yaml",
+		Releases: []ReleaseSpec{
+			{Name: "envoy", Chart: "stable/envoy"},
+		},
+		Repositories: []RepositorySpec{
+			{Name: "stable", URL: "https://kubernetes-charts.storage.googleapis.com"},
+		},
+		logger: logger,
+	}, fs)
+
+	resolved, err := state.ResolveDeps()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resolved.Releases[0].Version != "1.5.0" {
+		t.Errorf("unexpected version number: expected=1.5.0, got=%s", resolved.Releases[0].Version)
+	}
+}
+
+func TestUnresolvedDependencies_ToChartRequirements(t *testing.T) {
+	unresolved := &UnresolvedDependencies{deps: map[string][]unresolvedChartDependency{}}
+	for _, chart := range []string{"mysql", "envoy", "redis", "nginx", "etcd"} {
+		if err := unresolved.Add(chart, "https://stable.example.com", ""); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := unresolved.Add("envoy", "https://incubator.example.com", "~1.5"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := `dependencies:
+- name: envoy
+  repository: https://incubator.example.com
+  version: ~1.5
+- name: envoy
+  repository: https://stable.example.com
+  version: '*'
+- name: etcd
+  repository: https://stable.example.com
+  version: '*'
+- name: mysql
+  repository: https://stable.example.com
+  version: '*'
+- name: nginx
+  repository: https://stable.example.com
+  version: '*'
+- name: redis
+  repository: https://stable.example.com
+  version: '*'
+`
+	// Maps are iterated in random orders, so marshal the requirements multiple times to see they're stable
+	for i := 0; i < 10; i++ {
+		actual, err := yaml.Marshal(unresolved.ToChartRequirements())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if string(actual) != expected {
+			t.Fatalf("unexpected requirements:\nexpected=%s\ngot=%s", expected, string(actual))
+		}
+	}
+}
+
+func TestChartDependencyManager_WriteLockFileUnchanged(t *testing.T) {
+	files := map[string][]byte{}
+	depMan := NewChartDependencyManager("helmfile", logger)
+	depMan.readFile = func(filename string) ([]byte, error) {
+		content, ok := files[filename]
+		if !ok {
+			return nil, os.ErrNotExist
+		}
+		return content, nil
+	}
+	writes := 0
+	depMan.writeFile = func(filename string, data []byte, perm os.FileMode) error {
+		writes++
+		files[filename] = data
+		return nil
+	}
+
+	locked := func(version string) *ChartLockedRequirements {
+		return &ChartLockedRequirements{
+			ResolvedDependencies: []ResolvedChartDependency{
+				{ChartName: "envoy", Repository: "https://stable.example.com", Version: version},
+			},
+			Digest:    "sha256:abc",
+			Generated: time.Now().String(),
+		}
+	}
+
+	depMan.now = lockFileTime
+	if err := depMan.writeLockFile(locked("1.5.0")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	initial := string(files["helmfile.lock"])
+
+	depMan.now = func() time.Time { return lockFileTime().Add(time.Hour) }
+	if err := depMan.writeLockFile(locked("1.5.0")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if writes != 1 || string(files["helmfile.lock"]) != initial {
+		t.Errorf("unexpected rewrite of the unchanged lock file: writes=%d, content=%s", writes, files["helmfile.lock"])
+	}
+
+	if err := depMan.writeLockFile(locked("1.6.0")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if writes != 2 {
+		t.Errorf("unexpected writes: expected=2, got=%d", writes)
+	}
+}
+
+func TestChartDependencyManager_Update_KeepUnselected(t *testing.T) {
+	tests := []struct {
+		name           string
+		keepUnselected bool
+		expected       string
+	}{
+		{
+			name: "unselected charts are unlocked without selectors",
+			expected: `dependencies:
+- name: envoy
+  repository: https://stable.example.com
+  version: 1.5.0
+digest: sha256:new
+generated: "2019-06-01T00:00:00Z"
+metadata:
+  generatedAt: "2019-06-01T00:00:00Z"
+  helmfileVersion: unknown
+`,
+		},
+		{
+			name:           "unselected charts are kept locked with selectors",
+			keepUnselected: true,
+			expected: `dependencies:
+- name: envoy
+  repository: https://stable.example.com
+  version: 1.5.0
+- name: mysql
+  repository: https://stable.example.com
+  version: 1.0.0
+digest: sha256:new
+generated: "2019-06-01T00:00:00Z"
+metadata:
+  generatedAt: "2019-06-01T00:00:00Z"
+  helmfileVersion: unknown
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wd, err := ioutil.TempDir("", "")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer os.RemoveAll(wd)
+
+			files := map[string]string{
+				"helmfile.lock": `dependencies:
+- name: envoy
+  repository: https://stable.example.com
+  version: 1.4.0
+- name: mysql
+  repository: https://stable.example.com
+  version: 1.0.0
+digest: sha256:old
+generated: "2019-05-16T15:42:45.50486+09:00"
+`,
+			}
+
+			depMan := NewChartDependencyManager("helmfile", logger)
+			depMan.now = lockFileTime
+			depMan.KeepUnselected = tt.keepUnselected
+			depMan.readFile = func(filename string) ([]byte, error) {
+				if content, ok := files[filename]; ok {
+					return []byte(content), nil
+				}
+				return ioutil.ReadFile(filename)
+			}
+			depMan.writeFile = func(filename string, data []byte, perm os.FileMode) error {
+				if filepath.Dir(filename) == wd {
+					return ioutil.WriteFile(filename, data, perm)
+				}
+				files[filename] = string(data)
+				return nil
+			}
+
+			shell := dependencyUpdaterFunc(func(chart string) error {
+				return ioutil.WriteFile(filepath.Join(chart, "requirements.lock"), []byte(`dependencies:
+- name: envoy
+  repository: https://stable.example.com
+  version: 1.5.0
+digest: sha256:new
+generated: "2019-06-01T00:00:00Z"
+`), 0644)
+			})
+
+			unresolved := &UnresolvedDependencies{deps: map[string][]unresolvedChartDependency{}}
+			unresolved.Add("envoy", "https://stable.example.com", "")
+
+			if _, err := depMan.Update(shell, wd, unresolved); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if actual := files["helmfile.lock"]; actual != tt.expected {
+				t.Errorf("unexpected lock file: expected=%s, got=%s", tt.expected, actual)
+			}
+		})
+	}
+}
+
+func TestHelmState_newChartDependencyManager_DuplicateRepositoryURLs(t *testing.T) {
+	state := &HelmState{
+		FilePath: "/path/to/helmfile.yaml",
+		Repositories: []RepositorySpec{
+			{Name: "stable", URL: "https://charts.example.com"},
+			{Name: "mirror", URL: "https://charts.example.com"},
+			{Name: "incubator", URL: "https://incubator.example.com"},
+		},
+		logger: logger,
+	}
+
+	// Repeated, as the order of iterating maps varies between runs
+	for i := 0; i < 10; i++ {
+		depMan := state.newChartDependencyManager("helmfile")
+		expected := map[string]string{
+			"https://charts.example.com":    "mirror",
+			"https://incubator.example.com": "incubator",
+		}
+		if !reflect.DeepEqual(depMan.repoNames, expected) {
+			t.Fatalf("unexpected repository names: expected=%v, got=%v", expected, depMan.repoNames)
+		}
+	}
+}
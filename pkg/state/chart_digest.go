@@ -0,0 +1,175 @@
+package state
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/roboll/helmfile/pkg/helmexec"
+)
+
+// chartDigest returns the digest of the chart tarball at path, in the format of `sha256:<hex>`
+func chartDigest(path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return contentDigest(content), nil
+}
+
+// contentDigest returns the digest of the chart tarball content, in the format of `sha256:<hex>`
+func contentDigest(content []byte) string {
+	sum := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// chartTarballName returns the file name of the tarball of the chart version, like `envoy-1.5.0.tgz`
+func chartTarballName(chart, version string) string {
+	return fmt.Sprintf("%s-%s.tgz", chart, version)
+}
+
+// recordDigests records the digests of the chart tarballs in dir to the locked dependencies.
+// Dependencies whose tarballs aren't in dir are left without digests.
+func recordDigests(dir string, deps []ResolvedChartDependency) error {
+	for i, d := range deps {
+		digest, err := chartDigest(filepath.Join(dir, chartTarballName(d.ChartName, d.Version)))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		deps[i].Digest = digest
+	}
+	return nil
+}
+
+// VerifyChartDigests verifies that the tarball of each locked chart has the digest recorded in the lock file,
+// so that a chart re-published under the same version is never deployed.
+// Tarballs are read from `dependencyResolution.cacheDir` when cached there. Otherwise they are fetched with the credentials of their repositories,
+// into `dependencyResolution.cacheDir` when set so that the verified tarballs are deployed and aren't fetched again, or into a temporary directory.
+func (st *HelmState) VerifyChartDigests(helm helmexec.ChartFetcher) error {
+	filename, unresolved, err := getUnresolvedDependenciess(st)
+	if err != nil {
+		return err
+	}
+
+	if len(unresolved.deps) == 0 {
+		return nil
+	}
+
+	depMan := st.newChartDependencyManager(filename)
+	depMan.VerifyLockedVersions = false
+
+	resolved, lockfileExists, err := depMan.Resolve(unresolved)
+	if err != nil {
+		return fmt.Errorf("unable to resolve %d deps: %v", len(unresolved.deps), err)
+	}
+	if !lockfileExists {
+		return nil
+	}
+
+	fetchDir := st.DependencyResolution.CacheDir
+	defer func() {
+		if fetchDir != st.DependencyResolution.CacheDir {
+			os.RemoveAll(fetchDir)
+		}
+	}()
+
+	mismatches := []string{}
+	for _, dep := range resolved.sorted() {
+		if dep.Digest == "" {
+			continue
+		}
+
+		tarball := ""
+		if st.DependencyResolution.CacheDir != "" {
+			cached := filepath.Join(st.DependencyResolution.CacheDir, chartTarballName(dep.ChartName, dep.Version))
+			if pathExists(cached) {
+				tarball = cached
+			}
+		}
+
+		if tarball == "" {
+			if st.DependencyResolution.Offline {
+				st.warn(ResolutionWarningDigest, dep.ChartName, "unable to verify the digest of %s %s offline, as it isn't cached in dependencyResolution.cacheDir", dep.ChartName, dep.Version)
+				continue
+			}
+			if fetchDir == "" {
+				fetchDir, err = ioutil.TempDir("", "helmfile-digest")
+				if err != nil {
+					return fmt.Errorf("unable to create dir: %v", err)
+				}
+			}
+			chart, flags, err := depMan.fetchArgs(dep)
+			if err != nil {
+				return err
+			}
+			tarball = filepath.Join(fetchDir, chartTarballName(dep.ChartName, dep.Version))
+			if isChartURL(dep.Repository) {
+				tarball = filepath.Join(fetchDir, path.Base(dep.Repository))
+			}
+			if err := helm.Fetch(chart, append(flags, "--destination", fetchDir)...); err != nil {
+				return fmt.Errorf("unable to fetch %s %s to verify its digest: %v", dep.ChartName, dep.Version, err)
+			}
+		}
+
+		digest, err := chartDigest(tarball)
+		if err != nil {
+			return fmt.Errorf("unable to verify the digest of %s %s: %v", dep.ChartName, dep.Version, err)
+		}
+		if digest != dep.Digest {
+			mismatches = append(mismatches, fmt.Sprintf("%s %s from %s: locked %s, fetched %s", dep.ChartName, dep.Version, dep.Repository, dep.Digest, digest))
+		}
+	}
+
+	if len(mismatches) > 0 {
+		return fmt.Errorf("%d chart(s) don't match the digests in the lock file, which implies they were re-published under the same versions: %s", len(mismatches), strings.Join(mismatches, "; "))
+	}
+
+	return nil
+}
+
+// fetchArgs returns the chart and the flags to `helm fetch` the locked dependency with.
+// Charts in chart repositories and at tarball URLs are fetched with the credentials of their repositories,
+// as they may not be added to helm under the same names.
+func (m *chartDependencyManager) fetchArgs(dep ResolvedChartDependency) (string, []string, error) {
+	if isOCIRepository(dep.Repository) {
+		return dep.Repository + "/" + dep.ChartName, []string{"--version", dep.Version}, nil
+	}
+
+	repo, ok := m.repos[dep.Repository]
+	if !ok {
+		repo = RepositorySpec{URL: dep.Repository}
+	}
+	repo, err := withCredentials(m.credentials, repo)
+	if err != nil {
+		return "", nil, err
+	}
+
+	chart, flags := dep.ChartName, []string{"--repo", dep.Repository, "--version", dep.Version}
+	if isChartURL(dep.Repository) {
+		chart, flags = dep.Repository, []string{}
+	}
+	if repo.Username != "" {
+		flags = append(flags, "--username", repo.Username)
+	}
+	if repo.Password != "" {
+		flags = append(flags, "--password", repo.Password)
+	}
+	if repo.CertFile != "" {
+		flags = append(flags, "--cert-file", repo.CertFile)
+	}
+	if repo.KeyFile != "" {
+		flags = append(flags, "--key-file", repo.KeyFile)
+	}
+	if repo.CAFile != "" {
+		flags = append(flags, "--ca-file", repo.CAFile)
+	}
+	return chart, flags, nil
+}
@@ -0,0 +1,156 @@
+package state
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/roboll/helmfile/pkg/testhelper"
+)
+
+// emptyChartDigest is the digest of an empty chart tarball
+const emptyChartDigest = "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func TestRecordDigests(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "envoy-1.5.0.tgz"), []byte{}, 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	deps := []ResolvedChartDependency{
+		{ChartName: "envoy", Repository: "https://charts.example.com", Version: "1.5.0"},
+		{ChartName: "mysql", Repository: "https://charts.example.com", Version: "1.0.0"},
+	}
+	if err := recordDigests(dir, deps); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []ResolvedChartDependency{
+		{ChartName: "envoy", Repository: "https://charts.example.com", Version: "1.5.0", Digest: emptyChartDigest},
+		{ChartName: "mysql", Repository: "https://charts.example.com", Version: "1.0.0"},
+	}
+	if !reflect.DeepEqual(deps, expected) {
+		t.Errorf("unexpected dependencies: expected=%v, got=%v", expected, deps)
+	}
+}
+
+func TestHelmState_VerifyChartDigests(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	emptyCacheDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(emptyCacheDir)
+
+	if err := ioutil.WriteFile(filepath.Join(cacheDir, "envoy-1.5.0.tgz"), []byte{}, 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		digest    string
+		published string
+		cacheDir  string
+		username  string
+		fetched   []string
+		wantErr   string
+	}{
+		{
+			name:    "matched",
+			digest:  emptyChartDigest,
+			fetched: []string{"envoy", "--repo", "https://charts.example.com", "--version", "1.5.0"},
+		},
+		{
+			name:     "credentials",
+			digest:   emptyChartDigest,
+			username: "user",
+			fetched:  []string{"envoy", "--repo", "https://charts.example.com", "--version", "1.5.0", "--username", "user"},
+		},
+		{
+			name:     "fetched into the cache",
+			digest:   emptyChartDigest,
+			cacheDir: emptyCacheDir,
+			fetched:  []string{"envoy", "--repo", "https://charts.example.com", "--version", "1.5.0"},
+		},
+		{
+			name:      "re-published",
+			digest:    emptyChartDigest,
+			published: "re-published",
+			fetched:   []string{"envoy", "--repo", "https://charts.example.com", "--version", "1.5.0"},
+			wantErr: "1 chart(s) don't match the digests in the lock file, which implies they were re-published under the same versions: " +
+				"envoy 1.5.0 from https://charts.example.com: locked " + emptyChartDigest + ", fetched sha256:82d73ebde4b0e536144174f39134ada29f4249bf8c9cb48ede06f666b3202184",
+		},
+		{
+			name:     "cached",
+			digest:   emptyChartDigest,
+			cacheDir: cacheDir,
+		},
+		{
+			name: "no digest",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lockFile := `dependencies:
+- name: envoy
+  repository: https://charts.example.com
+  version: 1.5.0
+`
+			if tt.digest != "" {
+				lockFile += "  digest: " + tt.digest + "\n"
+			}
+			state := injectFs(&HelmState{
+				FilePath: "/path/to/helmfile.yaml",
+				Releases: []ReleaseSpec{
+					{Name: "envoy", Chart: "myrepo/envoy"},
+				},
+				Repositories: []RepositorySpec{
+					{Name: "myrepo", URL: "https://charts.example.com", Username: tt.username},
+				},
+				DependencyResolution: DependencyResolutionSpec{
+					CacheDir: tt.cacheDir,
+				},
+				logger: logger,
+			}, testhelper.NewTestFs(map[string]string{
+				"/path/to/helmfile.lock": lockFile,
+			}))
+
+			var fetched []string
+			var dest string
+			helm := chartFetcherFunc(func(chart string, flags ...string) error {
+				fetched = append([]string{chart}, flags[:len(flags)-2]...)
+				dest = flags[len(flags)-1]
+				return ioutil.WriteFile(filepath.Join(dest, fmt.Sprintf("%s-1.5.0.tgz", chart)), []byte(tt.published), 0644)
+			})
+
+			err := state.VerifyChartDigests(helm)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			} else if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("unexpected error:\nexpected=%s\ngot=%v", tt.wantErr, err)
+			}
+			if !reflect.DeepEqual(fetched, tt.fetched) {
+				t.Errorf("unexpected fetch: expected=%v, got=%v", tt.fetched, fetched)
+			}
+			if tt.cacheDir != "" && fetched != nil && dest != tt.cacheDir {
+				t.Errorf("unexpected destination: expected=%s, got=%s", tt.cacheDir, dest)
+			}
+		})
+	}
+}
@@ -0,0 +1,23 @@
+package state
+
+import (
+	"sort"
+)
+
+// ChartReleases returns the reverse index from each chart subject to dependency resolution to the sorted names of the releases referencing it.
+// Use it to see which releases a bump of the chart's version would affect.
+func (st *HelmState) ChartReleases() (map[string][]string, error) {
+	_, unresolved, err := getUnresolvedDependenciess(st)
+	if err != nil {
+		return nil, err
+	}
+
+	index := map[string][]string{}
+	for chart, releases := range unresolved.releases {
+		names := append([]string{}, releases...)
+		sort.Strings(names)
+		index[chart] = names
+	}
+
+	return index, nil
+}
@@ -0,0 +1,37 @@
+package state
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHelmState_ChartReleases(t *testing.T) {
+	state := &HelmState{
+		FilePath: "/path/to/helmfile.yaml",
+		Releases: []ReleaseSpec{
+			{Name: "envoy-prod", Chart: "stable/envoy"},
+			{Name: "app", Chart: "stable/app"},
+			{Name: "envoy-canary", Chart: "stable/envoy", Version: "1.6.0"},
+			{Name: "local", Chart: "./charts/local"},
+			{Name: "unpinned", Chart: "nopin/foo"},
+		},
+		Repositories: []RepositorySpec{
+			{Name: "stable", URL: "https://kubernetes-charts.storage.googleapis.com"},
+			{Name: "nopin", URL: "https://charts.example.com", NoPin: true},
+		},
+		logger: logger,
+	}
+
+	index, err := state.ChartReleases()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[string][]string{
+		"app":   {"app"},
+		"envoy": {"envoy-canary", "envoy-prod"},
+	}
+	if !reflect.DeepEqual(index, expected) {
+		t.Errorf("unexpected index: expected=%v, got=%v", expected, index)
+	}
+}
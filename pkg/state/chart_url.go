@@ -0,0 +1,128 @@
+package state
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/Masterminds/semver"
+)
+
+// isChartURL returns true when the chart is referenced by the URL of its tarball, like `https://example.com/charts/myapp-1.2.3.tgz`
+func isChartURL(chart string) bool {
+	return (strings.HasPrefix(chart, "https://") || strings.HasPrefix(chart, "http://")) && strings.HasSuffix(chart, ".tgz")
+}
+
+// chartURLVersion matches the full semver at the end of the tarball name, excluding partial versions like `2` in `myapp-2-1.0.0.tgz`
+var chartURLVersion = regexp.MustCompile(`^v?[0-9]+\.[0-9]+\.[0-9]+([-+].*)?$`)
+
+// splitChartURL returns the chart name `myapp` and the version `1.2.3` of the tarball URL like `https://example.com/charts/myapp-1.2.3.tgz`.
+// The version is the longest suffix of the file name after a hyphen that is a valid semver, so that both chart names and versions may contain hyphens.
+func splitChartURL(url string) (string, string, bool) {
+	if !isChartURL(url) {
+		return "", "", false
+	}
+	base := strings.TrimSuffix(path.Base(url), ".tgz")
+	for i := 0; i < len(base); i++ {
+		if base[i] != '-' || i == 0 {
+			continue
+		}
+		name, version := base[:i], base[i+1:]
+		if !chartURLVersion.MatchString(version) {
+			continue
+		}
+		if _, err := semver.NewVersion(version); err == nil {
+			return name, version, true
+		}
+	}
+	return "", "", false
+}
+
+// partitionByRepository splits the dependencies into the ones whose repositories match, like charts referenced by tarball URLs, and the rest
+func (d *UnresolvedDependencies) partitionByRepository(match func(string) bool) ([]unresolvedChartDependency, *UnresolvedDependencies) {
+	matched := []unresolvedChartDependency{}
+	rest := &UnresolvedDependencies{deps: map[string][]unresolvedChartDependency{}, releases: d.releases}
+
+	for _, deps := range d.deps {
+		for _, dep := range deps {
+			if match(dep.Repository) {
+				matched = append(matched, dep)
+				continue
+			}
+			rest.add(dep)
+		}
+	}
+
+	return matched, rest
+}
+
+// lockChartURLs locks the charts referenced by tarball URLs, which are pinned by the URLs themselves, without running helm.
+// The digests are taken from the lock file when the same tarballs are already locked there, or computed by downloading the tarballs otherwise,
+// so that a tarball re-published under the same URL is detected by VerifyChartDigests.
+func (m *chartDependencyManager) lockChartURLs(deps []unresolvedChartDependency, lockFileContent []byte) ([]ResolvedChartDependency, error) {
+	current, err := m.lockedRequirements(lockFileContent)
+	if err != nil {
+		return nil, err
+	}
+
+	locked := []ResolvedChartDependency{}
+	seen := map[string]bool{}
+	for _, d := range deps {
+		if seen[d.Repository] {
+			continue
+		}
+		seen[d.Repository] = true
+
+		dep := ResolvedChartDependency{ChartName: d.ChartName, Repository: d.Repository, Version: d.VersionConstraint}
+		for _, l := range current.ResolvedDependencies {
+			if l.ChartName == dep.ChartName && l.Repository == dep.Repository && l.Version == dep.Version {
+				dep.Digest = l.Digest
+				break
+			}
+		}
+
+		if dep.Digest == "" {
+			if m.Offline {
+				return nil, fmt.Errorf("unable to lock %s offline, as computing the digest of the chart requires downloading it", d.Repository)
+			}
+			digest, err := m.fetchChartDigest(d.Repository)
+			if err != nil {
+				return nil, err
+			}
+			dep.Digest = digest
+		}
+
+		locked = append(locked, dep)
+	}
+
+	return locked, nil
+}
+
+// fetchChartDigest downloads the chart tarball at the URL, with the credentials of the repository at the URL if any, and returns its digest
+func (m *chartDependencyManager) fetchChartDigest(url string) (string, error) {
+	repo, ok := m.repos[url]
+	if !ok {
+		repo = RepositorySpec{URL: url}
+	}
+	repo, err := withCredentials(m.credentials, repo)
+	if err != nil {
+		return "", err
+	}
+	content, err := m.indexFetcher.FetchChart(repo)
+	if err != nil {
+		return "", err
+	}
+	return contentDigest(content), nil
+}
+
+// FetchChart downloads the chart tarball at the URL of the repository
+func (f *repoIndexFetcher) FetchChart(repo RepositorySpec) ([]byte, error) {
+	f.logger.Debugf("fetching the chart tarball from %s", repo.URL)
+
+	content, err := f.get(repo.URL, repo)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch the chart tarball %s: %v", repo.URL, err)
+	}
+	return content, nil
+}
@@ -0,0 +1,137 @@
+package state
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/roboll/helmfile/pkg/testhelper"
+	"gopkg.in/yaml.v2"
+)
+
+func TestSplitChartURL(t *testing.T) {
+	tests := []struct {
+		url     string
+		chart   string
+		version string
+		ok      bool
+	}{
+		{url: "https://example.com/charts/myapp-1.2.3.tgz", chart: "myapp", version: "1.2.3", ok: true},
+		{url: "https://example.com/charts/my-app-1.2.3-rc.1.tgz", chart: "my-app", version: "1.2.3-rc.1", ok: true},
+		{url: "http://example.com/my-app-2-1.0.0.tgz", chart: "my-app-2", version: "1.0.0", ok: true},
+		{url: "https://example.com/charts/myapp.tgz"},
+		{url: "https://example.com/charts/myapp-1.2.3"},
+		{url: "stable/envoy"},
+	}
+
+	for _, tt := range tests {
+		chart, version, ok := splitChartURL(tt.url)
+		if chart != tt.chart || version != tt.version || ok != tt.ok {
+			t.Errorf("unexpected split of %s: expected=(%s, %s, %v), got=(%s, %s, %v)", tt.url, tt.chart, tt.version, tt.ok, chart, version, ok)
+		}
+	}
+}
+
+func TestGetUnresolvedDependencies_ChartURL(t *testing.T) {
+	state := injectFs(&HelmState{
+		FilePath: "/path/to/helmfile.yaml",
+		Releases: []ReleaseSpec{
+			{Name: "myapp", Chart: "https://example.com/charts/myapp-1.2.3.tgz"},
+		},
+		logger: logger,
+	}, testhelper.NewTestFs(map[string]string{}))
+
+	_, unresolved, err := getUnresolvedDependenciess(state)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[string][]unresolvedChartDependency{
+		"myapp": {{ChartName: "myapp", Repository: "https://example.com/charts/myapp-1.2.3.tgz", VersionConstraint: "1.2.3"}},
+	}
+	if !reflect.DeepEqual(unresolved.deps, expected) {
+		t.Errorf("unexpected dependencies: expected=%v, got=%v", expected, unresolved.deps)
+	}
+
+	state.Releases[0].Chart = "https://example.com/charts/myapp.tgz"
+	if _, _, err := getUnresolvedDependenciess(state); err == nil {
+		t.Error("expected error for the chart URL without version, got none")
+	}
+}
+
+func TestChartDependencyManager_UpdateChartURL(t *testing.T) {
+	var fetched int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/charts/myapp-1.2.3.tgz" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fetched++
+		w.Write([]byte("tarball"))
+	}))
+	defer server.Close()
+
+	url := server.URL + "/charts/myapp-1.2.3.tgz"
+
+	files := map[string]string{}
+	depMan := NewChartDependencyManager("helmfile", logger)
+	depMan.now = lockFileTime
+	depMan.readFile = func(filename string) ([]byte, error) {
+		if content, ok := files[filename]; ok {
+			return []byte(content), nil
+		}
+		return nil, &os.PathError{Op: "open", Path: filename, Err: os.ErrNotExist}
+	}
+	depMan.writeFile = func(filename string, data []byte, perm os.FileMode) error {
+		files[filename] = string(data)
+		return nil
+	}
+
+	shell := dependencyUpdaterFunc(func(chart string) error {
+		return errors.New("unexpected helm run")
+	})
+
+	unresolved := &UnresolvedDependencies{deps: map[string][]unresolvedChartDependency{}}
+	unresolved.Add("myapp", url, "1.2.3")
+
+	update := func() {
+		t.Helper()
+		resolved, err := depMan.Update(shell, "", unresolved)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		dep, err := resolved.getFromRepository("myapp", url, "1.2.3")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		expected := ResolvedChartDependency{ChartName: "myapp", Repository: url, Version: "1.2.3", Digest: contentDigest([]byte("tarball"))}
+		if *dep != expected {
+			t.Errorf("unexpected locked dependency: expected=%v, got=%v", expected, *dep)
+		}
+	}
+
+	update()
+	if fetched != 1 {
+		t.Errorf("unexpected number of downloads: expected=1, got=%d", fetched)
+	}
+
+	var locked ChartLockedRequirements
+	if err := yaml.Unmarshal([]byte(files["helmfile.lock"]), &locked); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(locked.ResolvedDependencies) != 1 || locked.ResolvedDependencies[0].Digest == "" {
+		t.Errorf("unexpected lock file: %s", files["helmfile.lock"])
+	}
+
+	// The digest already in the lock file is reused, even offline
+	depMan.Offline = true
+	depMan.now = func() time.Time { return lockFileTime().Add(time.Hour) }
+	update()
+	if fetched != 1 {
+		t.Errorf("unexpected download of the locked chart: expected=1, got=%d", fetched)
+	}
+}
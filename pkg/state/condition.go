@@ -0,0 +1,56 @@
+package state
+
+import (
+	"fmt"
+	"strings"
+)
+
+// conditionEnabled returns true when the release has no condition, or the value at the dot-separated path of the condition is true
+func conditionEnabled(r ReleaseSpec, values map[string]interface{}) (bool, error) {
+	if r.Condition == "" {
+		return true, nil
+	}
+
+	var v interface{} = values
+	for _, k := range strings.Split(r.Condition, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return false, fmt.Errorf("condition \"%s\" of release \"%s\": \"%s\" is not a map", r.Condition, r.Name, k)
+		}
+		v, ok = m[k]
+		if !ok {
+			return false, fmt.Errorf("condition \"%s\" of release \"%s\": key \"%s\" is not defined in the values", r.Condition, r.Name, k)
+		}
+	}
+
+	enabled, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("condition \"%s\" of release \"%s\": expected a boolean, got %v of type %T", r.Condition, r.Name, v, v)
+	}
+	return enabled, nil
+}
+
+// FilterReleasesByConditions excludes the releases whose `condition` is false in the state values, like `condition` in chart requirements.
+// Unlike `installed: false`, excluded releases are left as they are in the cluster.
+func (st *HelmState) FilterReleasesByConditions() error {
+	vals, err := st.Values()
+	if err != nil {
+		return err
+	}
+
+	releases := []ReleaseSpec{}
+	for _, r := range st.Releases {
+		enabled, err := conditionEnabled(r, vals)
+		if err != nil {
+			return err
+		}
+		if enabled {
+			releases = append(releases, r)
+		} else {
+			st.logger.Debugf("skipping release \"%s\" as its condition \"%s\" is false", r.Name, r.Condition)
+		}
+	}
+	st.Releases = releases
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package state
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/roboll/helmfile/pkg/environment"
+)
+
+func TestHelmState_FilterReleasesByConditions(t *testing.T) {
+	tests := []struct {
+		name      string
+		condition string
+		want      []string
+		wantErr   string
+	}{
+		{name: "enabled", condition: "monitoring.enabled", want: []string{"app", "prometheus"}},
+		{name: "disabled", condition: "logging.enabled", want: []string{"app"}},
+		{name: "undefined key", condition: "tracing.enabled", wantErr: `condition "tracing.enabled" of release "prometheus": key "tracing" is not defined in the values`},
+		{name: "not a boolean", condition: "monitoring.retention", wantErr: `condition "monitoring.retention" of release "prometheus": expected a boolean, got 15d of type string`},
+		{name: "not a map", condition: "monitoring.retention.days", wantErr: `condition "monitoring.retention.days" of release "prometheus": "days" is not a map`},
+	}
+
+	for i := range tests {
+		tt := tests[i]
+		t.Run(tt.name, func(t *testing.T) {
+			state := &HelmState{
+				logger: logger,
+				Env: environment.Environment{
+					Name: "production",
+					Defaults: map[string]interface{}{
+						"logging":    map[string]interface{}{"enabled": true},
+						"monitoring": map[string]interface{}{"enabled": false},
+					},
+					Values: map[string]interface{}{
+						"logging":    map[string]interface{}{"enabled": false},
+						"monitoring": map[string]interface{}{"enabled": true, "retention": "15d"},
+					},
+				},
+				Releases: []ReleaseSpec{
+					{Name: "app"},
+					{Name: "prometheus", Condition: tt.condition},
+				},
+			}
+
+			err := state.FilterReleasesByConditions()
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("unexpected error: expected=%s, got=%v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			actual := []string{}
+			for _, r := range state.Releases {
+				actual = append(actual, r.Name)
+			}
+			if !reflect.DeepEqual(actual, tt.want) {
+				t.Errorf("unexpected releases: expected=%v, got=%v", tt.want, actual)
+			}
+		})
+	}
+}
@@ -8,10 +8,13 @@ import (
 	"github.com/roboll/helmfile/pkg/environment"
 	"github.com/roboll/helmfile/pkg/helmexec"
 	"github.com/roboll/helmfile/pkg/maputil"
+	"github.com/roboll/helmfile/pkg/remote"
 	"go.uber.org/zap"
 	"gopkg.in/yaml.v2"
 	"io"
 	"os"
+	"sort"
+	"strings"
 )
 
 type StateLoadError struct {
@@ -23,12 +26,27 @@ func (e *StateLoadError) Error() string {
 	return fmt.Sprintf("%s: %v", e.msg, e.Cause)
 }
 
+// UndefinedEnvError is the error returned when the environment selected via `--environment` isn't defined in the helmfile
 type UndefinedEnvError struct {
-	msg string
+	Env string
+	// Known is the sorted names of the environments defined in the helmfile(s), including `default`
+	Known []string
 }
 
 func (e *UndefinedEnvError) Error() string {
-	return e.msg
+	return fmt.Sprintf("environment \"%s\" is not defined. known environments: %s", e.Env, strings.Join(e.Known, ", "))
+}
+
+// knownEnvs returns the sorted names of the environments available to the state, including `default`
+func (st *HelmState) knownEnvs() []string {
+	known := []string{DefaultEnv}
+	for name := range st.Environments {
+		if name != DefaultEnv {
+			known = append(known, name)
+		}
+	}
+	sort.Strings(known)
+	return known
 }
 
 type StateCreator struct {
@@ -40,6 +58,9 @@ type StateCreator struct {
 
 	Strict bool
 
+	// Remote fetches remote values and secrets files referenced from the state
+	Remote *remote.Remote
+
 	LoadFile func(inheritedEnv *environment.Environment, baseDir, file string, evaluateBases bool) (*HelmState, error)
 }
 
@@ -103,6 +124,7 @@ func (c *StateCreator) Parse(content []byte, baseDir, file string) (*HelmState,
 	state.removeFile = os.Remove
 	state.fileExists = c.fileExists
 	state.glob = c.glob
+	state.remote = c.Remote
 
 	return &state, nil
 }
@@ -166,7 +188,7 @@ func (c *StateCreator) loadBases(envValues *environment.Environment, st *HelmSta
 	layers = append(layers, st)
 
 	for i := 1; i < len(layers); i++ {
-		if err := mergo.Merge(layers[0], layers[i], mergo.WithAppendSlice); err != nil {
+		if err := mergo.Merge(layers[0], layers[i], mergo.WithAppendSlice, mergo.WithOverride); err != nil {
 			return nil, err
 		}
 	}
@@ -185,9 +207,16 @@ func (st *HelmState) loadEnvValues(name string, ctxEnv *environment.Environment,
 		}
 
 		if len(envSpec.Secrets) > 0 {
-			helm := helmexec.New(st.logger, "", &helmexec.ShellRunner{
-				Logger: st.logger,
-			})
+			runner := st.runner
+			if runner == nil {
+				runner = &helmexec.ShellRunner{
+					Logger: st.logger,
+				}
+			}
+			helm := helmexec.New(st.logger, "", runner)
+			if err := st.ensurePlugins(helm, "secrets"); err != nil {
+				return nil, err
+			}
 
 			var envSecretFiles []string
 			for _, urlOrPath := range envSpec.Secrets {
@@ -218,6 +247,10 @@ func (st *HelmState) loadEnvValues(name string, ctxEnv *environment.Environment,
 					return nil, err
 				}
 				bytes, err := readFile(decFile)
+				// Never leave the decrypted secrets on disk, as they're needed only for loading environment values
+				if rmErr := st.removeFile(decFile); rmErr != nil {
+					st.logger.Warnf("failed to remove decrypted environment secrets file \"%s\": %v", decFile, rmErr)
+				}
 				if err != nil {
 					return nil, fmt.Errorf("failed to load environment secrets file \"%s\": %v", path, err)
 				}
@@ -238,7 +271,7 @@ func (st *HelmState) loadEnvValues(name string, ctxEnv *environment.Environment,
 			}
 		}
 	} else if ctxEnv == nil && name != DefaultEnv {
-		return nil, &UndefinedEnvError{msg: fmt.Sprintf("environment \"%s\" is not defined", name)}
+		return nil, &UndefinedEnvError{Env: name, Known: st.knownEnvs()}
 	}
 
 	newEnv := &environment.Environment{Name: name, Values: envVals}
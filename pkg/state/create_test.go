@@ -4,8 +4,10 @@ import (
 	"github.com/roboll/helmfile/pkg/testhelper"
 	"go.uber.org/zap"
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 
 	. "gotest.tools/assert"
@@ -99,11 +101,17 @@ bar: {{ readFile "bar.txt" }}
 
 	expectedValues := `env: production`
 
+	releaseValuesFile := "/example/path/to/release.yaml.gotmpl"
+	releaseValuesContent := []byte(`fullnameOverride: {{ .Release.Name }}-{{ .Environment.Name }}`)
+
+	expectedReleaseValues := `fullnameOverride: myrelease-production`
+
 	testFs := testhelper.NewTestFs(map[string]string{
-		fooYamlFile: string(fooYamlContent),
-		barYamlFile: string(barYamlContent),
-		barTextFile: string(barTextContent),
-		valuesFile:  string(valuesContent),
+		fooYamlFile:       string(fooYamlContent),
+		barYamlFile:       string(barYamlContent),
+		barTextFile:       string(barTextContent),
+		valuesFile:        string(valuesContent),
+		releaseValuesFile: string(releaseValuesContent),
 	})
 	testFs.Cwd = "/example/path/to"
 
@@ -126,6 +134,16 @@ bar: {{ readFile "bar.txt" }}
 	if !reflect.DeepEqual(expectedValues, actualValues) {
 		t.Errorf("unexpected values: expected=%v, actual=%v", expectedValues, actualValues)
 	}
+
+	actualReleaseValuesData, err := state.renderReleaseValuesFileToBytes(&state.Releases[0], releaseValuesFile)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	actualReleaseValues := string(actualReleaseValuesData)
+
+	if !reflect.DeepEqual(expectedReleaseValues, actualReleaseValues) {
+		t.Errorf("unexpected release values: expected=%v, actual=%v", expectedReleaseValues, actualReleaseValues)
+	}
 }
 
 func TestReadFromYaml_StrictUnmarshalling(t *testing.T) {
@@ -348,3 +366,87 @@ func TestReadFromYaml_Helmfiles_Selectors(t *testing.T) {
 		Assert(t, cmp.DeepEqual(st.Helmfiles, test.helmfiles), "for path %v", test.path)
 	}
 }
+
+// secretsRunner runs `helm plugin list` with the secrets plugin installed, and `helm secrets dec` by writing the decrypted content
+type secretsRunner struct {
+	decrypted string
+}
+
+func (r *secretsRunner) Execute(cmd string, args []string, env map[string]string) ([]byte, error) {
+	for i, arg := range args {
+		if arg == "dec" && i+1 < len(args) {
+			return nil, ioutil.WriteFile(strings.Replace(args[i+1], ".yaml", ".yaml.dec", 1), []byte(r.decrypted), 0644)
+		}
+	}
+	return []byte("NAME   \tVERSION\tDESCRIPTION\nsecrets\t2.0.2  \tThis plugin provides secrets values encryption for Helm charts secure storing\n"), nil
+}
+
+func TestHelmState_loadEnvValues_RemovesDecryptedSecrets(t *testing.T) {
+	tests := []struct {
+		name      string
+		decrypted string
+		wantErr   bool
+	}{
+		{
+			name:      "loaded",
+			decrypted: "password: secret\n",
+		},
+		{
+			name:      "failed to parse",
+			decrypted: "password: [secret\n",
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer os.RemoveAll(dir)
+
+			if err := ioutil.WriteFile(filepath.Join(dir, "secrets.yaml"), []byte("password: ENC[...]\n"), 0644); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			removed := []string{}
+			state := &HelmState{
+				basePath: dir,
+				FilePath: filepath.Join(dir, "helmfile.yaml"),
+				Environments: map[string]EnvironmentSpec{
+					"production": {Secrets: []string{"secrets.yaml"}},
+				},
+				logger:   logger,
+				readFile: ioutil.ReadFile,
+				glob:     filepath.Glob,
+				runner:   &secretsRunner{decrypted: tt.decrypted},
+				removeFile: func(path string) error {
+					removed = append(removed, path)
+					return os.Remove(path)
+				},
+			}
+
+			env, err := state.loadEnvValues("production", nil, ioutil.ReadFile, filepath.Glob)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got none")
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if env.Values["password"] != "secret" {
+					t.Errorf("unexpected environment values: %v", env.Values)
+				}
+			}
+
+			if len(removed) != 1 {
+				t.Fatalf("unexpected removed files: expected=1 decrypted file, got=%v", removed)
+			}
+			if _, err := os.Stat(removed[0]); !os.IsNotExist(err) {
+				t.Errorf("unexpected decrypted secrets file left behind: %s", removed[0])
+			}
+		})
+	}
+}
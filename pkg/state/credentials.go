@@ -0,0 +1,142 @@
+package state
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// RepositoryCredentials are the secrets used to access a chart repository
+type RepositoryCredentials struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// Token is sent as the bearer token in requests helmfile makes to the repository by itself
+	Token    string `yaml:"token"`
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+}
+
+// CredentialsProvider looks up the credentials for the repository at resolution time.
+// Implement it to fetch credentials from secret stores like Vault or SOPS-encrypted files, so that they don't need to be in the helmfile or the environment.
+// It returns nil when it has no credentials for the repository.
+type CredentialsProvider interface {
+	Credentials(repo RepositorySpec) (*RepositoryCredentials, error)
+}
+
+var nonAlphanumeric = regexp.MustCompile("[^A-Z0-9]+")
+
+// EnvCredentialsProvider reads the credentials for the repository named `my-repo` from the envvars
+// `HELMFILE_REPO_MY_REPO_USERNAME`, `_PASSWORD`, `_TOKEN`, `_CERT_FILE` and `_KEY_FILE`
+type EnvCredentialsProvider struct {
+	getenv func(string) string
+}
+
+func NewEnvCredentialsProvider() *EnvCredentialsProvider {
+	return &EnvCredentialsProvider{getenv: os.Getenv}
+}
+
+func (p *EnvCredentialsProvider) Credentials(repo RepositorySpec) (*RepositoryCredentials, error) {
+	prefix := "HELMFILE_REPO_" + nonAlphanumeric.ReplaceAllString(strings.ToUpper(repo.Name), "_") + "_"
+
+	creds := &RepositoryCredentials{
+		Username: p.getenv(prefix + "USERNAME"),
+		Password: p.getenv(prefix + "PASSWORD"),
+		Token:    p.getenv(prefix + "TOKEN"),
+		CertFile: p.getenv(prefix + "CERT_FILE"),
+		KeyFile:  p.getenv(prefix + "KEY_FILE"),
+	}
+	if *creds == (RepositoryCredentials{}) {
+		return nil, nil
+	}
+	return creds, nil
+}
+
+// FileCredentialsProvider reads the credentials from the YAML file mapping repository names to credentials, like:
+//
+//	myrepo:
+//	  username: foo
+//	  password: bar
+//
+// The file is read on the first lookup.
+type FileCredentialsProvider struct {
+	Path string
+
+	readFile func(string) ([]byte, error)
+	creds    map[string]RepositoryCredentials
+}
+
+func NewFileCredentialsProvider(path string) *FileCredentialsProvider {
+	return &FileCredentialsProvider{Path: path, readFile: ioutil.ReadFile}
+}
+
+func (p *FileCredentialsProvider) Credentials(repo RepositorySpec) (*RepositoryCredentials, error) {
+	if p.creds == nil {
+		content, err := p.readFile(p.Path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read credentials: %v", err)
+		}
+		creds := map[string]RepositoryCredentials{}
+		// Never include the content in the error, as it contains secrets
+		if err := yaml.Unmarshal(content, &creds); err != nil {
+			return nil, fmt.Errorf("unable to parse credentials in %s", p.Path)
+		}
+		p.creds = creds
+	}
+
+	creds, ok := p.creds[repo.Name]
+	if !ok {
+		return nil, nil
+	}
+	return &creds, nil
+}
+
+// credentialsProvider returns the provider configured for the state, or nil if none
+func (st *HelmState) credentialsProvider() CredentialsProvider {
+	switch {
+	case st.DependencyResolution.CredentialsProvider != nil:
+		return st.DependencyResolution.CredentialsProvider
+	case st.DependencyResolution.CredentialsFile != "":
+		return NewFileCredentialsProvider(st.DependencyResolution.CredentialsFile)
+	case st.DependencyResolution.CredentialsFromEnv:
+		return NewEnvCredentialsProvider()
+	}
+	return nil
+}
+
+// withCredentials returns a copy of the repository with the credentials looked up via the provider, if any.
+// Credentials already declared for the repository take precedence.
+func withCredentials(provider CredentialsProvider, repo RepositorySpec) (RepositorySpec, error) {
+	if provider == nil {
+		return repo, nil
+	}
+
+	creds, err := provider.Credentials(repo)
+	if err != nil {
+		return repo, fmt.Errorf("unable to get credentials for the repository %s: %v", repo.Name, err)
+	}
+	if creds == nil {
+		return repo, nil
+	}
+
+	if repo.Username == "" && repo.Password == "" {
+		repo.Username = creds.Username
+		repo.Password = creds.Password
+	}
+	if repo.CertFile == "" && repo.KeyFile == "" {
+		repo.CertFile = creds.CertFile
+		repo.KeyFile = creds.KeyFile
+	}
+	if creds.Token != "" {
+		headers := map[string]string{"Authorization": "Bearer " + creds.Token}
+		for k, v := range repo.Headers {
+			headers[k] = v
+		}
+		repo.Headers = headers
+	}
+
+	return repo, nil
+}
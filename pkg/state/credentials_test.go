@@ -0,0 +1,87 @@
+package state
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestFileCredentialsProvider(t *testing.T) {
+	p := NewFileCredentialsProvider("/path/to/credentials.yaml")
+	var reads int
+	p.readFile = func(filename string) ([]byte, error) {
+		reads++
+		if filename != "/path/to/credentials.yaml" {
+			return nil, errors.New("unexpected file")
+		}
+		return []byte(`myrepo:
+  username: foo
+  password: bar
+tokenrepo:
+  token: secret
+`), nil
+	}
+
+	tests := []struct {
+		repo     RepositorySpec
+		expected RepositorySpec
+	}{
+		{
+			repo:     RepositorySpec{Name: "myrepo", URL: "https://charts.example.com"},
+			expected: RepositorySpec{Name: "myrepo", URL: "https://charts.example.com", Username: "foo", Password: "bar"},
+		},
+		{
+			repo:     RepositorySpec{Name: "myrepo", URL: "https://charts.example.com", Username: "declared", Password: "declared"},
+			expected: RepositorySpec{Name: "myrepo", URL: "https://charts.example.com", Username: "declared", Password: "declared"},
+		},
+		{
+			repo:     RepositorySpec{Name: "tokenrepo", URL: "https://charts.example.com", Headers: map[string]string{"X-Api-Version": "2"}},
+			expected: RepositorySpec{Name: "tokenrepo", URL: "https://charts.example.com", Headers: map[string]string{"Authorization": "Bearer secret", "X-Api-Version": "2"}},
+		},
+		{
+			repo:     RepositorySpec{Name: "unknown", URL: "https://charts.example.com"},
+			expected: RepositorySpec{Name: "unknown", URL: "https://charts.example.com"},
+		},
+	}
+
+	for _, tt := range tests {
+		actual, err := withCredentials(p, tt.repo)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(actual, tt.expected) {
+			t.Errorf("unexpected repository: expected=%v, got=%v", tt.expected, actual)
+		}
+	}
+
+	if reads != 1 {
+		t.Errorf("unexpected number of reads: expected=1, got=%d", reads)
+	}
+}
+
+func TestEnvCredentialsProvider(t *testing.T) {
+	p := &EnvCredentialsProvider{getenv: func(name string) string {
+		return map[string]string{
+			"HELMFILE_REPO_MY_REPO_TOKEN":     "secret",
+			"HELMFILE_REPO_MY_REPO_CERT_FILE": "/path/to/cert",
+			"HELMFILE_REPO_MY_REPO_KEY_FILE":  "/path/to/key",
+		}[name]
+	}}
+
+	creds, err := p.Credentials(RepositorySpec{Name: "my.repo"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := &RepositoryCredentials{Token: "secret", CertFile: "/path/to/cert", KeyFile: "/path/to/key"}
+	if !reflect.DeepEqual(creds, expected) {
+		t.Errorf("unexpected credentials: expected=%v, got=%v", expected, creds)
+	}
+
+	none, err := p.Credentials(RepositorySpec{Name: "other"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if none != nil {
+		t.Errorf("unexpected credentials: expected=nil, got=%v", none)
+	}
+}
@@ -12,4 +12,8 @@ type EnvironmentSpec struct {
 	// Use "Warn", "Info", or "Debug" if you want helmfile to not fail when a values file is missing, while just leaving
 	// a message about the missing file at the log-level.
 	MissingFileHandler *string `yaml:"missingFileHandler"`
+
+	// KubeContext is the kube context the releases are deployed to in the environment, overriding `helmDefaults.kubeContext`.
+	// It can't be used along with `--kube-context`.
+	KubeContext string `yaml:"kubeContext"`
 }
@@ -0,0 +1,51 @@
+package state
+
+import (
+	"fmt"
+
+	"github.com/roboll/helmfile/pkg/helmexec"
+	"gopkg.in/yaml.v2"
+)
+
+// execValuesCommand returns the command and its args of the values entry like `exec: ["./gen-values.sh", "prod"]`.
+// ok is false when the entry is inline values rather than the command.
+func execValuesCommand(entry map[interface{}]interface{}) (command []string, ok bool, err error) {
+	v, ok := entry["exec"]
+	if !ok || len(entry) != 1 {
+		return nil, false, nil
+	}
+
+	items, isList := v.([]interface{})
+	if !isList || len(items) == 0 {
+		return nil, false, fmt.Errorf("exec values entry must be a non-empty list of the command and its args, got %v", v)
+	}
+	for _, item := range items {
+		s, isString := item.(string)
+		if !isString {
+			return nil, false, fmt.Errorf("exec values entry must be a non-empty list of the command and its args, got %v of type %T in %v", item, item, v)
+		}
+		command = append(command, s)
+	}
+
+	return command, true, nil
+}
+
+// execValues runs the command in the directory of the state file and returns its stdout, which must be a YAML document of values
+func (st *HelmState) execValues(command []string) ([]byte, error) {
+	runner := st.runner
+	if runner == nil {
+		runner = helmexec.ShellRunner{Dir: st.basePath, Logger: st.logger}
+	}
+
+	bytes, err := runner.Execute(command[0], command[1:], map[string]string{})
+	if err != nil {
+		return nil, fmt.Errorf("failed running values command %v: %v", command, err)
+	}
+
+	m := map[string]interface{}{}
+	if err := yaml.Unmarshal(bytes, &m); err != nil {
+		return nil, fmt.Errorf("failed parsing the output of values command %v as YAML: %v", command, err)
+	}
+
+	return bytes, nil
+}
@@ -0,0 +1,104 @@
+package state
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type execValuesRunner struct {
+	output   string
+	err      error
+	commands [][]string
+}
+
+func (r *execValuesRunner) Execute(cmd string, args []string, env map[string]string) ([]byte, error) {
+	r.commands = append(r.commands, append([]string{cmd}, args...))
+	return []byte(r.output), r.err
+}
+
+func TestHelmState_generateTemporaryValuesFilesExec(t *testing.T) {
+	tests := []struct {
+		name    string
+		entry   map[interface{}]interface{}
+		output  string
+		err     error
+		want    string
+		wantErr string
+	}{
+		{
+			name:   "exec",
+			entry:  map[interface{}]interface{}{"exec": []interface{}{"./gen-values.sh", "prod"}},
+			output: "replicas: 2\n",
+			want:   "replicas: 2\n",
+		},
+		{
+			name:  "inline values having exec along with other keys",
+			entry: map[interface{}]interface{}{"exec": []interface{}{"a"}, "replicas": 2},
+			want:  "exec:\n- a\nreplicas: 2\n",
+		},
+		{
+			name:    "not a list",
+			entry:   map[interface{}]interface{}{"exec": "./gen-values.sh prod"},
+			wantErr: "exec values entry must be a non-empty list of the command and its args, got ./gen-values.sh prod",
+		},
+		{
+			name:    "failing command",
+			entry:   map[interface{}]interface{}{"exec": []interface{}{"./gen-values.sh"}},
+			err:     errors.New("exit status 1"),
+			wantErr: "failed running values command [./gen-values.sh]: exit status 1",
+		},
+		{
+			name:    "non-yaml output",
+			entry:   map[interface{}]interface{}{"exec": []interface{}{"./gen-values.sh"}},
+			output:  "- a\n",
+			wantErr: "failed parsing the output of values command [./gen-values.sh] as YAML",
+		},
+	}
+
+	for i := range tests {
+		tt := tests[i]
+		t.Run(tt.name, func(t *testing.T) {
+			runner := &execValuesRunner{output: tt.output, err: tt.err}
+			state := &HelmState{
+				basePath: ".",
+				logger:   logger,
+				runner:   runner,
+			}
+
+			files, err := state.generateTemporaryValuesFiles(&ReleaseSpec{Name: "app"}, []interface{}{tt.entry})
+			defer func() {
+				for _, f := range files {
+					os.Remove(f)
+				}
+			}()
+			if tt.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+					t.Fatalf("unexpected error: expected=%s, got=%v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if tt.output != "" {
+				expected := [][]string{{"./gen-values.sh", "prod"}}
+				if !reflect.DeepEqual(runner.commands, expected) {
+					t.Errorf("unexpected commands: expected=%v, got=%v", expected, runner.commands)
+				}
+			}
+
+			bs, err := ioutil.ReadFile(files[0])
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(bs) != tt.want {
+				t.Errorf("unexpected values: expected=%q, got=%q", tt.want, string(bs))
+			}
+		})
+	}
+}
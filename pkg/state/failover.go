@@ -0,0 +1,127 @@
+package state
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// HealthCheckIndex checks a repository's health by fetching its index. This is the default.
+	HealthCheckIndex = "index"
+	// HealthCheckHead checks a repository's health by sending a HEAD request for its index, which is cheaper for huge indexes
+	HealthCheckHead = "head"
+	// HealthCheckNone considers the repository always healthy
+	HealthCheckNone = "none"
+)
+
+// repoHealthChecker checks whether chart repositories are able to serve charts
+type repoHealthChecker struct {
+	client *http.Client
+}
+
+func newRepoHealthChecker() *repoHealthChecker {
+	return &repoHealthChecker{client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// check returns the reason the repository at the url is unhealthy, or nil if it is healthy
+func (c *repoHealthChecker) check(repo RepositorySpec, url string) error {
+	method := "GET"
+	switch repo.HealthCheck {
+	case "", HealthCheckIndex:
+	case HealthCheckHead:
+		method = "HEAD"
+	case HealthCheckNone:
+		return nil
+	default:
+		return fmt.Errorf("invalid healthCheck %q of the repository %s: it must be one of %q, %q and %q", repo.HealthCheck, repo.Name, HealthCheckIndex, HealthCheckHead, HealthCheckNone)
+	}
+
+	req, err := newRepositoryRequest(method, strings.TrimSuffix(url, "/")+"/index.yaml", repo)
+	if err != nil {
+		return err
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+
+	return nil
+}
+
+// repositorySources returns the map from the names of repositories with mirrors to the URLs serving charts for them.
+// The primary URL and then the mirrors are health-checked in order, and the first healthy one is chosen.
+// The result is memoized, so that repositories are added and charts are fetched from the same sources.
+func (st *HelmState) repositorySources() (map[string]string, error) {
+	if st.repoSources != nil {
+		return st.repoSources, nil
+	}
+
+	checker := st.repoHealthChecker
+	if checker == nil {
+		checker = newRepoHealthChecker()
+	}
+
+	sources := map[string]string{}
+	for _, repo := range st.Repositories {
+		if len(repo.Mirrors) == 0 {
+			continue
+		}
+
+		failures := []string{}
+		for _, url := range append([]string{repo.URL}, repo.Mirrors...) {
+			err := checker.check(repo, url)
+			if err == nil {
+				sources[repo.Name] = url
+				break
+			}
+			failures = append(failures, fmt.Sprintf("%s: %v", url, err))
+		}
+
+		if _, ok := sources[repo.Name]; !ok {
+			return nil, fmt.Errorf("no healthy source found for the repository %s: %s", repo.Name, strings.Join(failures, ", "))
+		}
+		if len(failures) > 0 {
+			st.warn(ResolutionWarningFailover, "", "failed over the repository %s to %s after health check failures: %s", repo.Name, sources[repo.Name], strings.Join(failures, ", "))
+		}
+	}
+
+	st.repoSources = sources
+
+	return sources, nil
+}
+
+// failoverRepositories rewrites the repository URLs of the unresolved dependencies to the URLs of the sources chosen by health checks,
+// and returns the map from the source URLs to the primary URLs
+func (st *HelmState) failoverRepositories(unresolved *UnresolvedDependencies) (map[string]string, error) {
+	sources, err := st.repositorySources()
+	if err != nil {
+		return nil, err
+	}
+
+	primaries := map[string]string{}
+	sourceOf := map[string]string{}
+	for _, repo := range st.Repositories {
+		if source, ok := sources[repo.Name]; ok {
+			primaries[source] = repo.URL
+			sourceOf[repo.URL] = source
+		}
+	}
+
+	for _, deps := range unresolved.deps {
+		for i := range deps {
+			if source, ok := sourceOf[deps[i].Repository]; ok {
+				deps[i].Repository = source
+			}
+		}
+	}
+
+	return primaries, nil
+}
@@ -0,0 +1,118 @@
+package state
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHelmState_Failover(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer primary.Close()
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("entries: {}\n"))
+	}))
+	defer mirror.Close()
+
+	state := &HelmState{
+		FilePath: "/path/to/helmfile.yaml",
+		Repositories: []RepositorySpec{
+			{Name: "myrepo", URL: primary.URL, Mirrors: []string{"http://127.0.0.1:1", mirror.URL}, HealthCheck: HealthCheckHead},
+		},
+		DependencyResolution: DependencyResolutionSpec{
+			Failover: true,
+		},
+		logger: logger,
+	}
+
+	warnings := state.collectResolutionWarnings()
+
+	unresolved := &UnresolvedDependencies{deps: map[string][]unresolvedChartDependency{}}
+	unresolved.Add("envoy", primary.URL, "")
+
+	primaries, err := state.failoverRepositories(unresolved)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if unresolved.deps["envoy"][0].Repository != mirror.URL {
+		t.Errorf("unexpected repository to fetch envoy from: expected=%s, got=%s", mirror.URL, unresolved.deps["envoy"][0].Repository)
+	}
+	if ws := warnings(); len(ws) != 1 || ws[0].Kind != ResolutionWarningFailover {
+		t.Errorf("unexpected warnings: %v", ws)
+	}
+
+	helm := &mockHelmExec{}
+	if errs := state.SyncRepos(helm); errs != nil {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	expectedRepo := []string{"myrepo", mirror.URL, "", "", "", ""}
+	if !reflect.DeepEqual(helm.repo, expectedRepo) {
+		t.Errorf("unexpected repository added: expected=%v, got=%v", expectedRepo, helm.repo)
+	}
+
+	wd, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(wd)
+
+	depMan := NewChartDependencyManager("helmfile", logger)
+	depMan.now = lockFileTime
+	depMan.primaries = primaries
+	var written string
+	depMan.writeFile = func(filename string, data []byte, perm os.FileMode) error {
+		if filename == depMan.lockFileName() {
+			written = string(data)
+			return nil
+		}
+		return ioutil.WriteFile(filename, data, perm)
+	}
+	depMan.readFile = func(filename string) ([]byte, error) {
+		if filename == depMan.lockFileName() {
+			if written == "" {
+				return nil, os.ErrNotExist
+			}
+			return []byte(written), nil
+		}
+		return ioutil.ReadFile(filename)
+	}
+
+	shell := dependencyUpdaterFunc(func(chart string) error {
+		content := "dependencies:\n- name: envoy\n  repository: " + mirror.URL + "\n  version: 1.5.0\n"
+		return ioutil.WriteFile(filepath.Join(chart, "requirements.lock"), []byte(content), 0644)
+	})
+
+	if _, err := depMan.Update(shell, wd, unresolved); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := "- name: envoy\n  repository: " + primary.URL + "\n  version: 1.5.0\n  source: " + mirror.URL + "\n"
+	if !strings.Contains(written, expected) {
+		t.Errorf("unexpected lock file: expected to contain=%s\ngot=%s", expected, written)
+	}
+}
+
+func TestHelmState_Failover_NoHealthySource(t *testing.T) {
+	state := &HelmState{
+		Repositories: []RepositorySpec{
+			{Name: "myrepo", URL: "http://127.0.0.1:1", Mirrors: []string{"http://127.0.0.1:2"}},
+		},
+		DependencyResolution: DependencyResolutionSpec{
+			Failover: true,
+		},
+		logger: logger,
+	}
+
+	_, err := state.repositorySources()
+	if err == nil || !strings.HasPrefix(err.Error(), "no healthy source found for the repository myrepo: http://127.0.0.1:1: ") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
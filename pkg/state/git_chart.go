@@ -0,0 +1,276 @@
+package state
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// gitChart is the chart in a git repository, referenced like `git::https://github.com/org/repo//charts/app?ref=v1.2.0`
+type gitChart struct {
+	// Repo is the URL of the git repository, like `https://github.com/org/repo`
+	Repo string
+	// Path is the directory of the chart in the repository, like `charts/app`. Empty means the root of the repository.
+	Path string
+	// Ref is the branch, tag or commit SHA to check out. Empty means the default branch.
+	Ref string
+}
+
+// isGitChart returns true when the chart is sourced from a git repository
+func isGitChart(chart string) bool {
+	return strings.HasPrefix(chart, "git::")
+}
+
+// parseGitChart parses the chart reference in the go-getter syntax, like `git::https://github.com/org/repo//charts/app?ref=v1.2.0`
+func parseGitChart(chart string) (*gitChart, error) {
+	src := strings.TrimPrefix(chart, "git::")
+
+	var ref string
+	if i := strings.Index(src, "?"); i >= 0 {
+		query, err := url.ParseQuery(src[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid git chart %q: %v", chart, err)
+		}
+		ref = query.Get("ref")
+		src = src[:i]
+	}
+
+	scheme := strings.Index(src, "://")
+	if scheme <= 0 {
+		return nil, fmt.Errorf("invalid git chart %q: expected a URL like git::https://github.com/org/repo//charts/app?ref=v1.2.0", chart)
+	}
+
+	repo, dir := src, ""
+	if i := strings.Index(src[scheme+3:], "//"); i >= 0 {
+		repo, dir = src[:scheme+3+i], strings.Trim(src[scheme+3+i+2:], "/")
+	}
+
+	return &gitChart{Repo: repo, Path: dir, Ref: ref}, nil
+}
+
+// name returns the name the chart is locked under, which is the last element of the chart directory, or of the repository for charts at the root
+func (c *gitChart) name() string {
+	if c.Path != "" {
+		return path.Base(c.Path)
+	}
+	return strings.TrimSuffix(path.Base(c.Repo), ".git")
+}
+
+// at returns the reference to the chart at the commit
+func (c *gitChart) at(sha string) string {
+	src := "git::" + c.Repo
+	if c.Path != "" {
+		src += "//" + c.Path
+	}
+	return src + "?ref=" + sha
+}
+
+var commitSHA = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// gitClient resolves refs of git repositories to commit SHAs, and checks out the commits
+type gitClient interface {
+	ResolveRef(repo, ref string) (string, error)
+	Checkout(repo, sha, dir string) error
+}
+
+// gitCommand is the gitClient running the git command
+type gitCommand struct{}
+
+func (gitCommand) run(dir string, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("git %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// ResolveRef returns the SHA of the commit the ref points to, without cloning the repository.
+// Annotated tags are resolved to the commits they tag.
+func (g gitCommand) ResolveRef(repo, ref string) (string, error) {
+	if commitSHA.MatchString(ref) {
+		return ref, nil
+	}
+	if ref == "" {
+		ref = "HEAD"
+	}
+
+	out, err := g.run("", "ls-remote", repo, ref, ref+"^{}")
+	if err != nil {
+		return "", err
+	}
+
+	var sha string
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if strings.HasSuffix(fields[1], "^{}") {
+			return fields[0], nil
+		}
+		if sha == "" {
+			sha = fields[0]
+		}
+	}
+	if sha == "" {
+		return "", fmt.Errorf("ref %q not found in %s", ref, repo)
+	}
+	return sha, nil
+}
+
+// Checkout clones the repository into dir and checks out the commit
+func (g gitCommand) Checkout(repo, sha, dir string) error {
+	if _, err := g.run("", "clone", "--quiet", repo, dir); err != nil {
+		return err
+	}
+	if _, err := g.run(dir, "checkout", "--quiet", "--detach", sha); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	return nil
+}
+
+func (st *HelmState) gitClient() gitClient {
+	if st.git != nil {
+		return st.git
+	}
+	return gitCommand{}
+}
+
+// gitCacheDir returns the directory git repositories of charts are checked out into
+func (st *HelmState) gitCacheDir() string {
+	if st.DependencyResolution.GitCacheDir != "" {
+		return expandHome(st.DependencyResolution.GitCacheDir)
+	}
+	return filepath.Join(os.TempDir(), "helmfile", "git")
+}
+
+// lockGitCharts locks the charts in git repositories at the commits their refs point to, without running helm.
+// Offline, the commits already in the lock file are kept, as resolving refs requires network access.
+func (m *chartDependencyManager) lockGitCharts(deps []unresolvedChartDependency, lockFileContent []byte) ([]ResolvedChartDependency, error) {
+	current, err := m.lockedRequirements(lockFileContent)
+	if err != nil {
+		return nil, err
+	}
+
+	locked := []ResolvedChartDependency{}
+	seen := map[string]bool{}
+	for _, d := range deps {
+		if seen[d.Repository] {
+			continue
+		}
+		seen[d.Repository] = true
+
+		dep := ResolvedChartDependency{ChartName: d.ChartName, Repository: d.Repository}
+		if m.Offline {
+			for _, l := range current.ResolvedDependencies {
+				if l.ChartName == dep.ChartName && l.Repository == dep.Repository {
+					dep.Version = l.Version
+					break
+				}
+			}
+			if dep.Version == "" {
+				return nil, fmt.Errorf("unable to lock %s offline, as resolving the ref requires network access", d.Repository)
+			}
+		} else {
+			c, err := parseGitChart(d.Repository)
+			if err != nil {
+				return nil, err
+			}
+			dep.Version, err = m.git.ResolveRef(c.Repo, c.Ref)
+			if err != nil {
+				return nil, fmt.Errorf("unable to lock %s: %v", d.Repository, err)
+			}
+		}
+
+		locked = append(locked, dep)
+	}
+
+	return locked, nil
+}
+
+// getGitChart returns the commit locked for the chart in the git repository, referenced exactly as in the release
+func (d *ResolvedDependencies) getGitChart(chart, repository string) (*ResolvedChartDependency, error) {
+	for _, dep := range d.deps[chart] {
+		if dep.Repository == repository {
+			dep := dep
+			return &dep, nil
+		}
+	}
+	return nil, fmt.Errorf("no resolved dependency found for %q from %s", chart, repository)
+}
+
+// pinGitChart rewrites the release's chart in a git repository to the one at the locked commit
+func (st *HelmState) pinGitChart(r *ReleaseSpec, resolved *ResolvedDependencies) error {
+	c, err := parseGitChart(r.Chart)
+	if err != nil {
+		return fmt.Errorf("release %q: %v", r.Name, err)
+	}
+	dep, err := resolved.getGitChart(c.name(), r.Chart)
+	if err != nil {
+		return err
+	}
+	r.Chart = c.at(dep.Version)
+	return nil
+}
+
+// checkoutGitCharts checks out the charts of the releases in git repositories into the git cache directory,
+// and rewrites the charts to the checked out directories so that they are deployed as local charts.
+// Each commit is checked out once into its own directory, which is reused across runs.
+func (st *HelmState) checkoutGitCharts() error {
+	git := st.gitClient()
+	for i := range st.Releases {
+		r := &st.Releases[i]
+		if !isGitChart(r.Chart) {
+			continue
+		}
+
+		c, err := parseGitChart(r.Chart)
+		if err != nil {
+			return fmt.Errorf("release %q: %v", r.Name, err)
+		}
+
+		sha := c.Ref
+		if !commitSHA.MatchString(sha) {
+			if st.DependencyResolution.Offline {
+				return fmt.Errorf("release %q: unable to resolve the ref of %s offline: run `helmfile deps` to lock it", r.Name, r.Chart)
+			}
+			sha, err = git.ResolveRef(c.Repo, c.Ref)
+			if err != nil {
+				return fmt.Errorf("release %q: %v", r.Name, err)
+			}
+		}
+
+		key := sha256.Sum256([]byte(c.Repo))
+		dir := filepath.Join(st.gitCacheDir(), hex.EncodeToString(key[:8]), sha)
+
+		exists, err := st.chartFileExists(dir)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			if st.DependencyResolution.Offline {
+				return fmt.Errorf("release %q: unable to check out %s offline", r.Name, r.Chart)
+			}
+			st.logger.Debugf("checking out %s at %s into %s", c.Repo, sha, dir)
+			if err := git.Checkout(c.Repo, sha, dir); err != nil {
+				return fmt.Errorf("release %q: %v", r.Name, err)
+			}
+		}
+
+		r.Chart = filepath.Join(dir, c.Path)
+	}
+	return nil
+}
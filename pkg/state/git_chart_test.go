@@ -0,0 +1,158 @@
+package state
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/roboll/helmfile/pkg/testhelper"
+	"gopkg.in/yaml.v2"
+)
+
+type gitClientFunc struct {
+	refs      map[string]string
+	checkouts []string
+}
+
+func (g *gitClientFunc) ResolveRef(repo, ref string) (string, error) {
+	sha, ok := g.refs[repo+"@"+ref]
+	if !ok {
+		return "", fmt.Errorf("ref %q not found in %s", ref, repo)
+	}
+	return sha, nil
+}
+
+func (g *gitClientFunc) Checkout(repo, sha, dir string) error {
+	g.checkouts = append(g.checkouts, fmt.Sprintf("%s@%s:%s", repo, sha, dir))
+	return nil
+}
+
+func TestParseGitChart(t *testing.T) {
+	tests := []struct {
+		chart    string
+		expected gitChart
+		name     string
+	}{
+		{
+			chart:    "git::https://github.com/org/repo//charts/app?ref=v1.2.0",
+			expected: gitChart{Repo: "https://github.com/org/repo", Path: "charts/app", Ref: "v1.2.0"},
+			name:     "app",
+		},
+		{
+			chart:    "git::ssh://git@github.com/org/app.git",
+			expected: gitChart{Repo: "ssh://git@github.com/org/app.git"},
+			name:     "app",
+		},
+	}
+
+	for _, tt := range tests {
+		c, err := parseGitChart(tt.chart)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if *c != tt.expected {
+			t.Errorf("unexpected git chart for %s: expected=%v, got=%v", tt.chart, tt.expected, *c)
+		}
+		if c.name() != tt.name {
+			t.Errorf("unexpected name for %s: expected=%s, got=%s", tt.chart, tt.name, c.name())
+		}
+	}
+
+	if _, err := parseGitChart("git::github.com/org/repo"); err == nil {
+		t.Error("expected error for the git chart without scheme, got none")
+	}
+}
+
+func TestChartDependencyManager_UpdateGitChart(t *testing.T) {
+	const sha = "0123456789abcdef0123456789abcdef01234567"
+	chart := "git::https://github.com/org/repo//charts/app?ref=v1.2.0"
+
+	files := map[string]string{}
+	depMan := NewChartDependencyManager("helmfile", logger)
+	depMan.now = lockFileTime
+	depMan.git = &gitClientFunc{refs: map[string]string{"https://github.com/org/repo@v1.2.0": sha}}
+	depMan.readFile = func(filename string) ([]byte, error) {
+		if content, ok := files[filename]; ok {
+			return []byte(content), nil
+		}
+		return nil, &os.PathError{Op: "open", Path: filename, Err: os.ErrNotExist}
+	}
+	depMan.writeFile = func(filename string, data []byte, perm os.FileMode) error {
+		files[filename] = string(data)
+		return nil
+	}
+
+	shell := dependencyUpdaterFunc(func(chart string) error {
+		return fmt.Errorf("unexpected helm run")
+	})
+
+	unresolved := &UnresolvedDependencies{deps: map[string][]unresolvedChartDependency{}}
+	unresolved.Add("app", chart, "v1.2.0")
+
+	if _, err := depMan.Update(shell, "", unresolved); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var locked ChartLockedRequirements
+	if err := yaml.Unmarshal([]byte(files["helmfile.lock"]), &locked); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []ResolvedChartDependency{{ChartName: "app", Repository: chart, Version: sha}}
+	if !reflect.DeepEqual(locked.ResolvedDependencies, expected) {
+		t.Errorf("unexpected locked dependencies: expected=%v, got=%v", expected, locked.ResolvedDependencies)
+	}
+}
+
+func TestHelmState_PrepareGitChart(t *testing.T) {
+	const sha = "0123456789abcdef0123456789abcdef01234567"
+	chart := "git::https://github.com/org/repo//charts/app?ref=v1.2.0"
+
+	git := &gitClientFunc{}
+	state := injectFs(&HelmState{
+		FilePath: "/path/to/helmfile.yaml",
+		Releases: []ReleaseSpec{
+			{Name: "app", Chart: chart},
+		},
+		DependencyResolution: DependencyResolutionSpec{GitCacheDir: "/cache"},
+		logger:               logger,
+		git:                  git,
+	}, testhelper.NewTestFs(map[string]string{
+		"/path/to/helmfile.lock": fmt.Sprintf(`dependencies:
+- name: app
+  repository: %s
+  version: %s
+digest: sha256:abc
+generated: "2019-06-01T00:00:00Z"
+`, chart, sha),
+	}))
+	state.fileExists = func(path string) (bool, error) {
+		return false, nil
+	}
+
+	updated, err := state.ResolveDeps()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	pinned := "git::https://github.com/org/repo//charts/app?ref=" + sha
+	if updated.Releases[0].Chart != pinned {
+		t.Errorf("unexpected chart: expected=%s, got=%s", pinned, updated.Releases[0].Chart)
+	}
+
+	if err := updated.checkoutGitCharts(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(git.checkouts) != 1 {
+		t.Fatalf("unexpected checkouts: %v", git.checkouts)
+	}
+	dir := filepath.Dir(filepath.Dir(updated.Releases[0].Chart))
+	if filepath.Base(updated.Releases[0].Chart) != "app" || filepath.Base(dir) != sha || !strings.HasPrefix(dir, "/cache/") {
+		t.Errorf("unexpected chart directory: %s", updated.Releases[0].Chart)
+	}
+	expected := fmt.Sprintf("https://github.com/org/repo@%s:%s", sha, dir)
+	if git.checkouts[0] != expected {
+		t.Errorf("unexpected checkout: expected=%s, got=%s", expected, git.checkouts[0])
+	}
+}
@@ -0,0 +1,37 @@
+package state
+
+import (
+	"fmt"
+
+	"github.com/Masterminds/semver"
+	"github.com/roboll/helmfile/pkg/helmexec"
+)
+
+// CheckHelmVersion fails when the version of the helm binary doesn't satisfy helmDefaults.requiredVersion,
+// so that helmfile stops before running any helm command instead of failing confusingly in the middle of the run
+func (st *HelmState) CheckHelmVersion(helm helmexec.Interface) error {
+	required := st.HelmDefaults.RequiredVersion
+	if required == "" {
+		return nil
+	}
+
+	constraint, err := semver.NewConstraint(normalizeVersionConstraint(required))
+	if err != nil {
+		return fmt.Errorf("invalid helmDefaults.requiredVersion %q in %s: %v", required, st.FilePath, err)
+	}
+
+	getter, ok := helm.(helmexec.VersionGetter)
+	if !ok {
+		return nil
+	}
+
+	v := getter.VersionOf(st.HelmDefaults.HelmBinary)
+	if v == nil {
+		return fmt.Errorf("unable to detect the version of helm, which %s requires to be %s", st.FilePath, required)
+	}
+	if !constraint.Check(v) {
+		return fmt.Errorf("helm %s doesn't satisfy the version %s required by %s", v, required, st.FilePath)
+	}
+
+	return nil
+}
@@ -0,0 +1,91 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/Masterminds/semver"
+)
+
+// mockVersionHelmExec reports the versions of helm binaries, keyed by the binaries with the empty key for the default one
+type mockVersionHelmExec struct {
+	mockHelmExec
+	versions map[string]string
+	bins     []string
+}
+
+func (helm *mockVersionHelmExec) VersionOf(bin string) *semver.Version {
+	helm.bins = append(helm.bins, bin)
+	v, ok := helm.versions[bin]
+	if !ok {
+		return nil
+	}
+	return semver.MustParse(v)
+}
+
+func TestHelmState_CheckHelmVersion(t *testing.T) {
+	tests := []struct {
+		name       string
+		defaults   HelmSpec
+		versions   map[string]string
+		wantErr    string
+		wantDetect bool
+	}{
+		{
+			name: "no required version",
+		},
+		{
+			name:       "satisfied",
+			defaults:   HelmSpec{RequiredVersion: ">=2.14 <3"},
+			versions:   map[string]string{"": "2.16.1"},
+			wantDetect: true,
+		},
+		{
+			name:       "unsatisfied",
+			defaults:   HelmSpec{RequiredVersion: ">=2.14 <3"},
+			versions:   map[string]string{"": "3.2.0+ge29ce2a"},
+			wantErr:    "helm 3.2.0+ge29ce2a doesn't satisfy the version >=2.14 <3 required by helmfile.yaml",
+			wantDetect: true,
+		},
+		{
+			name:       "helm binary in helmDefaults",
+			defaults:   HelmSpec{RequiredVersion: ">=3.2", HelmBinary: "helm3"},
+			versions:   map[string]string{"": "2.16.1", "helm3": "3.2.0"},
+			wantDetect: true,
+		},
+		{
+			name:       "undetected version",
+			defaults:   HelmSpec{RequiredVersion: ">=3"},
+			wantErr:    "unable to detect the version of helm, which helmfile.yaml requires to be >=3",
+			wantDetect: true,
+		},
+		{
+			name:     "invalid constraint",
+			defaults: HelmSpec{RequiredVersion: "latest"},
+			wantErr:  `invalid helmDefaults.requiredVersion "latest" in helmfile.yaml: improper constraint: latest`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := &HelmState{
+				FilePath:     "helmfile.yaml",
+				HelmDefaults: tt.defaults,
+			}
+			helm := &mockVersionHelmExec{versions: tt.versions}
+
+			err := state.CheckHelmVersion(helm)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+				t.Fatalf("unexpected error: expected=%s, got=%v", tt.wantErr, err)
+			}
+			if detected := len(helm.bins) > 0; detected != tt.wantDetect {
+				t.Errorf("unexpected version detection: expected=%v, got=%v", tt.wantDetect, detected)
+			}
+			if len(helm.bins) > 0 && helm.bins[0] != tt.defaults.HelmBinary {
+				t.Errorf("unexpected helm binary: expected=%s, got=%s", tt.defaults.HelmBinary, helm.bins[0])
+			}
+		})
+	}
+}
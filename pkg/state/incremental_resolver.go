@@ -0,0 +1,137 @@
+package state
+
+import (
+	"fmt"
+)
+
+// IncrementalResolver applies locked chart versions to releases added to the state one by one,
+// without re-resolving the releases added before.
+type IncrementalResolver struct {
+	st *HelmState
+
+	depMan    *chartDependencyManager
+	resolved  *ResolvedDependencies
+	pinFilter ReleaseFilter
+	repoToURL map[string]string
+}
+
+// NewIncrementalResolver loads the lock file for the releases already in the state.
+// The state's releases themselves are left as is. Use ResolveDeps for them.
+func (st *HelmState) NewIncrementalResolver() (*IncrementalResolver, error) {
+	filename, unresolved, err := getUnresolvedDependenciess(st)
+	if err != nil {
+		return nil, err
+	}
+
+	pinFilter, err := st.pinFilter()
+	if err != nil {
+		return nil, err
+	}
+
+	r := &IncrementalResolver{
+		st:        st,
+		depMan:    st.newChartDependencyManager(filename),
+		resolved:  &ResolvedDependencies{deps: map[string][]ResolvedChartDependency{}},
+		pinFilter: pinFilter,
+		repoToURL: st.repositoryURLs(),
+	}
+
+	if len(unresolved.deps) > 0 {
+		if err := r.load(unresolved); err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+// Add appends the release to the state, with the version locked for its chart if any
+func (r *IncrementalResolver) Add(release ReleaseSpec) error {
+	repo, chart, ok := r.st.resolveRemoteChart(release.Chart)
+	if ok && !release.SkipDeps {
+		url, ok := r.repoToURL[repo]
+		if ok {
+			constraint, err := r.versionConstraint(release)
+			if err != nil {
+				return err
+			}
+
+			if _, loaded := r.resolved.deps[chart]; !loaded {
+				unresolved := &UnresolvedDependencies{deps: map[string][]unresolvedChartDependency{}}
+				if err := unresolved.Add(chart, url, constraint); err != nil {
+					return err
+				}
+				if err := r.load(unresolved); err != nil {
+					return err
+				}
+			}
+
+			if _, locked := r.resolved.deps[chart]; locked {
+				if _, err := r.st.applyLockedVersion(&release, constraint, r.resolved, r.pinFilter, r.repoToURL); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	r.st.Releases = append(r.st.Releases, release)
+
+	return nil
+}
+
+// versionConstraint returns the version constraint of the release.
+// A version reference is resolved against the versions of the releases already in the state.
+func (r *IncrementalResolver) versionConstraint(release ReleaseSpec) (string, error) {
+	ref, err := parseVersionReference(release.Version)
+	if err != nil {
+		return "", fmt.Errorf("release %q: %v", release.Name, err)
+	}
+	if ref == nil {
+		_, chart, _ := r.st.resolveRemoteChart(release.Chart)
+		return r.st.versionConstraint(release, chart)
+	}
+
+	versions := map[string][]string{}
+	for _, existing := range r.st.Releases {
+		_, chart, ok := r.st.resolveRemoteChart(existing.Chart)
+		if ok && chart == ref.Chart && existing.Version != "" {
+			versions[chart] = appendVersion(versions[chart], existing.Version)
+		}
+	}
+
+	constraint, ok, err := ref.resolve(versions)
+	if err != nil {
+		return "", fmt.Errorf("release %q: %v", release.Name, err)
+	}
+	if !ok {
+		return "", fmt.Errorf("release %q: the version references the chart %q, which isn't resolved by any release added before", release.Name, ref.Chart)
+	}
+
+	return constraint, nil
+}
+
+// load merges the dependencies locked for the unresolved ones into the resolved set
+func (r *IncrementalResolver) load(unresolved *UnresolvedDependencies) error {
+	resolved, lockfileExists, err := r.depMan.Resolve(unresolved)
+	if err != nil {
+		return fmt.Errorf("unable to resolve %d deps: %v", len(unresolved.deps), err)
+	}
+	if !lockfileExists {
+		return nil
+	}
+
+	if resolved.digest != "" {
+		r.resolved.digest = resolved.digest
+	}
+
+	for _, dep := range resolved.sorted() {
+		if r.resolved.has(dep) {
+			continue
+		}
+		if err := r.resolved.add(dep); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
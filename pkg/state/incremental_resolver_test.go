@@ -0,0 +1,58 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/roboll/helmfile/pkg/testhelper"
+)
+
+func TestIncrementalResolver_Add(t *testing.T) {
+	fs := testhelper.NewTestFs(map[string]string{
+		"/path/to/helmfile.lock": `dependencies:
+- name: envoy
+  repository: https://kubernetes-charts.storage.googleapis.com
+  version: 1.5.0
+- name: mysql
+  repository: https://kubernetes-charts.storage.googleapis.com
+  version: 1.0.0
+`,
+	})
+	state := injectFs(&HelmState{
+		FilePath: "/path/to/helmfile.yaml",
+		Releases: []ReleaseSpec{
+			{Name: "proxy", Chart: "stable/envoy"},
+		},
+		Repositories: []RepositorySpec{
+			{
+				Name: "stable",
+				URL:  "https://kubernetes-charts.storage.googleapis.com",
+			},
+		},
+		logger: logger,
+	}, fs)
+
+	resolver, err := state.NewIncrementalResolver()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := resolver.Add(ReleaseSpec{Name: "db", Chart: "stable/mysql"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := resolver.Add(ReleaseSpec{Name: "myapp", Chart: "./charts/myapp", Version: "0.1.0"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(state.Releases) != 3 {
+		t.Fatalf("unexpected number of releases: expected=3, got=%d", len(state.Releases))
+	}
+	if state.Releases[0].Version != "" {
+		t.Errorf("unexpected version of the existing release: expected it to be untouched, got=%s", state.Releases[0].Version)
+	}
+	if state.Releases[1].Version != "1.0.0" {
+		t.Errorf("unexpected version number: expected=1.0.0, got=%s", state.Releases[1].Version)
+	}
+	if state.Releases[2].Version != "0.1.0" {
+		t.Errorf("unexpected version number: expected=0.1.0, got=%s", state.Releases[2].Version)
+	}
+}
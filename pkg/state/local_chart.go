@@ -0,0 +1,261 @@
+package state
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/roboll/helmfile/pkg/helmexec"
+	"gopkg.in/yaml.v2"
+)
+
+// localChartDir returns the directory of the release's chart when it is a local chart, or an empty string otherwise
+func (st *HelmState) localChartDir(r ReleaseSpec, repoToURL map[string]string) (string, error) {
+	if repo, _, ok := st.resolveRemoteChart(r.Chart); ok {
+		if _, declared := repoToURL[repo]; declared {
+			return "", nil
+		}
+	}
+
+	dir := r.Chart
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(st.basePath, dir)
+	}
+
+	exists, err := st.chartFileExists(filepath.Join(dir, "Chart.yaml"))
+	if err != nil || !exists {
+		return "", err
+	}
+	return dir, nil
+}
+
+func (st *HelmState) chartFileExists(path string) (bool, error) {
+	if st.fileExists != nil {
+		return st.fileExists(path)
+	}
+	return pathExists(path), nil
+}
+
+// localChartLocked returns true when the chart in dir has either `requirements.lock` or `Chart.lock` for helm v3
+func (st *HelmState) localChartLocked(dir string) (bool, error) {
+	for _, name := range []string{"requirements.lock", "Chart.lock"} {
+		exists, err := st.chartFileExists(filepath.Join(dir, name))
+		if err != nil || exists {
+			return exists, err
+		}
+	}
+	return false, nil
+}
+
+// localChartDependencies returns the dependencies declared in `requirements.yaml` of the chart in dir,
+// or in `Chart.yaml` for charts for helm v3
+func (st *HelmState) localChartDependencies(dir string) ([]unresolvedChartDependency, error) {
+	readFile := st.readFile
+	if readFile == nil {
+		readFile = ioutil.ReadFile
+	}
+
+	requirementsFile := filepath.Join(dir, "requirements.yaml")
+	exists, err := st.chartFileExists(requirementsFile)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		content, err := readFile(requirementsFile)
+		if err != nil {
+			return nil, err
+		}
+		var reqs ChartRequirements
+		if err := yaml.Unmarshal(content, &reqs); err != nil {
+			return nil, fmt.Errorf("unable to parse %s: %v", requirementsFile, err)
+		}
+		return reqs.UnresolvedDependencies, nil
+	}
+
+	chartFile := filepath.Join(dir, "Chart.yaml")
+	content, err := readFile(chartFile)
+	if err != nil {
+		return nil, err
+	}
+	var chart helm3Chart
+	if err := yaml.Unmarshal(content, &chart); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %v", chartFile, err)
+	}
+	return chart.Dependencies, nil
+}
+
+// addLocalChartDependencies adds the subchart dependencies of the local charts referenced by releases,
+// so that the helmfile lock file pins the whole tree of charts deployed by the state.
+// Subcharts in `file://` repositories are followed recursively, and `@name` and `alias:name` repositories are resolved to the repositories declared in the state.
+func (st *HelmState) addLocalChartDependencies(unresolved *UnresolvedDependencies, repoToURL map[string]string) error {
+	for _, r := range st.Releases {
+		if r.SkipDeps {
+			continue
+		}
+
+		dir, err := st.localChartDir(r, repoToURL)
+		if err != nil {
+			return err
+		}
+		if dir == "" {
+			continue
+		}
+
+		if err := st.addSubchartDependencies(unresolved, repoToURL, r.Name, dir, map[string]bool{}); err != nil {
+			return fmt.Errorf("release %q: %v", r.Name, err)
+		}
+	}
+	return nil
+}
+
+func (st *HelmState) addSubchartDependencies(unresolved *UnresolvedDependencies, repoToURL map[string]string, release, dir string, visited map[string]bool) error {
+	if visited[dir] {
+		return nil
+	}
+	visited[dir] = true
+
+	deps, err := st.localChartDependencies(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range deps {
+		url := d.Repository
+		switch {
+		case url == "":
+			// Vendored in the `charts/` directory of the chart
+			continue
+		case strings.HasPrefix(url, "file://"):
+			if err := st.addSubchartDependencies(unresolved, repoToURL, release, filepath.Join(dir, strings.TrimPrefix(url, "file://")), visited); err != nil {
+				return err
+			}
+			continue
+		case strings.HasPrefix(url, "@") || strings.HasPrefix(url, "alias:"):
+			name := strings.TrimPrefix(strings.TrimPrefix(url, "@"), "alias:")
+			var ok bool
+			url, ok = repoToURL[name]
+			if !ok {
+				return fmt.Errorf("the subchart %q of %s references the repository %q, which isn't declared in %s", d.ChartName, dir, name, st.FilePath)
+			}
+		}
+
+		if st.isNoPinURL(url, repoToURL) {
+			continue
+		}
+
+		constraint := normalizeVersionConstraint(d.VersionConstraint)
+		if constraint == "" {
+			constraint = "*"
+		}
+
+		unresolved.releases[d.ChartName] = append(unresolved.releases[d.ChartName], release)
+		if err := unresolved.Add(d.ChartName, url, constraint); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// lockedDependencies returns the dependencies locked in the helmfile lock file, or nil when it doesn't exist
+func (st *HelmState) lockedDependencies() (*ResolvedDependencies, error) {
+	filename, unresolved, err := getUnresolvedDependenciess(st)
+	if err != nil {
+		return nil, err
+	}
+	if len(unresolved.deps) == 0 {
+		return nil, nil
+	}
+
+	depMan := st.newChartDependencyManager(filename)
+	depMan.VerifyLockedVersions = false
+
+	resolved, lockfileExists, err := depMan.Resolve(unresolved)
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve %d deps: %v", len(unresolved.deps), err)
+	}
+	if !lockfileExists {
+		return nil, nil
+	}
+	return resolved, nil
+}
+
+// pinLocalChartDependencies rewrites the versions in the lock file of the local chart in dir to the ones locked by helmfile,
+// and rebuilds the dependencies of the chart with `helm dependency build` when any of them differs,
+// as `helm dependency update` resolves the subcharts on its own regardless of the helmfile lock file.
+// The digest in the lock file is kept, as it's the digest of the chart requirements, which are left untouched.
+func (st *HelmState) pinLocalChartDependencies(helm helmexec.Interface, dir string, locked *ResolvedDependencies) error {
+	readFile := st.readFile
+	if readFile == nil {
+		readFile = ioutil.ReadFile
+	}
+
+	lockFile := filepath.Join(dir, "requirements.lock")
+	exists, err := st.chartFileExists(lockFile)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		lockFile = filepath.Join(dir, "Chart.lock")
+		if exists, err = st.chartFileExists(lockFile); err != nil || !exists {
+			return err
+		}
+	}
+
+	deps, err := st.localChartDependencies(dir)
+	if err != nil {
+		return err
+	}
+	constraints := map[string]string{}
+	for _, d := range deps {
+		constraints[d.ChartName] = normalizeVersionConstraint(d.VersionConstraint)
+	}
+
+	content, err := readFile(lockFile)
+	if err != nil {
+		return err
+	}
+	var lock ChartLockedRequirements
+	if err := yaml.Unmarshal(content, &lock); err != nil {
+		return fmt.Errorf("unable to parse %s: %v", lockFile, err)
+	}
+
+	pinned := false
+	for i, d := range lock.ResolvedDependencies {
+		if d.Repository == "" || strings.HasPrefix(d.Repository, "file://") {
+			continue
+		}
+		// Subcharts excluded from locking, like the ones in noPin repositories, keep the versions resolved by helm
+		dep, err := locked.get(d.ChartName, constraints[d.ChartName])
+		if err != nil || dep.Version == d.Version {
+			continue
+		}
+		st.logger.Debugf("pinning the subchart %s of %s to %s locked by helmfile instead of %s", d.ChartName, dir, dep.Version, d.Version)
+		lock.ResolvedDependencies[i].Version = dep.Version
+		pinned = true
+	}
+	if !pinned {
+		return nil
+	}
+
+	content, err = yaml.Marshal(lock)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomically(lockFile, content, 0644); err != nil {
+		return err
+	}
+
+	return st.retry("building dependencies of "+dir, func() error { return helm.BuildDeps(dir) })
+}
+
+// isNoPinURL returns true when any repository at url is marked noPin
+func (st *HelmState) isNoPinURL(url string, repoToURL map[string]string) bool {
+	for name, u := range repoToURL {
+		if u == url && st.isNoPinRepository(name) {
+			return true
+		}
+	}
+	return false
+}
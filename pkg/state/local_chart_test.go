@@ -0,0 +1,185 @@
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/roboll/helmfile/pkg/testhelper"
+)
+
+func TestGetUnresolvedDependencies_LocalCharts(t *testing.T) {
+	fs := testhelper.NewTestFs(map[string]string{
+		"/path/to/charts/app/Chart.yaml": `name: app
+version: 0.1.0
+`,
+		"/path/to/charts/app/requirements.yaml": `dependencies:
+- name: mysql
+  repository: https://charts.example.com
+  version: ">=1.0 <2.0"
+- name: envoy
+  repository: "@myrepo"
+  version: ~1.5
+- name: lib
+  repository: file://../lib
+  version: 0.1.0
+- name: vendored
+  version: 0.1.0
+`,
+		"/path/to/charts/lib/Chart.yaml": `apiVersion: v2
+name: lib
+version: 0.1.0
+dependencies:
+- name: redis
+  repository: https://charts.example.com
+`,
+	})
+	state := injectFs(&HelmState{
+		basePath: "/path/to",
+		FilePath: "/path/to/helmfile.yaml",
+		Releases: []ReleaseSpec{
+			{Name: "app", Chart: "./charts/app"},
+		},
+		Repositories: []RepositorySpec{
+			{Name: "myrepo", URL: "https://myrepo.example.com"},
+		},
+		logger: logger,
+	}, fs)
+
+	_, unresolved, err := getUnresolvedDependenciess(state)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[string][]unresolvedChartDependency{
+		"mysql": {{ChartName: "mysql", Repository: "https://charts.example.com", VersionConstraint: ">=1.0, <2.0.0"}},
+		"envoy": {{ChartName: "envoy", Repository: "https://myrepo.example.com", VersionConstraint: "~1.5"}},
+		"redis": {{ChartName: "redis", Repository: "https://charts.example.com", VersionConstraint: "*"}},
+	}
+	if !reflect.DeepEqual(unresolved.deps, expected) {
+		t.Errorf("unexpected dependencies: expected=%v, got=%v", expected, unresolved.deps)
+	}
+
+	if releases := unresolved.releases["redis"]; !reflect.DeepEqual(releases, []string{"app"}) {
+		t.Errorf("unexpected releases: expected=[app], got=%v", releases)
+	}
+}
+
+func TestGetUnresolvedDependencies_LocalChartUndeclaredRepository(t *testing.T) {
+	fs := testhelper.NewTestFs(map[string]string{
+		"/path/to/charts/app/Chart.yaml": `name: app
+`,
+		"/path/to/charts/app/requirements.yaml": `dependencies:
+- name: envoy
+  repository: "@unknown"
+`,
+	})
+	state := injectFs(&HelmState{
+		basePath: "/path/to",
+		FilePath: "/path/to/helmfile.yaml",
+		Releases: []ReleaseSpec{
+			{Name: "app", Chart: "charts/app"},
+		},
+		logger: logger,
+	}, fs)
+
+	_, _, err := getUnresolvedDependenciess(state)
+	expected := `release "app": the subchart "envoy" of /path/to/charts/app references the repository "unknown", which isn't declared in /path/to/helmfile.yaml`
+	if err == nil || err.Error() != expected {
+		t.Errorf("unexpected error: expected=%s, got=%v", expected, err)
+	}
+}
+
+func TestHelmState_pinLocalChartDependencies(t *testing.T) {
+	tests := []struct {
+		name          string
+		lockedVersion string
+		expectedLock  string
+		built         []string
+	}{
+		{
+			name:          "resolved at the locked version",
+			lockedVersion: "1.2.0",
+			expectedLock: `dependencies:
+- name: mysql
+  repository: https://charts.example.com
+  version: 1.2.0
+digest: sha256:abc
+generated: 2019-01-01T00:00:00Z
+`,
+		},
+		{
+			name:          "resolved at another version",
+			lockedVersion: "1.1.0",
+			expectedLock: `dependencies:
+- name: mysql
+  repository: https://charts.example.com
+  version: 1.1.0
+digest: sha256:abc
+generated: "2019-01-01T00:00:00Z"
+`,
+			built: []string{"app"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer os.RemoveAll(dir)
+
+			chart := filepath.Join(dir, "app")
+			files := map[string]string{
+				"Chart.yaml": "name: app\nversion: 0.1.0\n",
+				"requirements.yaml": `dependencies:
+- name: mysql
+  repository: https://charts.example.com
+  version: ">=1.0 <2.0"
+`,
+				"requirements.lock": `dependencies:
+- name: mysql
+  repository: https://charts.example.com
+  version: 1.2.0
+digest: sha256:abc
+generated: 2019-01-01T00:00:00Z
+`,
+			}
+			if err := os.Mkdir(chart, 0755); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			for name, content := range files {
+				if err := ioutil.WriteFile(filepath.Join(chart, name), []byte(content), 0644); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+
+			locked := &ResolvedDependencies{deps: map[string][]ResolvedChartDependency{
+				"mysql": {{ChartName: "mysql", Repository: "https://charts.example.com", Version: tt.lockedVersion}},
+			}}
+			state := &HelmState{logger: logger}
+			helm := &mockHelmExec{}
+			if err := state.pinLocalChartDependencies(helm, chart, locked); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			lock, err := ioutil.ReadFile(filepath.Join(chart, "requirements.lock"))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(lock) != tt.expectedLock {
+				t.Errorf("unexpected lock file:\nexpected=%s\ngot=%s", tt.expectedLock, string(lock))
+			}
+			var built []string
+			for _, c := range helm.charts {
+				built = append(built, filepath.Base(c))
+			}
+			if !reflect.DeepEqual(built, tt.built) {
+				t.Errorf("unexpected charts built: expected=%v, got=%v", tt.built, built)
+			}
+		})
+	}
+}
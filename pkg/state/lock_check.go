@@ -0,0 +1,73 @@
+package state
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CheckLockFile re-resolves the version constraints of the releases against the lock file, without accessing chart repositories
+// nor writing anything, and returns the reasons the lock file is stale relative to the state file, if any.
+// The lock file is stale when it is missing, when any constraint isn't satisfied by the locked versions, e.g. as the constraint was changed
+// without running `helmfile deps`, or when it locks charts no longer used by any release.
+func (st *HelmState) CheckLockFile() ([]string, error) {
+	filename, unresolved, err := getUnresolvedDependenciess(st)
+	if err != nil {
+		return nil, err
+	}
+
+	depMan := st.newChartDependencyManager(filename)
+	depMan.VerifyLockedVersions = false
+
+	resolved, lockfileExists, err := depMan.Resolve(unresolved)
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve %d deps: %v", len(unresolved.deps), err)
+	}
+
+	if !lockfileExists {
+		if len(unresolved.deps) == 0 {
+			return nil, nil
+		}
+		return []string{fmt.Sprintf("the lock file %s is missing", depMan.lockFileName())}, nil
+	}
+
+	stale := []string{}
+	seen := map[string]bool{}
+
+	for _, d := range unresolved.ToChartRequirements().UnresolvedDependencies {
+		constraint := d.VersionConstraint
+		// Constraints referencing the versions of other charts are determined only once the other charts are resolved
+		if d.versionRef != nil {
+			constraint = "*"
+		}
+		var err error
+		if isGitChart(d.Repository) {
+			// Charts in git repositories are locked at commits, and are stale only when the refs in the releases change
+			_, err = resolved.getGitChart(d.ChartName, d.Repository)
+		} else {
+			_, err = resolved.getFromRepository(d.ChartName, d.Repository, constraint)
+		}
+		if err != nil {
+			releases := strings.Join(unresolved.releases[d.ChartName], ", ")
+			msg := fmt.Sprintf("%s %s from %s, used by %s, isn't locked", d.ChartName, constraint, d.Repository, releases)
+			if !seen[msg] {
+				seen[msg] = true
+				stale = append(stale, msg)
+			}
+		}
+	}
+
+	for _, l := range resolved.sorted() {
+		var used bool
+		for _, d := range unresolved.deps[l.ChartName] {
+			if d.Repository == l.Repository {
+				used = true
+				break
+			}
+		}
+		if !used {
+			stale = append(stale, fmt.Sprintf("%s %s from %s is locked, but no longer used by any release", l.ChartName, l.Version, l.Repository))
+		}
+	}
+
+	return stale, nil
+}
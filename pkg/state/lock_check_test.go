@@ -0,0 +1,101 @@
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/roboll/helmfile/pkg/testhelper"
+)
+
+func TestHelmState_CheckLockFile(t *testing.T) {
+	lockFile := `dependencies:
+- name: envoy
+  repository: https://charts.example.com
+  version: 1.5.0
+- name: mysql
+  repository: https://charts.example.com
+  version: 1.0.0
+`
+
+	tests := []struct {
+		name     string
+		releases []ReleaseSpec
+		files    map[string]string
+		expected []string
+	}{
+		{
+			name: "up to date",
+			releases: []ReleaseSpec{
+				{Name: "envoy", Chart: "myrepo/envoy", Version: "~1.5"},
+				{Name: "mysql", Chart: "myrepo/mysql"},
+			},
+			files:    map[string]string{"/path/to/helmfile.lock": lockFile},
+			expected: []string{},
+		},
+		{
+			name: "constraint changed",
+			releases: []ReleaseSpec{
+				{Name: "envoy", Chart: "myrepo/envoy", Version: "~1.6"},
+				{Name: "envoy2", Chart: "myrepo/envoy", Version: "~1.6"},
+				{Name: "mysql", Chart: "myrepo/mysql"},
+			},
+			files: map[string]string{"/path/to/helmfile.lock": lockFile},
+			expected: []string{
+				"envoy ~1.6 from https://charts.example.com, used by envoy, envoy2, isn't locked",
+			},
+		},
+		{
+			name: "release removed",
+			releases: []ReleaseSpec{
+				{Name: "envoy", Chart: "myrepo/envoy"},
+			},
+			files: map[string]string{"/path/to/helmfile.lock": lockFile},
+			expected: []string{
+				"mysql 1.0.0 from https://charts.example.com is locked, but no longer used by any release",
+			},
+		},
+		{
+			name: "no lock file",
+			releases: []ReleaseSpec{
+				{Name: "envoy", Chart: "myrepo/envoy"},
+			},
+			files: map[string]string{},
+			expected: []string{
+				"the lock file helmfile.lock is missing",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := injectFs(&HelmState{
+				FilePath: "/path/to/helmfile.yaml",
+				Releases: tt.releases,
+				Repositories: []RepositorySpec{
+					{Name: "myrepo", URL: "https://charts.example.com"},
+				},
+				logger: logger,
+			}, testhelper.NewTestFs(tt.files))
+			readFile := state.readFile
+			state.readFile = func(filename string) ([]byte, error) {
+				if _, ok := tt.files[filepath.Join("/path/to", filename)]; !ok {
+					return nil, &os.PathError{Op: "open", Path: filename, Err: os.ErrNotExist}
+				}
+				return readFile(filename)
+			}
+
+			actual, err := state.CheckLockFile()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(actual) == 0 && len(tt.expected) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(actual, tt.expected) {
+				t.Errorf("unexpected stale reasons:\nexpected=%v\ngot=%v", tt.expected, actual)
+			}
+		})
+	}
+}
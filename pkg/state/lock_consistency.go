@@ -0,0 +1,135 @@
+package state
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// DivergentPin is a chart pinned to different versions across lock files
+type DivergentPin struct {
+	Chart string
+	// Files maps each pinned version to the sorted lock files pinning the chart to it
+	Files map[string][]string
+}
+
+func (p DivergentPin) String() string {
+	versions := []string{}
+	for v := range p.Files {
+		versions = append(versions, v)
+	}
+	sort.Strings(versions)
+
+	pins := []string{}
+	for _, v := range versions {
+		pins = append(pins, fmt.Sprintf("%s in %s", v, strings.Join(p.Files[v], ", ")))
+	}
+
+	return fmt.Sprintf("%s is pinned to %s", p.Chart, strings.Join(pins, "; "))
+}
+
+// LockedDependencies returns the path to the lock file of the state and the dependencies locked in it, or nil if there's no lock file yet
+func (st *HelmState) LockedDependencies() (string, []ResolvedChartDependency, error) {
+	filename, unresolved, err := getUnresolvedDependenciess(st)
+	if err != nil {
+		return "", nil, err
+	}
+
+	depMan := st.newChartDependencyManager(filename)
+	path := depMan.lockFileName()
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(st.basePath, path)
+	}
+
+	if len(unresolved.deps) == 0 {
+		return path, nil, nil
+	}
+
+	// Never verify locked versions here, as this is a static check of the lock files
+	depMan.VerifyLockedVersions = false
+
+	resolved, lockfileExists, err := depMan.Resolve(unresolved)
+	if err != nil {
+		return "", nil, err
+	}
+	if !lockfileExists {
+		return path, nil, nil
+	}
+
+	return path, resolved.sorted(), nil
+}
+
+// FindDivergentPins returns the charts pinned to different versions across the lock files, ordered by chart name.
+// locks maps lock file paths to the dependencies locked in them. Charts in allow are intentionally divergent, and never reported.
+func FindDivergentPins(locks map[string][]ResolvedChartDependency, allow []string) []DivergentPin {
+	allowed := map[string]bool{}
+	for _, chart := range allow {
+		allowed[chart] = true
+	}
+
+	byChart := map[string]map[string][]string{}
+	for file, deps := range locks {
+		for _, d := range deps {
+			if allowed[d.ChartName] {
+				continue
+			}
+			if byChart[d.ChartName] == nil {
+				byChart[d.ChartName] = map[string][]string{}
+			}
+			files := byChart[d.ChartName][d.Version]
+			if len(files) == 0 || files[len(files)-1] != file {
+				byChart[d.ChartName][d.Version] = append(files, file)
+			}
+		}
+	}
+
+	divergent := []DivergentPin{}
+	for chart, files := range byChart {
+		// A chart is divergent when lock files pin it to different sets of versions.
+		// A lock file pinning the chart to multiple versions for different releases alone isn't divergent.
+		pinsPerFile := map[string][]string{}
+		for v, fs := range files {
+			sort.Strings(fs)
+			for _, f := range fs {
+				pinsPerFile[f] = append(pinsPerFile[f], v)
+			}
+		}
+		sets := map[string]bool{}
+		for _, vs := range pinsPerFile {
+			sort.Strings(vs)
+			sets[strings.Join(vs, ",")] = true
+		}
+		if len(sets) < 2 {
+			continue
+		}
+		divergent = append(divergent, DivergentPin{Chart: chart, Files: files})
+	}
+
+	sort.Slice(divergent, func(i, j int) bool {
+		return divergent[i].Chart < divergent[j].Chart
+	})
+
+	return divergent
+}
+
+// CheckLockFilesConsistency reads the lock files and returns the charts pinned to different versions across them
+func CheckLockFilesConsistency(files []string, allow []string) ([]DivergentPin, error) {
+	locks := map[string][]ResolvedChartDependency{}
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		locked := &ChartLockedRequirements{}
+		if err := yaml.Unmarshal(content, locked); err != nil {
+			return nil, fmt.Errorf("unable to parse %s: %v", file, err)
+		}
+		locks[file] = locked.ResolvedDependencies
+	}
+
+	return FindDivergentPins(locks, allow), nil
+}
@@ -0,0 +1,75 @@
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckLockFilesConsistency(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"helmfile-a.lock": `dependencies:
+- name: envoy
+  repository: https://kubernetes-charts.storage.googleapis.com
+  version: 1.5.0
+- name: mysql
+  repository: https://kubernetes-charts.storage.googleapis.com
+  version: 1.0.0
+- name: redis
+  repository: https://kubernetes-charts.storage.googleapis.com
+  version: 9.0.0
+- name: redis
+  repository: https://kubernetes-charts.storage.googleapis.com
+  version: 9.1.0
+`,
+		"helmfile-b.lock": `dependencies:
+- name: envoy
+  repository: https://kubernetes-charts.storage.googleapis.com
+  version: 1.4.0
+- name: mysql
+  repository: https://kubernetes-charts.storage.googleapis.com
+  version: 1.1.0
+- name: redis
+  repository: https://kubernetes-charts.storage.googleapis.com
+  version: 9.1.0
+- name: redis
+  repository: https://kubernetes-charts.storage.googleapis.com
+  version: 9.0.0
+`,
+		"helmfile-c.lock": `dependencies:
+- name: envoy
+  repository: https://kubernetes-charts.storage.googleapis.com
+  version: 1.5.0
+`,
+	}
+	paths := []string{}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		paths = append(paths, path)
+	}
+
+	divergent, err := CheckLockFilesConsistency(paths, []string{"mysql"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(divergent) != 1 {
+		t.Fatalf("unexpected divergent pins: %v", divergent)
+	}
+
+	a, b, c := filepath.Join(dir, "helmfile-a.lock"), filepath.Join(dir, "helmfile-b.lock"), filepath.Join(dir, "helmfile-c.lock")
+	expected := "envoy is pinned to 1.4.0 in " + b + "; 1.5.0 in " + a + ", " + c
+	if divergent[0].String() != expected {
+		t.Errorf("unexpected divergent pin:\nexpected=%s\ngot=%s", expected, divergent[0])
+	}
+}
@@ -0,0 +1,114 @@
+package state
+
+import (
+	"fmt"
+	"strings"
+)
+
+// releaseNamespace returns the namespace the release is installed into, which is overridden by `--namespace`
+func (st *HelmState) releaseNamespace(r *ReleaseSpec) string {
+	if st.Namespace != "" {
+		return st.Namespace
+	}
+	return r.Namespace
+}
+
+// releaseID returns the `namespace/name` the release is referred by in `needs`
+func (st *HelmState) releaseID(r *ReleaseSpec) string {
+	return st.releaseNamespace(r) + "/" + r.Name
+}
+
+// needID returns the `namespace/name` of the release the need refers to.
+// A need without the namespace refers to the release in the same namespace as the release having the need.
+// The namespace of the need is overridden by `--namespace` as well as the ones of releases.
+func (st *HelmState) needID(r *ReleaseSpec, need string) string {
+	if i := strings.Index(need, "/"); i >= 0 {
+		if st.Namespace != "" {
+			return st.Namespace + "/" + need[i+1:]
+		}
+		return need
+	}
+	return st.releaseNamespace(r) + "/" + need
+}
+
+// CheckNeeds returns an error when a release needs a release undefined in the state file, or releases need each other
+func (st *HelmState) CheckNeeds() error {
+	releases := []*ReleaseSpec{}
+	ids := map[string]bool{}
+	for i := range st.Releases {
+		r := &st.Releases[i]
+		releases = append(releases, r)
+		ids[st.releaseID(r)] = true
+	}
+
+	for _, r := range releases {
+		for _, need := range r.Needs {
+			if !ids[st.needID(r, need)] {
+				return fmt.Errorf("release \"%s\" needs \"%s\", which is not defined in \"%s\"", st.releaseID(r), need, st.FilePath)
+			}
+		}
+	}
+
+	_, err := st.groupReleasesByNeeds(releases)
+	return err
+}
+
+// groupReleasesByNeeds returns the indices of the releases grouped so that every release comes in a group after the releases it needs.
+// Releases in the same group don't need each other, so that they can be processed in parallel.
+// Needs of releases missing in `releases`, like ones excluded by selectors or having no changes to apply, are ignored.
+func (st *HelmState) groupReleasesByNeeds(releases []*ReleaseSpec) ([][]int, error) {
+	index := map[string]int{}
+	for i, r := range releases {
+		index[st.releaseID(r)] = i
+	}
+
+	// pending is the number of the needs of each release which aren't processed yet
+	pending := make([]int, len(releases))
+	dependents := make([][]int, len(releases))
+	for i, r := range releases {
+		for _, need := range r.Needs {
+			j, ok := index[st.needID(r, need)]
+			if !ok || j == i {
+				continue
+			}
+			pending[i]++
+			dependents[j] = append(dependents[j], i)
+		}
+	}
+
+	current := []int{}
+	for i := range releases {
+		if pending[i] == 0 {
+			current = append(current, i)
+		}
+	}
+
+	groups := [][]int{}
+	grouped := 0
+	for len(current) > 0 {
+		next := []int{}
+		for _, i := range current {
+			for _, d := range dependents[i] {
+				pending[d]--
+				if pending[d] == 0 {
+					next = append(next, d)
+				}
+			}
+		}
+		groups = append(groups, current)
+		grouped += len(current)
+		current = next
+	}
+
+	if grouped < len(releases) {
+		cyclic := []string{}
+		for i, r := range releases {
+			if pending[i] > 0 {
+				cyclic = append(cyclic, st.releaseID(r))
+			}
+		}
+		return nil, fmt.Errorf("unable to order releases by needs, as there are cyclic dependencies among: %s", strings.Join(cyclic, ", "))
+	}
+
+	return groups, nil
+}
@@ -0,0 +1,165 @@
+package state
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHelmState_groupReleasesByNeeds(t *testing.T) {
+	tests := []struct {
+		name      string
+		namespace string
+		releases  []ReleaseSpec
+		want      [][]int
+		wantErr   string
+	}{
+		{
+			name: "no needs",
+			releases: []ReleaseSpec{
+				{Name: "app", Namespace: "default"},
+				{Name: "db", Namespace: "default"},
+			},
+			want: [][]int{{0, 1}},
+		},
+		{
+			name: "needs in the same namespace and another namespace",
+			releases: []ReleaseSpec{
+				{Name: "app", Namespace: "default", Needs: []string{"db", "monitoring/prometheus"}},
+				{Name: "db", Namespace: "default", Needs: []string{"monitoring/prometheus"}},
+				{Name: "prometheus", Namespace: "monitoring"},
+				{Name: "worker", Namespace: "default", Needs: []string{"default/db"}},
+			},
+			want: [][]int{{2}, {1}, {0, 3}},
+		},
+		{
+			name:      "namespace overridden via --namespace",
+			namespace: "test",
+			releases: []ReleaseSpec{
+				{Name: "app", Namespace: "default", Needs: []string{"db"}},
+				{Name: "db", Namespace: "default"},
+			},
+			want: [][]int{{1}, {0}},
+		},
+		{
+			name:      "needs in another namespace overridden via --namespace",
+			namespace: "test",
+			releases: []ReleaseSpec{
+				{Name: "app", Namespace: "default", Needs: []string{"monitoring/prometheus"}},
+				{Name: "prometheus", Namespace: "monitoring"},
+			},
+			want: [][]int{{1}, {0}},
+		},
+		{
+			name: "needs on releases missing in the releases being processed",
+			releases: []ReleaseSpec{
+				{Name: "app", Namespace: "default", Needs: []string{"db"}},
+			},
+			want: [][]int{{0}},
+		},
+		{
+			name: "cyclic needs",
+			releases: []ReleaseSpec{
+				{Name: "app", Namespace: "default", Needs: []string{"db"}},
+				{Name: "db", Namespace: "default", Needs: []string{"app"}},
+				{Name: "cache", Namespace: "default"},
+			},
+			wantErr: "unable to order releases by needs, as there are cyclic dependencies among: default/app, default/db",
+		},
+	}
+
+	for i := range tests {
+		tt := tests[i]
+		t.Run(tt.name, func(t *testing.T) {
+			state := &HelmState{Namespace: tt.namespace}
+			releases := []*ReleaseSpec{}
+			for i := range tt.releases {
+				releases = append(releases, &tt.releases[i])
+			}
+
+			groups, err := state.groupReleasesByNeeds(releases)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("unexpected error: expected=%s, got=%v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(groups, tt.want) {
+				t.Errorf("unexpected groups: expected=%v, got=%v", tt.want, groups)
+			}
+		})
+	}
+}
+
+func TestHelmState_CheckNeeds(t *testing.T) {
+	state := &HelmState{
+		FilePath: "helmfile.yaml",
+		Releases: []ReleaseSpec{
+			{Name: "app", Namespace: "default", Needs: []string{"database"}},
+			{Name: "db", Namespace: "default"},
+		},
+	}
+
+	expected := `release "default/app" needs "database", which is not defined in "helmfile.yaml"`
+	if err := state.CheckNeeds(); err == nil || err.Error() != expected {
+		t.Errorf("unexpected error: expected=%s, got=%v", expected, err)
+	}
+
+	state.Releases[0].Needs = []string{"db"}
+	if err := state.CheckNeeds(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestHelmState_SyncReleasesNeeds(t *testing.T) {
+	tests := []struct {
+		name         string
+		releases     []ReleaseSpec
+		wantReleases []string
+		wantErr      bool
+	}{
+		{
+			name: "needed releases are synced first",
+			releases: []ReleaseSpec{
+				{Name: "app", Chart: "charts/app", Needs: []string{"db"}},
+				{Name: "db", Chart: "charts/db"},
+			},
+			wantReleases: []string{"db", "app"},
+		},
+		{
+			name: "releases needing failed releases are not synced",
+			releases: []ReleaseSpec{
+				{Name: "app", Chart: "charts/app", Needs: []string{"db-error"}},
+				{Name: "db-error", Chart: "charts/db"},
+			},
+			wantReleases: []string{},
+			wantErr:      true,
+		},
+	}
+
+	for i := range tests {
+		tt := tests[i]
+		t.Run(tt.name, func(t *testing.T) {
+			helm := &mockHelmExec{}
+			state := &HelmState{
+				Releases: tt.releases,
+				logger:   logger,
+			}
+
+			errs := state.SyncReleases(&AffectedReleases{}, helm, []string{}, 1)
+			if tt.wantErr != (len(errs) > 0) {
+				t.Fatalf("unexpected errors: %v", errs)
+			}
+
+			synced := []string{}
+			for _, r := range helm.releases {
+				synced = append(synced, r.name)
+			}
+			if !reflect.DeepEqual(synced, tt.wantReleases) {
+				t.Errorf("unexpected releases: expected=%v, got=%v", tt.wantReleases, synced)
+			}
+		})
+	}
+}
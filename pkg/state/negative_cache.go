@@ -0,0 +1,87 @@
+package state
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// DefaultNegativeCacheTTL is how long failed dependency updates due to missing charts or versions are remembered by default
+const DefaultNegativeCacheTTL = 5 * time.Second
+
+// chartNotFoundErrors match the errors from helm v2 and v3 telling that the chart or the version doesn't exist in the repository,
+// like `chart "envoy" matching 9.9.9 not found in stable index` and `Can't get a valid version for repositories envoy`
+var chartNotFoundErrors = []*regexp.Regexp{
+	regexp.MustCompile(`chart "[^"]*" (matching \S+ |version "[^"]*" )?not found in `),
+	regexp.MustCompile(`(?i)can't get a valid version for repositories `),
+	regexp.MustCompile(`no chart version found for `),
+	regexp.MustCompile(`no chart name found`),
+}
+
+func isChartNotFoundError(err error) bool {
+	msg := err.Error()
+	for _, re := range chartNotFoundErrors {
+		if re.MatchString(msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// negativeCache remembers dependency updates that failed because the charts or versions weren't found,
+// so that resolutions repeated by the same dependency manager in a tight loop, like a watch mode, don't hit the repositories with the same doomed requests.
+// Entries are keyed by the generated requirements, so that changing any version constraint misses the cache.
+type negativeCache struct {
+	mu      sync.Mutex
+	entries map[string]negativeCacheEntry
+	now     func() time.Time
+}
+
+type negativeCacheEntry struct {
+	err     error
+	expires time.Time
+}
+
+func newNegativeCache() *negativeCache {
+	return &negativeCache{
+		entries: map[string]negativeCacheEntry{},
+		now:     time.Now,
+	}
+}
+
+func negativeCacheKey(name string, requirements []byte) string {
+	return name + "\x00" + string(requirements)
+}
+
+// get returns the cached failure for the requirements, or nil if there's none or it has expired
+func (c *negativeCache) get(name string, requirements []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := negativeCacheKey(name, requirements)
+	e, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	if !c.now().Before(e.expires) {
+		delete(c.entries, key)
+		return nil
+	}
+	return fmt.Errorf("%v (cached failure, retrying after %s)", e.err, e.expires.Format(time.RFC3339))
+}
+
+// put caches the failure for the requirements for the ttl, and evicts the expired entries
+func (c *negativeCache) put(name string, requirements []byte, err error, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	for k, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+
+	c.entries[negativeCacheKey(name, requirements)] = negativeCacheEntry{err: err, expires: now.Add(ttl)}
+}
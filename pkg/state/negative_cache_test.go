@@ -0,0 +1,134 @@
+package state
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChartDependencyManager_Update_NegativeCache(t *testing.T) {
+	wd, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(wd)
+
+	now := time.Date(2019, 5, 16, 0, 0, 0, 0, time.UTC)
+	cache := newNegativeCache()
+	cache.now = func() time.Time { return now }
+
+	depMan := NewChartDependencyManager("helmfile", logger)
+	depMan.negativeCache = cache
+	depMan.readFile = func(filename string) ([]byte, error) {
+		if filename == depMan.lockFileName() {
+			return nil, os.ErrNotExist
+		}
+		return ioutil.ReadFile(filename)
+	}
+
+	var calls int
+	var failure error
+	shell := dependencyUpdaterFunc(func(chart string) error {
+		calls++
+		return failure
+	})
+
+	update := func(constraint string) error {
+		unresolved := &UnresolvedDependencies{deps: map[string][]unresolvedChartDependency{}}
+		unresolved.Add("envoy", "https://charts.example.com", constraint)
+		_, err := depMan.Update(shell, wd, unresolved)
+		return err
+	}
+
+	steps := []struct {
+		name       string
+		failure    error
+		constraint string
+		advance    time.Duration
+		wantCalls  int
+		wantCached bool
+	}{
+		{
+			name:       "first failure",
+			failure:    errors.New(`chart "envoy" matching 9.9.9 not found in stable index`),
+			constraint: "9.9.9",
+			wantCalls:  1,
+		},
+		{
+			name:       "repeated within ttl",
+			constraint: "9.9.9",
+			advance:    time.Second,
+			wantCalls:  1,
+			wantCached: true,
+		},
+		{
+			name:       "constraint changed",
+			failure:    errors.New(`chart "envoy" matching 9.9.8 not found in stable index`),
+			constraint: "9.9.8",
+			wantCalls:  2,
+		},
+		{
+			name:       "expired",
+			failure:    errors.New(`chart "envoy" matching 9.9.9 not found in stable index`),
+			constraint: "9.9.9",
+			advance:    DefaultNegativeCacheTTL,
+			wantCalls:  3,
+		},
+		{
+			name:       "transient failures aren't cached",
+			failure:    errors.New("connection refused"),
+			constraint: "1.0.0",
+			wantCalls:  4,
+		},
+		{
+			name:       "transient failure repeated",
+			failure:    errors.New("connection refused"),
+			constraint: "1.0.0",
+			wantCalls:  5,
+		},
+		{
+			name:       "unrelated not found errors aren't cached",
+			failure:    errors.New(`exec: "helm": executable file not found in $PATH`),
+			constraint: "2.0.0",
+			wantCalls:  6,
+		},
+		{
+			name:       "unrelated not found error repeated",
+			constraint: "2.0.0",
+			wantCalls:  7,
+		},
+		{
+			name:       "helm v3 failure",
+			failure:    errors.New("Error: can't get a valid version for repositories envoy. Try changing the version constraint in Chart.yaml"),
+			constraint: "3.0.0",
+			wantCalls:  8,
+		},
+		{
+			name:       "helm v3 failure repeated",
+			constraint: "3.0.0",
+			wantCalls:  8,
+			wantCached: true,
+		},
+	}
+
+	for _, s := range steps {
+		now = now.Add(s.advance)
+		if s.failure != nil {
+			failure = s.failure
+		}
+
+		err := update(s.constraint)
+		if err == nil {
+			t.Fatalf("%s: expected error, got none", s.name)
+		}
+		if calls != s.wantCalls {
+			t.Errorf("%s: unexpected number of dependency updates: expected=%d, got=%d", s.name, s.wantCalls, calls)
+		}
+		if cached := strings.Contains(err.Error(), "cached failure"); cached != s.wantCached {
+			t.Errorf("%s: unexpected cached failure: expected=%v, got=%v: %v", s.name, s.wantCached, cached, err)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package state
+
+import (
+	"fmt"
+	"strings"
+)
+
+// splitNestedChart splits the chart reference with a nested path in a repository, like `myrepo/library/nginx` for a Harbor project,
+// into the repository name `myrepo`, the path `library` and the chart name `nginx`
+func splitNestedChart(chart string) (string, string, string, bool) {
+	if strings.HasPrefix(chart, ".") || strings.HasPrefix(chart, "/") || strings.Contains(chart, "://") {
+		return "", "", "", false
+	}
+	parts := strings.Split(chart, "/")
+	if len(parts) < 3 {
+		return "", "", "", false
+	}
+	return parts[0], strings.Join(parts[1:len(parts)-1], "/"), parts[len(parts)-1], true
+}
+
+// nestedRepository returns the repository declared in the state that the nested chart path belongs to, along with the path and the chart name
+func (st *HelmState) nestedRepository(chart string) (*RepositorySpec, string, string, bool) {
+	repo, path, name, ok := splitNestedChart(chart)
+	if !ok {
+		return nil, "", "", false
+	}
+	for i := range st.Repositories {
+		if st.Repositories[i].Name == repo {
+			return &st.Repositories[i], path, name, true
+		}
+	}
+	return nil, "", "", false
+}
+
+// validateChartReference fails on nested chart paths in declared repositories with empty path segments, like `myrepo//nginx`,
+// which would otherwise be mistaken for local charts
+func (st *HelmState) validateChartReference(chart string) error {
+	if _, path, name, ok := st.nestedRepository(chart); ok {
+		for _, segment := range strings.Split(path, "/") {
+			if segment == "" {
+				return fmt.Errorf("invalid chart %q: the path in the repository contains an empty segment", chart)
+			}
+		}
+		if name == "" {
+			return fmt.Errorf("invalid chart %q: the chart name is empty", chart)
+		}
+	}
+	return nil
+}
+
+// resolveRemoteChart is resolveRemoteChart, aware of the nested chart paths in the repositories declared in the state.
+// For `myrepo/library/nginx`, it returns the repository `myrepo/library`, which is mapped to `<url of myrepo>/library` by repositoryURLs.
+func (st *HelmState) resolveRemoteChart(chart string) (string, string, bool) {
+	if repo, path, name, ok := st.nestedRepository(chart); ok && st.validateChartReference(chart) == nil {
+		return repo.Name + "/" + path, name, true
+	}
+	return resolveRemoteChart(chart)
+}
+
+// isLocalChart is isLocalChart, except that nested chart paths in the repositories declared in the state aren't local charts
+func (st *HelmState) isLocalChart(chart string) bool {
+	if _, _, _, ok := st.nestedRepository(chart); ok {
+		return false
+	}
+	return isLocalChart(chart)
+}
+
+// nestedRepositories returns the repositories for the nested chart paths referenced by releases, keyed by names like `myrepo/library`.
+// Each is its parent repository with the path appended to the URL, and keeps the parent's name so that credentials are looked up for the parent.
+func (st *HelmState) nestedRepositories() map[string]RepositorySpec {
+	nested := map[string]RepositorySpec{}
+	for _, r := range st.Releases {
+		parent, path, _, ok := st.nestedRepository(r.Chart)
+		if !ok || st.validateChartReference(r.Chart) != nil {
+			continue
+		}
+		repo := *parent
+		repo.URL = strings.TrimSuffix(parent.URL, "/") + "/" + path
+		repo.Mirrors = nil
+		nested[parent.Name+"/"+path] = repo
+	}
+	return nested
+}
+
+// helmRepositoryName returns the name of the repository added to helm for the nested repository name like `myrepo/library`,
+// as helm doesn't allow slashes in repository names
+func helmRepositoryName(name string) string {
+	return strings.Replace(name, "/", "-", -1)
+}
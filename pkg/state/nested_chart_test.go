@@ -0,0 +1,151 @@
+package state
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/roboll/helmfile/pkg/testhelper"
+)
+
+func TestSplitNestedChart(t *testing.T) {
+	tests := []struct {
+		chart string
+		repo  string
+		path  string
+		name  string
+		ok    bool
+	}{
+		{chart: "myrepo/library/nginx", repo: "myrepo", path: "library", name: "nginx", ok: true},
+		{chart: "myrepo/team/library/nginx", repo: "myrepo", path: "team/library", name: "nginx", ok: true},
+		{chart: "myrepo//nginx", repo: "myrepo", path: "", name: "nginx", ok: true},
+		{chart: "stable/envoy"},
+		{chart: "./charts/myapp/sub"},
+		{chart: "/path/to/charts/myapp"},
+		{chart: "oci://registry.example.com/charts/myapp"},
+	}
+
+	for _, tt := range tests {
+		repo, path, name, ok := splitNestedChart(tt.chart)
+		if repo != tt.repo || path != tt.path || name != tt.name || ok != tt.ok {
+			t.Errorf("unexpected split of %s: expected=(%s, %s, %s, %v), got=(%s, %s, %s, %v)", tt.chart, tt.repo, tt.path, tt.name, tt.ok, repo, path, name, ok)
+		}
+	}
+}
+
+func TestHelmState_ResolveRemoteChartNested(t *testing.T) {
+	state := &HelmState{
+		Repositories: []RepositorySpec{
+			{Name: "myrepo", URL: "https://harbor.example.com/chartrepo"},
+		},
+	}
+
+	tests := []struct {
+		chart string
+		repo  string
+		name  string
+		ok    bool
+	}{
+		{chart: "myrepo/library/nginx", repo: "myrepo/library", name: "nginx", ok: true},
+		{chart: "stable/envoy", repo: "stable", name: "envoy", ok: true},
+		{chart: "other/library/nginx"},
+		{chart: "myrepo//nginx"},
+	}
+
+	for _, tt := range tests {
+		repo, name, ok := state.resolveRemoteChart(tt.chart)
+		if repo != tt.repo || name != tt.name || ok != tt.ok {
+			t.Errorf("unexpected resolution of %s: expected=(%s, %s, %v), got=(%s, %s, %v)", tt.chart, tt.repo, tt.name, tt.ok, repo, name, ok)
+		}
+	}
+}
+
+func TestGetUnresolvedDependencies_Nested(t *testing.T) {
+	state := injectFs(&HelmState{
+		FilePath: "/path/to/helmfile.yaml",
+		Releases: []ReleaseSpec{
+			{Name: "nginx", Chart: "myrepo/library/nginx", Version: "~1.0"},
+		},
+		Repositories: []RepositorySpec{
+			{Name: "myrepo", URL: "https://harbor.example.com/chartrepo/"},
+		},
+		logger: logger,
+	}, testhelper.NewTestFs(map[string]string{}))
+
+	_, unresolved, err := getUnresolvedDependenciess(state)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[string][]unresolvedChartDependency{
+		"nginx": {{ChartName: "nginx", Repository: "https://harbor.example.com/chartrepo/library", VersionConstraint: "~1.0"}},
+	}
+	if !reflect.DeepEqual(unresolved.deps, expected) {
+		t.Errorf("unexpected dependencies: expected=%v, got=%v", expected, unresolved.deps)
+	}
+}
+
+func TestGetUnresolvedDependencies_InvalidNestedChart(t *testing.T) {
+	state := injectFs(&HelmState{
+		FilePath: "/path/to/helmfile.yaml",
+		Releases: []ReleaseSpec{
+			{Name: "nginx", Chart: "myrepo//nginx"},
+		},
+		Repositories: []RepositorySpec{
+			{Name: "myrepo", URL: "https://harbor.example.com/chartrepo"},
+		},
+		logger: logger,
+	}, testhelper.NewTestFs(map[string]string{}))
+
+	_, _, err := getUnresolvedDependenciess(state)
+	if err == nil {
+		t.Fatal("expected error, got none")
+	}
+	expected := `release "nginx": invalid chart "myrepo//nginx": the path in the repository contains an empty segment`
+	if err.Error() != expected {
+		t.Errorf("unexpected error: expected=%s, got=%s", expected, err.Error())
+	}
+}
+
+func TestHelmState_ChartReferenceNested(t *testing.T) {
+	state := &HelmState{
+		basePath: "/path/to",
+		Releases: []ReleaseSpec{
+			{Name: "nginx", Chart: "myrepo/library/nginx"},
+			{Name: "myapp", Chart: "myregistry/team/myapp"},
+		},
+		Repositories: []RepositorySpec{
+			{Name: "myrepo", URL: "https://harbor.example.com/chartrepo"},
+			{Name: "myregistry", URL: "oci://registry.example.com/charts"},
+		},
+	}
+
+	tests := map[string]string{
+		"myrepo/library/nginx":  "myrepo-library/nginx",
+		"myregistry/team/myapp": "oci://registry.example.com/charts/team/myapp",
+	}
+	for chart, expected := range tests {
+		if actual := state.chartReference(chart); actual != expected {
+			t.Errorf("unexpected chart reference for %s: expected=%s, got=%s", chart, expected, actual)
+		}
+	}
+}
+
+func TestHelmState_SyncReposNested(t *testing.T) {
+	helm := &mockHelmExec{}
+	state := &HelmState{
+		Releases: []ReleaseSpec{
+			{Name: "nginx", Chart: "myrepo/library/nginx"},
+		},
+		Repositories: []RepositorySpec{
+			{Name: "myrepo", URL: "https://harbor.example.com/chartrepo/", Username: "user", Password: "pass"},
+		},
+	}
+
+	if errs := state.SyncRepos(helm); len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	expected := []string{"myrepo-library", "https://harbor.example.com/chartrepo/library", "", "", "user", "pass"}
+	if !reflect.DeepEqual(helm.repo, expected) {
+		t.Errorf("unexpected repository added: expected=%v, got=%v", expected, helm.repo)
+	}
+}
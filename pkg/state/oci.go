@@ -0,0 +1,192 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// isOCIRepository returns true when the URL points to a path in an OCI registry, like `oci://registry.example.com/charts`
+func isOCIRepository(url string) bool {
+	return strings.HasPrefix(url, "oci://")
+}
+
+// splitOCIChart splits the chart reference like `oci://registry.example.com/charts/myapp`
+// into the repository `oci://registry.example.com/charts` and the chart name `myapp`
+func splitOCIChart(chart string) (string, string, bool) {
+	if !isOCIRepository(chart) {
+		return "", "", false
+	}
+	i := strings.LastIndex(chart, "/")
+	if i <= len("oci://") {
+		return "", "", false
+	}
+	return chart[:i], chart[i+1:], true
+}
+
+// registryHost returns the host of the OCI registry, like `registry.example.com` for `oci://registry.example.com/charts`
+func registryHost(repo string) string {
+	host := strings.TrimPrefix(repo, "oci://")
+	if i := strings.Index(host, "/"); i >= 0 {
+		host = host[:i]
+	}
+	return host
+}
+
+// chartReference returns the reference to the release's chart passed to helm.
+// Charts in OCI registries declared in `repositories`, like `myregistry/myapp`, are referenced by their full URLs,
+// as helm doesn't support repository names for OCI registries.
+// Nested chart paths like `myrepo/library/nginx` are referenced via the repositories added to helm for them, like `myrepo-library/nginx`.
+func (st *HelmState) chartReference(chart string) string {
+	if repo, name, ok := st.resolveRemoteChart(chart); ok {
+		if nested, ok := st.nestedRepositories()[repo]; ok {
+			if isOCIRepository(nested.URL) {
+				return nested.URL + "/" + name
+			}
+			return helmRepositoryName(repo) + "/" + name
+		}
+		for _, r := range st.Repositories {
+			if r.Name == repo && isOCIRepository(r.URL) {
+				return strings.TrimSuffix(r.URL, "/") + "/" + name
+			}
+		}
+	}
+	return normalizeChart(st.basePath, chart)
+}
+
+// ociTags is the response of the tag listing API of OCI registries
+type ociTags struct {
+	Tags []string `json:"tags"`
+}
+
+// FetchTags lists the tags of the chart in the OCI registry, as the registry has no `index.yaml`.
+// The tags are returned as the index of the chart, so that they can be resolved against version constraints as well as chart repositories.
+func (f *repoIndexFetcher) FetchTags(repo RepositorySpec, chart string) (*repoIndex, error) {
+	host := registryHost(repo.URL)
+	path := strings.TrimPrefix(strings.TrimPrefix(strings.TrimSuffix(repo.URL, "/"), "oci://"+host), "/")
+	if path != "" {
+		path += "/"
+	}
+	tagsURL := fmt.Sprintf("https://%s/v2/%s%s/tags/list", host, path, chart)
+
+	f.logger.Debugf("listing the tags of %s in the registry %s from %s", chart, repo.URL, tagsURL)
+
+	res, err := f.getRegistry(tagsURL, repo)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list the tags of %s in the registry %s: %v", chart, repo.URL, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to list the tags of %s in the registry %s: unexpected status %s", chart, repo.URL, res.Status)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var tags ociTags
+	if err := json.Unmarshal(body, &tags); err != nil {
+		return nil, fmt.Errorf("unable to parse the tags of %s in the registry %s: %v", chart, repo.URL, err)
+	}
+
+	entries := []repoIndexEntry{}
+	for _, tag := range tags.Tags {
+		// Registries replace `+` in the build metadata of chart versions with `_`, as `+` isn't allowed in tags
+		entries = append(entries, repoIndexEntry{Name: chart, Version: strings.Replace(tag, "_", "+", -1)})
+	}
+
+	return &repoIndex{Entries: map[string][]repoIndexEntry{chart: entries}}, nil
+}
+
+// getRegistry sends the GET request to the registry, following the bearer token authentication challenge of the registry if any
+func (f *repoIndexFetcher) getRegistry(u string, repo RepositorySpec) (*http.Response, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if repo.Username != "" || repo.Password != "" {
+		req.SetBasicAuth(repo.Username, repo.Password)
+	}
+
+	res, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	challenge := res.Header.Get("WWW-Authenticate")
+	if res.StatusCode != http.StatusUnauthorized || !strings.HasPrefix(challenge, "Bearer ") {
+		return res, nil
+	}
+	res.Body.Close()
+
+	token, err := f.registryToken(challenge, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err = http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return f.client.Do(req)
+}
+
+// registryToken obtains the bearer token from the realm in the authentication challenge like
+// `Bearer realm="https://auth.example.com/token",service="registry.example.com",scope="repository:charts/myapp:pull"`
+func (f *repoIndexFetcher) registryToken(challenge string, repo RepositorySpec) (string, error) {
+	params := map[string]string{}
+	for _, p := range strings.Split(strings.TrimPrefix(challenge, "Bearer "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+		if len(kv) == 2 {
+			params[kv[0]] = strings.Trim(kv[1], `"`)
+		}
+	}
+
+	realm, ok := params["realm"]
+	if !ok {
+		return "", fmt.Errorf("no realm in the authentication challenge %q", challenge)
+	}
+
+	query := url.Values{}
+	for _, k := range []string{"service", "scope"} {
+		if v, ok := params[k]; ok {
+			query.Set(k, v)
+		}
+	}
+
+	req, err := http.NewRequest("GET", realm+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	if repo.Username != "" || repo.Password != "" {
+		req.SetBasicAuth(repo.Username, repo.Password)
+	}
+
+	res, err := f.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unable to obtain the token from %s: unexpected status %s", realm, res.Status)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	if token.Token != "" {
+		return token.Token, nil
+	}
+	return token.AccessToken, nil
+}
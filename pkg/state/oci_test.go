@@ -0,0 +1,156 @@
+package state
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/roboll/helmfile/pkg/testhelper"
+)
+
+func TestSplitOCIChart(t *testing.T) {
+	tests := []struct {
+		chart string
+		repo  string
+		name  string
+		ok    bool
+	}{
+		{chart: "oci://registry.example.com/charts/myapp", repo: "oci://registry.example.com/charts", name: "myapp", ok: true},
+		{chart: "oci://registry.example.com/myapp", repo: "oci://registry.example.com", name: "myapp", ok: true},
+		{chart: "oci://registry.example.com"},
+		{chart: "stable/envoy"},
+	}
+
+	for _, tt := range tests {
+		repo, name, ok := splitOCIChart(tt.chart)
+		if repo != tt.repo || name != tt.name || ok != tt.ok {
+			t.Errorf("unexpected split of %s: expected=(%s, %s, %v), got=(%s, %s, %v)", tt.chart, tt.repo, tt.name, tt.ok, repo, name, ok)
+		}
+	}
+}
+
+func TestHelmState_ChartReference(t *testing.T) {
+	state := &HelmState{
+		basePath: "/path/to",
+		Repositories: []RepositorySpec{
+			{Name: "myregistry", URL: "oci://registry.example.com/charts/"},
+			{Name: "stable", URL: "https://stable.example.com"},
+		},
+	}
+
+	tests := map[string]string{
+		"myregistry/myapp":                        "oci://registry.example.com/charts/myapp",
+		"oci://registry.example.com/charts/myapp": "oci://registry.example.com/charts/myapp",
+		"stable/envoy":                            "stable/envoy",
+		"./charts/myapp":                          "/path/to/charts/myapp",
+	}
+	for chart, expected := range tests {
+		if actual := state.chartReference(chart); actual != expected {
+			t.Errorf("unexpected chart reference for %s: expected=%s, got=%s", chart, expected, actual)
+		}
+	}
+}
+
+func TestGetUnresolvedDependencies_OCI(t *testing.T) {
+	state := injectFs(&HelmState{
+		FilePath: "/path/to/helmfile.yaml",
+		Releases: []ReleaseSpec{
+			{Name: "myapp", Chart: "oci://registry.example.com/charts/myapp", Version: "~1.0"},
+			{Name: "other", Chart: "myregistry/other"},
+		},
+		Repositories: []RepositorySpec{
+			{Name: "myregistry", URL: "oci://registry.example.com/other"},
+		},
+		logger: logger,
+	}, testhelper.NewTestFs(map[string]string{}))
+
+	_, unresolved, err := getUnresolvedDependenciess(state)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[string][]unresolvedChartDependency{
+		"myapp": {{ChartName: "myapp", Repository: "oci://registry.example.com/charts", VersionConstraint: "~1.0"}},
+		"other": {{ChartName: "other", Repository: "oci://registry.example.com/other"}},
+	}
+	if !reflect.DeepEqual(unresolved.deps, expected) {
+		t.Errorf("unexpected dependencies: expected=%v, got=%v", expected, unresolved.deps)
+	}
+}
+
+func TestHelmState_SyncReposOCI(t *testing.T) {
+	helm := &mockHelmExec{}
+	state := &HelmState{
+		Repositories: []RepositorySpec{
+			{Name: "myregistry", URL: "oci://registry.example.com/charts", Username: "user", Password: "pass"},
+		},
+	}
+
+	if errs := state.SyncRepos(helm); len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if helm.repo != nil {
+		t.Errorf("unexpected repository added: %v", helm.repo)
+	}
+	expected := []string{"registry.example.com", "user", "pass"}
+	if !reflect.DeepEqual(helm.registry, expected) {
+		t.Errorf("unexpected registry login: expected=%v, got=%v", expected, helm.registry)
+	}
+}
+
+func TestRepoIndexFetcher_FetchTags(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			if user, pass, ok := r.BasicAuth(); !ok || user != "user" || pass != "pass" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if r.URL.Query().Get("scope") != "repository:charts/myapp:pull" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.Write([]byte(`{"token": "mytoken"}`))
+		case "/v2/charts/myapp/tags/list":
+			if r.Header.Get("Authorization") != "Bearer mytoken" {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="registry",scope="repository:charts/myapp:pull"`, server.URL))
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"name": "charts/myapp", "tags": ["1.0.0", "1.1.0", "1.1.1_build.1"]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	fetcher := newRepoIndexFetcher(logger)
+	fetcher.client = server.Client()
+
+	repo := RepositorySpec{URL: "oci://" + strings.TrimPrefix(server.URL, "https://") + "/charts", Username: "user", Password: "pass"}
+	index, err := fetcher.FetchTags(repo, "myapp")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []repoIndexEntry{
+		{Name: "myapp", Version: "1.0.0"},
+		{Name: "myapp", Version: "1.1.0"},
+		{Name: "myapp", Version: "1.1.1+build.1"},
+	}
+	if !reflect.DeepEqual(index.Entries["myapp"], expected) {
+		t.Errorf("unexpected entries: expected=%v, got=%v", expected, index.Entries["myapp"])
+	}
+
+	latest, err := index.latestVersion("myapp", "~1.1.0", 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if latest != "1.1.1+build.1" {
+		t.Errorf("unexpected latest version: expected=1.1.1+build.1, got=%s", latest)
+	}
+}
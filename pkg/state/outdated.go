@@ -0,0 +1,107 @@
+package state
+
+import (
+	"fmt"
+
+	"github.com/Masterminds/semver"
+)
+
+// ReleaseVersion is the chart version of a release, along with the versions available in the chart's repository
+type ReleaseVersion struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace,omitempty"`
+	Chart     string `json:"chart"`
+	// Version is the locked version of the chart, or the declared version when the chart isn't locked
+	Version string `json:"version"`
+	// Wanted is the latest version in the repository satisfying the declared version constraint
+	Wanted string `json:"wanted,omitempty"`
+	// Latest is the latest version in the repository
+	Latest string `json:"latest,omitempty"`
+}
+
+// Outdated returns true when a version newer than the current one is available in the repository
+func (v ReleaseVersion) Outdated() bool {
+	if v.Latest == "" {
+		return false
+	}
+
+	latest, err := semver.NewVersion(v.Latest)
+	if err != nil {
+		return false
+	}
+
+	current, err := semver.NewVersion(v.Version)
+	if err != nil {
+		// Versions like `*` and `~1.2` aren't pinned to any version yet
+		return true
+	}
+
+	return latest.GreaterThan(current)
+}
+
+// ReleaseVersions returns the chart versions of the releases, resolved from the lock file.
+// When checkRepositories is true, the latest versions available in the repositories of remote charts are looked up from their indexes.
+func (st *HelmState) ReleaseVersions(checkRepositories bool) ([]ReleaseVersion, error) {
+	if checkRepositories && st.DependencyResolution.Offline {
+		return nil, fmt.Errorf("unable to check the latest chart versions offline, as fetching repository indexes requires network access")
+	}
+
+	resolved, err := st.ResolveDeps()
+	if err != nil {
+		return nil, err
+	}
+
+	filename, _, err := getUnresolvedDependenciess(st)
+	if err != nil {
+		return nil, err
+	}
+	depMan := st.newChartDependencyManager(filename)
+	repoToURL := st.repositoryURLs()
+	indexes := map[string]*repoIndex{}
+
+	versions := []ReleaseVersion{}
+	for i, r := range st.Releases {
+		v := ReleaseVersion{
+			Name:      r.Name,
+			Namespace: r.Namespace,
+			Chart:     r.Chart,
+			Version:   resolved.Releases[i].Version,
+		}
+
+		repo, chart, ok := st.resolveRemoteChart(r.Chart)
+		url, declared := repoToURL[repo]
+		if !checkRepositories || !ok || !declared {
+			versions = append(versions, v)
+			continue
+		}
+
+		key := indexKey(url, chart)
+		index, ok := indexes[key]
+		if !ok {
+			index, err = depMan.fetchIndex(url, chart)
+			if err != nil {
+				return nil, err
+			}
+			indexes[key] = index
+		}
+
+		if latest, err := index.latestVersion(chart, "", depMan.MaxVersionsPerChart); err == nil {
+			v.Latest = latest
+		}
+
+		// Version references are resolved only against the versions of other charts, so there's no wanted version for them
+		if ref, err := parseVersionReference(r.Version); err == nil && ref == nil {
+			constraint, err := st.versionConstraint(r, chart)
+			if err != nil {
+				return nil, err
+			}
+			if wanted, err := index.latestVersion(chart, constraint, depMan.MaxVersionsPerChart); err == nil {
+				v.Wanted = wanted
+			}
+		}
+
+		versions = append(versions, v)
+	}
+
+	return versions, nil
+}
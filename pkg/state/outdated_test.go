@@ -0,0 +1,72 @@
+package state
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/roboll/helmfile/pkg/testhelper"
+)
+
+func TestHelmState_ReleaseVersions(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`entries:
+  envoy:
+  - name: envoy
+    version: 2.0.0
+  - name: envoy
+    version: 1.6.0
+  - name: envoy
+    version: 1.5.0
+  mysql:
+  - name: mysql
+    version: 1.0.0
+`))
+	}))
+	defer server.Close()
+
+	fs := testhelper.NewTestFs(map[string]string{
+		"/path/to/helmfile.lock": `dependencies:
+- name: envoy
+  repository: ` + server.URL + `
+  version: 1.5.0
+- name: mysql
+  repository: ` + server.URL + `
+  version: 1.0.0
+`,
+	})
+	state := injectFs(&HelmState{
+		FilePath: "/path/to/helmfile.yaml",
+		Releases: []ReleaseSpec{
+			{Name: "envoy", Namespace: "proxy", Chart: "myrepo/envoy", Version: "^1.5"},
+			{Name: "mysql", Chart: "myrepo/mysql"},
+			{Name: "app", Chart: "./charts/app"},
+		},
+		Repositories: []RepositorySpec{
+			{Name: "myrepo", URL: server.URL},
+		},
+		logger: logger,
+	}, fs)
+
+	actual, err := state.ReleaseVersions(true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []ReleaseVersion{
+		{Name: "envoy", Namespace: "proxy", Chart: "myrepo/envoy", Version: "1.5.0", Wanted: "1.6.0", Latest: "2.0.0"},
+		{Name: "mysql", Chart: "myrepo/mysql", Version: "1.0.0", Wanted: "1.0.0", Latest: "1.0.0"},
+		{Name: "app", Chart: "./charts/app"},
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("unexpected release versions:\nexpected=%v\ngot=%v", expected, actual)
+	}
+
+	outdated := []bool{true, false, false}
+	for i, v := range actual {
+		if v.Outdated() != outdated[i] {
+			t.Errorf("unexpected outdated for %s: expected=%v, got=%v", v.Name, outdated[i], v.Outdated())
+		}
+	}
+}
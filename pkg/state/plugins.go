@@ -0,0 +1,74 @@
+package state
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/roboll/helmfile/pkg/helmexec"
+)
+
+// helmPlugins are the URLs the helm plugins helmfile runs are installed from, keyed by the plugin names
+var helmPlugins = map[string]string{
+	"diff":    "https://github.com/databus23/helm-diff",
+	"secrets": "https://github.com/futuresimple/helm-secrets",
+}
+
+// requiredPlugins returns the names of the helm plugins the helmfile command needs for the releases:
+// helm-diff for `helmfile diff` and `helmfile apply`, and helm-secrets for releases with secrets
+func (st *HelmState) requiredPlugins(helmfileCommand string) []string {
+	plugins := []string{}
+	if helmfileCommand == "diff" || helmfileCommand == "apply" {
+		plugins = append(plugins, "diff")
+	}
+	for _, r := range st.Releases {
+		if len(r.Secrets) > 0 {
+			plugins = append(plugins, "secrets")
+			break
+		}
+	}
+	return plugins
+}
+
+// ensurePlugins installs the missing helm plugins when helmDefaults.installPlugins is enabled, or fails with the instruction to install them otherwise,
+// instead of letting helm fail with an unknown command error in the middle of the run
+func (st *HelmState) ensurePlugins(helm helmexec.Interface, plugins ...string) error {
+	if len(plugins) == 0 {
+		return nil
+	}
+
+	manager, ok := helm.(helmexec.PluginManager)
+	if !ok {
+		return nil
+	}
+
+	installed, err := manager.ListPlugins()
+	if err != nil {
+		// Leave it to helm to tell whether the plugins are missing, as older helm binaries may be unable to list plugins
+		st.logger.Debugf("unable to list helm plugins: %v", err)
+		return nil
+	}
+	has := map[string]bool{}
+	for _, p := range installed {
+		has[p] = true
+	}
+
+	missing := []string{}
+	for _, p := range plugins {
+		if !has[p] {
+			missing = append(missing, p)
+		}
+	}
+	sort.Strings(missing)
+
+	for _, p := range missing {
+		url := helmPlugins[p]
+		if !st.HelmDefaults.InstallPlugins {
+			return fmt.Errorf("the helm-%s plugin is required but not installed: run `helm plugin install %s`, or set `helmDefaults.installPlugins: true` to install it automatically", p, url)
+		}
+		if err := manager.InstallPlugin(url); err != nil {
+			return fmt.Errorf("unable to install the helm-%s plugin: %v", p, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,94 @@
+package state
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type mockPluginHelmExec struct {
+	mockHelmExec
+	plugins   []string
+	installed []string
+}
+
+func (helm *mockPluginHelmExec) ListPlugins() ([]string, error) {
+	return helm.plugins, nil
+}
+
+func (helm *mockPluginHelmExec) InstallPlugin(url string) error {
+	helm.installed = append(helm.installed, url)
+	return nil
+}
+
+func TestHelmState_EnsurePlugins(t *testing.T) {
+	tests := []struct {
+		name      string
+		command   string
+		secrets   bool
+		install   bool
+		plugins   []string
+		installed []string
+		err       string
+	}{
+		{
+			name:      "installs helm-diff for apply",
+			command:   "apply",
+			install:   true,
+			installed: []string{"https://github.com/databus23/helm-diff"},
+		},
+		{
+			name:      "installs helm-secrets for releases with secrets",
+			command:   "sync",
+			secrets:   true,
+			install:   true,
+			plugins:   []string{"diff"},
+			installed: []string{"https://github.com/futuresimple/helm-secrets"},
+		},
+		{
+			name:    "installed plugins",
+			command: "diff",
+			secrets: true,
+			install: true,
+			plugins: []string{"diff", "secrets"},
+		},
+		{
+			name:    "fails without opt-in",
+			command: "diff",
+			err:     "the helm-diff plugin is required but not installed",
+		},
+		{
+			name:    "no plugins needed",
+			command: "sync",
+		},
+	}
+
+	for _, tt := range tests {
+		release := ReleaseSpec{Name: "foo", Chart: "stable/foo"}
+		if tt.secrets {
+			release.Secrets = []string{"secrets.yaml"}
+		}
+		state := &HelmState{
+			HelmDefaults: HelmSpec{InstallPlugins: tt.install},
+			Releases:     []ReleaseSpec{release},
+			logger:       logger,
+		}
+		helm := &mockPluginHelmExec{plugins: tt.plugins}
+
+		err := state.ensurePlugins(helm, state.requiredPlugins(tt.command)...)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: unexpected error: expected=%s, got=%v", tt.name, tt.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		}
+		if len(helm.installed) != 0 || len(tt.installed) != 0 {
+			if !reflect.DeepEqual(helm.installed, tt.installed) {
+				t.Errorf("%s: unexpected installed plugins: expected=%v, got=%v", tt.name, tt.installed, helm.installed)
+			}
+		}
+	}
+}
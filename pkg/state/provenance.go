@@ -0,0 +1,125 @@
+package state
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/roboll/helmfile/pkg/helmexec"
+	"gopkg.in/yaml.v2"
+)
+
+// isVerified returns true when the provenance of the release's chart is verified via `--verify`
+func (st *HelmState) isVerified(release *ReleaseSpec) bool {
+	return release.Verify != nil && *release.Verify || release.Verify == nil && st.HelmDefaults.Verify
+}
+
+// keyring returns the keyring the provenance of the release's chart is verified with. Empty means helm's default keyring.
+func (st *HelmState) keyring(release *ReleaseSpec) string {
+	if release.Keyring != "" {
+		return expandHome(release.Keyring)
+	}
+	return expandHome(st.HelmDefaults.Keyring)
+}
+
+// appendVerifyFlags appends `--verify` and `--keyring` when the provenance of the release's chart is verified
+func (st *HelmState) appendVerifyFlags(flags []string, release *ReleaseSpec) []string {
+	if !st.isVerified(release) {
+		return flags
+	}
+	flags = append(flags, "--verify")
+	if keyring := st.keyring(release); keyring != "" {
+		flags = append(flags, "--keyring", keyring)
+	}
+	return flags
+}
+
+// provenanceKeyrings returns the keyrings of the remote charts whose provenance is verified, keyed by the chart names
+func (st *HelmState) provenanceKeyrings() map[string]string {
+	keyrings := map[string]string{}
+	for i := range st.Releases {
+		r := &st.Releases[i]
+		if !st.isVerified(r) || isGitChart(r.Chart) {
+			continue
+		}
+		chart, _, ok := splitChartURL(r.Chart)
+		if !ok {
+			_, chart, ok = st.resolveRemoteChart(r.Chart)
+		}
+		if ok {
+			keyrings[chart] = st.keyring(r)
+		}
+	}
+	return keyrings
+}
+
+// verifyProvenance fetches the locked charts whose provenance is verified with `helm fetch --verify`, with the credentials of their repositories,
+// so that a chart version whose provenance file fails validation is never locked.
+// Chart versions already in the current lock file were verified when they were locked, and aren't fetched again.
+func (m *chartDependencyManager) verifyProvenance(shell helmexec.DependencyUpdater, deps []ResolvedChartDependency, lockFileContent []byte) error {
+	if len(m.ProvenanceKeyrings) == 0 {
+		return nil
+	}
+
+	fetcher, ok := shell.(helmexec.ChartFetcher)
+	if !ok {
+		return fmt.Errorf("unable to verify the provenance of charts, as the dependency updater doesn't fetch charts")
+	}
+
+	current := &ChartLockedRequirements{}
+	if lockFileContent != nil {
+		if err := yaml.Unmarshal(lockFileContent, current); err != nil {
+			return err
+		}
+	}
+	verified := map[ResolvedChartDependency]bool{}
+	for _, d := range current.ResolvedDependencies {
+		verified[ResolvedChartDependency{ChartName: d.ChartName, Repository: d.Repository, Version: d.Version}] = true
+	}
+
+	var tempDir string
+	defer func() {
+		if tempDir != "" {
+			os.RemoveAll(tempDir)
+		}
+	}()
+
+	for _, dep := range deps {
+		keyring, ok := m.ProvenanceKeyrings[dep.ChartName]
+		if !ok || isGitChart(dep.Repository) {
+			continue
+		}
+
+		if verified[ResolvedChartDependency{ChartName: dep.ChartName, Repository: dep.Repository, Version: dep.Version}] {
+			continue
+		}
+
+		if m.Offline {
+			m.warn(ResolutionWarningProvenance, dep.ChartName, "unable to verify the provenance of %s %s offline", dep.ChartName, dep.Version)
+			continue
+		}
+
+		if tempDir == "" {
+			var err error
+			tempDir, err = ioutil.TempDir("", "helmfile-provenance")
+			if err != nil {
+				return fmt.Errorf("unable to create dir: %v", err)
+			}
+		}
+
+		chart, flags, err := m.fetchArgs(dep)
+		if err != nil {
+			return err
+		}
+		flags = append(flags, "--verify", "--destination", tempDir)
+		if keyring != "" {
+			flags = append(flags, "--keyring", keyring)
+		}
+
+		if err := fetcher.Fetch(chart, flags...); err != nil {
+			return fmt.Errorf("refusing to lock %s %s from %s, as its provenance failed validation: %v", dep.ChartName, dep.Version, dep.Repository, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,161 @@
+package state
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fetchingDependencyUpdater updates dependencies with the func, and records the charts fetched for verifying their provenance
+type fetchingDependencyUpdater struct {
+	dependencyUpdaterFunc
+	fetchErr error
+	fetched  [][]string
+}
+
+func (u *fetchingDependencyUpdater) Fetch(chart string, flags ...string) error {
+	u.fetched = append(u.fetched, append([]string{chart}, flags...))
+	return u.fetchErr
+}
+
+func TestChartDependencyManager_Update_VerifyProvenance(t *testing.T) {
+	tests := []struct {
+		name     string
+		locked   string
+		username string
+		fetchErr error
+		fetched  bool
+		wantErr  string
+	}{
+		{name: "valid provenance", fetched: true},
+		{name: "credentials", username: "user", fetched: true},
+		{
+			name: "already locked",
+			locked: `dependencies:
+- name: envoy
+  repository: https://stable.example.com
+  version: 1.5.0
+digest: sha256:old
+generated: "2019-05-01T00:00:00Z"
+`,
+		},
+		{name: "invalid provenance", fetchErr: fmt.Errorf("openpgp: signature made by unknown entity"), wantErr: "refusing to lock envoy 1.5.0 from https://stable.example.com, as its provenance failed validation: openpgp: signature made by unknown entity"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wd, err := ioutil.TempDir("", "")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer os.RemoveAll(wd)
+
+			files := map[string]string{}
+			depMan := NewChartDependencyManager("helmfile", logger)
+			depMan.now = lockFileTime
+			depMan.ProvenanceKeyrings = map[string]string{"envoy": "/keys/pubring.gpg"}
+			depMan.repos = map[string]RepositorySpec{"https://stable.example.com": {Name: "stable", URL: "https://stable.example.com", Username: tt.username}}
+			if tt.locked != "" {
+				files["helmfile.lock"] = tt.locked
+			}
+			depMan.readFile = func(filename string) ([]byte, error) {
+				if content, ok := files[filename]; ok {
+					return []byte(content), nil
+				}
+				return ioutil.ReadFile(filename)
+			}
+			depMan.writeFile = func(filename string, data []byte, perm os.FileMode) error {
+				if filepath.Dir(filename) == wd {
+					return ioutil.WriteFile(filename, data, perm)
+				}
+				files[filename] = string(data)
+				return nil
+			}
+
+			shell := &fetchingDependencyUpdater{
+				dependencyUpdaterFunc: func(chart string) error {
+					return ioutil.WriteFile(filepath.Join(chart, "requirements.lock"), []byte(`dependencies:
+- name: envoy
+  repository: https://stable.example.com
+  version: 1.5.0
+- name: mysql
+  repository: https://stable.example.com
+  version: 1.0.0
+digest: sha256:new
+generated: "2019-06-01T00:00:00Z"
+`), 0644)
+				},
+				fetchErr: tt.fetchErr,
+			}
+
+			unresolved := &UnresolvedDependencies{deps: map[string][]unresolvedChartDependency{}}
+			unresolved.Add("envoy", "https://stable.example.com", "")
+			unresolved.Add("mysql", "https://stable.example.com", "")
+
+			_, err = depMan.Update(shell, wd, unresolved)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("unexpected error: expected=%s, got=%v", tt.wantErr, err)
+				}
+				if _, ok := files["helmfile.lock"]; ok {
+					t.Errorf("unexpected lock file written for the chart failing provenance validation")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !tt.fetched {
+				if len(shell.fetched) != 0 {
+					t.Errorf("unexpected fetches of the chart already locked: %v", shell.fetched)
+				}
+			} else {
+				if len(shell.fetched) != 1 {
+					t.Fatalf("unexpected fetches: %v", shell.fetched)
+				}
+				fetched := shell.fetched[0]
+				dest := fetched[len(fetched)-3]
+				expected := []string{"envoy", "--repo", "https://stable.example.com", "--version", "1.5.0"}
+				if tt.username != "" {
+					expected = append(expected, "--username", tt.username)
+				}
+				expected = append(expected, "--verify", "--destination", dest, "--keyring", "/keys/pubring.gpg")
+				if !reflect.DeepEqual(fetched, expected) {
+					t.Errorf("unexpected fetch: expected=%v, got=%v", expected, fetched)
+				}
+			}
+			if !strings.Contains(files["helmfile.lock"], "version: 1.5.0") {
+				t.Errorf("unexpected lock file: %s", files["helmfile.lock"])
+			}
+		})
+	}
+}
+
+func TestHelmState_provenanceKeyrings(t *testing.T) {
+	enable := true
+	disable := false
+	state := &HelmState{
+		HelmDefaults: HelmSpec{Verify: true, Keyring: "/keys/default.gpg"},
+		Releases: []ReleaseSpec{
+			{Name: "envoy", Chart: "stable/envoy"},
+			{Name: "mysql", Chart: "stable/mysql", Keyring: "/keys/mysql.gpg"},
+			{Name: "redis", Chart: "stable/redis", Verify: &disable},
+			{Name: "app", Chart: "https://example.com/charts/app-1.2.3.tgz", Verify: &enable},
+			{Name: "local", Chart: "./charts/local"},
+		},
+	}
+
+	expected := map[string]string{
+		"envoy": "/keys/default.gpg",
+		"mysql": "/keys/mysql.gpg",
+		"app":   "/keys/default.gpg",
+	}
+	if actual := state.provenanceKeyrings(); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("unexpected keyrings: expected=%v, got=%v", expected, actual)
+	}
+}
@@ -2,6 +2,8 @@ package state
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/roboll/helmfile/pkg/tmpl"
 	"gopkg.in/yaml.v2"
@@ -48,6 +50,19 @@ func (r ReleaseSpec) ExecuteTemplateExpressions(renderer *tmpl.FileRenderer) (*R
 		}
 	}
 
+	if result.InstalledTemplate != nil {
+		ts := *result.InstalledTemplate
+		s, err := renderer.RenderTemplateContentToString([]byte(ts))
+		if err != nil {
+			return nil, fmt.Errorf("failed executing template expressions in release \"%s\".installedTemplate = \"%s\": %v", r.Name, ts, err)
+		}
+		installed, err := strconv.ParseBool(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("failed executing template expressions in release \"%s\".installedTemplate = \"%s\": expected true or false, got \"%s\"", r.Name, ts, s)
+		}
+		result.Installed = &installed
+	}
+
 	for i, t := range result.Values {
 		switch ts := t.(type) {
 		case string:
@@ -56,6 +71,12 @@ func (r ReleaseSpec) ExecuteTemplateExpressions(renderer *tmpl.FileRenderer) (*R
 				return nil, fmt.Errorf("failed executing template expressions in release \"%s\".values[%d] = \"%s\": %v", r.Name, i, ts, err)
 			}
 			result.Values[i] = s.String()
+		case map[interface{}]interface{}:
+			v, err := renderValues(renderer, ts)
+			if err != nil {
+				return nil, fmt.Errorf("failed executing template expressions in release \"%s\".values[%d]: %v", r.Name, i, err)
+			}
+			result.Values[i] = v
 		}
 	}
 
@@ -70,6 +91,40 @@ func (r ReleaseSpec) ExecuteTemplateExpressions(renderer *tmpl.FileRenderer) (*R
 	return result, nil
 }
 
+// renderValues renders template expressions in the strings nested in inline values, keeping the other values as they are
+func renderValues(renderer *tmpl.FileRenderer, v interface{}) (interface{}, error) {
+	switch typed := v.(type) {
+	case string:
+		s, err := renderer.RenderTemplateContentToString([]byte(typed))
+		if err != nil {
+			return nil, fmt.Errorf("\"%s\": %v", typed, err)
+		}
+		return s, nil
+	case map[interface{}]interface{}:
+		m := map[interface{}]interface{}{}
+		for k, e := range typed {
+			r, err := renderValues(renderer, e)
+			if err != nil {
+				return nil, fmt.Errorf("%v: %v", k, err)
+			}
+			m[k] = r
+		}
+		return m, nil
+	case []interface{}:
+		a := make([]interface{}, len(typed))
+		for i, e := range typed {
+			r, err := renderValues(renderer, e)
+			if err != nil {
+				return nil, fmt.Errorf("[%d]: %v", i, err)
+			}
+			a[i] = r
+		}
+		return a, nil
+	default:
+		return v, nil
+	}
+}
+
 func (r ReleaseSpec) Clone() (*ReleaseSpec, error) {
 	serialized, err := yaml.Marshal(r)
 	if err != nil {
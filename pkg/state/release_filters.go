@@ -17,10 +17,54 @@ type ReleaseFilter interface {
 type LabelFilter struct {
 	positiveLabels [][]string
 	negativeLabels [][]string
+	// expressions are the set-based, existence and regex requirements like `tier in (frontend,backend)`
+	expressions []labelExpression
+}
+
+// labelExpression is a requirement on a label other than equality and inequality
+type labelExpression struct {
+	key      string
+	operator string
+	values   []string
+	regex    *regexp.Regexp
+}
+
+func (e labelExpression) match(labels map[string]string) bool {
+	v, ok := labels[e.key]
+	switch e.operator {
+	case "in":
+		return ok && containsString(e.values, v)
+	case "notin":
+		return !ok || !containsString(e.values, v)
+	case "exists":
+		return ok
+	case "!":
+		return !ok
+	case "=~":
+		return ok && e.regex.MatchString(v)
+	case "!~":
+		return !ok || !e.regex.MatchString(v)
+	}
+	return false
+}
+
+func containsString(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
 }
 
 // Match will match a release that has the same labels as the filter
 func (l LabelFilter) Match(r ReleaseSpec) bool {
+	for _, e := range l.expressions {
+		if !e.match(r.Labels) {
+			return false
+		}
+	}
+
 	if len(l.positiveLabels) > 0 {
 		for _, element := range l.positiveLabels {
 			k := element[0]
@@ -47,23 +91,76 @@ func (l LabelFilter) Match(r ReleaseSpec) bool {
 	return true
 }
 
-// ParseLabels takes a label in the form foo=bar,baz!=bat and returns a LabelFilter that will match the labels
+var (
+	labelSetPattern      = regexp.MustCompile(`^([a-zA-Z0-9_-]+)\s+(in|notin)\s+\(([^()]*)\)$`)
+	labelExistsPattern   = regexp.MustCompile(`^(!?)([a-zA-Z0-9_-]+)$`)
+	labelRegexPattern    = regexp.MustCompile(`^([a-zA-Z0-9_-]+)(=~|!~)(.+)$`)
+	labelSetValuePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+)
+
+// ParseLabels takes a label in the form foo=bar,baz!=bat and returns a LabelFilter that will match the labels.
+// Besides equality and inequality, it supports `foo in (bar,baz)`, `foo notin (bar,baz)`, `foo` and `!foo` for existence,
+// and `foo=~regex` and `foo!~regex` for regex matching.
 func ParseLabels(l string) (LabelFilter, error) {
 	lf := LabelFilter{}
 	lf.positiveLabels = [][]string{}
 	lf.negativeLabels = [][]string{}
 	var err error
-	labels := strings.Split(l, ",")
+	labels := splitSelector(l)
 	for _, label := range labels {
+		label = strings.TrimSpace(label)
 		if match, _ := regexp.MatchString("^[a-zA-Z0-9_-]+!=[a-zA-Z0-9_-]+$", label); match == true { // k!=v case
 			kv := strings.Split(label, "!=")
 			lf.negativeLabels = append(lf.negativeLabels, kv)
 		} else if match, _ := regexp.MatchString("^[a-zA-Z0-9_-]+=[a-zA-Z0-9_-]+$", label); match == true { // k=v case
 			kv := strings.Split(label, "=")
 			lf.positiveLabels = append(lf.positiveLabels, kv)
+		} else if m := labelSetPattern.FindStringSubmatch(label); m != nil { // k in (v1,v2) and k notin (v1,v2) cases
+			values := []string{}
+			for _, v := range strings.Split(m[3], ",") {
+				v = strings.TrimSpace(v)
+				if !labelSetValuePattern.MatchString(v) {
+					return lf, fmt.Errorf("Malformed label: %s. Expected values in form k in (v1,v2)", label)
+				}
+				values = append(values, v)
+			}
+			lf.expressions = append(lf.expressions, labelExpression{key: m[1], operator: m[2], values: values})
+		} else if m := labelExistsPattern.FindStringSubmatch(label); m != nil { // k and !k cases
+			operator := "exists"
+			if m[1] == "!" {
+				operator = "!"
+			}
+			lf.expressions = append(lf.expressions, labelExpression{key: m[2], operator: operator})
+		} else if m := labelRegexPattern.FindStringSubmatch(label); m != nil { // k=~regex and k!~regex cases
+			re, err := regexp.Compile(m[3])
+			if err != nil {
+				return lf, fmt.Errorf("Malformed label: %s. Invalid regex: %v", label, err)
+			}
+			lf.expressions = append(lf.expressions, labelExpression{key: m[1], operator: m[2], regex: re})
 		} else { // malformed case
-			return lf, fmt.Errorf("Malformed label: %s. Expected label in form k=v or k!=v", label)
+			return lf, fmt.Errorf("Malformed label: %s. Expected label in form k=v, k!=v, k in (v1,v2), k notin (v1,v2), k, !k, k=~regex or k!~regex", label)
 		}
 	}
 	return lf, err
 }
+
+// splitSelector splits the selector by commas, except the ones in parentheses, brackets and braces like `k in (v1,v2)` and `k=~v{1,2}`
+func splitSelector(l string) []string {
+	labels := []string{}
+	depth := 0
+	start := 0
+	for i, c := range l {
+		switch c {
+		case '(', '[', '{':
+			depth++
+		case ')', ']', '}':
+			depth--
+		case ',':
+			if depth == 0 {
+				labels = append(labels, l[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(labels, l[start:])
+}
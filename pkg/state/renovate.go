@@ -0,0 +1,40 @@
+package state
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// RenovateMetadata renders the chart versions locked for this state in a format consumable by the Renovate regex manager.
+// Each locked chart is annotated with a `# renovate:` comment containing its datasource, name and repository URL,
+// so that Renovate can propose bumps against the locked versions.
+func (st *HelmState) RenovateMetadata() ([]byte, error) {
+	filename, unresolved, err := getUnresolvedDependenciess(st)
+	if err != nil {
+		return nil, err
+	}
+
+	depMan := st.newChartDependencyManager(filename)
+
+	resolved, lockfileExists, err := depMan.Resolve(unresolved)
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve %d deps: %v", len(unresolved.deps), err)
+	}
+	if !lockfileExists {
+		return nil, fmt.Errorf("no lock file found at %s: run `helmfile deps` to generate it", depMan.lockFileName())
+	}
+
+	return resolved.renovateMetadata(), nil
+}
+
+func (d *ResolvedDependencies) renovateMetadata() []byte {
+	var buf bytes.Buffer
+
+	buf.WriteString("charts:\n")
+	for _, dep := range d.sorted() {
+		fmt.Fprintf(&buf, "# renovate: datasource=helm depName=%s registryUrl=%s\n", dep.ChartName, dep.Repository)
+		fmt.Fprintf(&buf, "- name: %s\n  version: %s\n", dep.ChartName, dep.Version)
+	}
+
+	return buf.Bytes()
+}
@@ -0,0 +1,51 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/roboll/helmfile/pkg/testhelper"
+)
+
+func TestHelmState_RenovateMetadata(t *testing.T) {
+	fs := testhelper.NewTestFs(map[string]string{
+		"/path/to/helmfile.lock": `dependencies:
+- name: mysql
+  repository: https://kubernetes-charts.storage.googleapis.com
+  version: 1.0.0
+- name: envoy
+  repository: https://kubernetes-charts.storage.googleapis.com
+  version: 1.5.0
+`,
+	})
+	state := injectFs(&HelmState{
+		FilePath: "/path/to/helmfile.yaml",
+		Releases: []ReleaseSpec{
+			{Chart: "stable/envoy"},
+			{Chart: "stable/mysql"},
+		},
+		Repositories: []RepositorySpec{
+			{
+				Name: "stable",
+				URL:  "https://kubernetes-charts.storage.googleapis.com",
+			},
+		},
+		logger: logger,
+	}, fs)
+
+	actual, err := state.RenovateMetadata()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := `charts:
+# renovate: datasource=helm depName=envoy registryUrl=https://kubernetes-charts.storage.googleapis.com
+- name: envoy
+  version: 1.5.0
+# renovate: datasource=helm depName=mysql registryUrl=https://kubernetes-charts.storage.googleapis.com
+- name: mysql
+  version: 1.0.0
+`
+	if string(actual) != expected {
+		t.Errorf("unexpected metadata:\nexpected=%s\ngot=%s", expected, actual)
+	}
+}
@@ -0,0 +1,146 @@
+package state
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+)
+
+// repoIndex is the subset of a chart repository's `index.yaml` that helmfile relies on for dependency resolution
+type repoIndex struct {
+	Entries map[string][]repoIndexEntry `yaml:"entries"`
+}
+
+type repoIndexEntry struct {
+	Name    string   `yaml:"name"`
+	Version string   `yaml:"version"`
+	Digest  string   `yaml:"digest"`
+	URLs    []string `yaml:"urls"`
+}
+
+// repoIndexFetcher downloads `index.yaml` of chart repositories, applying the credentials and custom headers declared for each repository
+type repoIndexFetcher struct {
+	client *http.Client
+	logger *zap.SugaredLogger
+}
+
+func newRepoIndexFetcher(logger *zap.SugaredLogger) *repoIndexFetcher {
+	return &repoIndexFetcher{
+		client: http.DefaultClient,
+		logger: logger,
+	}
+}
+
+func (f *repoIndexFetcher) Fetch(repo RepositorySpec) (*repoIndex, error) {
+	url := strings.TrimSuffix(repo.URL, "/") + "/index.yaml"
+
+	f.logger.Debugf("fetching the index of the repository %s from %s", repo.Name, url)
+
+	body, err := f.get(url, repo)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch the index of the repository %s: %v", repo.Name, err)
+	}
+
+	index := &repoIndex{}
+	if err := yaml.Unmarshal(body, index); err != nil {
+		return nil, fmt.Errorf("unable to parse the index of the repository %s: %v", repo.Name, err)
+	}
+
+	return index, nil
+}
+
+// get downloads the content at the URL served by the repository
+func (f *repoIndexFetcher) get(url string, repo RepositorySpec) ([]byte, error) {
+	req, err := newRepositoryRequest("GET", url, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", res.Status)
+	}
+
+	return ioutil.ReadAll(res.Body)
+}
+
+// newRepositoryRequest creates the request to the URL served by the repository, with the credentials and the custom headers of the repository
+func newRepositoryRequest(method, url string, repo RepositorySpec) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if repo.Username != "" || repo.Password != "" {
+		req.SetBasicAuth(repo.Username, repo.Password)
+	}
+
+	// Headers may contain secrets like tenant IDs and tokens. Never log them.
+	for k, v := range repo.Headers {
+		req.Header.Set(k, v)
+	}
+
+	return req, nil
+}
+
+// hasHeaders returns true when the repository at the URL declares custom headers, which helm can't send while resolving its charts
+func (m *chartDependencyManager) hasHeaders(url string) bool {
+	return len(m.repos[url].Headers) > 0
+}
+
+// lockFromIndexes locks the charts in repositories declaring custom headers without running helm, which can't send the headers.
+// Each chart is locked at the latest version satisfying its constraint in the index helmfile fetches with the headers,
+// along with the digest published in the index.
+func (m *chartDependencyManager) lockFromIndexes(deps []unresolvedChartDependency) ([]ResolvedChartDependency, error) {
+	if len(deps) > 0 && m.Offline {
+		return nil, fmt.Errorf("unable to resolve %s offline, as charts in repositories with custom headers are resolved from the indexes of the repositories", deps[0].ChartName)
+	}
+
+	indexes := map[string]*repoIndex{}
+	locked := []ResolvedChartDependency{}
+	seen := map[ResolvedChartDependency]bool{}
+	for _, d := range deps {
+		if d.versionRef != nil {
+			return nil, fmt.Errorf("unable to resolve %s in %s: version references aren't supported for charts in repositories with custom headers", d.ChartName, d.Repository)
+		}
+
+		index, ok := indexes[d.Repository]
+		if !ok {
+			var err error
+			index, err = m.fetchIndex(d.Repository, d.ChartName)
+			if err != nil {
+				return nil, err
+			}
+			indexes[d.Repository] = index
+		}
+
+		version, err := index.latestVersion(d.ChartName, d.VersionConstraint, m.MaxVersionsPerChart)
+		if err != nil {
+			return nil, fmt.Errorf("unable to resolve %s in %s: %v", d.ChartName, d.Repository, err)
+		}
+
+		dep := ResolvedChartDependency{ChartName: d.ChartName, Repository: d.Repository, Version: version}
+		for _, e := range index.Entries[d.ChartName] {
+			if e.Version == version && e.Digest != "" {
+				dep.Digest = "sha256:" + e.Digest
+				break
+			}
+		}
+
+		if !seen[dep] {
+			seen[dep] = true
+			locked = append(locked, dep)
+		}
+	}
+
+	return locked, nil
+}
@@ -0,0 +1,188 @@
+package state
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/roboll/helmfile/pkg/testhelper"
+	"gopkg.in/yaml.v2"
+)
+
+func TestRepoIndexFetcher_Fetch(t *testing.T) {
+	var actualHeaders http.Header
+	var actualPath string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		actualHeaders = r.Header
+		actualPath = r.URL.Path
+		w.Write([]byte(`apiVersion: v1
+entries:
+  envoy:
+  - name: envoy
+    version: 1.5.0
+    digest: abc
+    urls:
+    - https://example.com/envoy-1.5.0.tgz
+`))
+	}))
+	defer server.Close()
+
+	fetcher := newRepoIndexFetcher(logger)
+
+	index, err := fetcher.Fetch(RepositorySpec{
+		Name: "myrepo",
+		URL:  server.URL + "/charts/",
+		Headers: map[string]string{
+			"X-Api-Version": "2",
+			"X-Tenant-Id":   "mytenant",
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if actualPath != "/charts/index.yaml" {
+		t.Errorf("unexpected path: expected=/charts/index.yaml, got=%s", actualPath)
+	}
+	if v := actualHeaders.Get("X-Api-Version"); v != "2" {
+		t.Errorf("unexpected X-Api-Version header: expected=2, got=%s", v)
+	}
+	if v := actualHeaders.Get("X-Tenant-Id"); v != "mytenant" {
+		t.Errorf("unexpected X-Tenant-Id header: expected=mytenant, got=%s", v)
+	}
+	if len(index.Entries["envoy"]) != 1 || index.Entries["envoy"][0].Version != "1.5.0" {
+		t.Errorf("unexpected index entries: %v", index.Entries)
+	}
+}
+
+func TestChartDependencyManager_Update_Headers(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Tenant-Id") != "mytenant" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`entries:
+  envoy:
+  - name: envoy
+    version: 1.6.0
+    digest: def
+  - name: envoy
+    version: 1.5.1
+    digest: abc
+`))
+	}))
+	defer server.Close()
+
+	files := map[string]string{}
+	depMan := NewChartDependencyManager("helmfile", logger)
+	depMan.now = lockFileTime
+	depMan.readFile = func(filename string) ([]byte, error) {
+		if content, ok := files[filename]; ok {
+			return []byte(content), nil
+		}
+		return nil, &os.PathError{Op: "open", Path: filename, Err: os.ErrNotExist}
+	}
+	depMan.writeFile = func(filename string, data []byte, perm os.FileMode) error {
+		files[filename] = string(data)
+		return nil
+	}
+	depMan.repos = map[string]RepositorySpec{
+		server.URL: {Name: "myrepo", URL: server.URL, Headers: map[string]string{"X-Tenant-Id": "mytenant"}},
+	}
+
+	// helm can't send the headers, so that it must not be run for the charts in the repository
+	shell := dependencyUpdaterFunc(func(chart string) error {
+		return errors.New("unexpected helm run")
+	})
+
+	unresolved := &UnresolvedDependencies{deps: map[string][]unresolvedChartDependency{}}
+	unresolved.Add("envoy", server.URL, "~1.5.0")
+
+	resolved, err := depMan.Update(shell, "", unresolved)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	dep, err := resolved.getFromRepository("envoy", server.URL, "~1.5.0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := ResolvedChartDependency{ChartName: "envoy", Repository: server.URL, Version: "1.5.1", Digest: "sha256:abc"}
+	if *dep != expected {
+		t.Errorf("unexpected locked dependency: expected=%v, got=%v", expected, *dep)
+	}
+
+	var locked ChartLockedRequirements
+	if err := yaml.Unmarshal([]byte(files["helmfile.lock"]), &locked); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(locked.ResolvedDependencies) != 1 || locked.ResolvedDependencies[0] != expected {
+		t.Errorf("unexpected lock file: %s", files["helmfile.lock"])
+	}
+
+	// Without network access, the index can't be fetched
+	depMan.Offline = true
+	if _, err := depMan.Update(shell, "", unresolved); err == nil {
+		t.Error("expected error for resolving offline, got none")
+	}
+}
+
+func TestHelmState_ResolveDeps_VerifyLockedVersions(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`entries:
+  envoy:
+  - name: envoy
+    version: 1.5.0
+  mysql:
+  - name: mysql
+    version: 1.1.0
+`))
+	}))
+	defer server.Close()
+
+	fs := testhelper.NewTestFs(map[string]string{
+		"/path/to/helmfile.lock": `dependencies:
+- name: envoy
+  repository: ` + server.URL + `
+  version: 1.5.0
+- name: mysql
+  repository: ` + server.URL + `
+  version: 1.0.0
+`,
+	})
+
+	for _, verify := range []bool{false, true} {
+		state := injectFs(&HelmState{
+			FilePath: "/path/to/helmfile.yaml",
+			Releases: []ReleaseSpec{
+				{Chart: "myrepo/envoy"},
+				{Chart: "myrepo/mysql"},
+			},
+			Repositories: []RepositorySpec{
+				{
+					Name: "myrepo",
+					URL:  server.URL,
+				},
+			},
+			DependencyResolution: DependencyResolutionSpec{
+				VerifyLockedVersions: verify,
+			},
+			logger: logger,
+		}, fs)
+
+		_, err := state.ResolveDeps()
+		if !verify {
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			continue
+		}
+
+		expected := "unable to resolve 2 deps: locked versions no longer published: mysql 1.0.0 in " + server.URL + ": run `helmfile deps` to re-resolve them"
+		if err == nil || err.Error() != expected {
+			t.Errorf("unexpected error:\nexpected=%s\ngot=%v", expected, err)
+		}
+	}
+}
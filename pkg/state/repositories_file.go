@@ -0,0 +1,49 @@
+package state
+
+import (
+	"gopkg.in/yaml.v2"
+)
+
+const redacted = "REDACTED"
+
+// helmRepositoryFile is the content of helm's `repositories.yaml`
+type helmRepositoryFile struct {
+	APIVersion   string                `yaml:"apiVersion"`
+	Repositories []helmRepositoryEntry `yaml:"repositories"`
+}
+
+type helmRepositoryEntry struct {
+	Name     string `yaml:"name"`
+	URL      string `yaml:"url"`
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// RenderRepositoriesYAML renders helm's `repositories.yaml` equivalent to the repositories declared in this state, so that users can verify their repository configuration.
+// Credentials are redacted.
+func (st *HelmState) RenderRepositoriesYAML() ([]byte, error) {
+	file := helmRepositoryFile{
+		APIVersion:   "v1",
+		Repositories: []helmRepositoryEntry{},
+	}
+
+	for _, r := range st.Repositories {
+		entry := helmRepositoryEntry{
+			Name:     r.Name,
+			URL:      r.URL,
+			CertFile: r.CertFile,
+			KeyFile:  r.KeyFile,
+		}
+		if r.Username != "" {
+			entry.Username = redacted
+		}
+		if r.Password != "" {
+			entry.Password = redacted
+		}
+		file.Repositories = append(file.Repositories, entry)
+	}
+
+	return yaml.Marshal(file)
+}
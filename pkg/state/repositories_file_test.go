@@ -0,0 +1,49 @@
+package state
+
+import (
+	"testing"
+)
+
+func TestHelmState_RenderRepositoriesYAML(t *testing.T) {
+	state := &HelmState{
+		Repositories: []RepositorySpec{
+			{
+				Name: "stable",
+				URL:  "https://kubernetes-charts.storage.googleapis.com",
+			},
+			{
+				Name:     "private",
+				URL:      "https://charts.example.com",
+				CertFile: "/path/to/cert",
+				KeyFile:  "/path/to/key",
+				Username: "user",
+				Password: "secret",
+				Headers:  map[string]string{"X-Tenant-Id": "mytenant"},
+			},
+		},
+	}
+
+	actual, err := state.RenderRepositoriesYAML()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := `apiVersion: v1
+repositories:
+- name: stable
+  url: https://kubernetes-charts.storage.googleapis.com
+  certFile: ""
+  keyFile: ""
+  username: ""
+  password: ""
+- name: private
+  url: https://charts.example.com
+  certFile: /path/to/cert
+  keyFile: /path/to/key
+  username: REDACTED
+  password: REDACTED
+`
+	if string(actual) != expected {
+		t.Errorf("unexpected repositories.yaml:\nexpected=%s\ngot=%s", expected, actual)
+	}
+}
@@ -0,0 +1,142 @@
+package state
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultResolutionCacheTTL is how long resolved chart versions in the resolution cache are reused by default
+const DefaultResolutionCacheTTL = time.Hour
+
+// resolutionCacheEntry is the chart version resolved for the version constraint of a chart in a repository,
+// persisted in the resolution cache directory across helmfile runs
+type resolutionCacheEntry struct {
+	ChartName         string `yaml:"name"`
+	Repository        string `yaml:"repository"`
+	VersionConstraint string `yaml:"constraint"`
+	Version           string `yaml:"version"`
+	Digest            string `yaml:"digest,omitempty"`
+	// ResolvedAt is the RFC3339 timestamp of when the version was resolved
+	ResolvedAt string `yaml:"resolvedAt"`
+}
+
+// expandHome expands the leading `~` of the path to the home directory
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, strings.TrimPrefix(path, "~"))
+}
+
+// resolutionCacheFile returns the path to the cache entry of the dependency, keyed by its repository, chart name and version constraint
+func (m *chartDependencyManager) resolutionCacheFile(dep unresolvedChartDependency) string {
+	constraint := dep.VersionConstraint
+	if constraint == "" {
+		constraint = "*"
+	}
+	sum := sha256.Sum256([]byte(strings.Join([]string{dep.Repository, dep.ChartName, constraint}, "\n")))
+	return filepath.Join(m.ResolutionCacheDir, hex.EncodeToString(sum[:])+".yaml")
+}
+
+// cachedResolution returns the version resolved for the dependency in a previous run, if any.
+// Entries older than ResolutionCacheTTL are ignored, unless resolving offline.
+func (m *chartDependencyManager) cachedResolution(dep unresolvedChartDependency) (*ResolvedChartDependency, bool) {
+	if m.ResolutionCacheDir == "" || (m.ResolutionCacheTTL <= 0 && !m.Offline) {
+		return nil, false
+	}
+
+	content, err := m.readFile(m.resolutionCacheFile(dep))
+	if err != nil {
+		return nil, false
+	}
+
+	var entry resolutionCacheEntry
+	if err := yaml.Unmarshal(content, &entry); err != nil {
+		m.logger.Debugf("ignoring the broken resolution cache entry for %s: %v", dep.ChartName, err)
+		return nil, false
+	}
+
+	if !m.Offline {
+		resolvedAt, err := time.Parse(time.RFC3339, entry.ResolvedAt)
+		if err != nil || m.now().Sub(resolvedAt) > m.ResolutionCacheTTL {
+			return nil, false
+		}
+	}
+
+	return &ResolvedChartDependency{
+		ChartName:  dep.ChartName,
+		Repository: dep.Repository,
+		Version:    entry.Version,
+		Digest:     entry.Digest,
+	}, true
+}
+
+// partitionCached splits the dependencies into the ones resolved from the resolution cache and the ones to be resolved by helm
+func (m *chartDependencyManager) partitionCached(unresolved *UnresolvedDependencies) ([]ResolvedChartDependency, *UnresolvedDependencies) {
+	hits := []ResolvedChartDependency{}
+	misses := &UnresolvedDependencies{deps: map[string][]unresolvedChartDependency{}, releases: unresolved.releases}
+
+	for _, deps := range unresolved.deps {
+		for _, d := range deps {
+			if cached, ok := m.cachedResolution(d); ok {
+				hits = append(hits, *cached)
+				continue
+			}
+			misses.add(d)
+		}
+	}
+
+	return hits, misses
+}
+
+// cacheResolutions records the versions helm resolved for the dependencies into the resolution cache.
+// Dependencies on the same chart in the same repository with different constraints aren't recorded,
+// as the lock file doesn't tell which version was resolved for which constraint.
+func (m *chartDependencyManager) cacheResolutions(unresolved *UnresolvedDependencies, locked []ResolvedChartDependency) {
+	if m.ResolutionCacheDir == "" {
+		return
+	}
+
+	for _, l := range locked {
+		var matches []unresolvedChartDependency
+		for _, d := range unresolved.deps[l.ChartName] {
+			if d.Repository == l.Repository {
+				matches = append(matches, d)
+			}
+		}
+		if len(matches) != 1 {
+			continue
+		}
+
+		entry := resolutionCacheEntry{
+			ChartName:         l.ChartName,
+			Repository:        l.Repository,
+			VersionConstraint: matches[0].VersionConstraint,
+			Version:           l.Version,
+			Digest:            l.Digest,
+			ResolvedAt:        m.now().UTC().Format(time.RFC3339),
+		}
+		content, err := yaml.Marshal(entry)
+		if err != nil {
+			m.logger.Warnf("unable to cache the resolution of %s: %v", l.ChartName, err)
+			continue
+		}
+		if err := m.mkdirAll(m.ResolutionCacheDir, 0755); err != nil {
+			m.logger.Warnf("unable to cache the resolution of %s: %v", l.ChartName, err)
+			continue
+		}
+		if err := m.writeFile(m.resolutionCacheFile(matches[0]), content, 0644); err != nil {
+			m.logger.Warnf("unable to cache the resolution of %s: %v", l.ChartName, err)
+		}
+	}
+}
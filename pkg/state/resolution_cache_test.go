@@ -0,0 +1,120 @@
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChartDependencyManager_ResolutionCache(t *testing.T) {
+	wd, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(wd)
+
+	cacheDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	files := map[string]string{}
+
+	depMan := NewChartDependencyManager("helmfile", logger)
+	depMan.ResolutionCacheDir = cacheDir
+	depMan.readFile = func(filename string) ([]byte, error) {
+		if content, ok := files[filename]; ok {
+			return []byte(content), nil
+		}
+		return ioutil.ReadFile(filename)
+	}
+	depMan.writeFile = func(filename string, data []byte, perm os.FileMode) error {
+		if filepath.Dir(filename) == wd || filepath.Dir(filename) == cacheDir {
+			return ioutil.WriteFile(filename, data, perm)
+		}
+		files[filename] = string(data)
+		return nil
+	}
+
+	var requirements []string
+	shell := dependencyUpdaterFunc(func(chart string) error {
+		content, err := ioutil.ReadFile(filepath.Join(chart, "requirements.yaml"))
+		if err != nil {
+			return err
+		}
+		requirements = append(requirements, string(content))
+
+		return ioutil.WriteFile(filepath.Join(chart, "requirements.lock"), []byte(`dependencies:
+- name: envoy
+  repository: https://stable.example.com
+  version: 1.5.2
+- name: mysql
+  repository: https://stable.example.com
+  version: 1.0.0
+digest: sha256:abc
+generated: "2019-06-01T00:00:00Z"
+`), 0644)
+	})
+
+	unresolved := &UnresolvedDependencies{deps: map[string][]unresolvedChartDependency{}}
+	unresolved.Add("envoy", "https://stable.example.com", "~1.5")
+	unresolved.Add("mysql", "https://stable.example.com", "")
+
+	update := func(elapsed time.Duration) {
+		t.Helper()
+		depMan.now = func() time.Time { return lockFileTime().Add(elapsed) }
+		resolved, err := depMan.Update(shell, wd, unresolved)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		version, err := resolved.Get("envoy", "~1.5")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if version != "1.5.2" {
+			t.Errorf("unexpected version: expected=1.5.2, got=%s", version)
+		}
+	}
+
+	update(0)
+	if len(requirements) != 1 {
+		t.Fatalf("unexpected number of helm runs: expected=1, got=%d", len(requirements))
+	}
+	entries, err := ioutil.ReadDir(cacheDir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("unexpected number of cache entries: expected=2, got=%d", len(entries))
+	}
+	lockFile := files["helmfile.lock"]
+
+	// Both dependencies are cached, so helm isn't run and the lock file is left untouched
+	update(10 * time.Minute)
+	if len(requirements) != 1 {
+		t.Errorf("unexpected helm run for the cached dependencies: %v", requirements[1:])
+	}
+	if files["helmfile.lock"] != lockFile {
+		t.Errorf("unexpected lock file change:\nexpected=%s\ngot=%s", lockFile, files["helmfile.lock"])
+	}
+
+	// Expired entries are resolved by helm again, but still reused offline
+	depMan.Offline = true
+	update(2 * time.Hour)
+	if len(requirements) != 1 {
+		t.Errorf("unexpected helm run offline: %v", requirements[1:])
+	}
+
+	depMan.Offline = false
+	update(2 * time.Hour)
+	if len(requirements) != 2 {
+		t.Fatalf("unexpected number of helm runs: expected=2, got=%d", len(requirements))
+	}
+	if !strings.Contains(requirements[1], "envoy") || !strings.Contains(requirements[1], "mysql") {
+		t.Errorf("unexpected requirements: %s", requirements[1])
+	}
+}
@@ -0,0 +1,94 @@
+package state
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/tatsushid/go-prettytable"
+)
+
+const (
+	// ResolutionActionLocked means the lock file already has a version satisfying the constraint
+	ResolutionActionLocked = "locked"
+	// ResolutionActionResolve means the chart is resolved by accessing its repository
+	ResolutionActionResolve = "resolve"
+)
+
+// ResolutionPlan describes what `helmfile deps` would do for each chart, computed without accessing the network or modifying the lock file
+type ResolutionPlan struct {
+	LockFile string
+	Entries  []ResolutionPlanEntry
+}
+
+type ResolutionPlanEntry struct {
+	Chart      string
+	Repository string
+	Constraint string
+	// LockedVersion is the version currently recorded in the lock file for the constraint, if any
+	LockedVersion string
+	Action        string
+}
+
+// PlanDependencyResolution computes the resolution plan from the state and the existing lock file
+func (st *HelmState) PlanDependencyResolution() (*ResolutionPlan, error) {
+	filename, unresolved, err := getUnresolvedDependenciess(st)
+	if err != nil {
+		return nil, err
+	}
+
+	depMan := st.newChartDependencyManager(filename)
+
+	plan := &ResolutionPlan{LockFile: depMan.lockFileName(), Entries: []ResolutionPlanEntry{}}
+
+	if len(unresolved.deps) == 0 {
+		return plan, nil
+	}
+
+	resolved, lockfileExists, err := depMan.Resolve(unresolved)
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve %d deps: %v", len(unresolved.deps), err)
+	}
+
+	for _, d := range unresolved.ToChartRequirements().UnresolvedDependencies {
+		entry := ResolutionPlanEntry{
+			Chart:      d.ChartName,
+			Repository: d.Repository,
+			Constraint: d.VersionConstraint,
+			Action:     ResolutionActionResolve,
+		}
+		if d.versionRef != nil {
+			entry.Constraint = d.versionRef.String()
+		}
+		if lockfileExists {
+			if dep, err := resolved.getFromRepository(d.ChartName, d.Repository, d.VersionConstraint); err == nil {
+				entry.LockedVersion = dep.Version
+				entry.Action = ResolutionActionLocked
+			}
+		}
+		plan.Entries = append(plan.Entries, entry)
+	}
+
+	sort.Slice(plan.Entries, func(i, j int) bool {
+		if plan.Entries[i].Chart != plan.Entries[j].Chart {
+			return plan.Entries[i].Chart < plan.Entries[j].Chart
+		}
+		return plan.Entries[i].Constraint < plan.Entries[j].Constraint
+	})
+
+	return plan, nil
+}
+
+// String renders the plan as a table
+func (p *ResolutionPlan) String() string {
+	tbl, _ := prettytable.NewTable(prettytable.Column{Header: "CHART"},
+		prettytable.Column{Header: "REPOSITORY"},
+		prettytable.Column{Header: "CONSTRAINT"},
+		prettytable.Column{Header: "LOCKED"},
+		prettytable.Column{Header: "ACTION"},
+	)
+	tbl.Separator = "   "
+	for _, e := range p.Entries {
+		tbl.AddRow(e.Chart, e.Repository, e.Constraint, e.LockedVersion, e.Action)
+	}
+	return fmt.Sprintf("Lock file: %s\n%s", p.LockFile, tbl.String())
+}
@@ -0,0 +1,59 @@
+package state
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/roboll/helmfile/pkg/testhelper"
+)
+
+func TestHelmState_PlanDependencyResolution(t *testing.T) {
+	fs := testhelper.NewTestFs(map[string]string{
+		"/path/to/helmfile.lock": `dependencies:
+- name: envoy
+  repository: https://kubernetes-charts.storage.googleapis.com
+  version: 1.5.0
+`,
+	})
+	state := injectFs(&HelmState{
+		FilePath: "/path/to/helmfile.yaml",
+		Releases: []ReleaseSpec{
+			{Chart: "stable/envoy", Version: "~1.5"},
+			{Chart: "stable/mysql"},
+		},
+		Repositories: []RepositorySpec{
+			{
+				Name: "stable",
+				URL:  "https://kubernetes-charts.storage.googleapis.com",
+			},
+		},
+		logger: logger,
+	}, fs)
+
+	plan, err := state.PlanDependencyResolution()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []ResolutionPlanEntry{
+		{
+			Chart:         "envoy",
+			Repository:    "https://kubernetes-charts.storage.googleapis.com",
+			Constraint:    "~1.5",
+			LockedVersion: "1.5.0",
+			Action:        ResolutionActionLocked,
+		},
+		{
+			Chart:      "mysql",
+			Repository: "https://kubernetes-charts.storage.googleapis.com",
+			Constraint: "*",
+			Action:     ResolutionActionResolve,
+		},
+	}
+	if !reflect.DeepEqual(plan.Entries, expected) {
+		t.Errorf("unexpected plan:\nexpected=%v\ngot=%v", expected, plan.Entries)
+	}
+	if plan.LockFile != "helmfile.lock" {
+		t.Errorf("unexpected lock file: expected=helmfile.lock, got=%s", plan.LockFile)
+	}
+}
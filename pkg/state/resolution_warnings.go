@@ -0,0 +1,63 @@
+package state
+
+import (
+	"fmt"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// ResolutionWarningNoRemoteCharts is emitted when repositories are declared but no release references a remote chart
+	ResolutionWarningNoRemoteCharts = "NoRemoteCharts"
+	// ResolutionWarningDefaultRepository is emitted when a chart is resolved from a built-in default repository
+	ResolutionWarningDefaultRepository = "DefaultRepository"
+	// ResolutionWarningRetry is emitted when a failed dependency update is retried
+	ResolutionWarningRetry = "Retry"
+	// ResolutionWarningCertificate is emitted when a repository's TLS certificate is invalid or expiring soon
+	ResolutionWarningCertificate = "Certificate"
+	// ResolutionWarningFailover is emitted when a repository is failed over to one of its mirrors
+	ResolutionWarningFailover = "Failover"
+	// ResolutionWarningDigest is emitted when the digest of a locked chart can't be verified
+	ResolutionWarningDigest = "Digest"
+	// ResolutionWarningProvenance is emitted when the provenance of a chart to be locked can't be verified
+	ResolutionWarningProvenance = "Provenance"
+)
+
+// ResolutionWarning is a diagnostic produced while resolving chart dependencies.
+// Callers can render, suppress or escalate warnings programmatically according to their Kind.
+type ResolutionWarning struct {
+	Kind string
+	// Chart is the chart the warning is about. Empty for warnings about the whole state.
+	Chart   string
+	Message string
+}
+
+// resolutionWarnings collects warnings emitted during a resolution, while logging them as they come
+type resolutionWarnings struct {
+	logger   *zap.SugaredLogger
+	warnings []ResolutionWarning
+}
+
+func (w *resolutionWarnings) add(kind, chart, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	w.logger.Warn(msg)
+	w.warnings = append(w.warnings, ResolutionWarning{Kind: kind, Chart: chart, Message: msg})
+}
+
+// warn logs the warning and records it if the state is being resolved via one of the *WithWarnings functions
+func (st *HelmState) warn(kind, chart, format string, args ...interface{}) {
+	if st.resolutionWarnings == nil {
+		st.logger.Warnf(format, args...)
+		return
+	}
+	st.resolutionWarnings.add(kind, chart, format, args...)
+}
+
+func (st *HelmState) collectResolutionWarnings() func() []ResolutionWarning {
+	w := &resolutionWarnings{logger: st.logger, warnings: []ResolutionWarning{}}
+	st.resolutionWarnings = w
+	return func() []ResolutionWarning {
+		st.resolutionWarnings = nil
+		return w.warnings
+	}
+}
@@ -0,0 +1,43 @@
+package state
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestHelmState_ResolveDepsWithWarnings(t *testing.T) {
+	state := &HelmState{
+		FilePath: "/path/to/helmfile.yaml",
+		Releases: []ReleaseSpec{
+			{Chart: "stable/envoy"},
+		},
+		DependencyResolution: DependencyResolutionSpec{
+			UseDefaultRepositories: true,
+		},
+		readFile: func(string) ([]byte, error) {
+			return nil, os.ErrNotExist
+		},
+		logger: logger,
+	}
+
+	_, warnings, err := state.ResolveDepsWithWarnings()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []ResolutionWarning{
+		{
+			Kind:    ResolutionWarningDefaultRepository,
+			Chart:   "envoy",
+			Message: `using the default repository https://kubernetes-charts.storage.googleapis.com for stable/envoy, as the repository "stable" isn't declared in /path/to/helmfile.yaml`,
+		},
+	}
+	if !reflect.DeepEqual(warnings, expected) {
+		t.Errorf("unexpected warnings:\nexpected=%v\ngot=%v", expected, warnings)
+	}
+
+	if state.resolutionWarnings != nil {
+		t.Errorf("expected warnings collection to be stopped after resolution")
+	}
+}
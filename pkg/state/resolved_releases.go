@@ -0,0 +1,60 @@
+package state
+
+import (
+	"encoding/csv"
+	"io"
+	"sort"
+)
+
+// ResolvedRelease is a flattened view of a release and the chart version it deploys, suitable for dashboards
+type ResolvedRelease struct {
+	Helmfile   string `json:"helmfile"`
+	Release    string `json:"release"`
+	Chart      string `json:"chart"`
+	Version    string `json:"version"`
+	Repository string `json:"repository"`
+}
+
+// ResolvedReleases returns one row per release of this state, ordered by release name.
+// Call this on the state returned by ResolveDeps so that versions are the locked ones.
+func (st *HelmState) ResolvedReleases() []ResolvedRelease {
+	repoToURL := st.repositoryURLs()
+
+	rows := []ResolvedRelease{}
+	for _, r := range st.Releases {
+		row := ResolvedRelease{
+			Helmfile: st.FilePath,
+			Release:  r.Name,
+			Chart:    r.Chart,
+			Version:  r.Version,
+		}
+		if repo, chart, ok := st.resolveRemoteChart(r.Chart); ok {
+			if url, ok := repoToURL[repo]; ok {
+				row.Chart = chart
+				row.Repository = url
+			}
+		}
+		rows = append(rows, row)
+	}
+
+	sort.SliceStable(rows, func(i, j int) bool {
+		return rows[i].Release < rows[j].Release
+	})
+
+	return rows
+}
+
+// WriteResolvedReleasesCSV writes the rows in CSV with a header line
+func WriteResolvedReleasesCSV(w io.Writer, rows []ResolvedRelease) error {
+	out := csv.NewWriter(w)
+	if err := out.Write([]string{"helmfile", "release", "chart", "version", "repository"}); err != nil {
+		return err
+	}
+	for _, r := range rows {
+		if err := out.Write([]string{r.Helmfile, r.Release, r.Chart, r.Version, r.Repository}); err != nil {
+			return err
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
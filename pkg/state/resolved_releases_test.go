@@ -0,0 +1,61 @@
+package state
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/roboll/helmfile/pkg/testhelper"
+)
+
+func TestHelmState_ResolvedReleases(t *testing.T) {
+	fs := testhelper.NewTestFs(map[string]string{
+		"/path/to/helmfile.lock": `dependencies:
+- name: envoy
+  repository: https://kubernetes-charts.storage.googleapis.com
+  version: 1.5.0
+`,
+	})
+	state := injectFs(&HelmState{
+		FilePath: "/path/to/helmfile.yaml",
+		Releases: []ReleaseSpec{
+			{Name: "proxy", Chart: "stable/envoy"},
+			{Name: "myapp", Chart: "./charts/myapp", Version: "0.1.0"},
+		},
+		Repositories: []RepositorySpec{
+			{
+				Name: "stable",
+				URL:  "https://kubernetes-charts.storage.googleapis.com",
+			},
+		},
+		logger: logger,
+	}, fs)
+
+	resolved, err := state.ResolveDeps()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	rows := resolved.ResolvedReleases()
+
+	expected := []ResolvedRelease{
+		{Helmfile: "/path/to/helmfile.yaml", Release: "myapp", Chart: "./charts/myapp", Version: "0.1.0"},
+		{Helmfile: "/path/to/helmfile.yaml", Release: "proxy", Chart: "envoy", Version: "1.5.0", Repository: "https://kubernetes-charts.storage.googleapis.com"},
+	}
+	if !reflect.DeepEqual(rows, expected) {
+		t.Errorf("unexpected rows:\nexpected=%v\ngot=%v", expected, rows)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteResolvedReleasesCSV(&buf, rows); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expectedCSV := `helmfile,release,chart,version,repository
+/path/to/helmfile.yaml,myapp,./charts/myapp,0.1.0,
+/path/to/helmfile.yaml,proxy,envoy,1.5.0,https://kubernetes-charts.storage.googleapis.com
+`
+	if buf.String() != expectedCSV {
+		t.Errorf("unexpected csv:\nexpected=%s\ngot=%s", expectedCSV, buf.String())
+	}
+}
@@ -0,0 +1,33 @@
+package state
+
+import (
+	"time"
+)
+
+// defaultRetryBackoff is the delay before the first retry of a failed helm operation, when helmDefaults.retryBackoff isn't set
+const defaultRetryBackoff = 2 * time.Second
+
+// retry runs the helm operation, retrying it up to helmDefaults.retries times while it fails with transient errors, like repository timeouts,
+// refused tiller connections and rate limiting by chart repositories.
+// The delay between attempts starts at helmDefaults.retryBackoff and doubles after each retry.
+func (st *HelmState) retry(op string, f func() error) error {
+	backoff := defaultRetryBackoff
+	if st.HelmDefaults.RetryBackoff > 0 {
+		backoff = time.Duration(st.HelmDefaults.RetryBackoff) * time.Second
+	}
+
+	sleep := st.sleep
+	if sleep == nil {
+		sleep = time.Sleep
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := f()
+		if err == nil || attempt >= st.HelmDefaults.Retries || !IsTransientError(err) {
+			return err
+		}
+		st.logger.Warnf("retrying %s (%d/%d) in %s after failure: %v", op, attempt+1, st.HelmDefaults.Retries, backoff, err)
+		sleep(backoff)
+		backoff *= 2
+	}
+}
@@ -0,0 +1,78 @@
+package state
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHelmState_Retry(t *testing.T) {
+	tests := []struct {
+		name     string
+		retries  int
+		backoff  int
+		errs     []error
+		attempts int
+		sleeps   []time.Duration
+		wantErr  bool
+	}{
+		{
+			name:     "succeeds after transient failures",
+			retries:  3,
+			errs:     []error{errors.New("dial tcp: i/o timeout"), errors.New("429 Too Many Requests"), nil},
+			attempts: 3,
+			sleeps:   []time.Duration{2 * time.Second, 4 * time.Second},
+		},
+		{
+			name:     "gives up after retries",
+			retries:  1,
+			backoff:  10,
+			errs:     []error{errors.New("connection refused"), errors.New("connection refused")},
+			attempts: 2,
+			sleeps:   []time.Duration{10 * time.Second},
+			wantErr:  true,
+		},
+		{
+			name:     "doesn't retry permanent failures",
+			retries:  3,
+			errs:     []error{errors.New("chart not found")},
+			attempts: 1,
+			wantErr:  true,
+		},
+		{
+			name:     "doesn't retry by default",
+			errs:     []error{errors.New("connection refused")},
+			attempts: 1,
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		sleeps := []time.Duration{}
+		state := &HelmState{
+			HelmDefaults: HelmSpec{Retries: tt.retries, RetryBackoff: tt.backoff},
+			logger:       logger,
+			sleep: func(d time.Duration) {
+				sleeps = append(sleeps, d)
+			},
+		}
+
+		attempts := 0
+		err := state.retry("upgrading release foo", func() error {
+			err := tt.errs[attempts]
+			attempts++
+			return err
+		})
+
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		}
+		if attempts != tt.attempts {
+			t.Errorf("%s: unexpected attempts: expected=%d, got=%d", tt.name, tt.attempts, attempts)
+		}
+		if len(tt.sleeps) > 0 && !reflect.DeepEqual(sleeps, tt.sleeps) {
+			t.Errorf("%s: unexpected backoffs: expected=%v, got=%v", tt.name, tt.sleeps, sleeps)
+		}
+	}
+}
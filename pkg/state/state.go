@@ -14,6 +14,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/roboll/helmfile/pkg/environment"
 	"github.com/roboll/helmfile/pkg/event"
@@ -50,6 +51,8 @@ type HelmState struct {
 
 	Templates map[string]TemplateSpec `yaml:"templates"`
 
+	DependencyResolution DependencyResolutionSpec `yaml:"dependencyResolution"`
+
 	Env environment.Environment
 
 	logger *zap.SugaredLogger
@@ -62,6 +65,24 @@ type HelmState struct {
 	tempDir    func(string, string) (string, error)
 
 	runner helmexec.Runner
+
+	// git checks out charts in git repositories. Defaults to running the git command.
+	git gitClient
+
+	// sleep waits between retries of failed helm operations. Defaults to time.Sleep.
+	sleep func(time.Duration)
+
+	// remote fetches remote values and secrets files. Remote files are treated as local paths when nil.
+	remote *remote.Remote
+
+	resolutionWarnings *resolutionWarnings
+
+	// repoSources memoizes the URLs chosen to serve charts for repositories with mirrors
+	repoSources       map[string]string
+	repoHealthChecker *repoHealthChecker
+
+	// channels memoizes the channel definitions read from DependencyResolution.ChannelsFile
+	channels map[string]map[string]string
 }
 
 // SubHelmfileSpec defines the subhelmfile path and options
@@ -84,6 +105,8 @@ type HelmSpec struct {
 	Tillerless      bool     `yaml:"tillerless"`
 	Args            []string `yaml:"args"`
 	Verify          bool     `yaml:"verify"`
+	// Keyring is the keyring containing the public keys the provenance of charts is verified against with `verify`. Defaults to helm's keyring
+	Keyring string `yaml:"keyring"`
 	// Devel, when set to true, use development versions, too. Equivalent to version '>0.0.0-0'
 	Devel bool `yaml:"devel"`
 	// Wait, if set to true, will wait until all Pods, PVCs, Services, and minimum number of Pods of a Deployment are in a ready state before marking the release as successful
@@ -96,11 +119,128 @@ type HelmSpec struct {
 	Force bool `yaml:"force"`
 	// Atomic, when set to true, restore previous state in case of a failed install/upgrade attempt
 	Atomic bool `yaml:"atomic"`
+	// CleanupOnFail, when set to true, deletes the new resources created in a failed upgrade
+	CleanupOnFail bool `yaml:"cleanupOnFail"`
+	// HistoryMax is the maximum number of revisions kept per release. 0 means no limit, and omitting it keeps helm's default of 10
+	HistoryMax *int `yaml:"historyMax"`
+	// SkipCRDs, when set to true, skips installing the CRDs in the `crds` directory of charts via `--skip-crds`. Requires helm v3
+	SkipCRDs bool `yaml:"skipCRDs"`
+	// CreateNamespace, when set to true, creates the namespaces of releases if missing on sync (default true)
+	CreateNamespace *bool `yaml:"createNamespace"`
+	// IncludeCRDs, when set to true, includes the CRDs in the output of `helmfile template` via `--include-crds`. Requires helm v3
+	IncludeCRDs bool `yaml:"includeCRDs"`
+	// HelmBinary is the path to the helm binary to deploy the releases with, overriding `--helm-binary`
+	HelmBinary string `yaml:"helmBinary"`
+	// RequiredVersion is the constraint the version of the helm binary must satisfy, like `>=2.14 <3`
+	RequiredVersion string `yaml:"requiredVersion"`
+	// Retries is the number of times helm operations like adding repositories and upgrading releases are retried when they fail with transient errors
+	Retries int `yaml:"retries"`
+	// RetryBackoff is the time in seconds to wait before the first retry, doubled after each retry (default 2)
+	RetryBackoff int `yaml:"retryBackoff"`
+	// InstallPlugins, when set to true, installs the helm-diff and helm-secrets plugins when they are needed but missing
+	InstallPlugins bool `yaml:"installPlugins"`
+	// MissingFileHandler is the default of `missingFileHandler` for releases which don't set it, either "Error", "Warn", "Info" or "Debug" (default "Error")
+	MissingFileHandler *string `yaml:"missingFileHandler"`
 
 	TLS       bool   `yaml:"tls"`
 	TLSCACert string `yaml:"tlsCACert"`
 	TLSKey    string `yaml:"tlsKey"`
 	TLSCert   string `yaml:"tlsCert"`
+	// TLSVerify, when set to true, verifies the certificate of tiller against TLSCACert, which helm ignores otherwise
+	TLSVerify bool `yaml:"tlsVerify"`
+	// TLSHostname is the server name the certificate of tiller is verified against
+	TLSHostname string `yaml:"tlsHostname"`
+}
+
+// DependencyResolutionSpec defines how chart dependencies of the helmfile state are resolved and locked
+type DependencyResolutionSpec struct {
+	// MaxDownloadSize is the maximum total size in bytes of chart tarballs fetched by `helmfile deps`. 0 means unlimited.
+	MaxDownloadSize int64 `yaml:"maxDownloadSize"`
+	// PinSelector restricts applying locked versions to releases matching the label selector like `tier=prod`. Non-matching releases keep their declared versions.
+	PinSelector string `yaml:"pinSelector"`
+	// UseDefaultRepositories, when set to true, resolves charts from well-known public repositories like `stable` and `bitnami` even when they aren't declared in `repositories`
+	UseDefaultRepositories bool `yaml:"useDefaultRepositories"`
+	// DefaultRepositories overrides or extends the built-in default repositories, keyed by repository name
+	DefaultRepositories map[string]string `yaml:"defaultRepositories"`
+	// SplitLockFile, when set to true, splits the lock file into one `<basename>.<repo>.lock` per repository to avoid merge conflicts
+	SplitLockFile bool `yaml:"splitLockFile"`
+	// LockFilePath is the path to the lock file, like `locks/shared.lock`, or the directory containing `<basename>.lock` when it ends with `/` or exists, like `locks/`.
+	// Relative paths are relative to the directory of the state file. Defaults to `<basename>.lock` next to the state file.
+	LockFilePath string `yaml:"lockFilePath"`
+	// VersionPrefix is either "strip" or "add". "strip" removes the leading `v` from locked versions applied to releases, whereas "add" prepends it.
+	// The lock file always records versions as published in the repository.
+	VersionPrefix string `yaml:"versionPrefix"`
+	// ChartsDir is the directory containing pre-downloaded `<name>-<version>.tgz` chart tarballs.
+	// When set, `helmfile deps` resolves version constraints against the tarballs in the directory, without accessing chart repositories.
+	ChartsDir string `yaml:"chartsDir"`
+	// ResolvedLabels maps release label keys to the resolved metadata recorded in them, which is one of "version", "digest" and "repository".
+	// This allows e.g. recording the provenance of the locked chart in releases.
+	ResolvedLabels map[string]string `yaml:"resolvedLabels"`
+	// WarnOnNoRemoteCharts, when set to true, warns when the state declares repositories but no release references a remote chart to resolve.
+	// This helps catching charts accidentally left as local paths.
+	WarnOnNoRemoteCharts bool `yaml:"warnOnNoRemoteCharts"`
+	// AirgapManifest is the path to the manifest of charts approved for the air-gapped environment.
+	// When set, every locked chart version must be listed in the manifest.
+	AirgapManifest string `yaml:"airgapManifest"`
+	// Retries is the number of times `helm dependency update` is retried on retryable failures
+	Retries int `yaml:"retries"`
+	// IsRetryable decides whether a failed `helm dependency update` is retried. Defaults to IsTransientError.
+	IsRetryable func(error) bool `yaml:"-"`
+	// StrictRepositoryMatch, when set to true, fails on a chart reference like `myrepo/mychart` whose repository isn't declared, unless it is an existing local directory.
+	// By default such references are silently treated as local charts.
+	StrictRepositoryMatch bool `yaml:"strictRepositoryMatch"`
+	// CacheDir is the directory chart tarballs of locked versions are fetched into by WarmCache
+	CacheDir string `yaml:"cacheDir"`
+	// VerifyLockedVersions, when set to true, confirms that every locked version is still published in its repository's index.
+	// This requires network access.
+	VerifyLockedVersions bool `yaml:"verifyLockedVersions"`
+	// Timeout is the time in seconds to wait for `helm dependency update` to resolve the charts. 0 means no timeout.
+	Timeout int `yaml:"timeout"`
+	// ChartTimeouts overrides Timeout per chart name. Charts with overrides are resolved separately from the others.
+	ChartTimeouts map[string]int `yaml:"chartTimeouts"`
+	// NegativeCacheTTL is the time in seconds to remember dependency updates that failed because the charts or versions weren't found,
+	// so that repeated resolutions don't hit the repositories with the same doomed requests. 0 disables it. Defaults to 5.
+	NegativeCacheTTL *int `yaml:"negativeCacheTTL"`
+	// ResolutionCacheDir is the directory to cache the chart versions resolved for each repository, chart and version constraint in,
+	// like `~/.cache/helmfile/deps`, so that repeated resolutions don't run `helm dependency update` for them. Empty disables the cache.
+	ResolutionCacheDir string `yaml:"resolutionCacheDir"`
+	// ResolutionCacheTTL is the time in seconds the cached versions are reused for. 0 reuses them only offline. Defaults to 3600.
+	ResolutionCacheTTL *int `yaml:"resolutionCacheTTL"`
+	// RewriteRequirements, when set, is called with the generated `requirements.yaml` and returns the content to be consumed by helm instead.
+	// It is an escape hatch for repository quirks helmfile doesn't model, available only to library users.
+	RewriteRequirements func([]byte) ([]byte, error) `yaml:"-"`
+	// CheckCertificates, when set to true, warns about HTTPS repositories whose TLS certificates are invalid or expiring soon before updating dependencies.
+	// This requires network access.
+	CheckCertificates bool `yaml:"checkCertificates"`
+	// CertificateExpiryWindow is the number of days before the expiry of a repository's TLS certificate to start warning about it. Defaults to 14.
+	CertificateExpiryWindow int `yaml:"certificateExpiryWindow"`
+	// CredentialsFile is the YAML file mapping repository names to their credentials, looked up at resolution time instead of being declared in the helmfile
+	CredentialsFile string `yaml:"credentialsFile"`
+	// CredentialsFromEnv, when set to true, looks up the credentials of the repository named `my-repo` from envvars like `HELMFILE_REPO_MY_REPO_USERNAME` at resolution time
+	CredentialsFromEnv bool `yaml:"credentialsFromEnv"`
+	// CredentialsProvider takes precedence over CredentialsFile and CredentialsFromEnv, so that library users can plug in secret stores like Vault
+	CredentialsProvider CredentialsProvider `yaml:"-"`
+	// Offline, when set to true, forbids any network access during dependency resolution.
+	// Charts are resolved only from the lock files, or from the chart tarballs in ChartsDir when updating dependencies.
+	Offline bool `yaml:"offline"`
+	// FrozenLockfile, when set to true, fails instead of updating the lock file when it is missing,
+	// or when any dependency isn't locked or its locked version no longer satisfies the version constraint.
+	FrozenLockfile bool `yaml:"frozenLockfile"`
+	// MaxVersionsPerChart is the number of the newest versions of a chart considered first when helmfile selects a version by itself,
+	// like from ChartsDir or repository indexes. Older versions are considered only when none of them satisfies the constraint. 0 means all the versions.
+	MaxVersionsPerChart int `yaml:"maxVersionsPerChart"`
+	// Failover, when set to true, health-checks repositories with mirrors and fails over to the first healthy mirror when updating dependencies.
+	// The URL that actually served each chart is recorded as `source` in the lock file.
+	Failover bool `yaml:"failover"`
+	// ChannelsFile is the YAML file mapping chart names to symbolic channel names like `stable` and `edge` to version constraints.
+	// Releases can then specify channel names in place of versions.
+	ChannelsFile string `yaml:"channelsFile"`
+	// GitCacheDir is the directory charts in git repositories, like `git::https://github.com/org/repo//charts/app?ref=v1.2.0`, are checked out into.
+	// Defaults to `helmfile/git` in the temporary directory.
+	GitCacheDir string `yaml:"gitCacheDir"`
+	// SkipResolve, when set to true, skips dependency resolution entirely for fast iteration, neither reading nor updating the lock files.
+	// Releases keep their declared versions. Set by `helmfile --skip-resolve`.
+	SkipResolve bool `yaml:"-"`
 }
 
 // RepositorySpec that defines values for a helm repo
@@ -111,6 +251,18 @@ type RepositorySpec struct {
 	KeyFile  string `yaml:"keyFile"`
 	Username string `yaml:"username"`
 	Password string `yaml:"password"`
+	// CAFile is the CA bundle to verify the repository's TLS certificate with, in requests helmfile makes to the repository by itself
+	CAFile string `yaml:"caFile"`
+	// Headers are custom HTTP headers like API versions and tenant IDs sent along with every request helmfile makes to the repository.
+	// As helm doesn't support custom headers, charts in the repository are resolved from the index helmfile fetches instead of by helm.
+	// They are never logged.
+	Headers map[string]string `yaml:"headers"`
+	// Mirrors are the URLs of the mirrors of the repository, failed over to in order when `dependencyResolution.failover` is enabled
+	Mirrors []string `yaml:"mirrors"`
+	// HealthCheck is how the repository and its mirrors are health-checked for failover: "index" (default), "head" or "none"
+	HealthCheck string `yaml:"healthCheck"`
+	// NoPin, when set to true, excludes charts from this repository from dependency locking, so that they always float to the version declared in releases
+	NoPin bool `yaml:"noPin"`
 }
 
 // ReleaseSpec defines the structure of a helm release
@@ -119,6 +271,8 @@ type ReleaseSpec struct {
 	Chart   string `yaml:"chart"`
 	Version string `yaml:"version"`
 	Verify  *bool  `yaml:"verify"`
+	// Keyring is the keyring the provenance of the chart is verified against, overriding the one in `helmDefaults`
+	Keyring string `yaml:"keyring"`
 	// Devel, when set to true, use development versions, too. Equivalent to version '>0.0.0-0'
 	Devel *bool `yaml:"devel"`
 	// Wait, if set to true, will wait until all Pods, PVCs, Services, and minimum number of Pods of a Deployment are in a ready state before marking the release as successful
@@ -131,8 +285,39 @@ type ReleaseSpec struct {
 	Force *bool `yaml:"force"`
 	// Installed, when set to true, `delete --purge` the release
 	Installed *bool `yaml:"installed"`
+	// Condition is the dot-separated path to the boolean in the environment and state values, like `monitoring.enabled`.
+	// The release is processed only when the value is true, otherwise it's left as it is in the cluster.
+	Condition string `yaml:"condition"`
+	// InstalledTemplate is the template expression rendered to `true` or `false` for each release, overriding `installed`.
+	// Use it instead of `installed` for conditions depending on the release, like `{{ ne .Release.Namespace "kube-system" }}` in release templates
+	InstalledTemplate *string `yaml:"installedTemplate"`
 	// Atomic, when set to true, restore previous state in case of a failed install/upgrade attempt
 	Atomic *bool `yaml:"atomic"`
+	// CleanupOnFail, when set to true, deletes the new resources created in a failed upgrade of the release
+	CleanupOnFail *bool `yaml:"cleanupOnFail"`
+	// HistoryMax is the maximum number of revisions kept for the release, so that long-lived releases don't accumulate revisions in the cluster. 0 means no limit
+	HistoryMax *int `yaml:"historyMax"`
+	// SkipCRDs, when set to true, skips installing the CRDs in the `crds` directory of the chart, overriding the one in `helmDefaults`
+	SkipCRDs *bool `yaml:"skipCRDs"`
+	// CreateNamespace, when set to true, creates the namespace of the release if missing on sync, overriding the one in `helmDefaults`
+	CreateNamespace *bool `yaml:"createNamespace"`
+	// NamespaceLabels and NamespaceAnnotations are set on the namespace of the release before installing it, like `istio-injection: enabled`.
+	// They're set only when the namespace is created on sync, overwriting the existing ones.
+	NamespaceLabels      map[string]string `yaml:"namespaceLabels"`
+	NamespaceAnnotations map[string]string `yaml:"namespaceAnnotations"`
+	// IncludeCRDs, when set to true, includes the CRDs of the chart in the output of `helmfile template`, overriding the one in `helmDefaults`
+	IncludeCRDs *bool `yaml:"includeCRDs"`
+	// SkipDeps, when set to true, excludes the release from the lock file driven version resolution, so that it is deployed with its declared version.
+	// `helm dependency update` and `helm dependency build` aren't run on its local chart, either, which helps with huge umbrella charts.
+	SkipDeps bool `yaml:"skipDeps"`
+	// HelmBinary is the path to the helm binary to deploy the release with, overriding the one in `helmDefaults`.
+	// This allows to drive releases on clusters running helm v2 and v3 from the same state file.
+	HelmBinary string `yaml:"helmBinary"`
+	// PostRenderer is the command the rendered manifests are piped through before being applied, like a script running kustomize. Requires helm 3.1+.
+	// A relative path is relative to the state file, while a command without a path is looked up in PATH.
+	PostRenderer string `yaml:"postRenderer"`
+	// PostRendererArgs are the arguments passed to PostRenderer. Requires helm 3.7+.
+	PostRendererArgs []string `yaml:"postRendererArgs"`
 
 	// MissingFileHandler is set to either "Error" or "Warn". "Error" instructs helmfile to fail when unable to find a values or secrets file. When "Warn", it prints the file and continues.
 	// The default value for MissingFileHandler is "Error".
@@ -141,6 +326,14 @@ type ReleaseSpec struct {
 	// Hooks is a list of extension points paired with operations, that are executed in specific points of the lifecycle of releases defined in helmfile
 	Hooks []event.Hook `yaml:"hooks"`
 
+	// Needs is the releases this release depends on, as either `namespace/name` or the name of a release in the same namespace.
+	// sync and apply process the needed releases before this release.
+	Needs []string `yaml:"needs"`
+
+	// Inherit is the names of the templates under `templates` this release inherits, from the lowest precedence.
+	// Settings of the release itself take precedence over the templates, while values, secrets, hooks and the like are appended to the templates' ones.
+	Inherit []string `yaml:"inherit"`
+
 	// Name is the name of this release
 	Name      string            `yaml:"name"`
 	Namespace string            `yaml:"namespace"`
@@ -148,6 +341,10 @@ type ReleaseSpec struct {
 	Values    []interface{}     `yaml:"values"`
 	Secrets   []string          `yaml:"secrets"`
 	SetValues []SetValue        `yaml:"set"`
+	// SetStringValues are passed via `--set-string`, so that helm doesn't coerce them into numbers and booleans
+	SetStringValues []SetValue `yaml:"setString"`
+	// SetFileValues are passed via `--set-file`, so that helm reads the values like large certificates from the files
+	SetFileValues []SetValue `yaml:"setFile"`
 
 	// The 'env' section is not really necessary any longer, as 'set' would now provide the same functionality
 	EnvValues []SetValue `yaml:"env"`
@@ -163,6 +360,10 @@ type ReleaseSpec struct {
 	TLSCACert string `yaml:"tlsCACert"`
 	TLSKey    string `yaml:"tlsKey"`
 	TLSCert   string `yaml:"tlsCert"`
+	// TLSVerify, when set to true, verifies the certificate of tiller against TLSCACert, which helm ignores otherwise
+	TLSVerify *bool `yaml:"tlsVerify"`
+	// TLSHostname is the server name the certificate of tiller is verified against
+	TLSHostname string `yaml:"tlsHostname"`
 
 	// These settings requires helm-x integration to work
 	Dependencies          []Dependency  `yaml:"dependencies"`
@@ -198,6 +399,13 @@ const MissingFileHandlerInfo = "Info"
 const MissingFileHandlerWarn = "Warn"
 const MissingFileHandlerDebug = "Debug"
 
+const VersionPrefixStrip = "strip"
+const VersionPrefixAdd = "add"
+
+const ResolvedLabelVersion = "version"
+const ResolvedLabelDigest = "digest"
+const ResolvedLabelRepository = "repository"
+
 func (st *HelmState) applyDefaultsTo(spec *ReleaseSpec) {
 	if st.Namespace != "" {
 		spec.Namespace = st.Namespace
@@ -207,15 +415,71 @@ func (st *HelmState) applyDefaultsTo(spec *ReleaseSpec) {
 type RepoUpdater interface {
 	AddRepo(name, repository, certfile, keyfile, username, password string) error
 	UpdateRepo() error
+	RegistryLogin(registry, username, password string) error
 }
 
 // SyncRepos will update the given helm releases
 func (st *HelmState) SyncRepos(helm RepoUpdater) []error {
 	errs := []error{}
 
+	creds := st.credentialsProvider()
+
+	var sources map[string]string
+	if st.DependencyResolution.Failover {
+		var err error
+		sources, err = st.repositorySources()
+		if err != nil {
+			return []error{err}
+		}
+	}
+
+	nestedRepos := st.nestedRepositories()
+	nestedNames := make([]string, 0, len(nestedRepos))
+	for name := range nestedRepos {
+		nestedNames = append(nestedNames, name)
+	}
+	sort.Strings(nestedNames)
+
+	var registries int
 	for _, repo := range st.Repositories {
-		if err := helm.AddRepo(repo.Name, repo.URL, repo.CertFile, repo.KeyFile, repo.Username, repo.Password); err != nil {
+		repo, err := withCredentials(creds, repo)
+		if err != nil {
 			errs = append(errs, err)
+			continue
+		}
+		if source, ok := sources[repo.Name]; ok {
+			repo.URL = source
+		}
+		// OCI registries aren't added as repositories, but logged in to when credentials are given
+		if isOCIRepository(repo.URL) {
+			registries++
+			if repo.Username == "" && repo.Password == "" {
+				continue
+			}
+			if err := st.retry("registry login to "+repo.URL, func() error {
+				return helm.RegistryLogin(registryHost(repo.URL), repo.Username, repo.Password)
+			}); err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		if err := st.retry("adding repository "+repo.Name, func() error {
+			return helm.AddRepo(repo.Name, repo.URL, repo.CertFile, repo.KeyFile, repo.Username, repo.Password)
+		}); err != nil {
+			errs = append(errs, err)
+		}
+		// Nested chart paths like `myrepo/library/nginx` are served from their own repositories under the parent's URL
+		for _, name := range nestedNames {
+			nested := nestedRepos[name]
+			if nested.Name != repo.Name {
+				continue
+			}
+			url := strings.TrimSuffix(repo.URL, "/") + strings.TrimPrefix(name, repo.Name)
+			if err := st.retry("adding repository "+name, func() error {
+				return helm.AddRepo(helmRepositoryName(name), url, repo.CertFile, repo.KeyFile, repo.Username, repo.Password)
+			}); err != nil {
+				errs = append(errs, err)
+			}
 		}
 	}
 
@@ -223,7 +487,11 @@ func (st *HelmState) SyncRepos(helm RepoUpdater) []error {
 		return errs
 	}
 
-	if err := helm.UpdateRepo(); err != nil {
+	if registries > 0 && registries == len(st.Repositories) {
+		return nil
+	}
+
+	if err := st.retry("updating repositories", helm.UpdateRepo); err != nil {
 		return []error{err}
 	}
 	return nil
@@ -331,10 +599,16 @@ func (st *HelmState) prepareSyncReleases(helm helmexec.Interface, additionalValu
 }
 
 func (st *HelmState) isReleaseInstalled(context helmexec.HelmContext, helm helmexec.Interface, release ReleaseSpec) (bool, error) {
-	out, err := helm.List(context, "^"+release.Name+"$", st.connectionFlags(&release)...)
+	var out string
+	err := st.retry("listing release "+release.Name, func() error {
+		var err error
+		// `--short` prints only the names of the matching releases, as helm v3 prints the table header even when no release matches
+		out, err = helm.List(context, "^"+release.Name+"$", append(st.connectionFlags(&release), "--short")...)
+		return err
+	})
 	if err != nil {
 		return false, err
-	} else if out != "" {
+	} else if strings.TrimSpace(out) != "" {
 		return true, nil
 	}
 	return false, nil
@@ -366,6 +640,43 @@ func (st *HelmState) SyncReleases(affectedReleases *AffectedReleases, helm helme
 		return prepErrs
 	}
 
+	releases := []*ReleaseSpec{}
+	for i := range preps {
+		releases = append(releases, preps[i].release)
+	}
+	groups, err := st.groupReleasesByNeeds(releases)
+	if err != nil {
+		return []error{err}
+	}
+
+	if len(groups) > 1 {
+		msgs := []string{}
+		for i, group := range groups {
+			ids := []string{}
+			for _, j := range group {
+				ids = append(ids, st.releaseID(releases[j]))
+			}
+			msgs = append(msgs, fmt.Sprintf("%d: %s", i+1, strings.Join(ids, ", ")))
+		}
+		st.logger.Infof("processing %d groups of releases in this order:\n%s", len(groups), strings.Join(msgs, "\n"))
+	}
+
+	// Releases needing failed releases are never processed
+	for _, group := range groups {
+		batch := []*syncPrepareResult{}
+		for _, i := range group {
+			batch = append(batch, &preps[i])
+		}
+		if errs := st.syncPreparedReleases(affectedReleases, helm, batch, workerLimit); len(errs) > 0 {
+			return errs
+		}
+	}
+
+	return nil
+}
+
+// syncPreparedReleases syncs the prepared releases in parallel
+func (st *HelmState) syncPreparedReleases(affectedReleases *AffectedReleases, helm helmexec.Interface, preps []*syncPrepareResult, workerLimit int) []error {
 	errs := []error{}
 	jobQueue := make(chan *syncPrepareResult, len(preps))
 	results := make(chan syncResult, len(preps))
@@ -375,7 +686,7 @@ func (st *HelmState) SyncReleases(affectedReleases *AffectedReleases, helm helme
 		len(preps),
 		func() {
 			for i := 0; i < len(preps); i++ {
-				jobQueue <- &preps[i]
+				jobQueue <- preps[i]
 			}
 			close(jobQueue)
 		},
@@ -383,7 +694,7 @@ func (st *HelmState) SyncReleases(affectedReleases *AffectedReleases, helm helme
 			for prep := range jobQueue {
 				release := prep.release
 				flags := prep.flags
-				chart := normalizeChart(st.basePath, release.Chart)
+				chart := st.chartReference(release.Chart)
 				var relErr *ReleaseError
 				context := st.createHelmContext(release, workerIndex)
 
@@ -395,14 +706,18 @@ func (st *HelmState) SyncReleases(affectedReleases *AffectedReleases, helm helme
 						relErr = newReleaseError(release, err)
 					} else if installed {
 						deletionFlags := st.appendConnectionFlags([]string{"--purge"}, release)
-						if err := helm.DeleteRelease(context, release.Name, deletionFlags...); err != nil {
+						if err := st.retry("deleting release "+release.Name, func() error {
+							return helm.DeleteRelease(context, release.Name, deletionFlags...)
+						}); err != nil {
 							affectedReleases.Failed = append(affectedReleases.Failed, release)
 							relErr = newReleaseError(release, err)
 						} else {
 							affectedReleases.Deleted = append(affectedReleases.Deleted, release)
 						}
 					}
-				} else if err := helm.SyncRelease(context, release.Name, chart, flags...); err != nil {
+				} else if err := st.retry("upgrading release "+release.Name, func() error {
+					return helm.SyncRelease(context, release.Name, chart, flags...)
+				}); err != nil {
 					affectedReleases.Failed = append(affectedReleases.Failed, release)
 					relErr = newReleaseError(release, err)
 				} else {
@@ -506,11 +821,14 @@ func (st *HelmState) downloadCharts(helm helmexec.Interface, dir string, concurr
 					if st.isDevelopment(release) {
 						fetchFlags = append(fetchFlags, "--devel")
 					}
+					fetchFlags = st.appendVerifyFlags(fetchFlags, release)
 
 					// only fetch chart if it is not already fetched
 					if _, err := os.Stat(chartPath); os.IsNotExist(err) {
 						fetchFlags = append(fetchFlags, "--untar", "--untardir", chartPath)
-						if err := helm.Fetch(release.Chart, fetchFlags...); err != nil {
+						if err := st.retry("fetching chart "+release.Chart, func() error {
+							return helm.Fetch(st.chartReference(release.Chart), fetchFlags...)
+						}); err != nil {
 							errs = append(errs, err)
 						}
 					}
@@ -791,11 +1109,30 @@ func (st *HelmState) createHelmContext(spec *ReleaseSpec, workerIndex int) helme
 	if spec.Tillerless != nil {
 		tillerless = *spec.Tillerless
 	}
+	helmBinary := st.HelmDefaults.HelmBinary
+	if spec.HelmBinary != "" {
+		helmBinary = spec.HelmBinary
+	}
+	kubeContext := st.HelmDefaults.KubeContext
+	if spec.KubeContext != "" {
+		kubeContext = spec.KubeContext
+	}
+	createNamespace := st.HelmDefaults.CreateNamespace == nil || *st.HelmDefaults.CreateNamespace
+	if spec.CreateNamespace != nil {
+		createNamespace = *spec.CreateNamespace
+	}
 
 	return helmexec.HelmContext{
 		Tillerless:      tillerless,
 		TillerNamespace: namespace,
 		WorkerIndex:     workerIndex,
+		Namespace:       spec.Namespace,
+		HelmBinary:      helmBinary,
+		KubeContext:     kubeContext,
+		CreateNamespace: createNamespace,
+
+		NamespaceLabels:      spec.NamespaceLabels,
+		NamespaceAnnotations: spec.NamespaceAnnotations,
 	}
 }
 
@@ -826,7 +1163,9 @@ func (st *HelmState) DiffReleases(helm helmexec.Interface, additionalValues []st
 			for prep := range jobQueue {
 				flags := prep.flags
 				release := prep.release
-				if err := helm.DiffRelease(st.createHelmContext(release, workerIndex), release.Name, normalizeChart(st.basePath, release.Chart), flags...); err != nil {
+				if err := st.retry("diffing release "+release.Name, func() error {
+					return helm.DiffRelease(st.createHelmContext(release, workerIndex), release.Name, st.chartReference(release.Chart), flags...)
+				}); err != nil {
 					switch e := err.(type) {
 					case helmexec.ExitError:
 						// Propagate any non-zero exit status from the external command like `helm` that is failed under the hood
@@ -871,7 +1210,9 @@ func (st *HelmState) ReleaseStatuses(helm helmexec.Interface, workerLimit int) [
 		flags := []string{}
 		flags = st.appendConnectionFlags(flags, &release)
 
-		return helm.ReleaseStatus(st.createHelmContext(&release, workerIndex), release.Name, flags...)
+		return st.retry("getting the status of release "+release.Name, func() error {
+			return helm.ReleaseStatus(st.createHelmContext(&release, workerIndex), release.Name, flags...)
+		})
 	})
 }
 
@@ -894,7 +1235,9 @@ func (st *HelmState) DeleteReleases(affectedReleases *AffectedReleases, helm hel
 			return err
 		}
 		if installed {
-			if err := helm.DeleteRelease(context, release.Name, flags...); err != nil {
+			if err := st.retry("deleting release "+release.Name, func() error {
+				return helm.DeleteRelease(context, release.Name, flags...)
+			}); err != nil {
 				affectedReleases.Failed = append(affectedReleases.Failed, &release)
 				return err
 			} else {
@@ -1000,11 +1343,20 @@ func (st *HelmState) PrepareReleases(helm helmexec.Interface, helmfileCommand st
 		return errs
 	}
 
+	if err := st.ensurePlugins(helm, st.requiredPlugins(helmfileCommand)...); err != nil {
+		return []error{err}
+	}
+
 	updated, err := st.ResolveDeps()
 	if err != nil {
 		return []error{err}
 	}
 
+	// Charts in git repositories are deployed as local charts checked out at the locked commits
+	if err := updated.checkoutGitCharts(); err != nil {
+		return []error{err}
+	}
+
 	*st = *updated
 
 	return nil
@@ -1036,8 +1388,13 @@ func (st *HelmState) triggerReleaseEvent(evt string, r *ReleaseSpec, helmfileCmd
 		Logger:        st.logger,
 		ReadFile:      st.readFile,
 	}
+	vals, err := st.Values()
+	if err != nil {
+		return false, err
+	}
 	data := map[string]interface{}{
 		"Release":         r,
+		"Values":          vals,
 		"HelmfileCommand": helmfileCmd,
 	}
 	return bus.Trigger(evt, data)
@@ -1048,15 +1405,56 @@ func (st *HelmState) ResolveDeps() (*HelmState, error) {
 	return st.mergeLockedDependencies()
 }
 
+// ResolveDepsWithWarnings is the same as ResolveDeps, but also returns the warnings emitted while resolving
+func (st *HelmState) ResolveDepsWithWarnings() (*HelmState, []ResolutionWarning, error) {
+	warnings := st.collectResolutionWarnings()
+	updated, err := st.mergeLockedDependencies()
+	return updated, warnings(), err
+}
+
+// UpdateDepsWithWarnings is the same as UpdateDeps, but also returns the warnings emitted while resolving
+func (st *HelmState) UpdateDepsWithWarnings(helm helmexec.Interface) ([]ResolutionWarning, []error) {
+	warnings := st.collectResolutionWarnings()
+	errs := st.UpdateDeps(helm)
+	return warnings(), errs
+}
+
 // UpdateDeps wrapper for updating dependencies on the releases
 func (st *HelmState) UpdateDeps(helm helmexec.Interface) []error {
 	errs := []error{}
+	localCharts := []string{}
 
 	for _, release := range st.Releases {
-		if isLocalChart(release.Chart) {
-			if err := helm.UpdateDeps(normalizeChart(st.basePath, release.Chart)); err != nil {
+		if release.SkipDeps {
+			continue
+		}
+		if st.isLocalChart(release.Chart) {
+			if st.DependencyResolution.Offline {
+				errs = append(errs, fmt.Errorf("unable to update dependencies of the local chart %s offline, as running `helm dependency update` requires network access", release.Chart))
+				continue
+			}
+			chart := normalizeChart(st.basePath, release.Chart)
+			if st.DependencyResolution.FrozenLockfile {
+				// `helm dependency build` falls back to `helm dependency update` when the chart has no lock file,
+				// so that its absence must be detected beforehand
+				locked, err := st.localChartLocked(chart)
+				if err != nil {
+					errs = append(errs, err)
+					continue
+				}
+				if !locked {
+					errs = append(errs, fmt.Errorf("the lock file of the local chart %s is missing, while the lock file is frozen: run `helmfile deps` without --frozen-lockfile to create it", release.Chart))
+					continue
+				}
+				if err := st.retry("building dependencies of "+chart, func() error { return helm.BuildDeps(chart) }); err != nil {
+					errs = append(errs, err)
+				}
+				continue
+			}
+			if err := st.retry("updating dependencies of "+chart, func() error { return helm.UpdateDeps(chart) }); err != nil {
 				errs = append(errs, err)
 			}
+			localCharts = append(localCharts, chart)
 		}
 	}
 
@@ -1071,6 +1469,20 @@ func (st *HelmState) UpdateDeps(helm helmexec.Interface) []error {
 		}
 	}
 
+	// The subcharts of local charts are locked by helmfile along with the other charts, which `helm dependency update` above doesn't know
+	if len(errs) == 0 && len(localCharts) > 0 {
+		locked, err := st.lockedDependencies()
+		if err != nil {
+			errs = append(errs, err)
+		} else if locked != nil {
+			for _, chart := range localCharts {
+				if err := st.pinLocalChartDependencies(helm, chart, locked); err != nil {
+					errs = append(errs, fmt.Errorf("unable to pin the dependencies of %s: %v", chart, err))
+				}
+			}
+		}
+	}
+
 	if len(errs) != 0 {
 		return errs
 	}
@@ -1082,8 +1494,12 @@ func (st *HelmState) BuildDeps(helm helmexec.Interface) []error {
 	errs := []error{}
 
 	for _, release := range st.Releases {
-		if isLocalChart(release.Chart) {
-			if err := helm.BuildDeps(normalizeChart(st.basePath, release.Chart)); err != nil {
+		if release.SkipDeps {
+			continue
+		}
+		if st.isLocalChart(release.Chart) {
+			chart := normalizeChart(st.basePath, release.Chart)
+			if err := st.retry("building dependencies of "+chart, func() error { return helm.BuildDeps(chart) }); err != nil {
 				errs = append(errs, err)
 			}
 		}
@@ -1091,6 +1507,11 @@ func (st *HelmState) BuildDeps(helm helmexec.Interface) []error {
 	if len(errs) != 0 {
 		return errs
 	}
+
+	if err := st.VerifyChartDigests(helm); err != nil {
+		return []error{err}
+	}
+
 	return nil
 }
 
@@ -1173,6 +1594,16 @@ func (st *HelmState) connectionFlags(release *ReleaseSpec) []string {
 			flags = append(flags, "--tls-ca-cert", st.HelmDefaults.TLSCACert)
 		}
 
+		if release.TLSVerify != nil && *release.TLSVerify || release.TLSVerify == nil && st.HelmDefaults.TLSVerify {
+			flags = append(flags, "--tls-verify")
+		}
+
+		if release.TLSHostname != "" {
+			flags = append(flags, "--tls-hostname", release.TLSHostname)
+		} else if st.HelmDefaults.TLSHostname != "" {
+			flags = append(flags, "--tls-hostname", st.HelmDefaults.TLSHostname)
+		}
+
 		if release.KubeContext != "" {
 			flags = append(flags, "--kube-context", release.KubeContext)
 		} else if st.HelmDefaults.KubeContext != "" {
@@ -1193,9 +1624,7 @@ func (st *HelmState) flagsForUpgrade(helm helmexec.Interface, release *ReleaseSp
 		flags = append(flags, "--devel")
 	}
 
-	if release.Verify != nil && *release.Verify || release.Verify == nil && st.HelmDefaults.Verify {
-		flags = append(flags, "--verify")
-	}
+	flags = st.appendVerifyFlags(flags, release)
 
 	if release.Wait != nil && *release.Wait || release.Wait == nil && st.HelmDefaults.Wait {
 		flags = append(flags, "--wait")
@@ -1221,6 +1650,21 @@ func (st *HelmState) flagsForUpgrade(helm helmexec.Interface, release *ReleaseSp
 		flags = append(flags, "--atomic")
 	}
 
+	if release.CleanupOnFail != nil && *release.CleanupOnFail || release.CleanupOnFail == nil && st.HelmDefaults.CleanupOnFail {
+		flags = append(flags, "--cleanup-on-fail")
+	}
+
+	if release.HistoryMax != nil {
+		flags = append(flags, "--history-max", strconv.Itoa(*release.HistoryMax))
+	} else if st.HelmDefaults.HistoryMax != nil {
+		flags = append(flags, "--history-max", strconv.Itoa(*st.HelmDefaults.HistoryMax))
+	}
+
+	if release.SkipCRDs != nil && *release.SkipCRDs || release.SkipCRDs == nil && st.HelmDefaults.SkipCRDs {
+		flags = append(flags, "--skip-crds")
+	}
+
+	flags = st.appendPostRendererFlags(flags, release)
 	flags = st.appendConnectionFlags(flags, release)
 
 	var err error
@@ -1240,6 +1684,10 @@ func (st *HelmState) flagsForTemplate(helm helmexec.Interface, release *ReleaseS
 	flags := []string{
 		"--name", release.Name,
 	}
+	if release.IncludeCRDs != nil && *release.IncludeCRDs || release.IncludeCRDs == nil && st.HelmDefaults.IncludeCRDs {
+		flags = append(flags, "--include-crds")
+	}
+	flags = st.appendPostRendererFlags(flags, release)
 
 	var err error
 	flags, err = st.appendHelmXFlags(flags, release)
@@ -1264,6 +1712,7 @@ func (st *HelmState) flagsForDiff(helm helmexec.Interface, release *ReleaseSpec,
 		flags = append(flags, "--devel")
 	}
 
+	flags = st.appendPostRendererFlags(flags, release)
 	flags = st.appendConnectionFlags(flags, release)
 
 	var err error
@@ -1279,6 +1728,23 @@ func (st *HelmState) flagsForDiff(helm helmexec.Interface, release *ReleaseSpec,
 	return append(flags, common...), nil
 }
 
+// appendPostRendererFlags appends the flags to pipe the rendered manifests of the release through its post-renderer, if any
+func (st *HelmState) appendPostRendererFlags(flags []string, release *ReleaseSpec) []string {
+	if release.PostRenderer == "" {
+		return flags
+	}
+
+	postRenderer := release.PostRenderer
+	if strings.ContainsRune(postRenderer, '/') {
+		postRenderer = st.storage().normalizePath(postRenderer)
+	}
+	flags = append(flags, "--post-renderer", postRenderer)
+	for _, a := range release.PostRendererArgs {
+		flags = append(flags, "--post-renderer-args", a)
+	}
+	return flags
+}
+
 func (st *HelmState) isDevelopment(release *ReleaseSpec) bool {
 	result := st.HelmDefaults.Devel
 	if release.Devel != nil {
@@ -1307,12 +1773,27 @@ func (st *HelmState) RenderValuesFileToBytes(path string) ([]byte, error) {
 	return r.RenderToBytes(path)
 }
 
+// renderReleaseValuesFileToBytes renders the values file of the release, in which the release is accessible as `.Release` if it's a `.gotmpl` file
+func (st *HelmState) renderReleaseValuesFileToBytes(release *ReleaseSpec, path string) ([]byte, error) {
+	r := tmpl.NewFileRenderer(st.readFile, filepath.Dir(path), st.releaseValuesFileTemplateData(release))
+	return r.RenderToBytes(path)
+}
+
+// missingFileHandler returns the `missingFileHandler` of the release, which defaults to the one in `helmDefaults`
+func (st *HelmState) missingFileHandler(release *ReleaseSpec) *string {
+	if release.MissingFileHandler != nil {
+		return release.MissingFileHandler
+	}
+	return st.HelmDefaults.MissingFileHandler
+}
+
 func (st *HelmState) storage() *Storage {
 	return &Storage{
 		FilePath: st.FilePath,
 		basePath: st.basePath,
 		glob:     st.glob,
 		logger:   st.logger,
+		remote:   st.remote,
 	}
 }
 
@@ -1341,13 +1822,13 @@ func (st *HelmState) ExpandedHelmfiles() ([]SubHelmfileSpec, error) {
 	return helmfiles, nil
 }
 
-func (st *HelmState) generateTemporaryValuesFiles(values []interface{}, missingFileHandler *string) ([]string, error) {
+func (st *HelmState) generateTemporaryValuesFiles(release *ReleaseSpec, values []interface{}) ([]string, error) {
 	generatedFiles := []string{}
 
 	for _, value := range values {
 		switch typedValue := value.(type) {
 		case string:
-			paths, skip, err := st.storage().resolveFile(missingFileHandler, "values", typedValue)
+			paths, skip, err := st.storage().resolveFile(st.missingFileHandler(release), "values", typedValue)
 			if err != nil {
 				return nil, err
 			}
@@ -1360,7 +1841,7 @@ func (st *HelmState) generateTemporaryValuesFiles(values []interface{}, missingF
 			}
 			path := paths[0]
 
-			yamlBytes, err := st.RenderValuesFileToBytes(path)
+			yamlBytes, err := st.renderReleaseValuesFileToBytes(release, path)
 			if err != nil {
 				return nil, fmt.Errorf("failed to render values files \"%s\": %v", typedValue, err)
 			}
@@ -1377,6 +1858,30 @@ func (st *HelmState) generateTemporaryValuesFiles(values []interface{}, missingF
 			st.logger.Debugf("successfully generated the value file at %s. produced:\n%s", path, string(yamlBytes))
 			generatedFiles = append(generatedFiles, valfile.Name())
 		case map[interface{}]interface{}:
+			command, isExec, err := execValuesCommand(typedValue)
+			if err != nil {
+				return nil, err
+			}
+			if isExec {
+				yamlBytes, err := st.execValues(command)
+				if err != nil {
+					return nil, err
+				}
+
+				valfile, err := ioutil.TempFile("", "values")
+				if err != nil {
+					return nil, err
+				}
+				defer valfile.Close()
+
+				if _, err := valfile.Write(yamlBytes); err != nil {
+					return nil, fmt.Errorf("failed to write %s: %v", valfile.Name(), err)
+				}
+				st.logger.Debugf("successfully generated the value file at %s from values command %v. produced:\n%s", valfile.Name(), command, string(yamlBytes))
+				generatedFiles = append(generatedFiles, valfile.Name())
+				continue
+			}
+
 			valfile, err := ioutil.TempFile("", "values")
 			if err != nil {
 				return nil, err
@@ -1412,7 +1917,7 @@ func (st *HelmState) namespaceAndValuesFlags(helm helmexec.Interface, release *R
 		}
 	}
 
-	generatedFiles, err := st.generateTemporaryValuesFiles(values, release.MissingFileHandler)
+	generatedFiles, err := st.generateTemporaryValuesFiles(release, values)
 	if err != nil {
 		return nil, err
 	}
@@ -1424,7 +1929,7 @@ func (st *HelmState) namespaceAndValuesFlags(helm helmexec.Interface, release *R
 	release.generatedValues = append(release.generatedValues, generatedFiles...)
 
 	for _, value := range release.Secrets {
-		paths, skip, err := st.storage().resolveFile(release.MissingFileHandler, "secrets", release.ValuesPathPrefix+value)
+		paths, skip, err := st.storage().resolveFile(st.missingFileHandler(release), "secrets", release.ValuesPathPrefix+value)
 		if err != nil {
 			return nil, err
 		}
@@ -1463,6 +1968,25 @@ func (st *HelmState) namespaceAndValuesFlags(helm helmexec.Interface, release *R
 		}
 	}
 
+	for _, set := range release.SetStringValues {
+		if len(set.Values) > 0 {
+			items := make([]string, len(set.Values))
+			for i, raw := range set.Values {
+				items[i] = escape(raw)
+			}
+			flags = append(flags, "--set-string", fmt.Sprintf("%s={%s}", escape(set.Name), strings.Join(items, ",")))
+		} else {
+			flags = append(flags, "--set-string", fmt.Sprintf("%s=%s", escape(set.Name), escape(set.Value)))
+		}
+	}
+
+	for _, set := range release.SetFileValues {
+		if set.File == "" {
+			return nil, fmt.Errorf("setFile \"%s\" of release \"%s\" has no file", set.Name, release.Name)
+		}
+		flags = append(flags, "--set-file", fmt.Sprintf("%s=%s", escape(set.Name), st.storage().normalizePath(set.File)))
+	}
+
 	/***********
 	 * START 'env' section for backwards compatibility
 	 ***********/
@@ -41,6 +41,15 @@ func (st *HelmState) valuesFileTemplateData() EnvironmentTemplateData {
 	}
 }
 
+func (st *HelmState) releaseValuesFileTemplateData(release *ReleaseSpec) releaseValuesTemplateData {
+	return releaseValuesTemplateData{
+		Environment: st.Env,
+		Namespace:   st.Namespace,
+		Values:      st.mustLoadVals(),
+		Release:     *release,
+	}
+}
+
 func (st *HelmState) ExecuteTemplates() (*HelmState, error) {
 	r := *st
 
@@ -50,6 +59,10 @@ func (st *HelmState) ExecuteTemplates() (*HelmState, error) {
 	}
 
 	for i, rt := range st.Releases {
+		rt, err := st.inheritTemplates(rt, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed inheriting templates in release \"%s\".\"%s\": %v", st.FilePath, rt.Name, err)
+		}
 		tmplData := releaseTemplateData{
 			Environment: st.Env,
 			Release:     rt,
@@ -65,3 +78,47 @@ func (st *HelmState) ExecuteTemplates() (*HelmState, error) {
 
 	return &r, nil
 }
+
+// inheritTemplates returns the release merged into the templates it inherits, so that template expressions in the templates are rendered per release.
+// `chain` is the templates being inherited, used to detect cyclic inheritance among templates.
+func (st *HelmState) inheritTemplates(r ReleaseSpec, chain []string) (ReleaseSpec, error) {
+	if len(r.Inherit) == 0 {
+		return r, nil
+	}
+
+	var merged *ReleaseSpec
+	for _, name := range r.Inherit {
+		for _, c := range chain {
+			if c == name {
+				return r, fmt.Errorf("cyclic inheritance of template \"%s\"", name)
+			}
+		}
+
+		t, ok := st.Templates[name]
+		if !ok {
+			return r, fmt.Errorf("template \"%s\" is not defined", name)
+		}
+
+		base, err := t.ReleaseSpec.Clone()
+		if err != nil {
+			return r, err
+		}
+		inherited, err := st.inheritTemplates(*base, append(chain, name))
+		if err != nil {
+			return r, err
+		}
+		inherited.Inherit = nil
+
+		if merged == nil {
+			merged = &inherited
+		} else if err := mergo.Merge(merged, inherited, mergo.WithOverride, mergo.WithAppendSlice); err != nil {
+			return r, fmt.Errorf("failed merging template \"%s\": %v", name, err)
+		}
+	}
+
+	if err := mergo.Merge(merged, r, mergo.WithOverride, mergo.WithAppendSlice); err != nil {
+		return r, err
+	}
+
+	return *merged, nil
+}
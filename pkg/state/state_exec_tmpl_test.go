@@ -33,6 +33,36 @@ func TestHelmState_executeTemplates(t *testing.T) {
 				Secrets:   []string{"config/test_env/test-app/secrets.yaml"},
 			},
 		},
+		{
+			name: "Has template expressions in inline values",
+			input: ReleaseSpec{
+				Chart: "test-charts/chart",
+				Name:  "test-app",
+				Values: []interface{}{
+					map[interface{}]interface{}{
+						"fullnameOverride": "{{ .Release.Name }}",
+						"replicas":         2,
+						"ingress": map[interface{}]interface{}{
+							"hosts": []interface{}{"{{ .Release.Name }}.{{ .Environment.Name }}.example.com"},
+						},
+					},
+				},
+			},
+			want: ReleaseSpec{
+				Chart: "test-charts/chart",
+				Name:  "test-app",
+				Values: []interface{}{
+					map[interface{}]interface{}{
+						"fullnameOverride": "test-app",
+						"replicas":         2,
+						"ingress": map[interface{}]interface{}{
+							"hosts": []interface{}{"test-app.test_env.example.com"},
+						},
+					},
+				},
+				Secrets: []string{},
+			},
+		},
 	}
 
 	for i := range tests {
@@ -77,3 +107,149 @@ func TestHelmState_executeTemplates(t *testing.T) {
 		})
 	}
 }
+
+func TestHelmState_executeTemplatesInherit(t *testing.T) {
+	enable := true
+	disable := false
+	state := &HelmState{
+		basePath: ".",
+		Env:      environment.Environment{Name: "test_env"},
+		Templates: map[string]TemplateSpec{
+			"default": {ReleaseSpec: ReleaseSpec{
+				Chart:     "charts/{{ .Release.Name }}",
+				Namespace: "apps",
+				Wait:      &enable,
+				Labels:    map[string]string{"team": "platform", "tier": "backend"},
+				Values:    []interface{}{"config/{{ .Release.Name }}/values.yaml"},
+			}},
+			"monitored": {ReleaseSpec: ReleaseSpec{
+				Inherit: []string{"default"},
+				Values:  []interface{}{"config/monitoring.yaml"},
+			}},
+		},
+		Releases: []ReleaseSpec{
+			{
+				Name:    "frontend",
+				Inherit: []string{"monitored"},
+				Wait:    &disable,
+				Labels:  map[string]string{"tier": "frontend"},
+				Values:  []interface{}{"config/{{ .Environment.Name }}.yaml"},
+			},
+			{
+				Name:    "backend",
+				Inherit: []string{"default"},
+			},
+		},
+	}
+
+	r, err := state.ExecuteTemplates()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	frontend := r.Releases[0]
+	if frontend.Chart != "charts/frontend" || frontend.Namespace != "apps" {
+		t.Errorf("unexpected chart and namespace: chart=%s, namespace=%s", frontend.Chart, frontend.Namespace)
+	}
+	if frontend.Wait == nil || *frontend.Wait {
+		t.Errorf("unexpected wait: expected=false, got=%v", frontend.Wait)
+	}
+	expectedLabels := map[string]string{"team": "platform", "tier": "frontend"}
+	if !reflect.DeepEqual(frontend.Labels, expectedLabels) {
+		t.Errorf("unexpected labels: expected=%v, got=%v", expectedLabels, frontend.Labels)
+	}
+	expectedValues := []interface{}{"config/frontend/values.yaml", "config/monitoring.yaml", "config/test_env.yaml"}
+	if !reflect.DeepEqual(frontend.Values, expectedValues) {
+		t.Errorf("unexpected values: expected=%v, got=%v", expectedValues, frontend.Values)
+	}
+
+	backend := r.Releases[1]
+	expectedValues = []interface{}{"config/backend/values.yaml"}
+	if !reflect.DeepEqual(backend.Values, expectedValues) {
+		t.Errorf("unexpected values: expected=%v, got=%v", expectedValues, backend.Values)
+	}
+	if backend.Labels["tier"] != "backend" {
+		t.Errorf("unexpected labels: %v", backend.Labels)
+	}
+}
+
+func TestHelmState_executeTemplatesInheritErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		templates map[string]TemplateSpec
+		want      string
+	}{
+		{
+			name: "undefined template",
+			want: `failed inheriting templates in release "helmfile.yaml"."app": template "default" is not defined`,
+		},
+		{
+			name: "cyclic inheritance",
+			templates: map[string]TemplateSpec{
+				"default": {ReleaseSpec: ReleaseSpec{Inherit: []string{"base"}}},
+				"base":    {ReleaseSpec: ReleaseSpec{Inherit: []string{"default"}}},
+			},
+			want: `failed inheriting templates in release "helmfile.yaml"."app": cyclic inheritance of template "default"`,
+		},
+	}
+
+	for i := range tests {
+		tt := tests[i]
+		t.Run(tt.name, func(t *testing.T) {
+			state := &HelmState{
+				basePath:  ".",
+				FilePath:  "helmfile.yaml",
+				Templates: tt.templates,
+				Releases:  []ReleaseSpec{{Name: "app", Inherit: []string{"default"}}},
+			}
+
+			_, err := state.ExecuteTemplates()
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("unexpected error: expected=%s, got=%v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestHelmState_executeTemplatesInstalledTemplate(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		want     bool
+		wantErr  string
+	}{
+		{name: "installed", template: `{{ eq .Release.Namespace "apps" }}`, want: true},
+		{name: "not installed", template: `{{ eq .Environment.Name "production" }}`, want: false},
+		{name: "not a boolean", template: `{{ .Release.Name }}`, wantErr: `failed executing templates in release "helmfile.yaml"."app": failed executing template expressions in release "app".installedTemplate = "{{ .Release.Name }}": expected true or false, got "app"`},
+	}
+
+	for i := range tests {
+		tt := tests[i]
+		t.Run(tt.name, func(t *testing.T) {
+			enable := true
+			state := &HelmState{
+				basePath: ".",
+				FilePath: "helmfile.yaml",
+				Env:      environment.Environment{Name: "test_env"},
+				Releases: []ReleaseSpec{
+					{Name: "app", Namespace: "apps", Installed: &enable, InstalledTemplate: &tt.template},
+				},
+			}
+
+			r, err := state.ExecuteTemplates()
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("unexpected error: expected=%s, got=%v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if actual := r.Releases[0].Desired(); actual != tt.want {
+				t.Errorf("unexpected installed: expected=%v, got=%v", tt.want, actual)
+			}
+		})
+	}
+}
@@ -7,7 +7,10 @@ import (
 	"reflect"
 	"testing"
 
+	"github.com/roboll/helmfile/pkg/environment"
+	"github.com/roboll/helmfile/pkg/event"
 	"github.com/roboll/helmfile/pkg/helmexec"
+	"github.com/roboll/helmfile/pkg/remote"
 	"github.com/roboll/helmfile/pkg/testhelper"
 
 	"errors"
@@ -34,7 +37,10 @@ func TestLabelParsing(t *testing.T) {
 		{"foo=bar", LabelFilter{positiveLabels: [][]string{[]string{"foo", "bar"}}, negativeLabels: [][]string{}}, false},
 		{"foo!=bar", LabelFilter{positiveLabels: [][]string{}, negativeLabels: [][]string{[]string{"foo", "bar"}}}, false},
 		{"foo!=bar,baz=bat", LabelFilter{positiveLabels: [][]string{[]string{"baz", "bat"}}, negativeLabels: [][]string{[]string{"foo", "bar"}}}, false},
-		{"foo", LabelFilter{positiveLabels: [][]string{}, negativeLabels: [][]string{}}, true},
+		{"foo", LabelFilter{positiveLabels: [][]string{}, negativeLabels: [][]string{}, expressions: []labelExpression{{key: "foo", operator: "exists"}}}, false},
+		{"foo=", LabelFilter{positiveLabels: [][]string{}, negativeLabels: [][]string{}}, true},
+		{"foo in (bar,)", LabelFilter{positiveLabels: [][]string{}, negativeLabels: [][]string{}}, true},
+		{"foo=~[", LabelFilter{positiveLabels: [][]string{}, negativeLabels: [][]string{}}, true},
 		{"foo!=bar=baz", LabelFilter{positiveLabels: [][]string{}, negativeLabels: [][]string{}}, true},
 		{"=bar", LabelFilter{positiveLabels: [][]string{}, negativeLabels: [][]string{}}, true},
 	}
@@ -50,6 +56,44 @@ func TestLabelParsing(t *testing.T) {
 	}
 }
 
+func TestLabelFilter_MatchExpressions(t *testing.T) {
+	releases := []ReleaseSpec{
+		{Name: "frontend", Labels: map[string]string{"name": "app-frontend", "tier": "frontend", "team": "web"}},
+		{Name: "backend", Labels: map[string]string{"name": "app-backend", "tier": "backend"}},
+		{Name: "db", Labels: map[string]string{"name": "db", "tier": "data"}},
+	}
+
+	cases := []struct {
+		selector string
+		expected []string
+	}{
+		{"tier in (frontend, backend)", []string{"frontend", "backend"}},
+		{"tier notin (frontend,backend)", []string{"db"}},
+		{"team", []string{"frontend"}},
+		{"!team", []string{"backend", "db"}},
+		{"name=~^app-", []string{"frontend", "backend"}},
+		{"name!~^app-", []string{"db"}},
+		{"name=~^app-(front|back)end$,tier!=backend", []string{"frontend"}},
+		{"name=~^[a-z]{2}$", []string{"db"}},
+	}
+
+	for _, c := range cases {
+		filter, err := ParseLabels(c.selector)
+		if err != nil {
+			t.Fatalf("unexpected error parsing %s: %v", c.selector, err)
+		}
+		actual := []string{}
+		for _, r := range releases {
+			if filter.Match(r) {
+				actual = append(actual, r.Name)
+			}
+		}
+		if !reflect.DeepEqual(actual, c.expected) {
+			t.Errorf("unexpected releases matching %s: expected=%v, got=%v", c.selector, c.expected, actual)
+		}
+	}
+}
+
 func TestHelmState_applyDefaultsTo(t *testing.T) {
 	type fields struct {
 		BaseChartPath      string
@@ -407,6 +451,146 @@ func TestHelmState_flagsForUpgrade(t *testing.T) {
 				"--namespace", "test-namespace",
 			},
 		},
+		{
+			name: "cleanup-on-fail-from-default",
+			defaults: HelmSpec{
+				CleanupOnFail: true,
+			},
+			release: &ReleaseSpec{
+				Chart:     "test/chart",
+				Version:   "0.1",
+				Name:      "test-charts",
+				Namespace: "test-namespace",
+			},
+			want: []string{
+				"--version", "0.1",
+				"--cleanup-on-fail",
+				"--namespace", "test-namespace",
+			},
+		},
+		{
+			name: "cleanup-on-fail-override-default",
+			defaults: HelmSpec{
+				CleanupOnFail: true,
+			},
+			release: &ReleaseSpec{
+				Chart:         "test/chart",
+				Version:       "0.1",
+				CleanupOnFail: &disable,
+				Name:          "test-charts",
+				Namespace:     "test-namespace",
+			},
+			want: []string{
+				"--version", "0.1",
+				"--namespace", "test-namespace",
+			},
+		},
+		{
+			name: "history-max-from-default",
+			defaults: HelmSpec{
+				HistoryMax: some(5),
+			},
+			release: &ReleaseSpec{
+				Chart:     "test/chart",
+				Version:   "0.1",
+				Name:      "test-charts",
+				Namespace: "test-namespace",
+			},
+			want: []string{
+				"--version", "0.1",
+				"--history-max", "5",
+				"--namespace", "test-namespace",
+			},
+		},
+		{
+			name: "history-max-unlimited-default",
+			defaults: HelmSpec{
+				HistoryMax: some(0),
+			},
+			release: &ReleaseSpec{
+				Chart:     "test/chart",
+				Version:   "0.1",
+				Name:      "test-charts",
+				Namespace: "test-namespace",
+			},
+			want: []string{
+				"--version", "0.1",
+				"--history-max", "0",
+				"--namespace", "test-namespace",
+			},
+		},
+		{
+			name: "history-max-override-default",
+			defaults: HelmSpec{
+				HistoryMax: some(5),
+			},
+			release: &ReleaseSpec{
+				Chart:      "test/chart",
+				Version:    "0.1",
+				HistoryMax: some(0),
+				Name:       "test-charts",
+				Namespace:  "test-namespace",
+			},
+			want: []string{
+				"--version", "0.1",
+				"--history-max", "0",
+				"--namespace", "test-namespace",
+			},
+		},
+		{
+			name: "verify-with-keyring",
+			defaults: HelmSpec{
+				Verify:  true,
+				Keyring: "/keys/default.gpg",
+			},
+			release: &ReleaseSpec{
+				Chart:     "test/chart",
+				Version:   "0.1",
+				Keyring:   "/keys/pubring.gpg",
+				Name:      "test-charts",
+				Namespace: "test-namespace",
+			},
+			want: []string{
+				"--version", "0.1",
+				"--verify",
+				"--keyring", "/keys/pubring.gpg",
+				"--namespace", "test-namespace",
+			},
+		},
+		{
+			name: "skip-crds-from-default",
+			defaults: HelmSpec{
+				SkipCRDs: true,
+			},
+			release: &ReleaseSpec{
+				Chart:     "test/chart",
+				Version:   "0.1",
+				Name:      "test-charts",
+				Namespace: "test-namespace",
+			},
+			want: []string{
+				"--version", "0.1",
+				"--skip-crds",
+				"--namespace", "test-namespace",
+			},
+		},
+		{
+			name: "skip-crds-override-default",
+			defaults: HelmSpec{
+				SkipCRDs: true,
+			},
+			release: &ReleaseSpec{
+				Chart:     "test/chart",
+				Version:   "0.1",
+				SkipCRDs:  &disable,
+				Name:      "test-charts",
+				Namespace: "test-namespace",
+			},
+			want: []string{
+				"--version", "0.1",
+				"--namespace", "test-namespace",
+			},
+		},
 		{
 			name: "atomic-override-default",
 			defaults: HelmSpec{
@@ -514,6 +698,76 @@ func TestHelmState_flagsForUpgrade(t *testing.T) {
 				"--tls-ca-cert", "ca.pem",
 			},
 		},
+		{
+			name: "tiller-verify",
+			defaults: HelmSpec{
+				TLS:         true,
+				TLSCACert:   "ca.pem",
+				TLSVerify:   true,
+				TLSHostname: "tiller.example.com",
+			},
+			release: &ReleaseSpec{
+				Chart:       "test/chart",
+				Version:     "0.1",
+				Name:        "test-charts",
+				TLSHostname: "tiller.prod.example.com",
+			},
+			want: []string{
+				"--version", "0.1",
+				"--tls",
+				"--tls-ca-cert", "ca.pem",
+				"--tls-verify",
+				"--tls-hostname", "tiller.prod.example.com",
+			},
+		},
+		{
+			name: "tiller-verify-override-default",
+			defaults: HelmSpec{
+				TLS:       true,
+				TLSVerify: true,
+			},
+			release: &ReleaseSpec{
+				Chart:     "test/chart",
+				Version:   "0.1",
+				Name:      "test-charts",
+				TLSVerify: &disable,
+			},
+			want: []string{
+				"--version", "0.1",
+				"--tls",
+			},
+		},
+		{
+			name:     "post-renderer",
+			defaults: HelmSpec{},
+			release: &ReleaseSpec{
+				Chart:            "test/chart",
+				Version:          "0.1",
+				Name:             "test-charts",
+				PostRenderer:     "./scripts/kustomize.sh",
+				PostRendererArgs: []string{"--overlay", "prod"},
+			},
+			want: []string{
+				"--version", "0.1",
+				"--post-renderer", "scripts/kustomize.sh",
+				"--post-renderer-args", "--overlay",
+				"--post-renderer-args", "prod",
+			},
+		},
+		{
+			name:     "post-renderer-in-path",
+			defaults: HelmSpec{},
+			release: &ReleaseSpec{
+				Chart:        "test/chart",
+				Version:      "0.1",
+				Name:         "test-charts",
+				PostRenderer: "kustomize-renderer",
+			},
+			want: []string{
+				"--version", "0.1",
+				"--post-renderer", "kustomize-renderer",
+			},
+		},
 	}
 	for i := range tests {
 		tt := tests[i]
@@ -538,6 +792,219 @@ func TestHelmState_flagsForUpgrade(t *testing.T) {
 	}
 }
 
+func TestHelmState_flagsForTemplateIncludeCRDs(t *testing.T) {
+	enable := true
+	disable := false
+
+	tests := []struct {
+		name     string
+		defaults HelmSpec
+		release  *ReleaseSpec
+		want     []string
+	}{
+		{
+			name:    "no-crds",
+			release: &ReleaseSpec{Chart: "test/chart", Name: "test-charts"},
+			want:    []string{"--name", "test-charts"},
+		},
+		{
+			name:     "include-crds-from-default",
+			defaults: HelmSpec{IncludeCRDs: true},
+			release:  &ReleaseSpec{Chart: "test/chart", Name: "test-charts"},
+			want:     []string{"--name", "test-charts", "--include-crds"},
+		},
+		{
+			name:     "include-crds-override-default",
+			defaults: HelmSpec{IncludeCRDs: true},
+			release:  &ReleaseSpec{Chart: "test/chart", Name: "test-charts", IncludeCRDs: &disable},
+			want:     []string{"--name", "test-charts"},
+		},
+		{
+			name:    "include-crds",
+			release: &ReleaseSpec{Chart: "test/chart", Name: "test-charts", IncludeCRDs: &enable},
+			want:    []string{"--name", "test-charts", "--include-crds"},
+		},
+	}
+	for i := range tests {
+		tt := tests[i]
+		t.Run(tt.name, func(t *testing.T) {
+			state := &HelmState{
+				basePath:     "./",
+				Releases:     []ReleaseSpec{*tt.release},
+				HelmDefaults: tt.defaults,
+			}
+			args, err := state.flagsForTemplate(&mockHelmExec{}, tt.release, 0)
+			if err != nil {
+				t.Errorf("unexpected error flagsForTemplate: %v", err)
+			}
+			if !reflect.DeepEqual(args, tt.want) {
+				t.Errorf("flagsForTemplate returned = %v, want %v", args, tt.want)
+			}
+		})
+	}
+}
+
+func TestHelmState_namespaceAndValuesFlagsMissingFileHandler(t *testing.T) {
+	warn := MissingFileHandlerWarn
+	fail := MissingFileHandlerError
+
+	tests := []struct {
+		name     string
+		defaults HelmSpec
+		release  *ReleaseSpec
+		wantErr  string
+	}{
+		{
+			name:    "error by default",
+			release: &ReleaseSpec{Name: "app", Values: []interface{}{"missing.yaml"}},
+			wantErr: `values file matching "missing.yaml" does not exist in "."`,
+		},
+		{
+			name:     "default from helmDefaults",
+			defaults: HelmSpec{MissingFileHandler: &warn},
+			release:  &ReleaseSpec{Name: "app", Values: []interface{}{"missing.yaml"}, Secrets: []string{"missing-secrets.yaml"}},
+		},
+		{
+			name:     "release overriding helmDefaults",
+			defaults: HelmSpec{MissingFileHandler: &warn},
+			release:  &ReleaseSpec{Name: "app", Secrets: []string{"missing-secrets.yaml"}, MissingFileHandler: &fail},
+			wantErr:  `secrets file matching "missing-secrets.yaml" does not exist in "."`,
+		},
+	}
+	for i := range tests {
+		tt := tests[i]
+		t.Run(tt.name, func(t *testing.T) {
+			state := &HelmState{
+				basePath:     ".",
+				logger:       logger,
+				HelmDefaults: tt.defaults,
+				glob: func(string) ([]string, error) {
+					return nil, nil
+				},
+			}
+			flags, err := state.namespaceAndValuesFlags(&mockHelmExec{}, tt.release, 0)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("unexpected error: expected=%s, got=%v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(flags) != 0 {
+				t.Errorf("unexpected flags: expected=[], got=%v", flags)
+			}
+		})
+	}
+}
+
+type remoteGetterFunc func(wd, src, dst string) error
+
+func (f remoteGetterFunc) Get(wd, src, dst string) error {
+	return fmt.Errorf("unexpected directory download: %s", src)
+}
+
+func (f remoteGetterFunc) GetFile(wd, src, dst string) error {
+	return f(wd, src, dst)
+}
+
+func TestHelmState_namespaceAndValuesFlagsRemoteValues(t *testing.T) {
+	files := map[string]string{
+		"/path/to/home/helmfile.yaml": "",
+	}
+	testfs := testhelper.NewTestFs(files)
+
+	downloaded := []string{}
+	getter := remoteGetterFunc(func(wd, src, dst string) error {
+		downloaded = append(downloaded, src)
+		files[filepath.Join(wd, dst)] = "replicas: 2\n"
+		return nil
+	})
+
+	state := &HelmState{
+		basePath: "/path/to/home",
+		logger:   logger,
+		readFile: testfs.ReadFile,
+		glob: func(string) ([]string, error) {
+			return nil, nil
+		},
+		remote: &remote.Remote{
+			Logger:     logger,
+			Home:       "/path/to/home",
+			Getter:     getter,
+			ReadFile:   testfs.ReadFile,
+			FileExists: testfs.FileExistsAt,
+			DirExists:  testfs.DirectoryExistsAt,
+		},
+	}
+	release := &ReleaseSpec{Name: "app", Values: []interface{}{"https://config.example.com/app/prod.yaml?checksum=sha256:123"}}
+
+	flags, err := state.namespaceAndValuesFlags(&mockHelmExec{}, release, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer func() {
+		for _, f := range release.generatedValues {
+			os.Remove(f)
+		}
+	}()
+
+	expected := []string{"https://config.example.com/app/prod.yaml?checksum=sha256:123"}
+	if !reflect.DeepEqual(downloaded, expected) {
+		t.Errorf("unexpected downloads: expected=%v, got=%v", expected, downloaded)
+	}
+	if len(flags) != 2 || flags[0] != "--values" {
+		t.Fatalf("unexpected flags: %v", flags)
+	}
+	bs, err := ioutil.ReadFile(flags[1])
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(bs) != "replicas: 2\n" {
+		t.Errorf("unexpected values: expected=%q, got=%q", "replicas: 2\n", string(bs))
+	}
+}
+
+func TestHelmState_triggerReleaseEventValues(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		wantErr bool
+	}{
+		{name: "matching", value: "bar"},
+		{name: "not matching", value: "baz", wantErr: true},
+	}
+
+	for i := range tests {
+		tt := tests[i]
+		t.Run(tt.name, func(t *testing.T) {
+			state := &HelmState{
+				basePath: ".",
+				logger:   logger,
+				Env: environment.Environment{
+					Name:     "default",
+					Defaults: map[string]interface{}{"foo": "bar"},
+				},
+			}
+			release := &ReleaseSpec{
+				Name: "app",
+				Hooks: []event.Hook{
+					{Name: "check", Events: []string{"presync"}, Command: "test", Args: []string{"{{ .Values.foo }}", "=", tt.value}},
+				},
+			}
+
+			executed, err := state.triggerPresyncEvent(release, "sync")
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !tt.wantErr && !executed {
+				t.Errorf("unexpected result: the hook wasn't executed")
+			}
+		})
+	}
+}
+
 func Test_isLocalChart(t *testing.T) {
 	type args struct {
 		chart string
@@ -670,6 +1137,7 @@ type listKey struct {
 type mockHelmExec struct {
 	charts   []string
 	repo     []string
+	registry []string
 	releases []mockRelease
 	deleted  []mockRelease
 	lists    map[listKey]string
@@ -724,6 +1192,10 @@ func (helm *mockHelmExec) AddRepo(name, repository, certfile, keyfile, username,
 	helm.repo = []string{name, repository, certfile, keyfile, username, password}
 	return nil
 }
+func (helm *mockHelmExec) RegistryLogin(registry, username, password string) error {
+	helm.registry = []string{registry, username, password}
+	return nil
+}
 func (helm *mockHelmExec) UpdateRepo() error {
 	return nil
 }
@@ -777,11 +1249,12 @@ func (helm *mockHelmExec) TemplateRelease(chart string, flags ...string) error {
 }
 func TestHelmState_SyncRepos(t *testing.T) {
 	tests := []struct {
-		name  string
-		repos []RepositorySpec
-		helm  *mockHelmExec
-		envs  map[string]string
-		want  []string
+		name               string
+		repos              []RepositorySpec
+		helm               *mockHelmExec
+		envs               map[string]string
+		credentialsFromEnv bool
+		want               []string
 	}{
 		{
 			name: "normal repository",
@@ -828,6 +1301,22 @@ func TestHelmState_SyncRepos(t *testing.T) {
 			helm: &mockHelmExec{},
 			want: []string{"name", "http://example.com/", "", "", "example_user", "example_password"},
 		},
+		{
+			name: "repository with credentials from envvars",
+			repos: []RepositorySpec{
+				{
+					Name: "my-repo",
+					URL:  "http://example.com/",
+				},
+			},
+			helm: &mockHelmExec{},
+			envs: map[string]string{
+				"HELMFILE_REPO_MY_REPO_USERNAME": "env_user",
+				"HELMFILE_REPO_MY_REPO_PASSWORD": "env_password",
+			},
+			credentialsFromEnv: true,
+			want:               []string{"my-repo", "http://example.com/", "", "", "env_user", "env_password"},
+		},
 	}
 	for i := range tests {
 		tt := tests[i]
@@ -840,6 +1329,9 @@ func TestHelmState_SyncRepos(t *testing.T) {
 			}
 			state := &HelmState{
 				Repositories: tt.repos,
+				DependencyResolution: DependencyResolutionSpec{
+					CredentialsFromEnv: tt.credentialsFromEnv,
+				},
 			}
 			if _ = state.SyncRepos(tt.helm); !reflect.DeepEqual(tt.helm.repo, tt.want) {
 				t.Errorf("HelmState.SyncRepos() for [%s] = %v, want %v", tt.name, tt.helm.repo, tt.want)
@@ -944,6 +1436,39 @@ func TestHelmState_SyncReleases(t *testing.T) {
 			helm:         &mockHelmExec{},
 			wantReleases: []mockRelease{{"releaseName", []string{"--set", "foo.bar[0]={A,B}"}}},
 		},
+		{
+			name: "set string and file values",
+			releases: []ReleaseSpec{
+				{
+					Name:  "releaseName",
+					Chart: "foo",
+					SetValues: []SetValue{
+						{
+							Name:  "foo",
+							Value: "FOO",
+						},
+					},
+					SetStringValues: []SetValue{
+						{
+							Name:  "image.tag",
+							Value: "1.10",
+						},
+						{
+							Name:   "args",
+							Values: []string{"true", "a,b"},
+						},
+					},
+					SetFileValues: []SetValue{
+						{
+							Name: "tls.crt",
+							File: "path/to/tls.crt",
+						},
+					},
+				},
+			},
+			helm:         &mockHelmExec{},
+			wantReleases: []mockRelease{{"releaseName", []string{"--set", "foo=FOO", "--set-string", "image.tag=1.10", "--set-string", "args={true,a\\,b}", "--set-file", "tls.crt=path/to/tls.crt"}}},
+		},
 	}
 	for i := range tests {
 		tt := tests[i]
@@ -1158,7 +1683,7 @@ func TestHelmState_SyncReleasesAffectedRealeases(t *testing.T) {
 			//simulate the release is already installed
 			for i, release := range tt.releases {
 				if tt.installed != nil && tt.installed[i] {
-					helm.lists[listKey{filter: "^" + release.Name + "$"}] = release.Name
+					helm.lists[listKey{filter: "^" + release.Name + "$", flags: "--short"}] = release.Name
 				}
 			}
 
@@ -1581,10 +2106,20 @@ generated: 2019-05-16T15:42:45.50486+09:00
 		return generatedDir, nil
 	}
 
+	// Write the lock file into a temporary directory, so that running the test doesn't leave it in the package directory
+	lockDir, err := ioutil.TempDir("", "helmfile-lock")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(lockDir)
+
 	logger := helmexec.NewLogger(os.Stderr, "debug")
 	state := &HelmState{
 		basePath: "/src",
 		FilePath: "/src/helmfile.yaml",
+		DependencyResolution: DependencyResolutionSpec{
+			LockFilePath: lockDir,
+		},
 		Releases: []ReleaseSpec{
 			{
 				Chart: "./..",
@@ -2072,7 +2607,7 @@ func TestHelmState_Delete(t *testing.T) {
 				deleted: []mockRelease{},
 			}
 			if tt.installed {
-				helm.lists[listKey{filter: "^" + name + "$", flags: tt.flags}] = name
+				helm.lists[listKey{filter: "^" + name + "$", flags: tt.flags + "--short"}] = name
 			}
 			affectedReleases := AffectedReleases{}
 			errs := state.DeleteReleases(&affectedReleases, helm, 1, tt.purge)
@@ -2088,3 +2623,96 @@ func TestHelmState_Delete(t *testing.T) {
 		t.Run(tt.name, f)
 	}
 }
+
+func TestHelmState_CreateHelmContextHelmBinary(t *testing.T) {
+	tests := []struct {
+		name     string
+		defaults string
+		release  string
+		expected string
+	}{
+		{name: "no override", expected: ""},
+		{name: "helmDefaults", defaults: "helm2", expected: "helm2"},
+		{name: "release overrides helmDefaults", defaults: "helm2", release: "helm3", expected: "helm3"},
+	}
+	for _, tt := range tests {
+		state := &HelmState{
+			HelmDefaults: HelmSpec{HelmBinary: tt.defaults},
+		}
+		release := &ReleaseSpec{Name: "foo", Namespace: "bar", HelmBinary: tt.release}
+		context := state.createHelmContext(release, 0)
+		if context.HelmBinary != tt.expected {
+			t.Errorf("%s: unexpected helm binary: expected=%s, got=%s", tt.name, tt.expected, context.HelmBinary)
+		}
+		if context.Namespace != "bar" {
+			t.Errorf("%s: unexpected namespace: expected=bar, got=%s", tt.name, context.Namespace)
+		}
+	}
+}
+
+func TestHelmState_CreateHelmContextTillerNamespace(t *testing.T) {
+	state := &HelmState{
+		HelmDefaults: HelmSpec{TillerNamespace: "tiller-system", Tillerless: true},
+	}
+	if context := state.createHelmContext(&ReleaseSpec{Name: "foo"}, 0); context.TillerNamespace != "tiller-system" || !context.Tillerless {
+		t.Errorf("unexpected tiller namespace: expected=tiller-system, got=%s", context.TillerNamespace)
+	}
+	if context := state.createHelmContext(&ReleaseSpec{Name: "foo", TillerNamespace: "team-a"}, 0); context.TillerNamespace != "team-a" {
+		t.Errorf("unexpected tiller namespace: expected=team-a, got=%s", context.TillerNamespace)
+	}
+}
+
+func TestHelmState_CreateHelmContextCreateNamespace(t *testing.T) {
+	enable := true
+	disable := false
+
+	tests := []struct {
+		name     string
+		defaults *bool
+		release  *bool
+		expected bool
+	}{
+		{name: "default", expected: true},
+		{name: "helmDefaults", defaults: &disable, expected: false},
+		{name: "release overrides helmDefaults", defaults: &disable, release: &enable, expected: true},
+		{name: "release", release: &disable, expected: false},
+	}
+	for _, tt := range tests {
+		state := &HelmState{
+			HelmDefaults: HelmSpec{CreateNamespace: tt.defaults},
+		}
+		context := state.createHelmContext(&ReleaseSpec{Name: "foo", Namespace: "bar", CreateNamespace: tt.release}, 0)
+		if context.CreateNamespace != tt.expected {
+			t.Errorf("%s: unexpected createNamespace: expected=%v, got=%v", tt.name, tt.expected, context.CreateNamespace)
+		}
+	}
+}
+
+func TestHelmState_CreateHelmContextNamespaceLabels(t *testing.T) {
+	state := &HelmState{}
+	release := &ReleaseSpec{
+		Name:                 "foo",
+		Namespace:            "bar",
+		NamespaceLabels:      map[string]string{"istio-injection": "enabled"},
+		NamespaceAnnotations: map[string]string{"owner": "team-a"},
+	}
+	context := state.createHelmContext(release, 0)
+	if !reflect.DeepEqual(context.NamespaceLabels, release.NamespaceLabels) {
+		t.Errorf("unexpected namespace labels: expected=%v, got=%v", release.NamespaceLabels, context.NamespaceLabels)
+	}
+	if !reflect.DeepEqual(context.NamespaceAnnotations, release.NamespaceAnnotations) {
+		t.Errorf("unexpected namespace annotations: expected=%v, got=%v", release.NamespaceAnnotations, context.NamespaceAnnotations)
+	}
+}
+
+func TestHelmState_CreateHelmContextKubeContext(t *testing.T) {
+	state := &HelmState{
+		HelmDefaults: HelmSpec{KubeContext: "default"},
+	}
+	if context := state.createHelmContext(&ReleaseSpec{Name: "foo"}, 0); context.KubeContext != "default" {
+		t.Errorf("unexpected kube context: expected=default, got=%s", context.KubeContext)
+	}
+	if context := state.createHelmContext(&ReleaseSpec{Name: "foo", KubeContext: "prod"}, 0); context.KubeContext != "prod" {
+		t.Errorf("unexpected kube context: expected=prod, got=%s", context.KubeContext)
+	}
+}
@@ -2,6 +2,7 @@ package state
 
 import (
 	"fmt"
+	"github.com/roboll/helmfile/pkg/remote"
 	"go.uber.org/zap"
 	"net/url"
 	"path/filepath"
@@ -15,6 +16,8 @@ type Storage struct {
 
 	basePath string
 	glob     func(string) ([]string, error)
+
+	remote *remote.Remote
 }
 
 func NewStorage(forFile string, logger *zap.SugaredLogger, glob func(string) ([]string, error)) *Storage {
@@ -29,6 +32,15 @@ func NewStorage(forFile string, logger *zap.SugaredLogger, glob func(string) ([]
 func (st *Storage) resolveFile(missingFileHandler *string, tpe, path string) ([]string, bool, error) {
 	title := fmt.Sprintf("%s file", tpe)
 
+	if st.remote != nil && remote.IsRemote(path) {
+		fetched, err := st.remote.Fetch(path)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed fetching %s \"%s\": %v", title, path, err)
+		}
+		st.logger.Debugf("fetched remote %s \"%s\" to local cache \"%s\"", title, path, fetched)
+		return []string{fetched}, false, nil
+	}
+
 	files, err := st.ExpandPaths(path)
 	if err != nil {
 		return nil, false, err
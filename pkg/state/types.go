@@ -28,3 +28,15 @@ type releaseTemplateData struct {
 	// Values is accessible as `.Values` and it contains default state values overrode by environment values and override values.
 	Values map[string]interface{}
 }
+
+// releaseValuesTemplateData provides variables accessible while executing golang text/template expressions in values files of a release
+type releaseValuesTemplateData struct {
+	// Environment is accessible as `.Environment` from any template expression executed by the renderer
+	Environment environment.Environment
+	// Namespace is accessible as `.Namespace`, which is the namespace given via `--namespace`
+	Namespace string
+	// Values is accessible as `.Values` and it contains default state values overrode by environment values and override values.
+	Values map[string]interface{}
+	// Release is accessible as `.Release`, which is the release the values file is rendered for
+	Release ReleaseSpec
+}
@@ -25,6 +25,11 @@ func isLocalChart(chart string) bool {
 }
 
 func resolveRemoteChart(repoAndChart string) (string, string, bool) {
+	// Charts in OCI registries like `oci://registry.example.com/charts/myapp` are their own repositories
+	if repo, chart, ok := splitOCIChart(repoAndChart); ok {
+		return repo, chart, true
+	}
+
 	if isLocalChart(repoAndChart) {
 		return "", "", false
 	}
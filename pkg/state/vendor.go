@@ -0,0 +1,156 @@
+package state
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/Masterminds/semver"
+	"github.com/roboll/helmfile/pkg/helmexec"
+)
+
+// VendoredChart is the result of vendoring the chart of a release into the output directory
+type VendoredChart struct {
+	Release    string
+	Chart      string
+	Version    string
+	Repository string
+	// Path is the directory containing `Chart.yaml` of the vendored chart
+	Path string
+	// Cached is true when the chart already existed in the output directory
+	Cached bool
+	Err    error
+}
+
+// VendorCharts downloads the chart of every release referencing a remote chart into outputDir, at the version locked in the lock file,
+// so that the state can be deployed without accessing chart repositories.
+// Each chart is extracted under `<outputDir>/<repository>/<chart>/<version>`, and charts already there are skipped.
+func (st *HelmState) VendorCharts(helm helmexec.ChartFetcher, outputDir string) ([]VendoredChart, error) {
+	if st.DependencyResolution.Offline {
+		return nil, fmt.Errorf("unable to vendor charts offline, as fetching charts requires network access")
+	}
+
+	resolved, err := st.ResolveDeps()
+	if err != nil {
+		return nil, err
+	}
+
+	fileExists := st.fileExists
+	if fileExists == nil {
+		fileExists = func(path string) (bool, error) {
+			return pathExists(path), nil
+		}
+	}
+
+	repoToURL := st.repositoryURLs()
+
+	results := []VendoredChart{}
+	for i, r := range st.Releases {
+		repo, chart, ok := st.resolveRemoteChart(r.Chart)
+		if !ok {
+			continue
+		}
+		url, ok := repoToURL[repo]
+		if !ok {
+			continue
+		}
+
+		result := VendoredChart{
+			Release:    r.Name,
+			Chart:      r.Chart,
+			Version:    resolved.Releases[i].Version,
+			Repository: url,
+		}
+
+		if _, err := semver.NewVersion(result.Version); err != nil {
+			result.Err = fmt.Errorf("the version %q of %s isn't locked: run `helmfile deps` to lock it", result.Version, r.Chart)
+			results = append(results, result)
+			continue
+		}
+
+		untarDir := filepath.Join(outputDir, strings.TrimPrefix(repo, "oci://"), chart, result.Version)
+		result.Path = filepath.Join(untarDir, chart)
+
+		exists, err := fileExists(filepath.Join(result.Path, "Chart.yaml"))
+		if err != nil {
+			result.Err = err
+		} else if exists {
+			result.Cached = true
+		} else {
+			name, flags := chart, []string{"--repo", url}
+			if isOCIRepository(url) {
+				name, flags = url+"/"+chart, nil
+			}
+			result.Err = helm.Fetch(name, append(flags, "--version", result.Version, "--untar", "--untardir", untarDir)...)
+		}
+
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// RewriteVendoredCharts rewrites the `chart` of each release in the state file content to the path of its vendored chart,
+// relative to the directory of the state file.
+// It returns the names of the releases whose charts couldn't be rewritten, e.g. as they are rendered from templates,
+// or as other releases referencing the same charts were vendored at different versions.
+func (st *HelmState) RewriteVendoredCharts(content []byte, charts []VendoredChart) ([]byte, []string) {
+	// Every `chart: <ref>` is rewritten at once, so that the chart referenced by releases vendored at different versions is left as is
+	paths := map[string]string{}
+	ambiguous := map[string]bool{}
+	for _, c := range charts {
+		if c.Err != nil {
+			continue
+		}
+		if p, ok := paths[c.Chart]; ok && p != c.Path {
+			ambiguous[c.Chart] = true
+		}
+		paths[c.Chart] = c.Path
+	}
+
+	missing := []string{}
+	rewritten := map[string]bool{}
+	for _, c := range charts {
+		if c.Err != nil {
+			continue
+		}
+		if ambiguous[c.Chart] {
+			missing = append(missing, c.Release)
+			continue
+		}
+		if rewritten[c.Chart] {
+			continue
+		}
+
+		path, err := relativePath(st.basePath, c.Path)
+		if err != nil {
+			path = c.Path
+		}
+		if !filepath.IsAbs(path) && !strings.HasPrefix(path, ".") {
+			path = "./" + path
+		}
+
+		re := regexp.MustCompile(`(?m)^([ \t]*-?[ \t]*chart:[ \t]*)(["']?)` + regexp.QuoteMeta(c.Chart) + `(["']?)[ \t]*$`)
+		if !re.Match(content) {
+			missing = append(missing, c.Release)
+			continue
+		}
+		content = re.ReplaceAll(content, []byte("${1}${2}"+path+"${3}"))
+		rewritten[c.Chart] = true
+	}
+
+	return content, missing
+}
+
+func relativePath(base, target string) (string, error) {
+	base, err := filepath.Abs(base)
+	if err != nil {
+		return "", err
+	}
+	target, err = filepath.Abs(target)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Rel(base, target)
+}
@@ -0,0 +1,140 @@
+package state
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/roboll/helmfile/pkg/testhelper"
+)
+
+func TestHelmState_VendorCharts(t *testing.T) {
+	fs := testhelper.NewTestFs(map[string]string{
+		"/path/to/helmfile.lock": `dependencies:
+- name: envoy
+  repository: https://charts.example.com
+  version: 1.5.0
+- name: myapp
+  repository: oci://registry.example.com/charts
+  version: 0.1.0
+`,
+		"/vendor/vendored/mysql/1.0.0/mysql/Chart.yaml": `name: mysql
+`,
+	})
+	state := injectFs(&HelmState{
+		basePath: "/path/to",
+		FilePath: "/path/to/helmfile.yaml",
+		Releases: []ReleaseSpec{
+			{Name: "envoy", Chart: "stable/envoy"},
+			{Name: "myapp", Chart: "oci://registry.example.com/charts/myapp"},
+			{Name: "mysql", Chart: "vendored/mysql", Version: "1.0.0"},
+			{Name: "redis", Chart: "vendored/redis", Version: "~1.0"},
+			{Name: "local", Chart: "./charts/local"},
+		},
+		Repositories: []RepositorySpec{
+			{Name: "stable", URL: "https://charts.example.com"},
+			{Name: "vendored", URL: "https://charts.example.com", NoPin: true},
+		},
+		logger: logger,
+	}, fs)
+
+	fetched := [][]string{}
+	helm := chartFetcherFunc(func(chart string, flags ...string) error {
+		fetched = append(fetched, append([]string{chart}, flags...))
+		return nil
+	})
+
+	results, err := state.VendorCharts(helm, "/vendor")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expectedFetched := [][]string{
+		{"envoy", "--repo", "https://charts.example.com", "--version", "1.5.0", "--untar", "--untardir", "/vendor/stable/envoy/1.5.0"},
+		{"oci://registry.example.com/charts/myapp", "--version", "0.1.0", "--untar", "--untardir", "/vendor/registry.example.com/charts/myapp/0.1.0"},
+	}
+	if !reflect.DeepEqual(fetched, expectedFetched) {
+		t.Errorf("unexpected fetches:\nexpected=%v\ngot=%v", expectedFetched, fetched)
+	}
+
+	if len(results) != 4 {
+		t.Fatalf("unexpected number of results: expected=4, got=%d", len(results))
+	}
+	if results[0].Path != "/vendor/stable/envoy/1.5.0/envoy" {
+		t.Errorf("unexpected path: expected=/vendor/stable/envoy/1.5.0/envoy, got=%s", results[0].Path)
+	}
+	if !results[2].Cached {
+		t.Errorf("unexpected fetch of the chart already in the output directory: %v", results[2])
+	}
+	if results[3].Err == nil || !strings.Contains(results[3].Err.Error(), "isn't locked") {
+		t.Errorf("unexpected error for the unlocked chart: %v", results[3].Err)
+	}
+}
+
+func TestHelmState_RewriteVendoredCharts(t *testing.T) {
+	state := &HelmState{basePath: "/path/to"}
+
+	content := []byte(`releases:
+- name: envoy
+  chart: stable/envoy
+  version: ~1.5
+- name: envoy2
+  chart: "stable/envoy"
+- name: mysql
+  chart: {{ .Values.mysqlChart }}
+- chart: stable/redis
+  name: redis
+`)
+	charts := []VendoredChart{
+		{Release: "envoy", Chart: "stable/envoy", Path: "/path/to/vendor/stable/envoy/1.5.0/envoy"},
+		{Release: "envoy2", Chart: "stable/envoy", Path: "/path/to/vendor/stable/envoy/1.5.0/envoy"},
+		{Release: "mysql", Chart: "stable/mysql", Path: "/path/to/vendor/stable/mysql/1.0.0/mysql"},
+		{Release: "redis", Chart: "stable/redis", Path: "/vendor/stable/redis/1.0.0/redis"},
+	}
+
+	actual, missing := state.RewriteVendoredCharts(content, charts)
+
+	expected := `releases:
+- name: envoy
+  chart: ./vendor/stable/envoy/1.5.0/envoy
+  version: ~1.5
+- name: envoy2
+  chart: "./vendor/stable/envoy/1.5.0/envoy"
+- name: mysql
+  chart: {{ .Values.mysqlChart }}
+- chart: ../../vendor/stable/redis/1.0.0/redis
+  name: redis
+`
+	if string(actual) != expected {
+		t.Errorf("unexpected content:\nexpected=%s\ngot=%s", expected, string(actual))
+	}
+	if !reflect.DeepEqual(missing, []string{"mysql"}) {
+		t.Errorf("unexpected missing releases: expected=[mysql], got=%v", missing)
+	}
+}
+
+func TestHelmState_RewriteVendoredCharts_DifferentVersions(t *testing.T) {
+	state := &HelmState{basePath: "/path/to"}
+
+	content := []byte(`releases:
+- name: envoy
+  chart: stable/envoy
+  version: 1.5.0
+- name: envoy2
+  chart: stable/envoy
+  version: 1.6.0
+`)
+	charts := []VendoredChart{
+		{Release: "envoy", Chart: "stable/envoy", Path: "/path/to/vendor/stable/envoy/1.5.0/envoy"},
+		{Release: "envoy2", Chart: "stable/envoy", Path: "/path/to/vendor/stable/envoy/1.6.0/envoy"},
+	}
+
+	actual, missing := state.RewriteVendoredCharts(content, charts)
+
+	if string(actual) != string(content) {
+		t.Errorf("unexpected content:\nexpected=%s\ngot=%s", string(content), string(actual))
+	}
+	if !reflect.DeepEqual(missing, []string{"envoy", "envoy2"}) {
+		t.Errorf("unexpected missing releases: expected=[envoy envoy2], got=%v", missing)
+	}
+}
@@ -0,0 +1,83 @@
+package state
+
+import (
+	"regexp"
+	"strings"
+)
+
+// develVersionConstraint is the version constraint helm uses for `--devel` without `--version`, which matches pre-release versions, too
+const develVersionConstraint = ">0.0.0-0"
+
+// versionConstraint returns the version constraint of the release's chart, from either its channel or its version.
+// Ranges like `>=1.0 <2.0` are normalized to `>=1.0, <2.0`, as the semver library used by helm and helmfile requires commas between the constraints to AND them.
+// Releases with `devel: true` and no version resolve to the latest version including pre-releases, as `helm upgrade --devel` does.
+func (st *HelmState) versionConstraint(r ReleaseSpec, chart string) (string, error) {
+	constraint, err := st.channelConstraint(r, chart)
+	if err != nil {
+		return "", err
+	}
+	if constraint == "" && st.isDevelopment(&r) {
+		return develVersionConstraint, nil
+	}
+	return normalizeVersionConstraint(constraint), nil
+}
+
+// lessThanPartialVersion matches the partial version in constraints like `<3`, which the semver library wrongly satisfies with `3.2.0`
+var lessThanPartialVersion = regexp.MustCompile(`<\s*v?([0-9]+(\.[0-9]+)?)([^.0-9]|$)`)
+
+// normalizeVersionConstraint joins the whitespace-separated constraints of each `||`-separated range with commas,
+// and completes the partial versions of `<` constraints like `<3` into `<3.0.0`.
+// Hyphen ranges like `1.0 - 2.0`, and constraints already separated by commas, are left unjoined.
+func normalizeVersionConstraint(constraint string) string {
+	return lessThanPartialVersion.ReplaceAllStringFunc(joinVersionConstraints(constraint), func(m string) string {
+		sub := lessThanPartialVersion.FindStringSubmatch(m)
+		version := sub[1]
+		for strings.Count(version, ".") < 2 {
+			version += ".0"
+		}
+		return "<" + version + sub[3]
+	})
+}
+
+// joinVersionConstraints joins the whitespace-separated constraints of each `||`-separated range with commas
+func joinVersionConstraints(constraint string) string {
+	if strings.Contains(constraint, ",") {
+		return constraint
+	}
+
+	ranges := strings.Split(constraint, "||")
+	for i, r := range ranges {
+		fields := strings.Fields(r)
+
+		// Operators separated from their versions by whitespaces, like `>= 1.0`, belong to the following versions
+		constraints := []string{}
+		op := ""
+		hyphen := false
+		for _, f := range fields {
+			if f == "-" {
+				hyphen = true
+				break
+			}
+			if strings.Trim(f, "<>=!~^") == "" {
+				op += f
+				continue
+			}
+			constraints = append(constraints, op+f)
+			op = ""
+		}
+		if hyphen || len(constraints) < 2 {
+			continue
+		}
+
+		ranges[i] = strings.Join(constraints, ", ")
+	}
+
+	if len(ranges) == 1 {
+		return ranges[0]
+	}
+
+	for i := range ranges {
+		ranges[i] = strings.TrimSpace(ranges[i])
+	}
+	return strings.Join(ranges, " || ")
+}
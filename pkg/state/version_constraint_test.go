@@ -0,0 +1,133 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/roboll/helmfile/pkg/testhelper"
+)
+
+func TestNormalizeVersionConstraint(t *testing.T) {
+	tests := []struct {
+		constraint string
+		expected   string
+	}{
+		{constraint: "", expected: ""},
+		{constraint: "1.5.0", expected: "1.5.0"},
+		{constraint: "~1.2", expected: "~1.2"},
+		{constraint: ">= 1.0", expected: ">= 1.0"},
+		{constraint: ">=1.0 <2.0", expected: ">=1.0, <2.0.0"},
+		{constraint: ">= 1.0 < 2.0", expected: ">=1.0, <2.0.0"},
+		{constraint: ">=1.0, <2.0", expected: ">=1.0, <2.0.0"},
+		{constraint: "1.0 - 2.0", expected: "1.0 - 2.0"},
+		{constraint: ">=1.0 <2.0 || ^3.0", expected: ">=1.0, <2.0.0 || ^3.0"},
+		{constraint: ">=2.14 <3", expected: ">=2.14, <3.0.0"},
+		{constraint: ">= 2.14, < 2.16", expected: ">= 2.14, <2.16.0"},
+		{constraint: "<3.1.0", expected: "<3.1.0"},
+		{constraint: "<=3", expected: "<=3"},
+		{constraint: "~2.14 || >=3.2", expected: "~2.14 || >=3.2"},
+	}
+
+	for _, tt := range tests {
+		if actual := normalizeVersionConstraint(tt.constraint); actual != tt.expected {
+			t.Errorf("unexpected constraint for %q: expected=%q, got=%q", tt.constraint, tt.expected, actual)
+		}
+	}
+}
+
+func TestHelmState_ResolveDeps_VersionRanges(t *testing.T) {
+	fs := testhelper.NewTestFs(map[string]string{
+		"/path/to/helmfile.lock": `dependencies:
+- name: envoy
+  repository: https://charts.example.com
+  version: 1.2.3
+- name: envoy
+  repository: https://charts.example.com
+  version: 1.5.0
+- name: envoy
+  repository: https://charts.example.com
+  version: 2.1.0
+`,
+	})
+
+	tests := []struct {
+		version  string
+		expected string
+	}{
+		{version: "~1.2", expected: "1.2.3"},
+		{version: "^2.0", expected: "2.1.0"},
+		{version: ">=1.0 <2.0", expected: "1.5.0"},
+		{version: ">=1.0, <2.0", expected: "1.5.0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			state := injectFs(&HelmState{
+				FilePath: "/path/to/helmfile.yaml",
+				Releases: []ReleaseSpec{
+					{Name: "envoy", Chart: "myrepo/envoy", Version: tt.version},
+				},
+				Repositories: []RepositorySpec{
+					{Name: "myrepo", URL: "https://charts.example.com"},
+				},
+				logger: logger,
+			}, fs)
+
+			resolved, err := state.ResolveDeps()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if resolved.Releases[0].Version != tt.expected {
+				t.Errorf("unexpected version number: expected=%s, got=%s", tt.expected, resolved.Releases[0].Version)
+			}
+		})
+	}
+}
+
+func TestHelmState_ResolveDeps_Devel(t *testing.T) {
+	fs := testhelper.NewTestFs(map[string]string{
+		"/path/to/helmfile.lock": `dependencies:
+- name: envoy
+  repository: https://charts.example.com
+  version: 1.5.0
+- name: envoy
+  repository: https://charts.example.com
+  version: 2.0.0-rc.1
+`,
+	})
+
+	devel := true
+	tests := []struct {
+		name     string
+		defaults HelmSpec
+		devel    *bool
+		expected string
+	}{
+		{name: "stable", expected: "1.5.0"},
+		{name: "devel", devel: &devel, expected: "2.0.0-rc.1"},
+		{name: "devel-from-default", defaults: HelmSpec{Devel: true}, expected: "2.0.0-rc.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := injectFs(&HelmState{
+				FilePath:     "/path/to/helmfile.yaml",
+				HelmDefaults: tt.defaults,
+				Releases: []ReleaseSpec{
+					{Name: "envoy", Chart: "myrepo/envoy", Devel: tt.devel},
+				},
+				Repositories: []RepositorySpec{
+					{Name: "myrepo", URL: "https://charts.example.com"},
+				},
+				logger: logger,
+			}, fs)
+
+			resolved, err := state.ResolveDeps()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if resolved.Releases[0].Version != tt.expected {
+				t.Errorf("unexpected version number: expected=%s, got=%s", tt.expected, resolved.Releases[0].Version)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package state
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Masterminds/semver"
+)
+
+const (
+	versionReferencePrefix = "@"
+
+	// VersionReferenceExact locks the chart to the same version as the referenced chart, like `@app`
+	VersionReferenceExact = ""
+	// VersionReferenceMinor locks the chart to the same major and minor versions as the referenced chart, like `@app:minor`
+	VersionReferenceMinor = "minor"
+	// VersionReferenceMajor locks the chart to the same major version as the referenced chart, like `@app:major`
+	VersionReferenceMajor = "major"
+)
+
+// versionReference is a release version referencing the version another chart in the same state resolved to
+type versionReference struct {
+	Chart string
+	Level string
+}
+
+// parseVersionReference parses versions like `@app`, `@app:minor` and `@app:major`.
+// It returns nil for usual version constraints.
+func parseVersionReference(version string) (*versionReference, error) {
+	if !strings.HasPrefix(version, versionReferencePrefix) {
+		return nil, nil
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(version, versionReferencePrefix), ":", 2)
+	ref := &versionReference{Chart: parts[0]}
+	if len(parts) == 2 {
+		ref.Level = parts[1]
+	}
+
+	if ref.Chart == "" {
+		return nil, fmt.Errorf("invalid version reference %q: chart name is missing", version)
+	}
+
+	switch ref.Level {
+	case VersionReferenceExact, VersionReferenceMinor, VersionReferenceMajor:
+	default:
+		return nil, fmt.Errorf("invalid version reference %q: it must end with either %q or %q, if any", version, ":"+VersionReferenceMinor, ":"+VersionReferenceMajor)
+	}
+
+	return ref, nil
+}
+
+// constraint returns the version constraint for the referenced chart resolved to the version
+func (r *versionReference) constraint(version string) (string, error) {
+	v, err := semver.NewVersion(version)
+	if err != nil {
+		return "", err
+	}
+
+	switch r.Level {
+	case VersionReferenceMinor:
+		return fmt.Sprintf("~%d.%d", v.Major(), v.Minor()), nil
+	case VersionReferenceMajor:
+		return fmt.Sprintf("^%d", v.Major()), nil
+	default:
+		return v.Original(), nil
+	}
+}
+
+func (r *versionReference) String() string {
+	if r.Level == VersionReferenceExact {
+		return versionReferencePrefix + r.Chart
+	}
+	return versionReferencePrefix + r.Chart + ":" + r.Level
+}
+
+// unresolvableReferencesError reports version references that can't be resolved due to cycles among them
+func unresolvableReferencesError(refs map[string]*versionReference) error {
+	edges := []string{}
+	for chart, ref := range refs {
+		edges = append(edges, fmt.Sprintf("%s -> %s", chart, ref.Chart))
+	}
+	sort.Strings(edges)
+	return fmt.Errorf("unable to resolve version references due to a cycle: %s", strings.Join(edges, ", "))
+}
+
+// resolve returns the version constraint computed from the version the referenced chart resolved to.
+// ok is false when the referenced chart isn't resolved yet.
+func (r *versionReference) resolve(versions map[string][]string) (string, bool, error) {
+	vs, ok := versions[r.Chart]
+	if !ok {
+		return "", false, nil
+	}
+	if len(vs) > 1 {
+		return "", false, fmt.Errorf("ambiguous version reference %s: the chart %q resolved to multiple versions %s", r, r.Chart, strings.Join(vs, ", "))
+	}
+	constraint, err := r.constraint(vs[0])
+	if err != nil {
+		return "", false, err
+	}
+	return constraint, true, nil
+}
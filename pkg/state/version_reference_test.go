@@ -0,0 +1,206 @@
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/roboll/helmfile/pkg/testhelper"
+)
+
+func TestHelmState_ResolveDeps_VersionReferences(t *testing.T) {
+	tests := []struct {
+		name     string
+		releases []ReleaseSpec
+		expected []string
+		wantErr  string
+	}{
+		{
+			name: "same minor version",
+			releases: []ReleaseSpec{
+				{Name: "operator", Chart: "stable/app-operator", Version: "@app:minor"},
+				{Name: "app", Chart: "stable/app", Version: "~1.2"},
+			},
+			expected: []string{"1.2.5", "1.2.3"},
+		},
+		{
+			name: "same major version",
+			releases: []ReleaseSpec{
+				{Name: "app", Chart: "stable/app", Version: "~1.2"},
+				{Name: "operator", Chart: "stable/app-operator", Version: "@app:major"},
+			},
+			expected: []string{"1.2.3", "1.3.0"},
+		},
+		{
+			name: "same version",
+			releases: []ReleaseSpec{
+				{Name: "app", Chart: "stable/app", Version: "~1.2"},
+				{Name: "operator", Chart: "stable/app-operator", Version: "@app"},
+			},
+			wantErr: `no resolved dependency found for "app-operator"`,
+		},
+		{
+			name: "cycle",
+			releases: []ReleaseSpec{
+				{Name: "app", Chart: "stable/app", Version: "@app-operator"},
+				{Name: "operator", Chart: "stable/app-operator", Version: "@app:minor"},
+			},
+			wantErr: "unable to resolve version references due to a cycle: app -> app-operator, app-operator -> app",
+		},
+		{
+			name: "missing reference",
+			releases: []ReleaseSpec{
+				{Name: "operator", Chart: "stable/app-operator", Version: "@app:minor"},
+			},
+			wantErr: `the version of chart "app-operator" references the chart "app", which isn't used by any release with a declared repository in /path/to/helmfile.yaml`,
+		},
+		{
+			name: "invalid level",
+			releases: []ReleaseSpec{
+				{Name: "operator", Chart: "stable/app-operator", Version: "@app:patch"},
+			},
+			wantErr: `release "operator": invalid version reference "@app:patch": it must end with either ":minor" or ":major", if any`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := testhelper.NewTestFs(map[string]string{
+				"/path/to/helmfile.lock": `dependencies:
+- name: app
+  repository: https://kubernetes-charts.storage.googleapis.com
+  version: 1.2.3
+- name: app-operator
+  repository: https://kubernetes-charts.storage.googleapis.com
+  version: 1.3.0
+- name: app-operator
+  repository: https://kubernetes-charts.storage.googleapis.com
+  version: 1.2.5
+`,
+			})
+			state := injectFs(&HelmState{
+				FilePath: "/path/to/helmfile.yaml",
+				Releases: tt.releases,
+				Repositories: []RepositorySpec{
+					{
+						Name: "stable",
+						URL:  "https://kubernetes-charts.storage.googleapis.com",
+					},
+				},
+				logger: logger,
+			}, fs)
+
+			resolved, err := state.ResolveDeps()
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("unexpected error: expected=%q, got=%v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			for i, v := range tt.expected {
+				if resolved.Releases[i].Version != v {
+					t.Errorf("unexpected version number of %s: expected=%s, got=%s", resolved.Releases[i].Name, v, resolved.Releases[i].Version)
+				}
+			}
+		})
+	}
+}
+
+func TestChartDependencyManager_Update_VersionReferences(t *testing.T) {
+	wd, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(wd)
+
+	depMan := NewChartDependencyManager("helmfile", logger)
+	depMan.now = lockFileTime
+
+	var written string
+	depMan.writeFile = func(filename string, data []byte, perm os.FileMode) error {
+		if filename == depMan.lockFileName() {
+			written = string(data)
+			return nil
+		}
+		return ioutil.WriteFile(filename, data, perm)
+	}
+	depMan.readFile = func(filename string) ([]byte, error) {
+		if filename == depMan.lockFileName() {
+			if written == "" {
+				return nil, os.ErrNotExist
+			}
+			return []byte(written), nil
+		}
+		return ioutil.ReadFile(filename)
+	}
+
+	requirements := []string{}
+	shell := dependencyUpdaterFunc(func(chart string) error {
+		reqs, err := ioutil.ReadFile(filepath.Join(chart, "requirements.yaml"))
+		if err != nil {
+			return err
+		}
+		requirements = append(requirements, string(reqs))
+
+		content := "dependencies:\n"
+		if strings.Contains(string(reqs), "name: app\n") {
+			content += "- name: app\n  repository: https://charts.example.com\n  version: 1.2.3\n"
+		}
+		if strings.Contains(string(reqs), "name: app-operator\n") {
+			content += "- name: app-operator\n  repository: https://charts.example.com\n  version: 1.2.5\n"
+		}
+		return ioutil.WriteFile(filepath.Join(chart, "requirements.lock"), []byte(content), 0644)
+	})
+
+	unresolved := &UnresolvedDependencies{deps: map[string][]unresolvedChartDependency{}}
+	unresolved.Add("app", "https://charts.example.com", "~1.2")
+	unresolved.addReference("app-operator", "https://charts.example.com", &versionReference{Chart: "app", Level: VersionReferenceMinor})
+
+	if _, err := depMan.Update(shell, wd, unresolved); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expectedRequirements := []string{
+		`dependencies:
+- name: app
+  repository: https://charts.example.com
+  version: ~1.2
+`,
+		`dependencies:
+- name: app-operator
+  repository: https://charts.example.com
+  version: ~1.2
+`,
+	}
+	if len(requirements) != len(expectedRequirements) {
+		t.Fatalf("unexpected number of dependency updates: expected=%d, got=%d", len(expectedRequirements), len(requirements))
+	}
+	for i := range expectedRequirements {
+		if requirements[i] != expectedRequirements[i] {
+			t.Errorf("unexpected requirements in phase %d:\nexpected=%s\ngot=%s", i, expectedRequirements[i], requirements[i])
+		}
+	}
+
+	expected := `dependencies:
+- name: app
+  repository: https://charts.example.com
+  version: 1.2.3
+- name: app-operator
+  repository: https://charts.example.com
+  version: 1.2.5
+digest: ""
+generated: ""
+metadata:
+  generatedAt: "2019-06-01T00:00:00Z"
+  helmfileVersion: unknown
+`
+	if written != expected {
+		t.Errorf("unexpected lock file:\nexpected=%s\ngot=%s", expected, written)
+	}
+}
@@ -0,0 +1,70 @@
+package state
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/Masterminds/semver"
+)
+
+// latestMatchingVersion returns the latest of the versions satisfying the constraint, or an empty string if none.
+// The versions are expected to be ordered newest first, as in chart repository indexes.
+//
+// When maxVersions is greater than 0, only the newest maxVersions versions are parsed and compared at first,
+// which is much faster for charts with thousands of published versions when a recent version matches.
+// Only when none of them satisfies the constraint, all the versions are considered,
+// so that the cap never makes a satisfiable constraint unsatisfiable.
+func latestMatchingVersion(versions []string, constraint *semver.Constraints, maxVersions int) string {
+	if maxVersions > 0 && maxVersions < len(versions) {
+		if v := latestMatchingVersionIn(versions[:maxVersions], constraint); v != "" {
+			return v
+		}
+	}
+
+	return latestMatchingVersionIn(versions, constraint)
+}
+
+func latestMatchingVersionIn(versions []string, constraint *semver.Constraints) string {
+	matched := []*semver.Version{}
+	for _, v := range versions {
+		ver, err := semver.NewVersion(v)
+		if err != nil {
+			// Skip malformed versions published to the repository, as helm does
+			continue
+		}
+		if constraint.Check(ver) {
+			matched = append(matched, ver)
+		}
+	}
+
+	if len(matched) == 0 {
+		return ""
+	}
+
+	sort.Sort(sort.Reverse(semver.Collection(matched)))
+
+	return matched[0].Original()
+}
+
+// latestVersion returns the latest version of the chart in the index satisfying the constraint, considering the newest maxVersions versions first
+func (idx *repoIndex) latestVersion(chart, versionConstraint string, maxVersions int) (string, error) {
+	if versionConstraint == "" {
+		versionConstraint = "*"
+	}
+	constraint, err := semver.NewConstraint(versionConstraint)
+	if err != nil {
+		return "", err
+	}
+
+	versions := []string{}
+	for _, e := range idx.Entries[chart] {
+		versions = append(versions, e.Version)
+	}
+
+	v := latestMatchingVersion(versions, constraint, maxVersions)
+	if v == "" {
+		return "", fmt.Errorf("no version of %s satisfying %q found in the repository index", chart, versionConstraint)
+	}
+
+	return v, nil
+}
@@ -0,0 +1,46 @@
+package state
+
+import (
+	"testing"
+)
+
+func TestRepoIndex_LatestVersion(t *testing.T) {
+	index := &repoIndex{Entries: map[string][]repoIndexEntry{
+		"envoy": {
+			{Name: "envoy", Version: "2.1.0"},
+			{Name: "envoy", Version: "2.0.0"},
+			{Name: "envoy", Version: "not-a-version"},
+			{Name: "envoy", Version: "1.5.0"},
+			{Name: "envoy", Version: "1.4.0"},
+		},
+	}}
+
+	tests := []struct {
+		constraint  string
+		maxVersions int
+		expected    string
+		wantErr     string
+	}{
+		{constraint: "", maxVersions: 0, expected: "2.1.0"},
+		{constraint: "~2.0", maxVersions: 2, expected: "2.0.0"},
+		{constraint: "~1.4", maxVersions: 2, expected: "1.4.0"},
+		{constraint: "< 2.0.0", maxVersions: 1, expected: "1.5.0"},
+		{constraint: ">= 3.0.0", maxVersions: 2, wantErr: `no version of envoy satisfying ">= 3.0.0" found in the repository index`},
+	}
+
+	for _, tt := range tests {
+		actual, err := index.latestVersion("envoy", tt.constraint, tt.maxVersions)
+		if tt.wantErr != "" {
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("unexpected error for %q: expected=%q, got=%v", tt.constraint, tt.wantErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if actual != tt.expected {
+			t.Errorf("unexpected version for %q with max %d: expected=%s, got=%s", tt.constraint, tt.maxVersions, tt.expected, actual)
+		}
+	}
+}
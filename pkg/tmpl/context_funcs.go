@@ -96,6 +96,10 @@ func (c *Context) Exec(command string, args []interface{}, inputs ...string) (st
 
 		bytes, err := cmd.Output()
 		if err != nil {
+			// Include what the command printed to stderr, as the exit status alone hardly tells why it failed
+			if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+				err = fmt.Errorf("%v: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+			}
 			cmdErrs <- fmt.Errorf("exec cmd=%s args=[%s] failed: %v", command, strings.Join(strArgs, ", "), err)
 		} else {
 			cmdOuts <- bytes
@@ -108,7 +112,12 @@ func (c *Context) Exec(command string, args []interface{}, inputs ...string) (st
 			return string(bytes), nil
 		case err := <-cmdErrs:
 			return "", err
-		case err := <-writeErrs:
+		case err, ok := <-writeErrs:
+			// writeErrs is closed once the input is written. Keep waiting for the command to exit
+			if !ok {
+				writeErrs = nil
+				continue
+			}
 			return "", err
 		}
 	}
@@ -200,9 +209,13 @@ func SetValueAtPath(path string, value interface{}, values Values) (Values, erro
 }
 
 func RequiredEnv(name string) (string, error) {
-	if val, exists := os.LookupEnv(name); exists && len(val) > 0 {
-		return val, nil
+	val, exists := os.LookupEnv(name)
+	if !exists {
+		return "", fmt.Errorf("required env var `%s` is not set", name)
+	}
+	if len(val) == 0 {
+		return "", fmt.Errorf("required env var `%s` is set but empty", name)
 	}
 
-	return "", fmt.Errorf("required env var `%s` is not set", name)
+	return val, nil
 }
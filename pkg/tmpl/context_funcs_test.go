@@ -2,6 +2,7 @@ package tmpl
 
 import (
 	"fmt"
+	"os"
 	"path/filepath"
 	"reflect"
 	"testing"
@@ -133,3 +134,58 @@ func TestTpl(t *testing.T) {
 		t.Errorf("unexpected result: expected=%v, actual=%v", expected, actual)
 	}
 }
+
+func TestRequiredEnv(t *testing.T) {
+	os.Unsetenv("HF_TEST_REQUIRED_UNSET")
+	os.Setenv("HF_TEST_REQUIRED_EMPTY", "")
+	os.Setenv("HF_TEST_REQUIRED", "value")
+	defer os.Unsetenv("HF_TEST_REQUIRED_EMPTY")
+	defer os.Unsetenv("HF_TEST_REQUIRED")
+
+	testcases := []struct {
+		name     string
+		expected string
+		err      string
+	}{
+		{name: "HF_TEST_REQUIRED", expected: "value"},
+		{name: "HF_TEST_REQUIRED_UNSET", err: "required env var `HF_TEST_REQUIRED_UNSET` is not set"},
+		{name: "HF_TEST_REQUIRED_EMPTY", err: "required env var `HF_TEST_REQUIRED_EMPTY` is set but empty"},
+	}
+
+	for _, tc := range testcases {
+		actual, err := RequiredEnv(tc.name)
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("unexpected error: expected=%s, actual=%v", tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if actual != tc.expected {
+			t.Errorf("unexpected result: expected=%v, actual=%v", tc.expected, actual)
+		}
+	}
+}
+
+func TestExec(t *testing.T) {
+	ctx := &Context{basePath: "."}
+
+	// Repeated to make sure the output is returned even when the input is written before the command exits
+	for i := 0; i < 20; i++ {
+		actual, err := ctx.Exec("cat", []interface{}{}, "foo: FOO\n")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if actual != "foo: FOO\n" {
+			t.Fatalf("unexpected result: expected=%q, actual=%q", "foo: FOO\n", actual)
+		}
+	}
+
+	expected := "exec cmd=sh args=[-c, echo oops >&2; exit 1] failed: exit status 1: oops"
+	_, err := ctx.Exec("sh", []interface{}{"-c", "echo oops >&2; exit 1"})
+	if err == nil || err.Error() != expected {
+		t.Errorf("unexpected error: expected=%s, actual=%v", expected, err)
+	}
+}